@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/reesporte/bugfruit"
@@ -33,6 +34,18 @@ func bench(iter, nops, keysz, valsz int, config *bugfruit.Config, name string, k
 	total := end.Sub(start).Seconds()
 	fmt.Printf("set, %d, %f, %d, %f\n", iter, total, nops, float64(nops)/total)
 
+	if err := s.Close(); err != nil {
+		log.Fatal(err)
+	}
+	start = time.Now()
+	s, err = bugfruit.NewStorage(name, 0777, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	end = time.Now()
+	total = end.Sub(start).Seconds()
+	fmt.Printf("open, %d, %f, %d, %f\n", iter, total, nops, float64(nops)/total)
+
 	start = time.Now()
 	for i := 0; i < nops; i++ {
 		k := string(keys[i])
@@ -68,11 +81,53 @@ func bench(iter, nops, keysz, valsz int, config *bugfruit.Config, name string, k
 	}
 }
 
+// benchSetSync sets nops keys with SetSync, split between writers concurrent
+// writers, which shows how well their fsyncs are grouped.
+func benchSetSync(iter, nops, keysz, valsz, writers int, config *bugfruit.Config, name string, keys [][]byte) {
+	s, err := bugfruit.NewStorage(name, 0777, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < nops; i += writers {
+				k := keys[i]
+				v := make([]byte, valsz)
+				for j := 0; j < valsz; j++ {
+					v[j] = k[j%keysz]
+				}
+				if err := s.SetSync(string(k), v); err != nil {
+					panic(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	end := time.Now()
+	total := end.Sub(start).Seconds()
+	fmt.Printf("setsync-%d, %d, %f, %d, %f\n", writers, iter, total, nops, float64(nops)/total)
+
+	if err := s.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.RemoveAll(name); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func main() {
 	nopsPtr := flag.Int("nops", 10000000, "how many operations to complete")
 	iterPtr := flag.Int("iter", 1000, "how many iterations to benchmark")
 	keyszPtr := flag.Int("keysz", 16, "how large keys should be (in bytes)")
 	valszPtr := flag.Int("valsz", 100, "how large vals should be (in bytes)")
+	wbufPtr := flag.Int("wbuf", 0, "how many bytes of writes to buffer")
+	mmapPtr := flag.Bool("mmap", false, "whether to memory-map the database file when opening it")
+	syncWritersPtr := flag.Int("syncwriters", 0, "how many concurrent writers to benchmark SetSync with, or 0 not to")
 
 	flag.Parse()
 
@@ -81,7 +136,7 @@ func main() {
 	keysz := *keyszPtr
 	valsz := *valszPtr
 
-	config := &bugfruit.Config{VacuumBatch: 0, FsyncBatch: 0}
+	config := &bugfruit.Config{VacuumBatch: 0, FsyncBatch: 0, WriteBufferSize: *wbufPtr, Mmap: *mmapPtr}
 
 	keys := make([][]byte, nops)
 	for i := 0; i < nops; i++ {
@@ -93,5 +148,8 @@ func main() {
 	fmt.Println("type, iteration, s, nops, opsps")
 	for i := 0; i < iter; i++ {
 		bench(i, nops, keysz, valsz, config, "benchmarks.db", keys)
+		if *syncWritersPtr > 0 {
+			benchSetSync(i, nops, keysz, valsz, *syncWritersPtr, config, "benchmarks.db", keys)
+		}
 	}
 }
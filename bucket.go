@@ -0,0 +1,74 @@
+package bugfruit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// bucketSeparator separates a bucket's name from the keys in it.
+const bucketSeparator = "\x00"
+
+// Bucket is a namespace of keys within a Storage. Its keys are stored in the
+// Storage with the bucket's name and a NUL byte in front of them.
+type Bucket struct {
+	s      *Storage
+	prefix string
+}
+
+// Bucket returns the bucket with the given name. Buckets don't need to be
+// created, and a bucket with no keys takes up no space. A name can't have a NUL
+// byte in it, since its keys could then be another bucket's, and
+// ErrInvalidBucketName is returned if it does.
+func (s *Storage) Bucket(name string) (*Bucket, error) {
+	if strings.Contains(name, bucketSeparator) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidBucketName, name)
+	}
+	return &Bucket{s: s, prefix: name + bucketSeparator}, nil
+}
+
+// Get returns a copy of the value for a key in the bucket and whether the key
+// was found.
+func (b *Bucket) Get(key string) ([]byte, bool) {
+	return b.s.Get(b.prefix + key)
+}
+
+// Set sets the key/value pair in the bucket in-memory and on disk. Returns nil
+// on success.
+func (b *Bucket) Set(key string, value []byte) error {
+	return b.s.Set(b.prefix+key, value)
+}
+
+// Delete deletes the key/value pair in the bucket in-memory and on disk.
+// Returns nil on success. If the key does not exist in the bucket, error is nil.
+func (b *Bucket) Delete(key string) error {
+	return b.s.Delete(b.prefix + key)
+}
+
+// Keys returns the keys in the bucket, without the bucket's name. The order of
+// the keys is unspecified.
+func (b *Bucket) Keys() []string {
+	keys := []string{}
+	now := b.s.now()
+	b.s.data.Range(func(k string, d *datum) bool {
+		if strings.HasPrefix(k, b.prefix) && !d.expired(now) {
+			keys = append(keys, k[len(b.prefix):])
+		}
+		return true
+	})
+	return keys
+}
+
+// DeleteBucket deletes every key in the bucket with the given name in-memory
+// and on disk, syncs the database file once, and returns how many keys were
+// deleted. Like DeleteMulti, the keys are not deleted atomically.
+func (s *Storage) DeleteBucket(name string) (int, error) {
+	b, err := s.Bucket(name)
+	if err != nil {
+		return 0, err
+	}
+	keys := b.Keys()
+	for i, k := range keys {
+		keys[i] = b.prefix + k
+	}
+	return s.DeleteMulti(keys)
+}
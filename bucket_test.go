@@ -0,0 +1,70 @@
+package bugfruit
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+func TestBucket(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	rohan, err := s.Bucket("rohan")
+	test.AssertNil(t, err)
+	gondor, err := s.Bucket("gondor")
+	test.AssertNil(t, err)
+	test.AssertNil(t, rohan.Set("king", []byte("Théoden")))
+	test.AssertNil(t, rohan.Set("marshal", []byte("Éomer")))
+	test.AssertNil(t, gondor.Set("king", []byte("Elessar")))
+	test.AssertNil(t, s.Set("king", []byte("Sauron")))
+
+	// the same key means different things in each bucket
+	got, ok := rohan.Get("king")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("Théoden"), got)
+	got, _ = gondor.Get("king")
+	test.AssertEqual(t, []byte("Elessar"), got)
+	got, _ = s.Get("king")
+	test.AssertEqual(t, []byte("Sauron"), got)
+	got, _ = s.Get("gondor\x00king")
+	test.AssertEqual(t, []byte("Elessar"), got)
+
+	keys := rohan.Keys()
+	sort.Strings(keys)
+	test.AssertEqual(t, []string{"king", "marshal"}, keys)
+	mordor, err := s.Bucket("mordor")
+	test.AssertNil(t, err)
+	test.AssertEqual(t, []string{}, mordor.Keys())
+
+	test.AssertNil(t, gondor.Delete("king"))
+	_, ok = gondor.Get("king")
+	test.AssertEqual(t, false, ok)
+
+	n, err := s.DeleteBucket("rohan")
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 2, n)
+	test.AssertEqual(t, []string{}, rohan.Keys())
+	test.AssertEqual(t, []string{"king"}, s.Keys())
+}
+
+// TestBucketNUL ensures a bucket name with a NUL byte in it, whose keys could be
+// another bucket's, is rejected.
+func TestBucketNUL(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	a, err := s.Bucket("a")
+	test.AssertNil(t, err)
+	test.AssertNil(t, a.Set("b\x00c", []byte("shadowfax")))
+
+	_, err = s.Bucket("a\x00b")
+	test.AssertEqual(t, true, errors.Is(err, ErrInvalidBucketName))
+	_, err = s.DeleteBucket("a\x00b")
+	test.AssertEqual(t, true, errors.Is(err, ErrInvalidBucketName))
+	test.AssertEqual(t, []string{"b\x00c"}, a.Keys())
+}
@@ -0,0 +1,106 @@
+package bugfruit
+
+import (
+	"container/list"
+	"sync"
+)
+
+// valueCache is a least recently used cache of values read from or written to
+// the database file, for a Storage with DiskValues. A nil *valueCache caches
+// nothing.
+type valueCache struct {
+	mu    sync.Mutex
+	max   int // the most bytes of values to cache
+	size  int // the bytes of values cached
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// cacheEntry is the value of a datum in a valueCache.
+type cacheEntry struct {
+	d     *datum
+	value []byte
+}
+
+// newValueCache returns a cache of up to max bytes of values, or nil if max
+// isn't positive.
+func newValueCache(max int) *valueCache {
+	if max <= 0 {
+		return nil
+	}
+	return &valueCache{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached value of d, and whether it was cached. The value must
+// not be modified.
+func (c *valueCache) get(d *datum) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[d.key]
+	if !ok || el.Value.(*cacheEntry).d != d {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+// add caches value as the value of d, replacing any value cached for its key,
+// and evicts the least recently used values until the cache fits. A value
+// larger than the whole cache isn't cached. The value must not be modified
+// afterwards.
+func (c *valueCache) add(d *datum, value []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.unprotectedRemove(d.key)
+	if len(value) > c.max {
+		return
+	}
+	c.items[d.key] = c.ll.PushFront(&cacheEntry{d: d, value: value})
+	c.size += len(value)
+	for c.size > c.max {
+		c.unprotectedRemove(c.ll.Back().Value.(*cacheEntry).d.key)
+	}
+}
+
+// remove drops the cached value for key, if there is one.
+func (c *valueCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unprotectedRemove(key)
+}
+
+// unprotectedRemove is remove without the lock.
+func (c *valueCache) unprotectedRemove(key string) {
+	if el, ok := c.items[key]; ok {
+		c.size -= len(el.Value.(*cacheEntry).value)
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// clear drops every cached value.
+func (c *valueCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.size = 0
+}
@@ -0,0 +1,60 @@
+package bugfruit
+
+import (
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestValueCache ensures the cache evicts the least recently used values once
+// it's full, and only returns a value for the datum it was cached for.
+func TestValueCache(t *testing.T) {
+	c := newValueCache(10)
+	gandalf := &datum{key: "gandalf"}
+	saruman := &datum{key: "saruman"}
+	radagast := &datum{key: "radagast"}
+
+	c.add(gandalf, []byte("grey"))
+	c.add(saruman, []byte("white"))
+	v, ok := c.get(gandalf)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("grey"), v)
+
+	// saruman is the least recently used, so he goes first
+	c.add(radagast, []byte("brown"))
+	_, ok = c.get(saruman)
+	test.AssertEqual(t, false, ok)
+	_, ok = c.get(radagast)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, 9, c.size)
+
+	// a new datum for a key replaces the old one's value
+	white := &datum{key: "gandalf"}
+	c.add(white, []byte("white"))
+	_, ok = c.get(gandalf)
+	test.AssertEqual(t, false, ok)
+	v, _ = c.get(white)
+	test.AssertEqual(t, []byte("white"), v)
+	test.AssertEqual(t, 10, c.size)
+
+	// a value bigger than the cache isn't cached
+	c.add(saruman, []byte("of many colours"))
+	_, ok = c.get(saruman)
+	test.AssertEqual(t, false, ok)
+
+	c.remove("radagast")
+	test.AssertEqual(t, 5, c.size)
+	c.clear()
+	test.AssertEqual(t, 0, c.size)
+	_, ok = c.get(white)
+	test.AssertEqual(t, false, ok)
+
+	// no cache caches nothing
+	var none *valueCache
+	test.AssertEqual(t, none, newValueCache(0))
+	none.add(gandalf, []byte("grey"))
+	_, ok = none.get(gandalf)
+	test.AssertEqual(t, false, ok)
+	none.remove("gandalf")
+	none.clear()
+}
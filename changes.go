@@ -0,0 +1,161 @@
+package bugfruit
+
+// changeBufferSize is how many changes a Subscribe channel holds, on top of the
+// ones it starts with, before a subscriber that isn't keeping up is cut off.
+const changeBufferSize = 256
+
+// Change describes a write to the database, numbered in the order the writes
+// were made.
+type Change struct {
+	Seq   uint64 // the sequence number of the write, which is higher than every earlier write's
+	Op    OpType
+	Key   string
+	Value []byte // the new value for an OpSet, and nil for an OpDelete
+}
+
+// changeFeed is the set of channels every change is published to, and the
+// latest changes, kept to catch up subscribers that start from earlier ones.
+type changeFeed struct {
+	subs map[uint64]*changeSub
+	next uint64
+	log  []Change // the latest changes, oldest first
+	lost uint64   // the sequence number of the latest change not in the log
+}
+
+// changeSub is a subscriber to the changes from a sequence number on.
+type changeSub struct {
+	ch   chan Change
+	from uint64
+}
+
+// Subscribe returns a channel that receives a Change for every write to the
+// database, in the order the writes were made, from the change numbered
+// fromSeq on, and a function that unsubscribes and closes the channel. Every
+// set of a key is an OpSet, including by Expire, RenameKey, a Batch, or
+// Undelete, and every delete is an OpDelete, including of every key by Clear. A
+// fromSeq of 0 starts from the next change.
+//
+// Changes made before the channel was subscribed are replayed from the log of
+// the latest ChangeLogSize changes. If some of the changes from fromSeq on were
+// made before the Storage was opened, or aren't in the log anymore, the channel
+// is closed without receiving any.
+//
+// Unlike Watch, no change is ever skipped. The channel is buffered, and if it's
+// full because the subscriber isn't keeping up, it's closed instead, so the
+// subscriber can subscribe again from the change after the last one it got.
+// Writes never wait on a subscriber. Closing the Storage closes every channel.
+// The value of a change must not be modified.
+//
+// A ReadSnapshot and a subscription from the change after its Seq together see
+// every write exactly once, as long as the changes since the snapshot was taken
+// are still in the log, so a replica can be copied from one and kept up to date
+// with the other.
+func (s *Storage) Subscribe(fromSeq uint64) (<-chan Change, func()) {
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	f := &s.changes
+	if s.isClosed() || fromSeq > 0 && fromSeq <= f.lost {
+		ch := make(chan Change)
+		close(ch)
+		return ch, func() {}
+	}
+	if fromSeq == 0 {
+		fromSeq = s.seq + 1
+	}
+	replay := []Change{}
+	for _, c := range f.log {
+		if c.Seq >= fromSeq {
+			replay = append(replay, c)
+		}
+	}
+	ch := make(chan Change, len(replay)+changeBufferSize)
+	for _, c := range replay {
+		ch <- c
+	}
+	if f.subs == nil {
+		f.subs = make(map[uint64]*changeSub)
+	}
+	id := f.next
+	f.next++
+	f.subs[id] = &changeSub{ch: ch, from: fromSeq}
+
+	return ch, func() {
+		s.muFile.Lock()
+		defer s.muFile.Unlock()
+		f.unsubscribe(id)
+	}
+}
+
+// unprotectedPublishChange sends c to every subscriber, and cuts off the ones
+// that don't have room for it, and adds it to the log of the latest changes. It
+// publishes it to the watchers too.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedPublishChange(c Change) {
+	s.watchers.publish(c.Key, c.Op, c.Value)
+	s.noteHook(Event{Key: c.Key, Op: c.Op, Value: c.Value})
+	f := &s.changes
+	size := s.config.ChangeLogSize
+	if len(f.subs) == 0 && size <= 0 {
+		f.lost = c.Seq
+		return
+	}
+	if c.Op == OpSet {
+		c.Value = append([]byte{}, c.Value...)
+	}
+	if size > 0 {
+		f.log = append(f.log, c)
+		if n := len(f.log); n > size {
+			f.lost = f.log[n-size-1].Seq
+			f.log = f.log[n-size:]
+		}
+	} else {
+		f.lost = c.Seq
+	}
+	for id, sub := range f.subs {
+		if c.Seq < sub.from {
+			continue
+		}
+		select {
+		case sub.ch <- c:
+		default:
+			// the subscriber is behind, so cut it off rather than block the
+			// write or skip a change
+			f.unsubscribe(id)
+		}
+	}
+}
+
+// unprotectedPublishDelete publishes the delete of d's key as the next change,
+// once its sequence number is written over d's, which is being deleted.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedPublishDelete(d *datum) error {
+	if err := s.writeSeq(d, s.seq+1); err != nil {
+		return err
+	}
+	s.seq++
+	s.unprotectedPublishChange(Change{Seq: s.seq, Op: OpDelete, Key: d.key})
+	return nil
+}
+
+// unsubscribe closes the channel of the subscriber id, if it's still
+// subscribed.
+func (f *changeFeed) unsubscribe(id uint64) {
+	if sub, ok := f.subs[id]; ok {
+		delete(f.subs, id)
+		close(sub.ch)
+	}
+}
+
+// reset empties the log, as if every change up to seq was dropped from it.
+func (f *changeFeed) reset(seq uint64) {
+	f.log = nil
+	f.lost = seq
+}
+
+// close closes every subscriber's channel.
+func (f *changeFeed) close() {
+	for id := range f.subs {
+		f.unsubscribe(id)
+	}
+}
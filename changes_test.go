@@ -0,0 +1,202 @@
+package bugfruit
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestSubscribe ensures every write is published as a change, numbered in the
+// order the writes were made.
+func TestSubscribe(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+
+	changes, unsubscribe := s.Subscribe(0)
+	test.AssertNil(t, s.Set("eärendil", []byte("the Mariner")))
+	test.AssertNil(t, s.SetWithTTL("silmaril", []byte("bound upon his brow"), time.Hour))
+	test.AssertNil(t, s.Delete("eärendil"))
+	test.AssertNil(t, s.Delete("morgoth"))
+	test.AssertNil(t, s.Undelete("eärendil"))
+	test.AssertNil(t, s.RenameKey("eärendil", "elwing"))
+	b := s.Batch()
+	b.Set("vingilot", []byte("the ship"))
+	b.Delete("silmaril")
+	test.AssertNil(t, b.Commit())
+	_, elwing, _ := s.GetVersioned("elwing")
+	test.AssertNil(t, s.Clear())
+
+	want := []Change{
+		{Seq: 1, Op: OpSet, Key: "eärendil", Value: []byte("the Mariner")},
+		{Seq: 2, Op: OpSet, Key: "silmaril", Value: []byte("bound upon his brow")},
+		{Seq: 3, Op: OpDelete, Key: "eärendil"},
+		{Seq: 4, Op: OpSet, Key: "eärendil", Value: []byte("the Mariner")},
+		{Seq: 5, Op: OpSet, Key: "elwing", Value: []byte("the Mariner")},
+		{Seq: 6, Op: OpDelete, Key: "eärendil"},
+		{Seq: 7, Op: OpSet, Key: "vingilot", Value: []byte("the ship")},
+		{Seq: 8, Op: OpDelete, Key: "silmaril"},
+	}
+	for _, c := range want {
+		test.AssertEqual(t, c, <-changes)
+	}
+	test.AssertEqual(t, uint64(5), elwing)
+
+	// Clear deletes every key
+	cleared := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		c := <-changes
+		test.AssertEqual(t, OpDelete, c.Op)
+		test.AssertEqual(t, true, c.Seq > 8)
+		cleared[c.Key] = true
+	}
+	test.AssertEqual(t, map[string]bool{"elwing": true, "vingilot": true}, cleared)
+
+	// unsubscribing closes the channel, and is safe to repeat
+	unsubscribe()
+	unsubscribe()
+	_, ok := <-changes
+	test.AssertEqual(t, false, ok)
+
+	// closing the database closes the rest
+	other, _ := s.Subscribe(0)
+	test.AssertNil(t, s.Close())
+	_, ok = <-other
+	test.AssertEqual(t, false, ok)
+	closed, _ := s.Subscribe(0)
+	_, ok = <-closed
+	test.AssertEqual(t, false, ok)
+}
+
+// TestSubscribeFrom ensures changes from before a subscription are replayed
+// from the change log, and that a subscriber that falls behind is cut off
+// instead of skipping changes, and can catch up from where it left off.
+func TestSubscribeFrom(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithChangeLogSize(changeBufferSize*2))
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("gil-galad", []byte("an elven-king")))
+	test.AssertNil(t, s.Set("gil-galad", []byte("the last whose realm was fair and free")))
+	test.AssertNil(t, s.Close())
+
+	// changes from before the Storage was opened aren't kept
+	s, err = NewStorage(fname, 0600, WithChangeLogSize(changeBufferSize*2))
+	test.AssertNil(t, err)
+	defer s.Close()
+	lost, _ := s.Subscribe(2)
+	_, ok := <-lost
+	test.AssertEqual(t, false, ok)
+
+	snap := s.ReadSnapshot()
+	test.AssertEqual(t, uint64(2), snap.Seq())
+	test.AssertNil(t, s.Set("ereinion", []byte("gil-galad")))
+	test.AssertNil(t, s.Delete("gil-galad"))
+
+	// a replica copied from a read snapshot picks up from the changes since
+	replica := map[string]string{}
+	v, _ := snap.Get("gil-galad")
+	replica["gil-galad"] = string(v)
+	snap.Release()
+	changes, unsubscribe := s.Subscribe(snap.Seq() + 1)
+	for i := 0; i < 2; i++ {
+		c := <-changes
+		if c.Op == OpSet {
+			replica[c.Key] = string(c.Value)
+		} else {
+			delete(replica, c.Key)
+		}
+	}
+	test.AssertEqual(t, map[string]string{"ereinion": "gil-galad"}, replica)
+	unsubscribe()
+
+	// a subscriber that falls behind is cut off
+	changes, _ = s.Subscribe(0)
+	for i := 0; i < changeBufferSize+1; i++ {
+		test.AssertNil(t, s.Set("gil-galad", []byte("his sword was long, his lance was keen")))
+	}
+	last := uint64(0)
+	for c := range changes {
+		last = c.Seq
+	}
+	test.AssertEqual(t, uint64(4+changeBufferSize), last)
+
+	// but catches up from the change log
+	changes, unsubscribe = s.Subscribe(last + 1)
+	defer unsubscribe()
+	c := <-changes
+	test.AssertEqual(t, Change{Seq: last + 1, Op: OpSet, Key: "gil-galad", Value: []byte("his sword was long, his lance was keen")}, c)
+
+	// until the change is dropped from the log
+	for i := 0; i < changeBufferSize*2; i++ {
+		test.AssertNil(t, s.Delete("gil-galad"))
+		test.AssertNil(t, s.Set("gil-galad", []byte("his shining helm afar was seen")))
+	}
+	lost, _ = s.Subscribe(last + 1)
+	_, ok = <-lost
+	test.AssertEqual(t, false, ok)
+}
+
+// TestSubscribeReopen ensures the sequence numbers of deletes and undeletes are
+// kept in the database file, even once it's vacuumed or cleared, so they aren't
+// handed out again once it's reopened, whether or not records are compressed
+// and encrypted.
+func TestSubscribeReopen(t *testing.T) {
+	for _, opts := range [][]Option{
+		{},
+		{WithCompression(GzipCompression), WithEncryptionKey(bytes.Repeat([]byte("k"), 32))},
+	} {
+		fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+		opts = append(opts, WithVacuumBatch(0))
+		s, err := NewStorage(fname, 0600, opts...)
+		test.AssertNil(t, err)
+		test.AssertNil(t, s.Set("beren", []byte("one-hand")))
+		test.AssertNil(t, s.Set("lúthien", bytes.Repeat([]byte("tinúviel"), 100)))
+		test.AssertNil(t, s.Delete("lúthien"))
+		test.AssertNil(t, s.Close())
+
+		reopen := func(seq uint64) {
+			t.Helper()
+			s, err = NewStorage(fname, 0600, opts...)
+			test.AssertNil(t, err)
+			snap := s.ReadSnapshot()
+			test.AssertEqual(t, seq, snap.Seq())
+			snap.Release()
+		}
+		reopen(3)
+		changes, unsubscribe := s.Subscribe(4)
+		test.AssertNil(t, s.Set("huan", bytes.Repeat([]byte("the hound of valinor"), 100)))
+		_, huan, _ := s.GetVersioned("huan")
+		test.AssertEqual(t, uint64(4), huan)
+		test.AssertEqual(t, Change{Seq: 4, Op: OpSet, Key: "huan", Value: bytes.Repeat([]byte("the hound of valinor"), 100)}, <-changes)
+		unsubscribe()
+
+		// an undelete is a write of the record it brings back
+		test.AssertNil(t, s.Delete("huan"))
+		test.AssertNil(t, s.Undelete("huan"))
+		test.AssertNil(t, s.Close())
+		reopen(6)
+		v, huan, _ := s.GetVersioned("huan")
+		test.AssertEqual(t, uint64(6), huan)
+		test.AssertEqual(t, bytes.Repeat([]byte("the hound of valinor"), 100), v)
+
+		// the deleted records are gone after a vacuum, but their sequence
+		// numbers aren't
+		test.AssertNil(t, s.Delete("huan"))
+		test.AssertNil(t, s.Vacuum())
+		test.AssertNil(t, s.Close())
+		reopen(7)
+
+		// or after a clear
+		test.AssertNil(t, s.Clear())
+		test.AssertNil(t, s.Close())
+		reopen(8)
+		test.AssertEqual(t, 0, s.Len())
+		test.AssertNil(t, s.Set("beren", []byte("erchamion")))
+		_, beren, _ := s.GetVersioned("beren")
+		test.AssertEqual(t, uint64(9), beren)
+		test.AssertNil(t, s.Close())
+	}
+}
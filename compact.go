@@ -0,0 +1,158 @@
+package bugfruit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// CompactKey reclaims the space of the dead records at the end of the database
+// file, like the old versions of a key that's set over and over, without
+// rewriting the whole file like Vacuum does. If the key's record is among them,
+// it's moved to the first of them that's the same size, so all the ones after
+// it can be cut off. Dead records before the last record of any other key are
+// left for Vacuum. It returns ErrKeyNotFound if the key doesn't exist, and
+// ErrSnapshotActive while there's a ReadSnapshot.
+func (s *Storage) CompactKey(key string) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	d, ok := s.data.Load(key)
+	if !ok || d.expired(s.now()) {
+		return ErrKeyNotFound
+	}
+	// there's nothing on disk to compact
+	if s.mem {
+		return nil
+	}
+	// the file is cut short, and the key's record may move
+	if err := s.unprotectedWaitForSnapshots(); err != nil {
+		return err
+	}
+	if err := s.unprotectedFlush(); err != nil {
+		return err
+	}
+
+	// every record from the end of the last one of another key is dead, but for
+	// the key's
+	tail := uint64(headerSize)
+	liveSeq := uint64(0)
+	s.data.Range(func(k string, o *datum) bool {
+		if k != key && o.idx+o.Size() > tail {
+			tail = o.idx + o.Size()
+		}
+		if o.meta.seq > liveSeq {
+			liveSeq = o.meta.seq
+		}
+		return true
+	})
+	end := headerSize + s.dataBytes
+	newEnd := tail
+	if d.idx >= tail {
+		to, err := s.firstOfSize(tail, d.idx, d.Size())
+		if err != nil {
+			return err
+		}
+		if to != d.idx {
+			if err := s.moveDatum(d, to); err != nil {
+				return fmt.Errorf("moving '%s': %w", key, err)
+			}
+		}
+		newEnd = to + d.Size()
+	}
+	if newEnd >= end {
+		return nil
+	}
+
+	if err := s.unprotectedDropIndex(); err != nil {
+		return err
+	}
+	if err := s.file.Truncate(int64(newEnd)); err != nil {
+		return fmt.Errorf("truncating %s: %w", s.name, err)
+	}
+	s.log.Printf("bugfruit: compacted %s: %d bytes down to %d", s.name, end, newEnd)
+	s.idx = newEnd
+	s.dataBytes = newEnd - headerSize
+	s.deadBytes -= end - newEnd
+	for size, offs := range s.free {
+		kept := offs[:0]
+		for _, off := range offs {
+			if off < newEnd {
+				kept = append(kept, off)
+			}
+		}
+		s.free[size] = kept
+	}
+	for idx := range s.tombKeys {
+		if idx >= newEnd {
+			s.dropTombstoneAt(idx)
+		}
+	}
+	// the records cut off may have had the latest sequence number
+	if err := s.unprotectedKeepSeq(liveSeq); err != nil {
+		return err
+	}
+	return s.unprotectedSync()
+}
+
+// firstOfSize returns the offset of the first record in the database file from
+// start that's size bytes, or end if there isn't one before end. Every record
+// between start and end must be dead.
+// It is NOT thread safe without external file locking.
+func (s *Storage) firstOfSize(start, end, size uint64) (uint64, error) {
+	r := bufio.NewReader(io.NewSectionReader(s.file, int64(start), int64(end-start)))
+	buf := make([]byte, maxMetaSize)
+	for idx := start; idx < end; {
+		m, mb, err := readMeta(r, s.version, buf)
+		if err != nil {
+			return 0, fmt.Errorf("record at %d: reading metadata: %w", idx, err)
+		}
+		msz := uint64(len(mb))
+		n := msz + uint64(m.keySize) + uint64(m.valSize)
+		if n == size {
+			return idx, nil
+		}
+		if _, err := r.Discard(int(n - msz)); err != nil {
+			return 0, fmt.Errorf("record at %d: skipping: %w", idx, err)
+		}
+		idx += n
+	}
+	return end, nil
+}
+
+// moveDatum copies the record of the live datum d over the dead record at to,
+// which is the same size, and then deletes the record it was copied from. The
+// copy is synced before the original is deleted, so a crash leaves at least one
+// of them.
+// It is NOT thread safe without external file locking.
+func (s *Storage) moveDatum(d *datum, to uint64) error {
+	rec := make([]byte, d.Size())
+	if _, err := s.file.ReadAt(rec, int64(d.idx)); err != nil {
+		return fmt.Errorf("reading record at %d: %w", d.idx, err)
+	}
+	if err := s.writeAt(to, rec); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", s.name, err)
+	}
+
+	m := *d.meta
+	old := &datum{meta: &m, key: d.key, idx: d.idx, size: d.size}
+	old.MarkDeleted()
+	if err := s.writeDeletedByte(old); err != nil {
+		return err
+	}
+	// the record at to is live again
+	s.unfreeSpace(to, d.Size())
+	s.dropTombstoneAt(to)
+
+	s.data.Lock()
+	d.idx = to
+	s.data.Unlock()
+	return nil
+}
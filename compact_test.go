@@ -0,0 +1,89 @@
+package bugfruit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestCompactKey ensures CompactKey cuts the dead records at the end of the
+// database file off, moving the key's record back if it has to, and that the
+// file opens the same afterwards.
+func TestCompactKey(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithVacuumBatch(0))
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("gimli", []byte("son of gloin")))
+	test.AssertNil(t, s.Set("legolas", []byte("prince of mirkwood")))
+	test.AssertNil(t, s.Delete("legolas"))
+	for i := 0; i < 41; i++ {
+		_, err := s.Increment("orcs-slain", 1)
+		test.AssertNil(t, err)
+	}
+	test.AssertNil(t, s.Sync())
+	before, err := os.Stat(fname)
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.CompactKey("orcs-slain"))
+	d, _ := s.data.Load("orcs-slain")
+	gimli, _ := s.data.Load("gimli")
+	after, err := os.Stat(fname)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(d.idx+d.Size()), after.Size())
+	test.AssertEqual(t, true, after.Size() < before.Size())
+	// only the deleted legolas record is left between gimli and the counter
+	test.AssertEqual(t, gimli.idx+gimli.Size(), s.tombstones["legolas"].idx)
+	test.AssertEqual(t, s.tombstones["legolas"].Size(), s.deadBytes)
+
+	n, err := s.Increment("orcs-slain", 1)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(42), n)
+	test.AssertNil(t, s.CompactKey("orcs-slain"))
+	test.AssertEqual(t, ErrKeyNotFound, s.CompactKey("sauron"))
+	dead := s.deadBytes
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0600, WithVacuumBatch(0))
+	test.AssertNil(t, err)
+	got, _ := s.Get("gimli")
+	test.AssertEqual(t, []byte("son of gloin"), got)
+	n, err = s.Increment("orcs-slain", 1)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(43), n)
+	test.AssertEqual(t, dead+d.Size(), s.deadBytes)
+	test.AssertNil(t, s.Close())
+
+	test.AssertEqual(t, ErrDBClosed, s.CompactKey("orcs-slain"))
+}
+
+// TestCompactKeyOthers ensures CompactKey leaves the dead records before another
+// key's record for Vacuum.
+func TestCompactKeyOthers(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithVacuumBatch(0))
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := s.Increment("orcs-slain", 1)
+		test.AssertNil(t, err)
+	}
+	test.AssertNil(t, s.Set("gimli", []byte("son of gloin")))
+	dead := s.deadBytes
+	test.AssertNil(t, s.CompactKey("orcs-slain"))
+	test.AssertEqual(t, dead, s.deadBytes)
+
+	// the counter's dead records after gimli are cut off, but not the ones before
+	for i := 0; i < 10; i++ {
+		_, err := s.Increment("orcs-slain", 1)
+		test.AssertNil(t, err)
+	}
+	test.AssertNil(t, s.CompactKey("orcs-slain"))
+	d, _ := s.data.Load("orcs-slain")
+	test.AssertEqual(t, dead+d.Size(), s.deadBytes)
+	n, _ := s.Increment("orcs-slain", 0)
+	test.AssertEqual(t, int64(20), n)
+}
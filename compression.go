@@ -0,0 +1,50 @@
+package bugfruit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// Compression is a way of compressing values in the database file.
+type Compression int
+
+const (
+	// NoCompression stores values as they are.
+	NoCompression Compression = iota
+
+	// GzipCompression compresses values with gzip.
+	GzipCompression
+)
+
+// compress compresses a value with c, and returns the compressed value and
+// whether it's smaller than the original. Values that don't get smaller are
+// stored as they are.
+func compress(c Compression, value []byte) ([]byte, bool) {
+	if c != GzipCompression || len(value) == 0 {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, false
+	}
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(value) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// decompress decompresses a value compressed by compress with gzip.
+func decompress(value []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,79 @@
+package bugfruit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestCompression ensures compressible values are compressed in the database
+// file and incompressible ones aren't, and that both read back unchanged.
+func TestCompression(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, WithCompression(GzipCompression), WithVacuumBatch(0))
+	test.AssertNil(t, err)
+
+	song := bytes.Repeat([]byte("The Road goes ever on and on, down from the door where it began. "), 100)
+	noise := make([]byte, 1000)
+	_, err = rand.Read(noise)
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("bilbo", song))
+	test.AssertNil(t, s.Set("gollum", noise))
+
+	// the compressible value takes up less space in the file
+	bilbo, _ := s.data.Load("bilbo")
+	gollum, _ := s.data.Load("gollum")
+	raw := newDatum()
+	test.AssertNil(t, raw.Set("bilbo", song))
+	test.AssertEqual(t, true, bilbo.Size() < raw.Size())
+	test.AssertNil(t, raw.Set("gollum", noise))
+	test.AssertEqual(t, raw.Size(), gollum.Size())
+	size, err := s.fileSize()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, headerSize+bilbo.Size()+gollum.Size(), size)
+
+	got, _ := s.Get("bilbo")
+	test.AssertEqual(t, song, got)
+	test.AssertNil(t, s.Verify())
+
+	// vacuuming keeps values compressed
+	test.AssertNil(t, s.Set("bilbo", song))
+	test.AssertNil(t, s.Vacuum())
+	size, err = s.fileSize()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, headerSize+bilbo.Size()+gollum.Size(), size)
+	test.AssertNil(t, s.Close())
+
+	// values read back the same, even without compressing new values
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+	got, _ = s.Get("bilbo")
+	test.AssertEqual(t, song, got)
+	got, _ = s.Get("gollum")
+	test.AssertEqual(t, noise, got)
+}
+
+// TestCompress ensures that values are only compressed when it makes them
+// smaller.
+func TestCompress(t *testing.T) {
+	v := bytes.Repeat([]byte("Hobbitses! "), 20)
+	_, ok := compress(NoCompression, v)
+	test.AssertEqual(t, false, ok)
+	_, ok = compress(GzipCompression, []byte("Sneaky."))
+	test.AssertEqual(t, false, ok)
+	_, ok = compress(GzipCompression, nil)
+	test.AssertEqual(t, false, ok)
+
+	c, ok := compress(GzipCompression, v)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, true, len(c) < len(v))
+	got, err := decompress(c)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, v, got)
+}
@@ -1,10 +1,384 @@
 package bugfruit
 
+import "time"
+
 // Config encapsulates all config options for a Storage.
 type Config struct {
 	// VacuumBatch is the number of write operations between vaccuums. 0 turns off vacuuming.
 	VacuumBatch uint64
 
+	// VacuumFragmentationThreshold is the fraction of the database file taken up by
+	// deleted data, between 0 and 1, over which the file is vacuumed. 0 turns off
+	// vacuuming by fragmentation. It works alongside VacuumBatch.
+	VacuumFragmentationThreshold float64
+
+	// VacuumInterval is how often the database file is vacuumed in the
+	// background, whatever the writes. A scheduled vacuum is skipped if less
+	// than 1% of the file is deleted data. It works alongside VacuumBatch and
+	// VacuumFragmentationThreshold. 0 turns off scheduled vacuuming.
+	VacuumInterval time.Duration
+
 	// FsyncBatch is the number of write operations between fsync calls. 0 turns off fsync, except on Close.
 	FsyncBatch uint64
+
+	// FsyncInterval is how often the database file is synced in the background,
+	// if it's been written to since it was last synced. It works alongside
+	// FsyncBatch, and bounds how long a write can go unsynced when writes stop
+	// short of a batch. 0 turns off syncing in the background.
+	FsyncInterval time.Duration
+
+	// ReuseSpace writes new datums in the space of deleted datums of the same
+	// size, when there are any, instead of at the end of the database file, and
+	// overwrites a key's datum in place when its new value makes a datum of the
+	// same size. Only space freed since the file was opened or last vacuumed is
+	// reused. It makes vacuuming needed less often, but a crash while overwriting
+	// a datum can corrupt the middle of the file instead of just its end.
+	ReuseSpace bool
+
+	// WriteBufferSize is the number of bytes of new records to buffer before
+	// writing them to the database file. Buffered records are also written on
+	// fsync, Sync, and Close. Buffered records are lost if the process crashes,
+	// not just if the machine does. 0 turns off buffering.
+	WriteBufferSize int
+
+	// Mmap memory-maps the database file to read it when it's opened, which makes
+	// opening large files faster. It's ignored on platforms without mmap.
+	Mmap bool
+
+	// OpenConcurrency is how many goroutines decode the records of the database
+	// file when it's read on open. The offsets of the records are found first,
+	// by reading just their metadata, then the records are checked and decoded
+	// in parallel, which helps most with compressed or encrypted values. 0 or 1
+	// reads the file in one pass on one goroutine.
+	OpenConcurrency int
+
+	// RepairTornWrite truncates a record cut short at the end of the database
+	// file when it's opened, like one left behind by a crash in the middle of
+	// appending it, instead of failing with a TornWriteError. Invalid records
+	// anywhere else are still an error, since they mean the file is damaged.
+	RepairTornWrite bool
+
+	// Compression is how values are compressed in the database file. Values are
+	// only compressed if it makes them smaller.
+	Compression Compression
+
+	// EncryptionKey is the 32 byte AES-256 key the keys and values in the database
+	// file are encrypted with. nil turns off encryption.
+	EncryptionKey []byte
+
+	// Clock returns the current time, for expiry and modification times. nil uses time.Now.
+	Clock func() time.Time
+
+	// OnSet is called with the key and value after each successful set of a key,
+	// by any write, like Set, a Batch, Update, or Expire. OnDelete is called with
+	// the key after each successful delete of a key that exists, by any write,
+	// like Delete, Pop, DeletePrefix, or Clear. They're called synchronously on
+	// the writing goroutine, in the order of its writes, after the file lock is
+	// released, so a slow hook only slows down its own writer. The value must
+	// not be modified.
+	OnSet    func(key string, value []byte)
+	OnDelete func(key string)
+
+	// Ordered keeps an index of the keys in order, so that SortedKeys, RangeKeys,
+	// and ScanPrefix don't have to sort every key on each call. It makes writes a
+	// little slower, and takes more memory.
+	Ordered bool
+
+	// Logger logs internal events, like vacuums, fsyncs, and opening the database
+	// file. nil turns off logging.
+	Logger Logger
+
+	// MaxKeySize and MaxValueSize are the most bytes a key or value can be set
+	// to. 0 means no limit, other than the math.MaxUint32 bytes the file format
+	// can hold.
+	MaxKeySize   uint32
+	MaxValueSize uint32
+
+	// ExpectedKeys is about how many keys the database holds, so the in-memory
+	// map can be sized up front instead of growing while the file is read on
+	// open. It's only a hint. 0 lets the map grow as needed.
+	ExpectedKeys int
+
+	// TempDir is the directory the temporary file is created in while vacuuming.
+	// "" uses the database file's directory. The vacuumed file is renamed over
+	// the database file, so a crash leaves one or the other intact, but from
+	// another filesystem it has to be copied over it instead, which isn't safe
+	// from crashes.
+	TempDir string
+
+	// WAL makes committing a Batch all-or-nothing across crashes, by writing and
+	// syncing it to a write-ahead log next to the database file, named like it
+	// but ending in ".wal", before writing it to the database file. Batches
+	// committed to the log are written to the database file when it's next
+	// opened, if they weren't already. It's ignored for a Storage that only
+	// lives in memory.
+	WAL bool
+
+	// DiskValues keeps only the offset and size of each value in memory, and
+	// reads values from the database file when they're got, so the values don't
+	// all have to fit in memory. Keys are still all kept in memory. Reads that
+	// miss the value cache read the file concurrently, without waiting on
+	// writes, unless the record is still in the write buffer. It's ignored for a
+	// Storage that only lives in memory.
+	DiskValues bool
+
+	// ValueCacheSize is how many bytes of the most recently used values are
+	// kept in memory with DiskValues, so hot keys don't have to be read from the
+	// database file. 0 turns off the cache.
+	ValueCacheSize int
+
+	// IndexFile writes the offset and size of every live record to an index
+	// file next to the database file, named like it but ending in ".idx", on
+	// Close and Sync. When it's opened again, the in-memory map is rebuilt from
+	// the index file instead of by reading the whole database file, unless the
+	// database file has changed since. It's most useful with DiskValues, since
+	// otherwise every value is still read from the database file on open. It's
+	// ignored for a Storage that only lives in memory.
+	IndexFile bool
+
+	// ChangeLogSize is how many of the latest changes are kept in memory, so
+	// Subscribe can replay them to a subscriber that starts from an earlier
+	// change, like one catching up after it was cut off. 0 keeps none, so
+	// subscribers only get the changes made after they subscribe.
+	ChangeLogSize int
+}
+
+// Logger logs internal events of a Storage. A *log.Logger is a Logger.
+type Logger interface {
+	Printf(format string, args ...any)
+}
+
+// nopLogger is a Logger that doesn't log anything.
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...any) {}
+
+// defaultConfig returns the config a Storage uses when no options are given.
+func defaultConfig() *Config {
+	return &Config{
+		VacuumBatch: 50000,
+		FsyncBatch:  25000,
+	}
+}
+
+// Option configures a Storage. A *Config is itself an Option that replaces the
+// entire config, which keeps NewStorage(filename, mode, config) working.
+type Option interface {
+	apply(c *Config)
+}
+
+// apply replaces c with a copy of the config. A nil config leaves c unchanged.
+func (cfg *Config) apply(c *Config) {
+	if cfg != nil {
+		*c = *cfg
+	}
+}
+
+// optionFunc is an Option that calls a function on the config.
+type optionFunc func(c *Config)
+
+func (f optionFunc) apply(c *Config) {
+	f(c)
+}
+
+// WithConfig replaces the entire config with a copy of config.
+func WithConfig(config *Config) Option {
+	return config
+}
+
+// WithVacuumBatch sets the number of write operations between vacuums. 0 turns
+// off vacuuming.
+func WithVacuumBatch(n uint64) Option {
+	return optionFunc(func(c *Config) {
+		c.VacuumBatch = n
+	})
+}
+
+// WithVacuumFragmentationThreshold sets the fraction of the database file taken
+// up by deleted data, between 0 and 1, over which the file is vacuumed. 0 turns
+// off vacuuming by fragmentation.
+func WithVacuumFragmentationThreshold(th float64) Option {
+	return optionFunc(func(c *Config) {
+		c.VacuumFragmentationThreshold = th
+	})
+}
+
+// WithVacuumInterval sets how often the database file is vacuumed in the
+// background. 0 turns off scheduled vacuuming.
+func WithVacuumInterval(d time.Duration) Option {
+	return optionFunc(func(c *Config) {
+		c.VacuumInterval = d
+	})
+}
+
+// WithFsyncBatch sets the number of write operations between fsync calls. 0
+// turns off fsync, except on Close.
+func WithFsyncBatch(n uint64) Option {
+	return optionFunc(func(c *Config) {
+		c.FsyncBatch = n
+	})
+}
+
+// WithFsyncInterval sets how often the database file is synced in the
+// background, if it's been written to. 0 turns off syncing in the background.
+func WithFsyncInterval(d time.Duration) Option {
+	return optionFunc(func(c *Config) {
+		c.FsyncInterval = d
+	})
+}
+
+// WithReuseSpace sets whether to write new datums in the space of deleted datums
+// of the same size instead of at the end of the database file.
+func WithReuseSpace(reuse bool) Option {
+	return optionFunc(func(c *Config) {
+		c.ReuseSpace = reuse
+	})
+}
+
+// WithWriteBufferSize sets the number of bytes of new records to buffer before
+// writing them to the database file. 0 turns off buffering.
+func WithWriteBufferSize(n int) Option {
+	return optionFunc(func(c *Config) {
+		c.WriteBufferSize = n
+	})
+}
+
+// WithMmap sets whether to memory-map the database file to read it when it's
+// opened.
+func WithMmap(mmap bool) Option {
+	return optionFunc(func(c *Config) {
+		c.Mmap = mmap
+	})
+}
+
+// WithOpenConcurrency sets how many goroutines decode records when the
+// database file is opened.
+func WithOpenConcurrency(n int) Option {
+	return optionFunc(func(c *Config) {
+		c.OpenConcurrency = n
+	})
+}
+
+// WithRepairTornWrite sets whether to truncate a record cut short at the end
+// of the database file when it's opened.
+func WithRepairTornWrite(repair bool) Option {
+	return optionFunc(func(c *Config) {
+		c.RepairTornWrite = repair
+	})
+}
+
+// WithCompression sets how values are compressed in the database file.
+func WithCompression(c Compression) Option {
+	return optionFunc(func(c2 *Config) {
+		c2.Compression = c
+	})
+}
+
+// WithEncryptionKey sets the 32 byte AES-256 key the keys and values in the
+// database file are encrypted with.
+func WithEncryptionKey(key []byte) Option {
+	return optionFunc(func(c *Config) {
+		c.EncryptionKey = key
+	})
+}
+
+// WithClock sets the function used to get the current time, for expiry and
+// modification times.
+func WithClock(now func() time.Time) Option {
+	return optionFunc(func(c *Config) {
+		c.Clock = now
+	})
+}
+
+// WithOnSet sets the function called after each successful set.
+func WithOnSet(fn func(key string, value []byte)) Option {
+	return optionFunc(func(c *Config) {
+		c.OnSet = fn
+	})
+}
+
+// WithOnDelete sets the function called after each successful delete.
+func WithOnDelete(fn func(key string)) Option {
+	return optionFunc(func(c *Config) {
+		c.OnDelete = fn
+	})
+}
+
+// WithLogger sets the Logger internal events are logged to.
+func WithLogger(l Logger) Option {
+	return optionFunc(func(c *Config) {
+		c.Logger = l
+	})
+}
+
+// WithOrdered sets whether to keep an index of the keys in order.
+func WithOrdered(ordered bool) Option {
+	return optionFunc(func(c *Config) {
+		c.Ordered = ordered
+	})
+}
+
+// WithMaxSizes sets the most bytes a key or value can be set to. 0 means no
+// limit.
+func WithMaxSizes(key, value uint32) Option {
+	return optionFunc(func(c *Config) {
+		c.MaxKeySize = key
+		c.MaxValueSize = value
+	})
+}
+
+// WithExpectedKeys sets about how many keys the database holds, to size the
+// in-memory map up front.
+func WithExpectedKeys(n int) Option {
+	return optionFunc(func(c *Config) {
+		c.ExpectedKeys = n
+	})
+}
+
+// WithTempDir sets the directory the temporary file is created in while
+// vacuuming.
+func WithTempDir(dir string) Option {
+	return optionFunc(func(c *Config) {
+		c.TempDir = dir
+	})
+}
+
+// WithWAL sets whether to write batches to a write-ahead log before the
+// database file.
+func WithWAL(wal bool) Option {
+	return optionFunc(func(c *Config) {
+		c.WAL = wal
+	})
+}
+
+// WithDiskValues sets whether to keep values in the database file, instead of
+// in memory.
+func WithDiskValues(disk bool) Option {
+	return optionFunc(func(c *Config) {
+		c.DiskValues = disk
+	})
+}
+
+// WithValueCacheSize sets how many bytes of values to cache in memory with
+// DiskValues.
+func WithValueCacheSize(size int) Option {
+	return optionFunc(func(c *Config) {
+		c.ValueCacheSize = size
+	})
+}
+
+// WithIndexFile sets whether to keep an index file next to the database file,
+// so it opens without being read in full.
+func WithIndexFile(index bool) Option {
+	return optionFunc(func(c *Config) {
+		c.IndexFile = index
+	})
+}
+
+// WithChangeLogSize sets how many of the latest changes to keep for Subscribe
+// to replay.
+func WithChangeLogSize(n int) Option {
+	return optionFunc(func(c *Config) {
+		c.ChangeLogSize = n
+	})
 }
@@ -0,0 +1,39 @@
+package bugfruit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestOptions ensures that options are applied in order on top of the default
+// config.
+func TestOptions(t *testing.T) {
+	apply := func(opts ...Option) *Config {
+		return newStorage("", opts).config
+	}
+
+	// no options keeps the defaults
+	test.AssertEqual(t, defaultConfig(), apply())
+	test.AssertEqual(t, defaultConfig(), apply(nil))
+	test.AssertEqual(t, defaultConfig(), apply((*Config)(nil)))
+
+	// a config replaces everything
+	test.AssertEqual(t, &Config{VacuumBatch: 1}, apply(&Config{VacuumBatch: 1}))
+	test.AssertEqual(t, &Config{FsyncBatch: 2}, apply(WithConfig(&Config{FsyncBatch: 2})))
+
+	// individual options only change their own field
+	test.AssertEqual(t, &Config{VacuumBatch: 3, FsyncBatch: 25000}, apply(WithVacuumBatch(3)))
+	test.AssertEqual(t, &Config{VacuumBatch: 50000, FsyncBatch: 4}, apply(WithFsyncBatch(4)))
+	test.AssertEqual(t, &Config{VacuumBatch: 50000, VacuumFragmentationThreshold: 0.5, FsyncBatch: 25000}, apply(WithVacuumFragmentationThreshold(0.5)))
+
+	// the clock is used by the storage
+	now := time.Unix(3019, 0)
+	s := newStorage("", []Option{WithClock(func() time.Time { return now })})
+	test.AssertEqual(t, now, s.now())
+	test.AssertEqual(t, true, newStorage("", nil).now != nil)
+
+	// later options win
+	test.AssertEqual(t, &Config{VacuumBatch: 5, FsyncBatch: 6}, apply(&Config{VacuumBatch: 1}, WithVacuumBatch(5), WithFsyncBatch(6)))
+}
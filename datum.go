@@ -2,23 +2,44 @@ package bugfruit
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
 )
 
+// crcTable is the table used to compute datum checksums.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // datum represents a key value pair and its metadata.
 type datum struct {
 	meta  *meta
 	key   string
 	value []byte
-	idx   uint32
+	idx   uint64
+	size  uint64 // the size of the datum in the file, or 0 if it's the same as in memory
+
+	spilled bool // whether the value is only in the database file, with DiskValues
 }
 
+// maxSize is the most bytes a key or value can be, since their sizes are
+// stored as uint32s. It's a variable so tests can lower it.
+var maxSize uint64 = math.MaxUint32
+
 // newDatum instantiates a new datum
 func newDatum() *datum {
 	return &datum{meta: &meta{}}
 }
 
-// Set sets the key and value for a datum as well as its associated metadata.
+// Set sets the key and value for a datum as well as its associated metadata,
+// including its checksum. It returns ErrKeyTooLarge or ErrValueTooLarge if
+// the key or value is too large for the file format.
 func (d *datum) Set(key string, value []byte) error {
+	if err := checkSize(key, value, maxSize, maxSize); err != nil {
+		return err
+	}
 	if !bytes.Equal(value, d.value) {
 		d.meta.valSize = uint32(len(value))
 		d.value = value
@@ -27,42 +48,158 @@ func (d *datum) Set(key string, value []byte) error {
 		d.meta.keySize = uint32(len([]byte(key)))
 		d.key = key
 	}
+	d.meta.crc = d.Checksum()
+	return nil
+}
+
+// checkSize returns ErrKeyTooLarge if the key is longer than maxKey bytes, or
+// ErrValueTooLarge if the value is longer than maxVal bytes.
+func checkSize(key string, value []byte, maxKey, maxVal uint64) error {
+	if sz := uint64(len(key)); sz > maxKey {
+		return fmt.Errorf("%w: %d bytes, the most is %d", ErrKeyTooLarge, sz, maxKey)
+	}
+	if sz := uint64(len(value)); sz > maxVal {
+		return fmt.Errorf("%w: %d bytes, the most is %d", ErrValueTooLarge, sz, maxVal)
+	}
 	return nil
 }
 
 // Clone returns a deep copy of a datum.
 func (d *datum) Clone() *datum {
+	return d.withValue(d.value)
+}
+
+// withValue returns a deep copy of a datum with value as its value, like Clone,
+// for a datum whose value was read from the database file.
+func (d *datum) withValue(value []byte) *datum {
 	newD := newDatum()
-	newD.Set(d.key, d.value)
+	newD.Set(d.key, value)
+	newD.meta.expires = d.meta.expires
+	newD.meta.modTime = d.meta.modTime
+	newD.meta.seq = d.meta.seq
 	newD.idx = d.idx
 	return newD
 }
 
+// Value returns a copy of the datum's value, so that callers can't modify the
+// stored value out from under it.
+func (d *datum) Value() []byte {
+	v := make([]byte, len(d.value))
+	copy(v, d.value)
+	return v
+}
+
 // MarkDeleted marks a datum as deleted
 func (d *datum) MarkDeleted() {
 	d.meta.deleted = byte(1)
 }
 
+// deletedCopy returns a shallow copy of the datum with its own meta, marked as
+// deleted, so its record can be marked deleted without changing the datum
+// itself, which readers may still see in the in-memory map.
+func (d *datum) deletedCopy() *datum {
+	m := *d.meta
+	c := *d
+	c.meta = &m
+	c.MarkDeleted()
+	return &c
+}
+
 // Deleted returns the deleted value of a datum's meta.
 func (d *datum) Deleted() byte {
 	return d.meta.deleted
 }
 
+// expired returns whether the datum has an expiry time at or before now.
+func (d *datum) expired(now time.Time) bool {
+	return d.meta.expires != 0 && d.meta.expires <= now.UnixNano()
+}
+
+// decode decrypts the key and value of a datum read from file with aead, if
+// they're encrypted, and decompresses the value, if it's compressed, so the
+// datum holds its key and value as they were set.
+func (d *datum) decode(aead cipher.AEAD) error {
+	if d.meta.flags&flagEncrypted != 0 {
+		if aead == nil {
+			return fmt.Errorf("record is encrypted, but there's no encryption key: %w", ErrAuthFailed)
+		}
+		plain, err := open(aead, append([]byte(d.key), d.value...))
+		if err != nil {
+			return fmt.Errorf("decrypting: %w", err)
+		}
+		if uint32(len(plain)) < d.meta.keySize {
+			return fmt.Errorf("decrypting: %w: key is %d bytes, but only %d were decrypted", ErrCorrupt, d.meta.keySize, len(plain))
+		}
+		d.meta.flags &^= flagEncrypted
+		if err := d.Set(string(plain[:d.meta.keySize]), plain[d.meta.keySize:]); err != nil {
+			return err
+		}
+	}
+	if d.meta.flags&flagGzip != 0 {
+		v, err := decompress(d.value)
+		if err != nil {
+			return fmt.Errorf("decompressing value: %w", err)
+		}
+		d.meta.flags &^= flagGzip
+		return d.Set(d.key, v)
+	}
+	return nil
+}
+
+// Checksum returns the CRC32 (Castagnoli) checksum of the datum's key and value.
+func (d *datum) Checksum() uint32 {
+	crc := crc32.Checksum([]byte(d.key), crcTable)
+	return crc32.Update(crc, crcTable, d.value)
+}
+
 // Bytes converts a datum struct to a byte slice for writing to file.
 func (d *datum) Bytes() []byte {
-	b := make([]byte, d.Size())
+	msz := d.meta.size()
+	b := make([]byte, uint64(d.meta.keySize)+uint64(d.meta.valSize)+msz)
 	// add the metadata
-	copy(b[:metaSize], d.meta.Bytes())
+	d.meta.put(b[:msz])
 
 	// add the key
-	copy(b[metaSize:metaSize+d.meta.keySize], []byte(d.key))
+	copy(b[msz:msz+uint64(d.meta.keySize)], []byte(d.key))
 
 	// add the value
-	copy(b[metaSize+d.meta.keySize:], []byte(d.value))
+	copy(b[msz+uint64(d.meta.keySize):], []byte(d.value))
 
 	return b
 }
 
+// WriteTo writes the datum to w as it's written to file, like Bytes, but
+// without building a byte slice of the whole datum.
+func (d *datum) WriteTo(w io.Writer) (int64, error) {
+	n, err := d.meta.writeTo(w)
+	if err != nil {
+		return n, err
+	}
+	nk, err := io.WriteString(w, d.key)
+	n += int64(nk)
+	if err != nil {
+		return n, err
+	}
+	nv, err := w.Write(d.value)
+	return n + int64(nv), err
+}
+
+// sliceWriter is an io.Writer that appends to the byte slice it points to. It's
+// only a pointer, so it's an io.Writer without being allocated.
+type sliceWriter struct {
+	b *[]byte
+}
+
+func (w sliceWriter) Write(p []byte) (int, error) {
+	*w.b = append(*w.b, p...)
+	return len(p), nil
+}
+
+func (w sliceWriter) WriteString(s string) (int, error) {
+	*w.b = append(*w.b, s...)
+	return len(s), nil
+}
+
 // KeyValFromBytes converts a byte slice to a key/value pair and saves it to the
 // datum. It returns an error if the length of the byte slice does not equal the
 // keySize plus the valSize.
@@ -80,7 +217,23 @@ func (d *datum) KeyValFromBytes(b []byte) (err error) {
 	return nil
 }
 
+// metaSize returns the size of the metadata in the record of d. If the value is
+// compressed or encrypted, its size in the file isn't the one in d's metadata,
+// but it's the only one whose uvarint fits in the rest of the record.
+func (d *datum) metaSize() uint64 {
+	k := uint64(d.meta.keySize)
+	rest := d.Size() - k - (minMetaSize - 2) - uvarintSize(k)
+	u := uint64(1)
+	for uvarintSize(rest-u) != u {
+		u++
+	}
+	return minMetaSize - 2 + uvarintSize(k) + u
+}
+
 // Size returns the size of the datum when written to file in bytes.
-func (d *datum) Size() uint32 {
-	return d.meta.keySize + d.meta.valSize + metaSize
+func (d *datum) Size() uint64 {
+	if d.size != 0 {
+		return d.size
+	}
+	return uint64(d.meta.keySize) + uint64(d.meta.valSize) + d.meta.size()
 }
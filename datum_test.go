@@ -1,6 +1,7 @@
 package bugfruit
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/reesporte/bugfruit/test"
@@ -26,6 +27,7 @@ func TestSetDatum(t *testing.T) {
 	test.AssertEqual(t, d.meta.valSize, uint32(len(v)))
 	test.AssertEqual(t, d.key, k)
 	test.AssertEqual(t, d.value, v)
+	test.AssertEqual(t, d.Checksum(), d.meta.crc)
 }
 
 // TestCloneDatum ensures that cloning a datum works properly.
@@ -42,6 +44,19 @@ func TestCloneDatum(t *testing.T) {
 	test.AssertEqual(t, d, clone)
 }
 
+// TestValue ensures that a datum's value is copied, not shared.
+func TestValue(t *testing.T) {
+	d := newDatum()
+	err := d.Set("heck", []byte("yeah"))
+	test.AssertNil(t, err)
+
+	v := d.Value()
+	test.AssertEqual(t, []byte("yeah"), v)
+
+	v[0] = 'n'
+	test.AssertEqual(t, []byte("yeah"), d.value)
+}
+
 // TestSize ensures that calling d.Size() and d.ValSize()
 // and d.KeySize() and d.unprotectedSize() returns
 // the correct size.
@@ -54,7 +69,7 @@ func TestSize(t *testing.T) {
 	keySize := uint32(len(k))
 	valSize := uint32(len(v))
 
-	exp := keySize + valSize + metaSize
+	exp := uint64(keySize) + uint64(valSize) + minMetaSize
 	test.AssertEqual(t, exp, d.Size())
 	test.AssertEqual(t, valSize, d.meta.valSize)
 	test.AssertEqual(t, keySize, d.meta.keySize)
@@ -91,12 +106,24 @@ func TestDatum(t *testing.T) {
 
 	// convert to bytes
 	b := d.Bytes()
-	test.AssertEqual(t, []byte{0x4, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x0, 0x74, 0x65, 0x73, 0x74, 0x74, 0x69, 0x6d, 0x65}, b)
+	test.AssertEqual(t, []byte{0x0, 0x4, 0x4, 0x81, 0xc8, 0xf1, 0xc9, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x74, 0x65, 0x73, 0x74, 0x74, 0x69, 0x6d, 0x65}, b)
+
+	// writing it writes the same bytes, to a slice or any other writer
+	got := []byte{}
+	n, err := d.WriteTo(sliceWriter{&got})
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(len(b)), n)
+	test.AssertEqual(t, b, got)
+	var buf bytes.Buffer
+	n, err = d.WriteTo(&buf)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(len(b)), n)
+	test.AssertEqual(t, b, buf.Bytes())
 
 	// and back again
 	d2 := newDatum()
-	test.AssertNil(t, d2.meta.FromBytes(b[0:metaSize]))
-	test.AssertNil(t, d2.KeyValFromBytes(b[metaSize:]))
+	test.AssertNil(t, d2.meta.FromBytes(b[0:minMetaSize]))
+	test.AssertNil(t, d2.KeyValFromBytes(b[minMetaSize:]))
 	test.AssertEqual(t, d, d2)
 
 	// wrong size byte slice should err
@@ -105,5 +132,5 @@ func TestDatum(t *testing.T) {
 	// nil metadata should err
 	d3 := newDatum()
 	d3.meta = nil
-	test.AssertEqual(t, ErrNoMetadata, d3.KeyValFromBytes(b[metaSize:]))
+	test.AssertEqual(t, ErrNoMetadata, d3.KeyValFromBytes(b[minMetaSize:]))
 }
@@ -0,0 +1,65 @@
+package bugfruit
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Diff compares the live key/value pairs in two databases. It returns the keys
+// only in a, the keys only in b, and the keys in both whose values differ, each
+// sorted.
+//
+// Each database is read under its locks, one after the other, so writes to a
+// while b is being read are not taken into account.
+func Diff(a, b *Storage) (onlyA []string, onlyB []string, changed []string, err error) {
+	if a.isClosed() || b.isClosed() {
+		return nil, nil, nil, ErrDBClosed
+	}
+
+	vals, err := liveValues(a)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bVals, err := liveValues(b)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for k, bv := range bVals {
+		if v, ok := vals[k]; !ok {
+			onlyB = append(onlyB, k)
+		} else {
+			if !bytes.Equal(v, bv) {
+				changed = append(changed, k)
+			}
+			delete(vals, k)
+		}
+	}
+	for k := range vals {
+		onlyA = append(onlyA, k)
+	}
+
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+	sort.Strings(changed)
+	return onlyA, onlyB, changed, nil
+}
+
+// liveValues returns a copy of the value of every live key in s. The file lock
+// is held too, to read values from the file.
+func liveValues(s *Storage) (map[string][]byte, error) {
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	vals := make(map[string][]byte, s.data.Len())
+	now := s.now()
+	var err error
+	s.data.Range(func(k string, d *datum) bool {
+		if d.Deleted() != byte(1) && !d.expired(now) {
+			if vals[k], err = s.unprotectedValue(d); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	return vals, err
+}
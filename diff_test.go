@@ -0,0 +1,46 @@
+package bugfruit
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+func TestDiff(t *testing.T) {
+	a, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer a.Close()
+	test.AssertNil(t, a.Set("frodo", []byte("Ring-bearer")))
+	test.AssertNil(t, a.Set("sam", []byte("Gardener")))
+	test.AssertNil(t, a.Set("boromir", []byte("Captain of the White Tower")))
+	test.AssertNil(t, a.Set("gandalf", []byte("the Grey")))
+
+	snapname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	test.AssertNil(t, a.Snapshot(snapname, 0644))
+	b, err := NewStorage(snapname, 0644, nil)
+	test.AssertNil(t, err)
+	defer b.Close()
+
+	onlyA, onlyB, changed, err := Diff(a, b)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, []string(nil), onlyA)
+	test.AssertEqual(t, []string(nil), onlyB)
+	test.AssertEqual(t, []string(nil), changed)
+
+	test.AssertNil(t, a.Delete("boromir"))
+	test.AssertNil(t, b.Set("gandalf", []byte("the White")))
+	test.AssertNil(t, b.Set("faramir", []byte("Captain of Gondor")))
+	test.AssertNil(t, b.Set("merry", []byte("Esquire of Rohan")))
+	test.AssertNil(t, b.Delete("sam"))
+
+	onlyA, onlyB, changed, err = Diff(a, b)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, []string{"sam"}, onlyA)
+	test.AssertEqual(t, []string{"boromir", "faramir", "merry"}, onlyB)
+	test.AssertEqual(t, []string{"gandalf"}, changed)
+
+	test.AssertNil(t, b.Close())
+	_, _, _, err = Diff(a, b)
+	test.AssertEqual(t, ErrDBClosed, err)
+}
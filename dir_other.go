@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package bugfruit
+
+// syncDir does nothing on this platform, where directories can't be fsynced.
+func syncDir(dir string) error {
+	return nil
+}
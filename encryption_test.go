@@ -0,0 +1,62 @@
+package bugfruit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestEncryption ensures keys and values are encrypted in the database file,
+// read back with the right encryption key, and fail to open with the wrong one.
+func TestEncryption(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	key := bytes.Repeat([]byte{0x42}, encryptionKeySize)
+
+	s, err := NewStorage(fname, 0644, WithEncryptionKey(key), WithCompression(GzipCompression), WithVacuumBatch(0))
+	test.AssertNil(t, err)
+
+	secret := []byte("The Ring is in the Shire, in a hobbit-hole called Bag End.")
+	song := bytes.Repeat([]byte("Three Rings for the Elven-kings under the sky. "), 20)
+	test.AssertNil(t, s.Set("gollum", secret))
+	test.AssertNil(t, s.Set("galadriel", song))
+	test.AssertNil(t, s.Set("gollum", secret))
+	test.AssertNil(t, s.Vacuum())
+	test.AssertNil(t, s.Verify())
+
+	got, _ := s.Get("gollum")
+	test.AssertEqual(t, secret, got)
+	test.AssertNil(t, s.Close())
+
+	// neither keys nor values are in the file
+	b, err := os.ReadFile(fname)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, bytes.Contains(b, []byte("gollum")))
+	test.AssertEqual(t, false, bytes.Contains(b, []byte("Bag End")))
+	test.AssertEqual(t, false, bytes.Contains(b, []byte("galadriel")))
+
+	// the right key reads everything back
+	s, err = NewStorage(fname, 0644, WithEncryptionKey(key))
+	test.AssertNil(t, err)
+	got, _ = s.Get("gollum")
+	test.AssertEqual(t, secret, got)
+	got, _ = s.Get("galadriel")
+	test.AssertEqual(t, song, got)
+	test.AssertNil(t, s.Close())
+
+	// the wrong key or no key fails
+	wrong := bytes.Repeat([]byte{0x41}, encryptionKeySize)
+	_, err = NewStorage(fname, 0644, WithEncryptionKey(wrong))
+	test.AssertEqual(t, true, errors.Is(err, ErrAuthFailed))
+	_, err = NewStorage(fname, 0644, nil)
+	test.AssertEqual(t, true, errors.Is(err, ErrAuthFailed))
+
+	// keys have to be the right size
+	_, err = NewStorage(fname, 0644, WithEncryptionKey([]byte("speak friend and enter")))
+	test.AssertNotEqual(t, nil, err)
+	_, err = NewMemStorage(WithEncryptionKey([]byte("mellon")))
+	test.AssertNotEqual(t, nil, err)
+}
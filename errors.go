@@ -1,6 +1,13 @@
 package bugfruit
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
+
+// errMmapUnsupported is returned when memory-mapping files isn't supported on
+// this platform.
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
 
 var (
 	// ErrDBClosed is returned when a method that requires an open DB is called on a
@@ -20,4 +27,98 @@ var (
 	// ErrNoMetadata is returned when performing operations on a datum with no
 	// metadata.
 	ErrNoMetadata = errors.New("no metadata")
+
+	// ErrChecksumMismatch is returned when the checksum of a datum read from
+	// file does not match its key and value.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrCorrupt is returned when a record in the database file is not
+	// structurally valid.
+	ErrCorrupt = errors.New("corrupt record")
+
+	// ErrInvalidHeader is returned when a file does not start with a bugfruit
+	// database file header.
+	ErrInvalidHeader = errors.New("not a bugfruit database file")
+
+	// ErrUnsupportedVersion is returned when a database file's format version is
+	// not supported.
+	ErrUnsupportedVersion = errors.New("unsupported file format version")
+
+	// ErrAuthFailed is returned when an encrypted record can't be decrypted,
+	// because the encryption key is wrong or missing, or the record was tampered
+	// with.
+	ErrAuthFailed = errors.New("authentication failed: wrong encryption key or tampered data")
+
+	// ErrKeyTooLarge is returned when setting a key longer than the configured
+	// MaxKeySize, or than the file format can hold.
+	ErrKeyTooLarge = errors.New("key too large")
+
+	// ErrValueTooLarge is returned when setting a value longer than the
+	// configured MaxValueSize, or than the file format can hold.
+	ErrValueTooLarge = errors.New("value too large")
+
+	// ErrLocked is returned when opening a database file that another Storage,
+	// in this process or another, already has open.
+	ErrLocked = errors.New("database file is locked by another Storage")
+
+	// ErrNotCounter is returned when incrementing a key whose value is not an
+	// 8 byte counter.
+	ErrNotCounter = errors.New("value is not a counter")
+
+	// ErrInvalidBucketName is returned when getting a bucket whose name has a
+	// NUL byte in it.
+	ErrInvalidBucketName = errors.New("bucket name has a NUL byte in it")
+
+	// ErrKeyNotFound is returned when a method that needs a key to exist, like
+	// RenameKey, is called with a key that doesn't.
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrMergeContended is returned by Merge when keys in both databases keep
+	// being written to while their conflicts are resolved.
+	ErrMergeContended = errors.New("keys kept being written to while their merge conflicts were resolved")
+
+	// ErrNotDeleted is returned by Undelete when a key has no deleted record
+	// left to restore.
+	ErrNotDeleted = errors.New("no deleted record to restore")
+
+	// ErrTxDone is returned when writing to or committing a Tx that was already
+	// committed or rolled back.
+	ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+	// ErrNoWAL is returned when committing a Tx on a database file without
+	// Config.WAL, which it needs to be all-or-nothing.
+	ErrNoWAL = errors.New("transactions need the write-ahead log")
+
+	// ErrSnapshotActive is returned by Vacuum, Clear, CompactKey, and Undelete
+	// while there's a ReadSnapshot that hasn't been released, since they'd
+	// change the records it reads.
+	ErrSnapshotActive = errors.New("a read snapshot hasn't been released")
+
+	// ErrTornWrite is matched by a TornWriteError.
+	ErrTornWrite = errors.New("torn write at the end of the database file")
 )
+
+// TornWriteError is returned when opening a database file whose last record
+// was cut short, like by a crash in the middle of appending it. Every record
+// before it is intact, so truncating the file to Good bytes, or opening it with
+// RepairTornWrite, loses nothing but the write that never finished. It matches
+// ErrTornWrite with errors.Is.
+type TornWriteError struct {
+	Good int64 // the size of the file up to the end of the last intact record
+	Size int64 // the size of the file
+	Err  error // what's wrong with the last record
+}
+
+func (e *TornWriteError) Error() string {
+	return fmt.Sprintf("%v: %d bytes after the last intact record, which ends at %d: %v", ErrTornWrite, e.Size-e.Good, e.Good, e.Err)
+}
+
+// Is returns whether target is ErrTornWrite.
+func (e *TornWriteError) Is(target error) bool {
+	return target == ErrTornWrite
+}
+
+// Unwrap returns what's wrong with the last record.
+func (e *TornWriteError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,114 @@
+package bugfruit
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// jsonPair is a key/value pair as it's exported to JSON. The value is base64
+// encoded, since it can be any bytes.
+type jsonPair struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// jsonBinaryPair is a key/value pair whose key isn't valid UTF-8 as it's
+// exported to JSON. The key is base64 encoded too, since a JSON string would
+// replace its invalid bytes.
+type jsonBinaryPair struct {
+	Key   []byte `json:"key_b64"`
+	Value []byte `json:"value"`
+}
+
+// ExportJSON writes the key/value pairs in the database to w as a JSON array of
+// objects, in an unspecified order. The pairs are written one at a time, rather
+// than all at once. Returns nil on success.
+//
+// Each object has a base64 encoded "value", and its key in one of two shapes:
+// a "key" string if the key is valid UTF-8, or otherwise a base64 encoded
+// "key_b64", since a JSON string would replace its invalid bytes. An importer
+// has to check for both.
+//
+// Like with ForEach, writes wait for ExportJSON to finish, so it has every key
+// that's live the whole time it's taking place, except with DiskValues, where
+// writes while it runs may be seen.
+func (s *Storage) ExportJSON(w io.Writer) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return fmt.Errorf("exporting JSON: %w", err)
+	}
+
+	var werr error
+	sep := ""
+	err := s.ForEach(func(key string, value []byte) bool {
+		var pair any = jsonPair{Key: key, Value: value}
+		if !utf8.ValidString(key) {
+			pair = jsonBinaryPair{Key: []byte(key), Value: value}
+		}
+		b, err := json.Marshal(pair)
+		if err != nil {
+			werr = err
+			return false
+		}
+		if _, werr = io.WriteString(w, sep); werr != nil {
+			return false
+		}
+		if _, werr = w.Write(b); werr != nil {
+			return false
+		}
+		sep = ","
+		return true
+	})
+	if err != nil {
+		return err
+	} else if werr != nil {
+		return fmt.Errorf("exporting JSON: %w", werr)
+	}
+
+	if _, err := io.WriteString(w, "]\n"); err != nil {
+		return fmt.Errorf("exporting JSON: %w", err)
+	}
+	return nil
+}
+
+// ExportCSV writes the key/value pairs in the database to w as CSV, with a
+// "key,value" header row, and a row with each key and its base64 encoded value,
+// in an unspecified order. Returns nil on success.
+//
+// Like with ForEach, writes wait for ExportCSV to finish, so it has every key
+// that's live the whole time it's taking place, except with DiskValues, where
+// writes while it runs may be seen.
+func (s *Storage) ExportCSV(w io.Writer) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"key", "value"}); err != nil {
+		return fmt.Errorf("exporting CSV: %w", err)
+	}
+
+	var werr error
+	err := s.ForEach(func(key string, value []byte) bool {
+		werr = cw.Write([]string{key, base64.StdEncoding.EncodeToString(value)})
+		return werr == nil
+	})
+	if err != nil {
+		return err
+	} else if werr != nil {
+		return fmt.Errorf("exporting CSV: %w", werr)
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("exporting CSV: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package bugfruit
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// errWriter is an io.Writer that always fails.
+type errWriter struct{}
+
+var errWrite = errors.New("the Balrog got it")
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errWrite
+}
+
+// TestExportJSON ensures ExportJSON writes every live key/value pair as JSON.
+func TestExportJSON(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	// an empty database is an empty array
+	var buf bytes.Buffer
+	test.AssertNil(t, s.ExportJSON(&buf))
+	test.AssertEqual(t, "[]\n", buf.String())
+
+	test.AssertNil(t, s.Set("gandalf", []byte("You shall not pass!")))
+	test.AssertNil(t, s.Set("balrog", []byte{0x00, 0xff, 0xfe}))
+	test.AssertNil(t, s.Set("saruman", []byte("You have elected the way of pain.")))
+	test.AssertNil(t, s.Delete("saruman"))
+
+	buf.Reset()
+	test.AssertNil(t, s.ExportJSON(&buf))
+	var pairs []jsonPair
+	test.AssertNil(t, json.Unmarshal(buf.Bytes(), &pairs))
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	test.AssertEqual(t, []jsonPair{
+		{Key: "balrog", Value: []byte{0x00, 0xff, 0xfe}},
+		{Key: "gandalf", Value: []byte("You shall not pass!")},
+	}, pairs)
+
+	// a key that isn't valid UTF-8 is base64 encoded, so it isn't mangled
+	test.AssertNil(t, s.Set("durin\xff\x00", []byte("the Deathless")))
+	buf.Reset()
+	test.AssertNil(t, s.ExportJSON(&buf))
+	var exported []struct {
+		Key    *string `json:"key"`
+		KeyB64 []byte  `json:"key_b64"`
+		Value  []byte  `json:"value"`
+	}
+	test.AssertNil(t, json.Unmarshal(buf.Bytes(), &exported))
+	test.AssertEqual(t, 3, len(exported))
+	binary := 0
+	for _, p := range exported {
+		if p.KeyB64 != nil {
+			binary++
+			test.AssertEqual(t, (*string)(nil), p.Key)
+			test.AssertEqual(t, []byte("durin\xff\x00"), p.KeyB64)
+			test.AssertEqual(t, []byte("the Deathless"), p.Value)
+		}
+	}
+	test.AssertEqual(t, 1, binary)
+
+	test.AssertEqual(t, true, errors.Is(s.ExportJSON(errWriter{}), errWrite))
+
+	test.AssertNil(t, s.Close())
+	test.AssertEqual(t, ErrDBClosed, s.ExportJSON(&buf))
+}
+
+// TestExportCSV ensures ExportCSV writes every live key/value pair as CSV.
+func TestExportCSV(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.Set("gandalf", []byte("You shall not pass!")))
+	test.AssertNil(t, s.Set("balrog, of Morgoth", []byte{0x00, 0xff, 0xfe}))
+	test.AssertNil(t, s.Set("saruman", []byte("You have elected the way of pain.")))
+	test.AssertNil(t, s.Delete("saruman"))
+
+	var buf bytes.Buffer
+	test.AssertNil(t, s.ExportCSV(&buf))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	test.AssertNil(t, err)
+	sort.Slice(rows[1:], func(i, j int) bool { return rows[i+1][0] < rows[j+1][0] })
+	test.AssertEqual(t, [][]string{
+		{"key", "value"},
+		{"balrog, of Morgoth", "AP/+"},
+		{"gandalf", "WW91IHNoYWxsIG5vdCBwYXNzIQ=="},
+	}, rows)
+
+	test.AssertEqual(t, true, errors.Is(s.ExportCSV(errWriter{}), errWrite))
+
+	test.AssertNil(t, s.Close())
+	test.AssertEqual(t, ErrDBClosed, s.ExportCSV(&buf))
+}
+
+// TestExportConcurrentWrites ensures the exports have every key while other
+// goroutines overwrite them.
+func TestExportConcurrentWrites(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	keys := []string{}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("hobbit-%d", i))
+		test.AssertNil(t, s.Set(keys[i], []byte("second breakfast")))
+	}
+	overwriteWhile(t, s, keys, 1000, func() {
+		var buf bytes.Buffer
+		test.AssertNil(t, s.ExportJSON(&buf))
+		var pairs []map[string]any
+		test.AssertNil(t, json.Unmarshal(buf.Bytes(), &pairs))
+		test.AssertEqual(t, len(keys), len(pairs))
+
+		buf.Reset()
+		test.AssertNil(t, s.ExportCSV(&buf))
+		rows, err := csv.NewReader(&buf).ReadAll()
+		test.AssertNil(t, err)
+		test.AssertEqual(t, len(keys)+1, len(rows))
+	})
+}
@@ -0,0 +1,115 @@
+package bugfruit
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// file is the backing store for a Storage. *os.File satisfies it. ReadAt must
+// be safe to call concurrently with the other methods, since values are read
+// with it without the file lock.
+type file interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+}
+
+// nopFile is a file that discards everything written to it, for a Storage that
+// only lives in memory. It keeps track of its size and position so that the
+// offsets of the datums stay consistent.
+type nopFile struct {
+	size   int64
+	pos    int64
+	closed bool
+}
+
+// Read always returns io.EOF, since nothing is ever stored.
+func (f *nopFile) Read(b []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	return 0, io.EOF
+}
+
+// ReadAt always returns io.EOF, like Read.
+func (f *nopFile) ReadAt(b []byte, off int64) (int, error) {
+	return f.Read(b)
+}
+
+// Write discards b, and advances the position by len(b).
+func (f *nopFile) Write(b []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	f.pos += int64(len(b))
+	if f.pos > f.size {
+		f.size = f.pos
+	}
+	return len(b), nil
+}
+
+// Seek sets the position for the next Write.
+func (f *nopFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+		f.pos = offset
+	case io.SeekCurrent:
+		f.pos += offset
+	case io.SeekEnd:
+		f.pos = f.size + offset
+	}
+	return f.pos, nil
+}
+
+// Close closes the nopFile.
+func (f *nopFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// Sync does nothing.
+func (f *nopFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+// Truncate changes the size of the nopFile.
+func (f *nopFile) Truncate(size int64) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.size = size
+	return nil
+}
+
+// Stat returns a FileInfo describing the nopFile.
+func (f *nopFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	return nopFileInfo{size: f.size}, nil
+}
+
+// nopFileInfo describes a nopFile.
+type nopFileInfo struct {
+	size int64
+}
+
+func (fi nopFileInfo) Name() string       { return "" }
+func (fi nopFileInfo) Size() int64        { return fi.size }
+func (fi nopFileInfo) Mode() os.FileMode  { return 0 }
+func (fi nopFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi nopFileInfo) IsDir() bool        { return false }
+func (fi nopFileInfo) Sys() any           { return nil }
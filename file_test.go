@@ -0,0 +1,56 @@
+package bugfruit
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestNopFile ensures that a nopFile tracks its size and position without
+// storing anything.
+func TestNopFile(t *testing.T) {
+	f := &nopFile{}
+
+	n, err := f.Write([]byte("Even the smallest person can change the course of the future."))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 61, n)
+
+	off, err := f.Seek(0, io.SeekEnd)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(61), off)
+
+	off, err = f.Seek(8, io.SeekStart)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(8), off)
+
+	// writing in the middle doesn't grow the file
+	_, err = f.Write([]byte{1})
+	test.AssertNil(t, err)
+	fi, err := f.Stat()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(61), fi.Size())
+
+	// nothing to read
+	n, err = f.Read(make([]byte, 9))
+	test.AssertEqual(t, io.EOF, err)
+	test.AssertEqual(t, 0, n)
+	n, err = f.ReadAt(make([]byte, 9), 8)
+	test.AssertEqual(t, io.EOF, err)
+	test.AssertEqual(t, 0, n)
+
+	test.AssertNil(t, f.Truncate(0))
+	fi, err = f.Stat()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(0), fi.Size())
+
+	test.AssertNil(t, f.Sync())
+	test.AssertNil(t, f.Close())
+
+	// closed files err
+	test.AssertEqual(t, os.ErrClosed, f.Close())
+	test.AssertEqual(t, os.ErrClosed, f.Sync())
+	_, err = f.Write([]byte{1})
+	test.AssertEqual(t, os.ErrClosed, err)
+}
@@ -0,0 +1,11 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package bugfruit
+
+import "os"
+
+// lockFile does nothing on this platform, which has no advisory file locks.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,49 @@
+package bugfruit
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestLockFile ensures a database file can only be opened by one Storage at a
+// time, including after it's been vacuumed.
+func TestLockFile(t *testing.T) {
+	switch runtime.GOOS {
+	case "darwin", "dragonfly", "freebsd", "linux", "netbsd", "openbsd", "windows":
+	default:
+		t.Skipf("there are no file locks on %s", runtime.GOOS)
+	}
+
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0644)
+	test.AssertNil(t, err)
+	_, err = NewStorage(fname, 0644)
+	test.AssertEqual(t, true, errors.Is(err, ErrLocked))
+
+	// the vacuumed file that replaces it is locked too
+	test.AssertNil(t, s.Set("barad-dur", []byte("the dark tower")))
+	test.AssertNil(t, s.Set("barad-dur", []byte("fortress of sauron")))
+	test.AssertNil(t, s.Vacuum())
+	_, err = NewStorage(fname, 0644)
+	test.AssertEqual(t, true, errors.Is(err, ErrLocked))
+
+	// nor can it be restored over
+	var buf bytes.Buffer
+	_, err = s.WriteTo(&buf)
+	test.AssertNil(t, err)
+	_, err = RestoreFrom(fname, 0644, &buf)
+	test.AssertEqual(t, true, errors.Is(err, ErrLocked))
+
+	// closing releases the lock
+	test.AssertNil(t, s.Close())
+	s, err = NewStorage(fname, 0644)
+	test.AssertNil(t, err)
+	got, _ := s.Get("barad-dur")
+	test.AssertEqual(t, []byte("fortress of sauron"), got)
+	test.AssertNil(t, s.Close())
+}
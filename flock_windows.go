@@ -0,0 +1,37 @@
+//go:build windows
+// +build windows
+
+package bugfruit
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// flags and errors for LockFileEx
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockFile takes an exclusive lock on f without waiting for it, or returns
+// ErrLocked if another open file holds one. The lock is on a byte past the end
+// of any file, so it doesn't stop reads or writes. It's released when f is
+// closed.
+func lockFile(f *os.File) error {
+	flags := uint32(lockfileFailImmediately | lockfileExclusiveLock)
+	ol := &syscall.Overlapped{Offset: ^uint32(0), OffsetHigh: ^uint32(0)}
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation || err == syscall.ERROR_IO_PENDING {
+		return ErrLocked
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package bugfruit
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const headerSize = 6 // 6 bytes == 4 magic bytes plus 1 uint16
+
+// formatVersion is the version of the file format this package writes, and the
+// newest version it can read.
+const formatVersion uint16 = 6
+
+// byteOrder is the byte order of the numbers in the database file. It's
+// little-endian on every platform, so files can be moved between machines.
+var byteOrder = binary.LittleEndian
+
+// magic identifies a bugfruit database file.
+var magic = []byte("BGFR")
+
+// header is the header at the start of every database file.
+type header struct {
+	version uint16 // the version of the file format
+}
+
+// FromBytes converts a byte slice to a header struct. It returns an error if the
+// magic bytes don't match, or if the version isn't supported.
+func (h *header) FromBytes(b []byte) error {
+	if len(b) != headerSize {
+		return ErrInvalidHeader
+	}
+	if !bytes.Equal(b[:4], magic) {
+		return ErrInvalidHeader
+	}
+
+	h.version = byteOrder.Uint16(b[4:6])
+	if h.version == 0 || h.version > formatVersion {
+		return ErrUnsupportedVersion
+	}
+	return nil
+}
+
+// Bytes converts a header struct to a byte slice for writing to file.
+func (h *header) Bytes() []byte {
+	b := make([]byte, headerSize)
+	copy(b[:4], magic)
+	byteOrder.PutUint16(b[4:6], h.version)
+
+	return b
+}
@@ -0,0 +1,27 @@
+package bugfruit
+
+import (
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestHeader ensures converting headers to and from byte slices works.
+func TestHeader(t *testing.T) {
+	// converting to bytes
+	there := &header{version: formatVersion}
+	b := there.Bytes()
+	expected := []byte{'B', 'G', 'F', 'R', byte(formatVersion), 0x0}
+	test.AssertEqual(t, expected, b)
+
+	// and back again
+	back := &header{}
+	test.AssertNil(t, back.FromBytes(b))
+	test.AssertEqual(t, there, back)
+
+	// bad slices
+	test.AssertEqual(t, ErrInvalidHeader, (&header{}).FromBytes([]byte("BGF")))
+	test.AssertEqual(t, ErrInvalidHeader, (&header{}).FromBytes([]byte("BFRG\x01\x00")))
+	test.AssertEqual(t, ErrUnsupportedVersion, (&header{}).FromBytes([]byte("BGFR\x00\x00")))
+	test.AssertEqual(t, ErrUnsupportedVersion, (&header{}).FromBytes((&header{version: formatVersion + 1}).Bytes()))
+}
@@ -0,0 +1,44 @@
+package bugfruit
+
+// noteHook keeps e for the OnSet or OnDelete hook, to be called once the file
+// lock is released, if there is one. Writes made while the Storage is opened,
+// like batches replayed from the write-ahead log, aren't kept.
+// It is NOT thread safe without external file locking.
+func (s *Storage) noteHook(e Event) {
+	if !s.opened {
+		return
+	}
+	if e.Op == OpSet && s.config.OnSet == nil || e.Op == OpDelete && s.config.OnDelete == nil {
+		return
+	}
+	s.hooked = append(s.hooked, e)
+}
+
+// takeHooks returns the writes made while the file lock has been held, for
+// the OnSet and OnDelete hooks.
+// It is NOT thread safe without external file locking.
+func (s *Storage) takeHooks() []Event {
+	hooked := s.hooked
+	s.hooked = nil
+	return hooked
+}
+
+// runHooks calls the OnSet or OnDelete hook for each write, in order.
+func (s *Storage) runHooks(hooked []Event) {
+	for _, e := range hooked {
+		if e.Op == OpSet {
+			s.config.OnSet(e.Key, e.Value)
+		} else {
+			s.config.OnDelete(e.Key)
+		}
+	}
+}
+
+// unlockFile releases the file lock, then calls the OnSet and OnDelete hooks
+// for the writes made while it was held, so a slow hook doesn't hold up other
+// writers.
+func (s *Storage) unlockFile() {
+	hooked := s.takeHooks()
+	s.muFile.Unlock()
+	s.runHooks(hooked)
+}
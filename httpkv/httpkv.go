@@ -0,0 +1,96 @@
+// Package httpkv serves a bugfruit Storage over HTTP.
+package httpkv
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/reesporte/bugfruit"
+)
+
+// prefix is the path that keys are under.
+const prefix = "/kv/"
+
+// Handler returns an http.Handler that serves the key/value pairs in s under
+// /kv/{key}, with the raw value as the body:
+//
+//   - GET returns the value, or 404 if the key doesn't exist.
+//   - PUT sets the value to the request body, or returns 413 if it's longer
+//     than the Storage's MaxValueSize, or 414 if the key is longer than its
+//     MaxKeySize.
+//   - DELETE deletes the key, or returns 404 if it doesn't exist.
+//
+// The key is everything in the path after /kv/, and can contain slashes.
+func Handler(s *bugfruit.Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, prefix)
+		if key == "" || len(key) == len(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			val, ok := s.Get(key)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(val)
+
+		case http.MethodPut:
+			// a body longer than the largest value can't be set, so it isn't
+			// read past that
+			max := int64(s.MaxValueSize())
+			if r.ContentLength > max {
+				writeError(w, bugfruit.ErrValueTooLarge)
+				return
+			}
+			val, err := io.ReadAll(http.MaxBytesReader(w, r.Body, max))
+			if err != nil && int64(len(val)) >= max {
+				writeError(w, bugfruit.ErrValueTooLarge)
+				return
+			} else if err != nil {
+				http.Error(w, "reading body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.Set(key, val); err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		case http.MethodDelete:
+			_, ok, err := s.Pop(key)
+			if err != nil {
+				writeError(w, err)
+				return
+			} else if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// writeError writes the response for an error from the Storage.
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, bugfruit.ErrDBClosed):
+		code = http.StatusServiceUnavailable
+	case errors.Is(err, bugfruit.ErrValueTooLarge):
+		code = http.StatusRequestEntityTooLarge
+	case errors.Is(err, bugfruit.ErrKeyTooLarge):
+		code = http.StatusRequestURITooLong
+	}
+	http.Error(w, err.Error(), code)
+}
@@ -0,0 +1,102 @@
+package httpkv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/reesporte/bugfruit"
+	"github.com/reesporte/bugfruit/test"
+)
+
+func TestHandler(t *testing.T) {
+	s, err := bugfruit.NewMemStorage()
+	test.AssertNil(t, err)
+	h := Handler(s)
+
+	do := func(method, path, body string) (int, string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		b, err := io.ReadAll(w.Result().Body)
+		test.AssertNil(t, err)
+		return w.Code, string(b)
+	}
+
+	code, _ := do(http.MethodGet, "/kv/bombadil", "")
+	test.AssertEqual(t, http.StatusNotFound, code)
+
+	code, _ = do(http.MethodPut, "/kv/bombadil", "Hey dol! merry dol! ring a dong dillo!")
+	test.AssertEqual(t, http.StatusNoContent, code)
+	got, _ := s.Get("bombadil")
+	test.AssertEqual(t, []byte("Hey dol! merry dol! ring a dong dillo!"), got)
+
+	code, body := do(http.MethodGet, "/kv/bombadil", "")
+	test.AssertEqual(t, http.StatusOK, code)
+	test.AssertEqual(t, "Hey dol! merry dol! ring a dong dillo!", body)
+
+	// keys can have slashes
+	code, _ = do(http.MethodPut, "/kv/old/forest", "Old Man Willow")
+	test.AssertEqual(t, http.StatusNoContent, code)
+	code, body = do(http.MethodGet, "/kv/old/forest", "")
+	test.AssertEqual(t, http.StatusOK, code)
+	test.AssertEqual(t, "Old Man Willow", body)
+
+	code, _ = do(http.MethodDelete, "/kv/bombadil", "")
+	test.AssertEqual(t, http.StatusNoContent, code)
+	code, _ = do(http.MethodDelete, "/kv/bombadil", "")
+	test.AssertEqual(t, http.StatusNotFound, code)
+	test.AssertEqual(t, false, s.Has("bombadil"))
+
+	code, _ = do(http.MethodPost, "/kv/goldberry", "River-daughter")
+	test.AssertEqual(t, http.StatusMethodNotAllowed, code)
+	code, _ = do(http.MethodGet, "/kv/", "")
+	test.AssertEqual(t, http.StatusNotFound, code)
+	code, _ = do(http.MethodGet, "/bombadil", "")
+	test.AssertEqual(t, http.StatusNotFound, code)
+
+	test.AssertNil(t, s.Close())
+	code, _ = do(http.MethodPut, "/kv/bombadil", "Eldest")
+	test.AssertEqual(t, http.StatusServiceUnavailable, code)
+}
+
+// TestHandlerTooLarge ensures a body longer than the largest value isn't read
+// past it, and that keys and values that are too large are client errors.
+func TestHandlerTooLarge(t *testing.T) {
+	s, err := bugfruit.NewMemStorage(bugfruit.WithMaxSizes(8, 16))
+	test.AssertNil(t, err)
+	defer s.Close()
+	h := Handler(s)
+	put := func(path string, body io.Reader, length int64) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, path, body)
+		r.ContentLength = length
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	test.AssertEqual(t, http.StatusNoContent, put("/kv/bree", strings.NewReader("Prancing Pony"), 13))
+	test.AssertEqual(t, http.StatusNoContent, put("/kv/bree", strings.NewReader(strings.Repeat("b", 16)), 16))
+	test.AssertEqual(t, http.StatusRequestEntityTooLarge, put("/kv/bree", strings.NewReader(strings.Repeat("b", 17)), 17))
+	test.AssertEqual(t, http.StatusRequestURITooLong, put("/kv/barliman-butterbur", strings.NewReader("Bree"), 4))
+
+	// without a length, the body is only read up to the limit
+	body := &countReader{r: strings.NewReader(strings.Repeat("b", 1<<20))}
+	test.AssertEqual(t, http.StatusRequestEntityTooLarge, put("/kv/bree", body, -1))
+	test.AssertEqual(t, true, body.n <= 1<<10)
+	got, _ := s.Get("bree")
+	test.AssertEqual(t, []byte(strings.Repeat("b", 16)), got)
+}
+
+// countReader counts the bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
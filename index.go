@@ -0,0 +1,121 @@
+package bugfruit
+
+// skiplistMaxLevel is the most levels a skiplist node can be in, which is enough
+// for far more keys than fit in memory.
+const skiplistMaxLevel = 32
+
+// skiplist is an ordered set of keys, which can be searched from any key
+// onwards. It is NOT thread safe.
+type skiplist struct {
+	head  *skiplistNode
+	level int    // the number of levels in use
+	rnd   uint64 // the state of the random number generator for node levels
+	len   int    // the number of keys
+}
+
+// skiplistNode is a key in a skiplist, and the next node in each of its levels.
+type skiplistNode struct {
+	key  string
+	next []*skiplistNode
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skiplistNode{next: make([]*skiplistNode, skiplistMaxLevel)},
+		level: 1,
+		rnd:   0x9e3779b97f4a7c15,
+	}
+}
+
+// randomLevel returns a random number of levels for a new node, with each level
+// a quarter as likely as the one below it.
+func (l *skiplist) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel {
+		// xorshift64
+		l.rnd ^= l.rnd << 13
+		l.rnd ^= l.rnd >> 7
+		l.rnd ^= l.rnd << 17
+		if l.rnd&3 != 0 {
+			break
+		}
+		level++
+	}
+	return level
+}
+
+// path returns the last node before key in each level.
+func (l *skiplist) path(key string) [skiplistMaxLevel]*skiplistNode {
+	var prev [skiplistMaxLevel]*skiplistNode
+	n := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+		prev[i] = n
+	}
+	return prev
+}
+
+// insert adds key to the skiplist, if it isn't there already.
+func (l *skiplist) insert(key string) {
+	prev := l.path(key)
+	if n := prev[0].next[0]; n != nil && n.key == key {
+		return
+	}
+
+	level := l.randomLevel()
+	for ; l.level < level; l.level++ {
+		prev[l.level] = l.head
+	}
+	n := &skiplistNode{key: key, next: make([]*skiplistNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+	l.len++
+}
+
+// remove deletes key from the skiplist, if it's there.
+func (l *skiplist) remove(key string) {
+	prev := l.path(key)
+	n := prev[0].next[0]
+	if n == nil || n.key != key {
+		return
+	}
+
+	for i := range n.next {
+		prev[i].next[i] = n.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.len--
+}
+
+// seek returns the node of the first key >= key, or nil if there isn't one.
+func (l *skiplist) seek(key string) *skiplistNode {
+	return l.path(key)[0].next[0]
+}
+
+// before returns the node of the last key < key, or nil if there isn't one.
+func (l *skiplist) before(key string) *skiplistNode {
+	if n := l.path(key)[0]; n != l.head {
+		return n
+	}
+	return nil
+}
+
+// last returns the node of the last key, or nil if the skiplist is empty.
+func (l *skiplist) last() *skiplistNode {
+	n := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for n.next[i] != nil {
+			n = n.next[i]
+		}
+	}
+	if n == l.head {
+		return nil
+	}
+	return n
+}
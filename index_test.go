@@ -0,0 +1,60 @@
+package bugfruit
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// keysFrom returns the keys in the skiplist from key onwards.
+func keysFrom(l *skiplist, key string) []string {
+	keys := []string{}
+	for n := l.seek(key); n != nil; n = n.next[0] {
+		keys = append(keys, n.key)
+	}
+	return keys
+}
+
+func TestSkiplist(t *testing.T) {
+	l := newSkiplist()
+	test.AssertEqual(t, []string{}, keysFrom(l, ""))
+
+	for _, k := range []string{"thorin", "fili", "kili", "balin", "dwalin", "oin", "gloin", "fili"} {
+		l.insert(k)
+	}
+	test.AssertEqual(t, 7, l.len)
+	test.AssertEqual(t, []string{"balin", "dwalin", "fili", "gloin", "kili", "oin", "thorin"}, keysFrom(l, ""))
+	test.AssertEqual(t, []string{"gloin", "kili", "oin", "thorin"}, keysFrom(l, "g"))
+	test.AssertEqual(t, []string{"kili", "oin", "thorin"}, keysFrom(l, "kili"))
+	test.AssertEqual(t, []string{}, keysFrom(l, "z"))
+
+	test.AssertEqual(t, "thorin", l.last().key)
+	test.AssertEqual(t, "oin", l.before("thorin").key)
+	test.AssertEqual(t, "gloin", l.before("h").key)
+	test.AssertEqual(t, true, l.before("balin") == nil)
+
+	l.remove("kili")
+	l.remove("fili")
+	l.remove("bombur")
+	test.AssertEqual(t, 5, l.len)
+	test.AssertEqual(t, []string{"balin", "dwalin", "gloin", "oin", "thorin"}, keysFrom(l, ""))
+
+	// lots of keys stay in order, and can all be removed
+	var keys []string
+	for i := 0; i < 10000; i++ {
+		k := fmt.Sprintf("dwarf %d", i*7919%10000)
+		keys = append(keys, k)
+		l.insert(k)
+	}
+	sort.Strings(keys)
+	test.AssertEqual(t, keys, keysFrom(l, "dwarf ")[:len(keys)])
+	for _, k := range keysFrom(l, "") {
+		l.remove(k)
+	}
+	test.AssertEqual(t, 0, l.len)
+	test.AssertEqual(t, 1, l.level)
+	test.AssertEqual(t, []string{}, keysFrom(l, ""))
+	test.AssertEqual(t, true, l.last() == nil)
+}
@@ -0,0 +1,213 @@
+package bugfruit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// indexSuffix is added to the name of the database file to get the name of its
+// index file.
+const indexSuffix = ".idx"
+
+// indexMagic starts every index file, followed by the index file's format
+// version, the size and modification time of the database file it describes,
+// the sequence number of the last write to it, the size of the entries, the
+// entries, and their checksum.
+var indexMagic = []byte("BGFX")
+
+// the format version of index files, and the size of their header
+const (
+	indexVersion    = 2
+	indexHeaderSize = 4 + 2 + 8 + 8 + 8 + 4
+)
+
+// unprotectedWriteIndex writes the index file, with the metadata and offset of
+// every live datum, so the next open doesn't have to read the whole database
+// file. It's written to a temporary file that's renamed over the old one, so a
+// crash never leaves half an index file. The database file must be synced
+// first. The keys are encrypted if the database file is. Nothing is written if
+// the index file is already up to date, or if the Storage failed to open, since
+// the in-memory map may be missing keys.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedWriteIndex() error {
+	if !s.indexFile() || !s.opened || s.indexed {
+		return nil
+	}
+	fi, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("statting '%s': %w", s.name, err)
+	}
+
+	// in file order, so reading the values on open reads the file in order
+	ds := make([]*datum, 0, s.data.Len())
+	now := s.now()
+	s.data.Range(func(_ string, d *datum) bool {
+		if !d.expired(now) {
+			ds = append(ds, d)
+		}
+		return true
+	})
+	sort.Slice(ds, func(i, j int) bool { return ds[i].idx < ds[j].idx })
+
+	entries := []byte{}
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, d := range ds {
+		entries = append(entries, d.meta.Bytes()...)
+		entries = append(entries, d.key...)
+		entries = append(entries, tmp[:binary.PutUvarint(tmp, d.idx)]...)
+		entries = append(entries, tmp[:binary.PutUvarint(tmp, d.size)]...)
+	}
+	if s.aead != nil {
+		if entries, err = seal(s.aead, entries); err != nil {
+			return fmt.Errorf("encrypting: %w", err)
+		}
+	}
+
+	b := make([]byte, indexHeaderSize+len(entries)+4)
+	copy(b, indexMagic)
+	byteOrder.PutUint16(b[4:], indexVersion)
+	byteOrder.PutUint64(b[6:], uint64(fi.Size()))
+	byteOrder.PutUint64(b[14:], uint64(fi.ModTime().UnixNano()))
+	byteOrder.PutUint64(b[22:], s.seq)
+	byteOrder.PutUint32(b[30:], uint32(len(entries)))
+	copy(b[indexHeaderSize:], entries)
+	byteOrder.PutUint32(b[indexHeaderSize+len(entries):], crc32.Checksum(entries, crcTable))
+
+	f, err := os.CreateTemp(filepath.Dir(s.name), "bugfruit-index")
+	if err != nil {
+		return fmt.Errorf("creating temp index file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("writing temp index file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing temp index file: %w", err)
+	}
+	if err := os.Rename(f.Name(), s.name+indexSuffix); err != nil {
+		return fmt.Errorf("renaming temp index file: %w", err)
+	}
+	s.indexed = true
+	return nil
+}
+
+// indexFile returns whether the database file has an index file.
+func (s *Storage) indexFile() bool {
+	return s.config.IndexFile && !s.mem
+}
+
+// unprotectedDropIndex removes the index file before the database file is
+// first written to after the index file was written or loaded, so a crash
+// can't leave an index file that doesn't match the database file.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedDropIndex() error {
+	if !s.indexed {
+		return nil
+	}
+	if err := os.Remove(s.name + indexSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing index file: %w", err)
+	}
+	s.indexed = false
+	return nil
+}
+
+// loadIndex fills the in-memory map from the index file instead of reading the
+// whole database file, and returns whether it did. It doesn't if there's no
+// index file, or if it doesn't match the size and modification time of the
+// database file, or is damaged, in which case it's removed. Values are read from the database file at the
+// offsets in the index file, unless they're kept there with DiskValues.
+// It is NOT thread safe without external file locking.
+func (s *Storage) loadIndex() (bool, error) {
+	name := s.name + indexSuffix
+	b, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("reading index file %s: %w", name, err)
+	}
+	fi, err := s.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("statting '%s': %w", s.name, err)
+	}
+
+	stale := func(why string) (bool, error) {
+		s.log.Printf("bugfruit: not using index file %s: %s", name, why)
+		s.data.Clear()
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("removing index file: %w", err)
+		}
+		return false, nil
+	}
+	if len(b) < indexHeaderSize+4 || string(b[:4]) != string(indexMagic) || byteOrder.Uint16(b[4:]) != indexVersion {
+		return stale("unknown format")
+	}
+	if s.version != formatVersion {
+		return stale("the database file is in an older format")
+	}
+	if byteOrder.Uint64(b[6:]) != uint64(fi.Size()) || int64(byteOrder.Uint64(b[14:])) != fi.ModTime().UnixNano() {
+		return stale("the database file changed since it was written")
+	}
+	n := uint64(byteOrder.Uint32(b[30:]))
+	if uint64(len(b)) != indexHeaderSize+n+4 {
+		return stale("it's the wrong size")
+	}
+	entries := b[indexHeaderSize : indexHeaderSize+n]
+	if byteOrder.Uint32(b[indexHeaderSize+n:]) != crc32.Checksum(entries, crcTable) {
+		return stale("checksum mismatch")
+	}
+	if s.aead != nil {
+		if entries, err = open(s.aead, entries); err != nil {
+			return stale(err.Error())
+		}
+	}
+
+	now := s.now()
+	for len(entries) > 0 {
+		msz, ok := metaLen(entries, formatVersion)
+		if !ok || msz > uint64(len(entries)) {
+			return stale("invalid metadata")
+		}
+		m := &meta{}
+		if err := m.fromVarintBytes(entries[:msz], formatVersion); err != nil {
+			return stale("invalid metadata")
+		}
+		entries = entries[msz:]
+		if uint64(m.keySize) > uint64(len(entries)) {
+			return stale("truncated key")
+		}
+		d := &datum{meta: m, key: string(entries[:m.keySize])}
+		entries = entries[m.keySize:]
+		for _, x := range []*uint64{&d.idx, &d.size} {
+			v, sz := binary.Uvarint(entries)
+			if sz <= 0 {
+				return stale("truncated offset")
+			}
+			*x, entries = v, entries[sz:]
+		}
+		if d.idx+d.Size() > uint64(fi.Size()) {
+			return stale("an offset is past the end of the database file")
+		}
+
+		if d.expired(now) {
+			continue
+		}
+		if s.diskValues() {
+			d.spilled = true
+		} else if d.value, err = s.readValueAt(d); err != nil {
+			return stale(err.Error())
+		}
+		s.data.Store(d.key, d)
+	}
+
+	s.idx = uint64(fi.Size())
+	s.seq = byteOrder.Uint64(b[22:])
+	s.indexed = true
+	s.log.Printf("bugfruit: loaded %d keys from index file %s", s.data.Len(), name)
+	return true, nil
+}
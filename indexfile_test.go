@@ -0,0 +1,124 @@
+package bugfruit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestIndexFile ensures the index file is written on Close and Sync, and that
+// opening from it gets the same keys, values, and dead bytes as reading the
+// whole database file.
+func TestIndexFile(t *testing.T) {
+	configs := map[string][]Option{
+		"plain":       {},
+		"disk values": {WithDiskValues(true)},
+		"encrypted":   {WithDiskValues(true), WithEncryptionKey(bytes.Repeat([]byte("k"), 32)), WithCompression(GzipCompression)},
+	}
+	for name, opts := range configs {
+		t.Run(name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+			opts := append([]Option{WithIndexFile(true)}, opts...)
+			s, err := NewStorage(fname, 0600, opts...)
+			test.AssertNil(t, err)
+			test.AssertNil(t, s.Set("aragorn", []byte("strider")))
+			test.AssertNil(t, s.Set("boromir", []byte("captain of the white tower")))
+			test.AssertNil(t, s.Set("faramir", []byte("ranger of ithilien")))
+			test.AssertNil(t, s.Set("aragorn", []byte("elessar")))
+			test.AssertNil(t, s.Delete("boromir"))
+			test.AssertNil(t, s.SetWithTTL("denethor", []byte("steward"), time.Hour))
+			test.AssertNil(t, s.Close())
+
+			b, err := os.ReadFile(fname + indexSuffix)
+			test.AssertNil(t, err)
+			if name == "encrypted" {
+				test.AssertEqual(t, false, bytes.Contains(b, []byte("aragorn")))
+			}
+
+			l := &recordLogger{}
+			s, err = NewStorage(fname, 0600, append(opts, WithLogger(l))...)
+			test.AssertNil(t, err)
+			test.AssertEqual(t, true, loggedPrefix(l, "bugfruit: loaded 3 keys from index file "+fname+indexSuffix))
+			got, _ := s.Get("aragorn")
+			test.AssertEqual(t, []byte("elessar"), got)
+			got, _ = s.Get("faramir")
+			test.AssertEqual(t, []byte("ranger of ithilien"), got)
+			_, ok := s.Get("boromir")
+			test.AssertEqual(t, false, ok)
+			ttl, ok := s.GetTTL("denethor")
+			test.AssertEqual(t, true, ok)
+			test.AssertEqual(t, true, ttl > 0)
+			indexed := s.deadBytes
+			test.AssertNil(t, s.Close())
+
+			// the same as reading the file in full
+			s, err = NewStorage(fname, 0600, opts[1:]...)
+			test.AssertNil(t, err)
+			test.AssertEqual(t, s.deadBytes, indexed)
+			test.AssertNil(t, s.Close())
+
+			// the index file is removed before the database file changes, and
+			// written again on Sync
+			s, err = NewStorage(fname, 0600, opts...)
+			test.AssertNil(t, err)
+			test.AssertNil(t, s.Set("faramir", []byte("prince of ithilien")))
+			_, err = os.Stat(fname + indexSuffix)
+			test.AssertEqual(t, true, os.IsNotExist(err))
+			test.AssertNil(t, s.Sync())
+			_, err = os.Stat(fname + indexSuffix)
+			test.AssertNil(t, err)
+			test.AssertNil(t, s.Vacuum())
+			test.AssertNil(t, s.Close())
+
+			s, err = NewStorage(fname, 0600, append(opts, WithLogger(l))...)
+			test.AssertNil(t, err)
+			got, _ = s.Get("faramir")
+			test.AssertEqual(t, []byte("prince of ithilien"), got)
+			test.AssertNil(t, s.Close())
+		})
+	}
+}
+
+// TestIndexFileStale ensures an index file that doesn't match the database file
+// is removed, and the database file is read in full instead.
+func TestIndexFileStale(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithIndexFile(true))
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Set("theoden", []byte("king of rohan")))
+	test.AssertNil(t, s.Close())
+	old, err := os.ReadFile(fname + indexSuffix)
+	test.AssertNil(t, err)
+
+	// written to without the index file
+	s, err = NewStorage(fname, 0600)
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Set("theoden", []byte("theoden king")))
+	test.AssertNil(t, s.Close())
+
+	damaged := append([]byte{}, old...)
+	damaged[indexHeaderSize] ^= 0xff
+	for name, b := range map[string][]byte{
+		"stale":     old,
+		"damaged":   damaged,
+		"truncated": old[:len(old)-1],
+		"not one":   []byte("wormtongue"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			test.AssertNil(t, os.WriteFile(fname+indexSuffix, b, 0600))
+			l := &recordLogger{}
+			s, err := NewStorage(fname, 0600, WithIndexFile(true), WithLogger(l))
+			test.AssertNil(t, err)
+			test.AssertEqual(t, true, loggedPrefix(l, "bugfruit: not using index file "+fname+indexSuffix))
+			_, err = os.Stat(fname + indexSuffix)
+			test.AssertEqual(t, true, os.IsNotExist(err))
+			got, _ := s.Get("theoden")
+			test.AssertEqual(t, []byte("theoden king"), got)
+			test.AssertNil(t, s.Close())
+		})
+	}
+}
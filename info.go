@@ -0,0 +1,59 @@
+package bugfruit
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RecordInfo describes the record a key/value pair is stored in.
+type RecordInfo struct {
+	// KeySize and ValueSize are the sizes of the key and value as they were set.
+	KeySize, ValueSize uint32
+
+	// Size is the number of bytes the record takes up in the database file,
+	// including its metadata, after compression and encryption.
+	Size uint64
+
+	// Offset is where the record starts in the database file.
+	Offset uint64
+
+	// ModTime is when the key was last set, or the zero time if it was set
+	// before modification times were recorded.
+	ModTime time.Time
+
+	// Expires is when the key expires, or the zero time if it never does.
+	Expires time.Time
+}
+
+// GetWithMeta returns a copy of the value for a key, a description of the
+// record it's stored in, and whether the key was found. Nothing is found once
+// the Storage is closed.
+func (s *Storage) GetWithMeta(key string) ([]byte, RecordInfo, bool) {
+	atomic.AddUint64(&s.gets, 1)
+	// a vacuum moves records while holding the file lock
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	d, ok := s.load(key)
+	if !ok {
+		return nil, RecordInfo{}, false
+	}
+	info := RecordInfo{
+		KeySize:   d.meta.keySize,
+		ValueSize: d.meta.valSize,
+		Size:      d.Size(),
+		Offset:    d.idx,
+	}
+	if d.meta.modTime != 0 {
+		info.ModTime = time.Unix(0, d.meta.modTime)
+	}
+	if d.meta.expires != 0 {
+		info.Expires = time.Unix(0, d.meta.expires)
+	}
+	v, err := s.unprotectedValue(d)
+	if err != nil {
+		s.log.Printf("bugfruit: %v", err)
+		return nil, RecordInfo{}, false
+	}
+	return v, info, true
+}
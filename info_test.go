@@ -0,0 +1,49 @@
+package bugfruit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestGetWithMeta ensures GetWithMeta describes the record a key is stored in,
+// including where the record moves to when it's vacuumed.
+func TestGetWithMeta(t *testing.T) {
+	now := time.Unix(3018, 0)
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0644, WithClock(func() time.Time { return now }))
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("tom", []byte("bombadil")))
+	test.AssertNil(t, s.SetWithTTL("goldberry", []byte("river-daughter"), time.Hour))
+
+	v, info, ok := s.GetWithMeta("goldberry")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("river-daughter"), v)
+	_, tom, _ := s.GetWithMeta("tom")
+	test.AssertEqual(t, RecordInfo{KeySize: 3, ValueSize: 8, Size: minMetaSize + 3 + 8, Offset: headerSize, ModTime: now}, tom)
+	exp := RecordInfo{
+		KeySize:   9,
+		ValueSize: 14,
+		Size:      minMetaSize + 9 + 14,
+		Offset:    headerSize + tom.Size,
+		ModTime:   now,
+		Expires:   now.Add(time.Hour),
+	}
+	test.AssertEqual(t, exp, info)
+
+	// vacuuming moves goldberry up to where tom was
+	test.AssertNil(t, s.Delete("tom"))
+	test.AssertNil(t, s.Vacuum())
+	_, info, _ = s.GetWithMeta("goldberry")
+	test.AssertEqual(t, uint64(headerSize), info.Offset)
+
+	_, info, ok = s.GetWithMeta("tom")
+	test.AssertEqual(t, false, ok)
+	test.AssertEqual(t, RecordInfo{}, info)
+	test.AssertNil(t, s.Close())
+	_, _, ok = s.GetWithMeta("goldberry")
+	test.AssertEqual(t, false, ok)
+}
@@ -0,0 +1,88 @@
+package bugfruit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// dumpValueSize is how many bytes of each value DumpLayout writes.
+const dumpValueSize = 16
+
+// DumpLayout writes a line to w for every record in the database file, in the
+// order they're in the file, including deleted records. Each line has the
+// record's offset and size, its key and value sizes, whether it's deleted, its
+// flags, whether its checksum matches, its key, and the first 16 bytes of its
+// value, as they're stored in the file, so encrypted keys and values are
+// written encrypted. If a record can't be read, DumpLayout stops there and
+// returns an error. A Storage that only lives in memory has no records to
+// write.
+//
+// No writes can occur while DumpLayout is taking place.
+func (s *Storage) DumpLayout(w io.Writer) error {
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+	if s.mem {
+		return nil
+	}
+
+	if err := s.unprotectedFlush(); err != nil {
+		return err
+	}
+	fi, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("statting '%s': %w", s.name, err)
+	}
+	size := uint64(fi.Size())
+	if r, err := s.file.Seek(headerSize, 0); err != nil || r != headerSize {
+		return fmt.Errorf("tried to seek to index %d, got to %d: %w", headerSize, r, err)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "header: version=%d size=%d\n", s.version, size)
+	r := bufio.NewReader(s.file)
+	for off := uint64(headerSize); off < size; {
+		m, buf, err := readMeta(r, s.version, nil)
+		if err != nil {
+			bw.Flush()
+			return fmt.Errorf("record at %d: reading metadata: %w", off, err)
+		}
+		msz := uint64(len(buf))
+		totalSize := uint64(m.keySize) + uint64(m.valSize)
+		if left := size - off - msz; left < totalSize {
+			bw.Flush()
+			return fmt.Errorf("record at %d: %w: %d bytes left, need %d for key/val data", off, ErrCorrupt, left, totalSize)
+		}
+		kv := make([]byte, totalSize)
+		if _, err := io.ReadFull(r, kv); err != nil {
+			bw.Flush()
+			return fmt.Errorf("record at %d: reading key/val data: %w", off, err)
+		}
+
+		d := newDatum()
+		d.meta = m
+		if err := d.KeyValFromBytes(kv); err != nil {
+			bw.Flush()
+			return fmt.Errorf("record at %d: converting key/val data: %w", off, err)
+		}
+		crc := "ok"
+		if d.Checksum() != m.crc {
+			crc = "mismatch"
+		}
+		value, more := d.value, ""
+		if len(value) > dumpValueSize {
+			value, more = value[:dumpValueSize], "..."
+		}
+		fmt.Fprintf(bw, "offset=%d size=%d keySize=%d valSize=%d deleted=%t flags=%#x crc=%s key=%q value=%q%s\n",
+			off, msz+totalSize, m.keySize, m.valSize, m.deleted == byte(1), m.flags, crc, d.key, value, more)
+		off += msz + totalSize
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("dumping layout: %w", err)
+	}
+	return nil
+}
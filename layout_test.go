@@ -0,0 +1,52 @@
+package bugfruit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestDumpLayout ensures DumpLayout writes every record in the file, deleted or
+// not, and stops at a record that can't be read.
+func TestDumpLayout(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0644)
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("tom", []byte("bombadil")))
+	test.AssertNil(t, s.Set("goldberry", []byte("the river-woman's daughter")))
+	test.AssertNil(t, s.Set("tom", []byte("eldest")))
+	test.AssertNil(t, s.Delete("goldberry"))
+
+	buf := &bytes.Buffer{}
+	test.AssertNil(t, s.DumpLayout(buf))
+	tom, goldberry := uint64(minMetaSize+3+8), uint64(minMetaSize+9+26)
+	exp := fmt.Sprintf("header: version=%d size=%d\n", formatVersion, headerSize+tom+goldberry+minMetaSize+3+6) +
+		fmt.Sprintf("offset=%d size=%d keySize=3 valSize=8 deleted=true flags=0x0 crc=ok key=\"tom\" value=\"bombadil\"\n", headerSize, tom) +
+		fmt.Sprintf("offset=%d size=%d keySize=9 valSize=26 deleted=true flags=0x0 crc=ok key=\"goldberry\" value=\"the river-woman'\"...\n", headerSize+tom, goldberry) +
+		fmt.Sprintf("offset=%d size=%d keySize=3 valSize=6 deleted=false flags=0x0 crc=ok key=\"tom\" value=\"eldest\"\n", headerSize+tom+goldberry, minMetaSize+3+6)
+	test.AssertEqual(t, exp, buf.String())
+
+	// half a record at the end of the file
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0)
+	test.AssertNil(t, err)
+	_, err = f.Write([]byte{0, 3, 8})
+	test.AssertNil(t, err)
+	test.AssertNil(t, f.Close())
+	buf.Reset()
+	err = s.DumpLayout(buf)
+	test.AssertEqual(t, true, errors.Is(err, io.ErrUnexpectedEOF))
+	_, records, _ := strings.Cut(exp, "\n")
+	_, got, _ := strings.Cut(buf.String(), "\n")
+	test.AssertEqual(t, records, got)
+
+	test.AssertNil(t, s.Close())
+	test.AssertEqual(t, ErrDBClosed, s.DumpLayout(buf))
+}
@@ -0,0 +1,185 @@
+package bugfruit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// loadChunkSize is about how many bytes of records each goroutine reads at a
+// time when the database file is loaded concurrently. A record bigger than it
+// is read on its own.
+const loadChunkSize = 1 << 20
+
+// loadChunk is a run of records in the database file, which are read with one
+// read and decoded by one goroutine.
+type loadChunk struct {
+	start, end uint64   // the offsets the records start and end at
+	offs       []uint64 // the offsets of the live records among them
+}
+
+// loadConcurrently reads every datum in the database file, which is read with
+// ra, into the in-memory map like loadFile, but decodes them on n goroutines.
+// It first reads just the metadata of the records to find where they are, so
+// the records can be split up between the goroutines. Of the records for a key,
+// the one latest in the file wins, like when they're loaded in order.
+// It is NOT thread safe without external file locking.
+func (s *Storage) loadConcurrently(ra io.ReaderAt, n int) error {
+	fi, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("statting '%s': %w", s.name, err)
+	}
+
+	// an error finding the records is past every record that was found, so
+	// it's only returned if they all decode
+	chunks, findErr := s.findRecords(ra, uint64(fi.Size()))
+
+	ds := make([][]*datum, len(chunks))
+	errs := make([]error, len(chunks))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < n && w < len(chunks); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				ds[i], errs[i] = s.decodeChunk(ra, chunks[i])
+			}
+		}()
+	}
+	for i := range chunks {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	if findErr != nil {
+		return findErr
+	}
+	for _, c := range ds {
+		for _, d := range c {
+			s.loadDatum(d)
+		}
+	}
+	return nil
+}
+
+// findRecords reads the metadata of every record in the database file, which
+// is read with ra and holds size bytes, starting from the current index, and
+// returns the live records split up into chunks. It moves the current index to
+// the end of the last record, like reading the records with readDatumFrom. If
+// there's an error, the chunks of the records before it are returned with it.
+// It is NOT thread safe without external file locking.
+func (s *Storage) findRecords(ra io.ReaderAt, size uint64) ([]loadChunk, error) {
+	r := bufio.NewReaderSize(io.NewSectionReader(ra, int64(s.idx), int64(size-s.idx)), 64<<10)
+	buf := make([]byte, maxMetaSize)
+	chunks := []loadChunk{}
+	for {
+		m, mb, err := readMeta(r, s.version, buf)
+		if err == io.EOF {
+			// a clean EOF at a record boundary
+			return chunks, nil
+		} else if errors.Is(err, ErrInvalidMetaSlice) {
+			return chunks, fmt.Errorf("reading database file: converting metadata: %w", err)
+		} else if err != nil {
+			return chunks, fmt.Errorf("reading database file: reading metadata: %w", err)
+		}
+		msz := uint64(len(mb))
+		totalSize := uint64(m.keySize) + uint64(m.valSize)
+		if m.seq > s.seq {
+			s.seq = m.seq
+		}
+
+		// skip deleted records, even if they run past the end of the file, like
+		// readDatumFrom does
+		n, err := r.Discard(int(totalSize))
+		if m.deleted == byte(1) {
+			s.idx += msz + totalSize
+			continue
+		} else if err == io.EOF {
+			return chunks, fmt.Errorf("reading database file: reading key/val data: read %d bytes, need %d", n, totalSize)
+		} else if err != nil {
+			return chunks, fmt.Errorf("reading database file: reading key/val data: %w", err)
+		}
+
+		end := s.idx + msz + totalSize
+		if len(chunks) == 0 || end-chunks[len(chunks)-1].start > loadChunkSize {
+			chunks = append(chunks, loadChunk{start: s.idx})
+		}
+		c := &chunks[len(chunks)-1]
+		c.offs = append(c.offs, s.idx)
+		c.end = end
+		s.idx = end
+	}
+}
+
+// decodeChunk reads the records in c from the database file with ra, and
+// returns their datums in the order they're in the file. It's safe to call
+// concurrently.
+func (s *Storage) decodeChunk(ra io.ReaderAt, c loadChunk) ([]*datum, error) {
+	buf := make([]byte, c.end-c.start)
+	if _, err := ra.ReadAt(buf, int64(c.start)); err != nil {
+		return nil, fmt.Errorf("reading database file: reading records at %d: %w", c.start, err)
+	}
+
+	ds := make([]*datum, 0, len(c.offs))
+	for _, off := range c.offs {
+		b := buf[off-c.start:]
+		m, mb, err := readMeta(bytes.NewReader(b), s.version, nil)
+		if err != nil {
+			return nil, fmt.Errorf("reading database file: reading metadata: %w", err)
+		}
+		msz := uint64(len(mb))
+		d, err := recordDatum(m, msz, b[msz:msz+uint64(m.keySize)+uint64(m.valSize)], off, s.aead)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// recoverTornWrite is called when loading the database file failed with
+// loadErr, and checks whether it's because the last record is cut short. If it
+// is, the file is truncated to the end of the last intact record and loaded
+// again if the config calls for it, and otherwise a TornWriteError is
+// returned. Any other error is returned as it is.
+// It is NOT thread safe without external file locking.
+func (s *Storage) recoverTornWrite(loadErr error) error {
+	fi, err := s.file.Stat()
+	if err != nil {
+		return loadErr
+	}
+	size := uint64(fi.Size())
+	r := bufio.NewReader(io.NewSectionReader(s.file, headerSize, int64(size-headerSize)))
+	good, torn, err := checkRecords(r, size, s.version)
+	if err == nil || !torn {
+		return loadErr
+	}
+	if !s.config.RepairTornWrite {
+		return &TornWriteError{Good: int64(good), Size: int64(size), Err: err}
+	}
+
+	if err := truncateTorn(s.name, s.file, good); err != nil {
+		return fmt.Errorf("repairing torn write: %w", err)
+	}
+	s.log.Printf("bugfruit: discarded %d bytes of a torn write at the end of %s", size-good, s.name)
+
+	// start over from the first record
+	s.data.Clear()
+	s.cache.clear()
+	s.superseded = nil
+	s.idx = headerSize
+	if _, err := s.file.Seek(headerSize, 0); err != nil {
+		return fmt.Errorf("seeking to %d: %w", headerSize, err)
+	}
+	return s.loadFile()
+}
@@ -0,0 +1,116 @@
+package bugfruit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestLoadConcurrently ensures loading the database file on several goroutines
+// gets the same keys, values, and offsets as loading it in order, across more
+// than one chunk, and fails the same way on a damaged file.
+func TestLoadConcurrently(t *testing.T) {
+	opts := []Option{WithCompression(GzipCompression), WithEncryptionKey(bytes.Repeat([]byte("k"), 32))}
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, opts...)
+	test.AssertNil(t, err)
+	// random enough not to compress away, so the file spans a few chunks
+	for i := 0; i < 3000; i++ {
+		v := make([]byte, 1000)
+		for j := range v {
+			v[j] = byte(i*j*7919 + j>>3)
+		}
+		test.AssertNil(t, s.Set(fmt.Sprintf("ent-%d", i%2000), v))
+	}
+	for i := 0; i < 2000; i += 7 {
+		test.AssertNil(t, s.Delete(fmt.Sprintf("ent-%d", i)))
+	}
+	test.AssertNil(t, s.SetWithTTL("ent-1", []byte("treebeard"), time.Hour))
+	test.AssertNil(t, s.SetWithTTL("ent-2", []byte("quickbeam"), time.Nanosecond))
+	test.AssertNil(t, s.Close())
+
+	load := func(extra ...Option) (map[string]*datum, uint64, error) {
+		s, err := NewStorage(fname, 0600, append(append([]Option{}, opts...), extra...)...)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer s.Close()
+		ds := map[string]*datum{}
+		s.data.Range(func(k string, d *datum) bool {
+			ds[k] = d
+			return true
+		})
+		return ds, s.deadBytes, nil
+	}
+	want, dead, err := load()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 1713, len(want))
+	for _, extra := range [][]Option{
+		{WithOpenConcurrency(4)},
+		{WithOpenConcurrency(4), WithMmap(true)},
+		{WithOpenConcurrency(64)},
+	} {
+		got, gotDead, err := load(extra...)
+		test.AssertNil(t, err)
+		test.AssertEqual(t, want, got)
+		test.AssertEqual(t, dead, gotDead)
+	}
+
+	// a damaged record fails the same way, whichever chunk it's in
+	b, err := os.ReadFile(fname)
+	test.AssertNil(t, err)
+	mid, last := want["ent-1000"], want["ent-1"]
+	for _, off := range []uint64{mid.idx + mid.Size() - 1, last.idx + last.Size() - 1} {
+		damaged := append([]byte{}, b...)
+		damaged[off] ^= 0xff
+		test.AssertNil(t, os.WriteFile(fname, damaged, 0600))
+		_, _, want := load()
+		_, _, got := load(WithOpenConcurrency(4))
+		test.AssertEqual(t, want.Error(), got.Error())
+	}
+
+	// and so does a truncated one
+	test.AssertNil(t, os.WriteFile(fname, b[:len(b)-10], 0600))
+	_, _, want2 := load()
+	_, _, got := load(WithOpenConcurrency(4))
+	test.AssertEqual(t, want2.Error(), got.Error())
+}
+
+// BenchmarkLoadConcurrently measures opening a file of encrypted records on one
+// goroutine and on several.
+func BenchmarkLoadConcurrently(b *testing.B) {
+	opts := []Option{WithEncryptionKey(bytes.Repeat([]byte("k"), 32)), WithVacuumBatch(0)}
+	fname := filepath.Join(b.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, append(opts, WithFsyncBatch(0), WithWriteBufferSize(1<<20))...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("mellon"), 16)
+	for i := 0; i < 100000; i++ {
+		if err := s.Set(fmt.Sprintf("door-of-durin-%d", i), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, n := range []int{1, 8} {
+		b.Run(fmt.Sprintf("%d goroutines", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s, err := NewStorage(fname, 0600, append(opts, WithOpenConcurrency(n))...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := s.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
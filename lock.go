@@ -0,0 +1,40 @@
+package bugfruit
+
+import (
+	"context"
+	"time"
+)
+
+// The bounds of how long lockCtx waits between tries of a lock.
+const (
+	minLockWait = 50 * time.Microsecond
+	maxLockWait = 5 * time.Millisecond
+)
+
+// lockCtx acquires a lock by calling tryLock until it succeeds, waiting a little
+// longer after each failure, and gives up and returns ctx.Err() if ctx is done
+// first. If ctx can never be done, it just calls lock.
+func lockCtx(ctx context.Context, lock func(), tryLock func() bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
+
+	wait := minLockWait
+	for !tryLock() {
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		if wait *= 2; wait > maxLockWait {
+			wait = maxLockWait
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package bugfruit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+func TestLockCtx(t *testing.T) {
+	var mu sync.Mutex
+
+	// an uncontended lock is acquired right away
+	test.AssertNil(t, lockCtx(context.Background(), mu.Lock, mu.TryLock))
+
+	// a held lock times out
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	test.AssertEqual(t, context.DeadlineExceeded, lockCtx(ctx, mu.Lock, mu.TryLock))
+
+	// a lock that's released in time is acquired
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		mu.Unlock()
+	}()
+	test.AssertNil(t, lockCtx(ctx, mu.Lock, mu.TryLock))
+
+	// a canceled context never acquires the lock
+	mu.Unlock()
+	cancel()
+	test.AssertEqual(t, context.Canceled, lockCtx(ctx, mu.Lock, mu.TryLock))
+	test.AssertEqual(t, true, mu.TryLock())
+}
@@ -2,15 +2,18 @@ package bugfruit
 
 import "sync"
 
-// muMap is a map that has a RWMutex on it.
+// muMap is a map that has a RWMutex on it, and optionally an index of its keys
+// in order.
 type muMap struct {
-	data map[string]*datum
-	mu   sync.RWMutex
+	data  map[string]*datum
+	index *skiplist // the keys in order, or nil if they aren't indexed
+	mu    sync.RWMutex
 }
 
-func newMuMap() muMap {
+// newMuMap returns an empty map with room for about n keys. n may be 0.
+func newMuMap(n int) muMap {
 	return muMap{
-		data: make(map[string]*datum),
+		data: make(map[string]*datum, n),
 	}
 }
 
@@ -18,6 +21,9 @@ func newMuMap() muMap {
 func (m *muMap) Store(key string, value *datum) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if _, ok := m.data[key]; !ok && m.index != nil {
+		m.index.insert(key)
+	}
 	m.data[key] = value
 }
 
@@ -30,6 +36,14 @@ func (m *muMap) Load(key string) (*datum, bool) {
 	return val, ok
 }
 
+// LoadBytes is Load for a key given as bytes. It doesn't copy the key.
+func (m *muMap) LoadBytes(key []byte) (*datum, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	val, ok := m.data[string(key)]
+	return val, ok
+}
+
 // Load returns a key/value pair from the map,
 // if it can, and whether the key exists in the map.
 // It deletes the key from the map if it existed.
@@ -38,11 +52,107 @@ func (m *muMap) LoadAndDelete(key string) (*datum, bool) {
 	defer m.mu.Unlock()
 	val, ok := m.data[key]
 	if ok {
-		delete(m.data, key)
+		m.unprotectedDelete(key)
 	}
 	return val, ok
 }
 
+// unprotectedDelete deletes a key/value pair from the map. It is NOT thread safe
+// without holding the write lock.
+func (m *muMap) unprotectedDelete(key string) {
+	delete(m.data, key)
+	if m.index != nil {
+		m.index.remove(key)
+	}
+}
+
+// Clear deletes every key/value pair in the map.
+func (m *muMap) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = make(map[string]*datum)
+	if m.index != nil {
+		m.index = newSkiplist()
+	}
+}
+
+// Len returns the number of keys in the map.
+func (m *muMap) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.data)
+}
+
+// Keys returns a slice of the keys in the map.
+func (m *muMap) Keys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.data))
+	for k := range m.data {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Range calls fn for each key/value pair in the map, in an unspecified order,
+// until fn returns false. The map is locked for reading the whole time, so fn
+// must not modify the map.
+func (m *muMap) Range(fn func(key string, d *datum) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for k, d := range m.data {
+		if !fn(k, d) {
+			return
+		}
+	}
+}
+
+// Ordered returns whether the keys in the map are indexed in order.
+func (m *muMap) Ordered() bool {
+	return m.index != nil
+}
+
+// RangeFrom calls fn for each key/value pair in the map with a key >= start, in
+// order, until fn returns false. The keys must be indexed. The map is locked for
+// reading the whole time, so fn must not modify the map.
+func (m *muMap) RangeFrom(start string, fn func(key string, d *datum) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for n := m.index.seek(start); n != nil; n = n.next[0] {
+		if !fn(n.key, m.data[n.key]) {
+			return
+		}
+	}
+}
+
+// RangeBackFrom calls fn for each key/value pair in the map with a key < end,
+// in reverse order, until fn returns false. An empty end starts from the last
+// key. The keys must be indexed. The map is locked for reading the whole time,
+// so fn must not modify the map.
+func (m *muMap) RangeBackFrom(end string, fn func(key string, d *datum) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := m.index.last()
+	if end != "" {
+		n = m.index.before(end)
+	}
+	for ; n != nil; n = m.index.before(n.key) {
+		if !fn(n.key, m.data[n.key]) {
+			return
+		}
+	}
+}
+
+// Lock locks muMap for writing.
+func (m *muMap) Lock() {
+	m.mu.Lock()
+}
+
+// Unlock unlocks muMap for writing.
+func (m *muMap) Unlock() {
+	m.mu.Unlock()
+}
+
 // RLock locks muMap for reading.
 func (m *muMap) RLock() {
 	m.mu.RLock()
@@ -52,3 +162,8 @@ func (m *muMap) RLock() {
 func (m *muMap) RUnlock() {
 	m.mu.RUnlock()
 }
+
+// TryRLock tries to lock muMap for reading, and reports whether it did.
+func (m *muMap) TryRLock() bool {
+	return m.mu.TryRLock()
+}
@@ -25,13 +25,15 @@ func TestMuMap(t *testing.T) {
 		},
 	}
 
-	m := newMuMap()
+	m := newMuMap(0)
 	for _, kv := range kvs {
 		d := newDatum()
 		err := d.Set(kv.k, kv.v)
 		test.AssertNil(t, err)
 
 		m.Store(kv.k, d)
+		test.AssertEqual(t, 1, m.Len())
+		test.AssertEqual(t, []string{kv.k}, m.Keys())
 
 		got, ok := m.Load(kv.k)
 		test.AssertEqual(t, true, ok)
@@ -43,7 +45,31 @@ func TestMuMap(t *testing.T) {
 
 		got, ok = m.Load(kv.k)
 		test.AssertEqual(t, false, ok)
+		test.AssertEqual(t, 0, m.Len())
 		d = nil
 		test.AssertEqual(t, d, got)
 	}
+	// clear everything at once
+	for _, kv := range kvs {
+		m.Store(kv.k, newDatum())
+	}
+	test.AssertEqual(t, len(kvs), m.Len())
+
+	// range over everything, then stop early
+	seen := 0
+	m.Range(func(key string, d *datum) bool {
+		seen++
+		return true
+	})
+	test.AssertEqual(t, len(kvs), seen)
+	seen = 0
+	m.Range(func(key string, d *datum) bool {
+		seen++
+		return false
+	})
+	test.AssertEqual(t, 1, seen)
+
+	m.Clear()
+	test.AssertEqual(t, 0, m.Len())
+	test.AssertEqual(t, []string{}, m.Keys())
 }
@@ -2,35 +2,241 @@ package bugfruit
 
 import (
 	"encoding/binary"
+	"io"
 )
 
-const metaSize = 9 // 9 bytes == 2 uint32s plus 1 byte
+// In the current format version, the metadata is the deleted byte, the key and
+// value sizes as uvarints, and then the crc, expiry, modification time, flags,
+// and sequence number. These are its smallest and largest sizes.
+const (
+	minMetaSize = 32 // 32 bytes == 2 bytes plus 2 one byte uvarints plus 1 uint32 plus 2 int64s plus 1 uint64
+	maxMetaSize = 40 // 40 bytes == 2 bytes plus 2 five byte uvarints plus 1 uint32 plus 2 int64s plus 1 uint64
+)
+
+// minMetaSizeV5 is the smallest size of the metadata in format version 5, which
+// has no sequence number.
+const minMetaSizeV5 = 24
+
+// deletedOffset is the offset of the deleted byte within the metadata.
+const deletedOffset = 0
+
+// deletedOffsetV4 is the offset of the deleted byte within the metadata in
+// format versions before 5.
+const deletedOffsetV4 = 8
+
+// flagGzip is set in the metadata flags when the value is compressed with gzip.
+const flagGzip byte = 1 << 0
+
+// flagEncrypted is set in the metadata flags when the key and value are
+// encrypted.
+const flagEncrypted byte = 1 << 1
 
 // meta is the metadata for a given key
 type meta struct {
 	keySize uint32 // how many bytes does the key span
 	valSize uint32 // how many bytes does the data span
 	deleted byte   // whether the data is deleted
+	crc     uint32 // the CRC32 (Castagnoli) checksum of the key and data
+	expires int64  // when the data expires, in Unix nanoseconds, or 0 if never
+	modTime int64  // when the data was last written, in Unix nanoseconds, or 0 if unknown
+	flags   byte   // how the data is stored in the file, like flagGzip
+	seq     uint64 // the sequence number of the write, which is the key's version, or 0 if it's from before version 6
+}
+
+// metaSizeOf returns the size of the metadata in format versions before 5,
+// where it has a fixed size.
+func metaSizeOf(version uint16) uint64 {
+	switch {
+	case version < 2:
+		return 13
+	case version < 3:
+		return 21
+	case version < 4:
+		return 29
+	}
+	return 30
+}
+
+// uvarintSize returns how many bytes x takes up as a uvarint.
+func uvarintSize(x uint64) uint64 {
+	n := uint64(1)
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+// minVarintMetaSize returns the smallest size of the metadata in format
+// versions from 5 on, where its size depends on the uvarints in it.
+func minVarintMetaSize(version uint16) uint64 {
+	if version < 6 {
+		return minMetaSizeV5
+	}
+	return minMetaSize
+}
+
+// size returns the size of the metadata when written to file in bytes.
+func (m *meta) size() uint64 {
+	return minMetaSize - 2 + uvarintSize(uint64(m.keySize)) + uvarintSize(uint64(m.valSize))
 }
 
 // FromBytes converts a byte slice to a meta struct.
 func (m *meta) FromBytes(b []byte) error {
-	if len(b) != metaSize {
+	return m.fromVersionBytes(b, formatVersion)
+}
+
+// fromVersionBytes converts a byte slice in the given format version to a meta
+// struct. Fields that don't exist in that version are zeroed.
+func (m *meta) fromVersionBytes(b []byte, version uint16) error {
+	if version >= 5 {
+		return m.fromVarintBytes(b, version)
+	}
+	if uint64(len(b)) != metaSizeOf(version) {
+		return ErrInvalidMetaSlice
+	}
+
+	m.keySize = byteOrder.Uint32(b[0:4])
+	m.valSize = byteOrder.Uint32(b[4:8])
+	m.deleted = b[deletedOffsetV4]
+	m.crc = byteOrder.Uint32(b[9:13])
+	m.expires, m.modTime, m.flags, m.seq = 0, 0, 0, 0
+	if version >= 2 {
+		m.expires = int64(byteOrder.Uint64(b[13:21]))
+	}
+	if version >= 3 {
+		m.modTime = int64(byteOrder.Uint64(b[21:29]))
+	}
+	if version >= 4 {
+		m.flags = b[29]
+	}
+	return nil
+}
+
+// fromVarintBytes converts a byte slice in the given format version, from 5 on,
+// to a meta struct. The sizes must be encoded in as few bytes as possible, so
+// that the metadata is the same size when it's written back.
+func (m *meta) fromVarintBytes(b []byte, version uint16) error {
+	n, ok := metaLen(b, version)
+	if !ok || uint64(len(b)) != n {
 		return ErrInvalidMetaSlice
 	}
 
-	m.keySize = binary.LittleEndian.Uint32(b[0:4])
-	m.valSize = binary.LittleEndian.Uint32(b[4:8])
-	m.deleted = b[8]
+	m.deleted = b[deletedOffset]
+	i := uint64(1)
+	for _, size := range []*uint32{&m.keySize, &m.valSize} {
+		x, n := binary.Uvarint(b[i:])
+		*size = uint32(x)
+		i += uint64(n)
+	}
+	m.crc = byteOrder.Uint32(b[i : i+4])
+	m.expires = int64(byteOrder.Uint64(b[i+4 : i+12]))
+	m.modTime = int64(byteOrder.Uint64(b[i+12 : i+20]))
+	m.flags = b[i+20]
+	m.seq = 0
+	if version >= 6 {
+		m.seq = byteOrder.Uint64(b[i+21 : i+29])
+	}
 	return nil
 }
 
+// metaLen returns the size of the metadata in the given format version, from 5
+// on, that b starts with, which only needs to hold the deleted byte and the
+// uvarints. It returns false if the uvarints are invalid, too big for a uint32,
+// or not encoded in as few bytes as possible.
+func metaLen(b []byte, version uint16) (uint64, bool) {
+	size := minVarintMetaSize(version) - 2
+	i := 1
+	for j := 0; j < 2; j++ {
+		if i > len(b) {
+			return 0, false
+		}
+		x, n := binary.Uvarint(b[i:])
+		if n <= 0 || x > 1<<32-1 || uint64(n) != uvarintSize(x) {
+			return 0, false
+		}
+		size += uint64(n)
+		i += n
+	}
+	return size, true
+}
+
+// readMeta reads the metadata for a record in the given format version from r.
+// It returns the metadata and the bytes it was read from, which are read into
+// buf if it's big enough, instead of allocating. It returns io.EOF if r is at
+// its end, and io.ErrUnexpectedEOF if r ends partway through.
+func readMeta(r io.Reader, version uint16, buf []byte) (*meta, []byte, error) {
+	m := &meta{}
+	if version < 5 {
+		b := growBuf(buf, int(metaSizeOf(version)))
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, nil, err
+		}
+		return m, b, m.fromVersionBytes(b, version)
+	}
+
+	// every record has at least the smallest size of metadata, and the rest of
+	// its size is in the first few bytes of it
+	minSize := minVarintMetaSize(version)
+	b := growBuf(buf, maxMetaSize)[:minSize]
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, nil, err
+	}
+	n, ok := metaLen(b, version)
+	if !ok {
+		return nil, nil, ErrInvalidMetaSlice
+	}
+	b = b[:n]
+	if _, err := io.ReadFull(r, b[minSize:]); err == io.EOF {
+		return nil, nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return m, b, m.fromVarintBytes(b, version)
+}
+
 // Bytes converts a meta struct to a byte slice for writing to file.
 func (m *meta) Bytes() []byte {
-	b := make([]byte, 9)
-	binary.LittleEndian.PutUint32(b[:4], m.keySize)
-	binary.LittleEndian.PutUint32(b[4:8], m.valSize)
-	b[8] = m.deleted
-
+	b := make([]byte, m.size())
+	m.put(b)
 	return b
 }
+
+// writeTo writes the meta struct to w as it's written to file, without
+// allocating a byte slice for it.
+func (m *meta) writeTo(w io.Writer) (int64, error) {
+	// a slice can be encoded into in place. Otherwise, the buffer escapes to
+	// the heap once it's passed to w.Write.
+	if sw, ok := w.(sliceWriter); ok {
+		n, sz := len(*sw.b), int(m.size())
+		*sw.b = append(*sw.b, make([]byte, sz)...)
+		m.put((*sw.b)[n:])
+		return int64(sz), nil
+	}
+	var b [maxMetaSize]byte
+	n, err := w.Write(b[:m.put(b[:])])
+	return int64(n), err
+}
+
+// put encodes the meta struct into b, which must hold at least m.size() bytes,
+// and returns how many bytes it took.
+func (m *meta) put(b []byte) int {
+	b[deletedOffset] = m.deleted
+	i := 1
+	i += binary.PutUvarint(b[i:], uint64(m.keySize))
+	i += binary.PutUvarint(b[i:], uint64(m.valSize))
+	byteOrder.PutUint32(b[i:i+4], m.crc)
+	byteOrder.PutUint64(b[i+4:i+12], uint64(m.expires))
+	byteOrder.PutUint64(b[i+12:i+20], uint64(m.modTime))
+	b[i+20] = m.flags
+	byteOrder.PutUint64(b[i+21:i+29], m.seq)
+	return i + 29
+}
+
+// growBuf returns buf resliced to n bytes, or a new slice of n bytes if buf
+// isn't big enough.
+func growBuf(buf []byte, n int) []byte {
+	if cap(buf) < n {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
@@ -1,6 +1,8 @@
 package bugfruit
 
 import (
+	"bytes"
+	"io"
 	"testing"
 
 	"github.com/reesporte/bugfruit/test"
@@ -9,20 +11,102 @@ import (
 // TestMeta ensures converting meta to and from byte slices works.
 func TestMeta(t *testing.T) {
 	// converting to bytes
-	there := &meta{keySize: 8675309, valSize: 10, deleted: 1}
-	bytes := there.Bytes()
-	expected := []byte{0xed, 0x5f, 0x84, 0x0, 0xa, 0x0, 0x0, 0x0, 0x1}
-	test.AssertEqual(t, expected, bytes)
+	there := &meta{keySize: 8675309, valSize: 10, deleted: 1, crc: 0xdeadbeef, expires: 1 << 40, modTime: 42, flags: flagGzip, seq: 1 << 33}
+	b := there.Bytes()
+	expected := []byte{0x1, 0xed, 0xbf, 0x91, 0x4, 0xa, 0xef, 0xbe, 0xad, 0xde, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x2a, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0}
+	test.AssertEqual(t, expected, b)
+	test.AssertEqual(t, uint64(len(expected)), there.size())
+	var buf bytes.Buffer
+	n, err := there.writeTo(&buf)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(len(expected)), n)
+	test.AssertEqual(t, expected, buf.Bytes())
 
 	// and back again
 	back := &meta{}
-	err := back.FromBytes(bytes)
+	err = back.FromBytes(b)
 	test.AssertNil(t, err)
 	test.AssertEqual(t, there, back)
 
+	// version 5 meta has no sequence number
+	there.seq = 0
+	v5 := b[:len(b)-8]
+	old := &meta{}
+	err = old.fromVersionBytes(v5, 5)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, there, old)
+	m, mb, err := readMeta(bytes.NewReader(v5), 5, nil)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, there, m)
+	test.AssertEqual(t, v5, mb)
+
+	// version 4 meta has fixed size fields
+	v4 := []byte{0xed, 0x5f, 0x84, 0x0, 0xa, 0x0, 0x0, 0x0, 0x1, 0xef, 0xbe, 0xad, 0xde, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x2a, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1}
+	err = old.fromVersionBytes(v4, 4)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, there, old)
+
+	// version 1 meta has no expiry
+	err = old.fromVersionBytes(v4[:metaSizeOf(1)], 1)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, &meta{keySize: 8675309, valSize: 10, deleted: 1, crc: 0xdeadbeef}, old)
+
 	// convert a bad slice into meta
 	bad := &meta{}
 	err = bad.FromBytes([]byte{0x62, 0x61, 0x64})
 	got, exp := err.Error(), ErrInvalidMetaSlice.Error()
 	test.AssertEqual(t, exp, got)
+
+	// sizes that aren't encoded in as few bytes as possible are invalid
+	long := append([]byte{0x0, 0x84, 0x0}, b[4:]...)
+	test.AssertEqual(t, ErrInvalidMetaSlice, bad.FromBytes(long))
+}
+
+// TestMetaSize ensures the metadata grows with the sizes it holds.
+func TestMetaSize(t *testing.T) {
+	test.AssertEqual(t, uint64(minMetaSize), (&meta{}).size())
+	test.AssertEqual(t, uint64(minMetaSize), (&meta{keySize: 127, valSize: 127}).size())
+	test.AssertEqual(t, uint64(minMetaSize+1), (&meta{keySize: 16, valSize: 128}).size())
+	test.AssertEqual(t, uint64(maxMetaSize), (&meta{keySize: 1<<32 - 1, valSize: 1<<32 - 1}).size())
+
+	for _, m := range []*meta{{}, {valSize: 128}, {keySize: 1<<32 - 1, valSize: 1<<32 - 1}} {
+		test.AssertEqual(t, m.size(), uint64(len(m.Bytes())))
+	}
+}
+
+// TestReadMeta ensures metadata is read one record at a time, and that running
+// out partway through is an unexpected EOF.
+func TestReadMeta(t *testing.T) {
+	small := &meta{keySize: 7, valSize: 8, crc: 0xfeedface}
+	large := &meta{keySize: 70000, valSize: 1 << 30, deleted: 1, expires: 3019}
+	r := bytes.NewReader(append(small.Bytes(), large.Bytes()...))
+
+	m, b, err := readMeta(r, formatVersion, nil)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, small, m)
+	test.AssertEqual(t, small.Bytes(), b)
+
+	// a big enough buffer is read into
+	buf := make([]byte, maxMetaSize)
+	m, b, err = readMeta(r, formatVersion, buf)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, large, m)
+	test.AssertEqual(t, large.Bytes(), b)
+	test.AssertEqual(t, &buf[0], &b[0])
+
+	_, _, err = readMeta(r, formatVersion, nil)
+	test.AssertEqual(t, io.EOF, err)
+
+	// cut off in the fixed part, and after it
+	for _, n := range []int{minMetaSize - 1, int(large.size()) - 1} {
+		_, _, err = readMeta(bytes.NewReader(large.Bytes()[:n]), formatVersion, nil)
+		test.AssertEqual(t, io.ErrUnexpectedEOF, err)
+	}
+
+	// older versions have a fixed size
+	v4 := make([]byte, metaSizeOf(4))
+	m, b, err = readMeta(bytes.NewReader(v4), 4, nil)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, &meta{}, m)
+	test.AssertEqual(t, v4, b)
 }
@@ -0,0 +1,104 @@
+// Package metrics exposes the Stats of a bugfruit Storage as Prometheus
+// metrics. It's its own module, so bugfruit itself doesn't depend on Prometheus.
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/reesporte/bugfruit"
+)
+
+// Collector is a prometheus.Collector for a Storage. Register it with
+//
+//	prometheus.MustRegister(metrics.NewCollector(s))
+type Collector struct {
+	s *bugfruit.Storage
+
+	keys, fileSize, deadBytes *prometheus.Desc
+	sets, gets, deletes       *prometheus.Desc
+	errors                    prometheus.Counter
+
+	vacuums, vacuumTime *prometheus.Desc
+
+	// the vacuum histogram is fed from the latest vacuum times in Stats, so
+	// this is how many vacuums it's seen so far
+	mu       sync.Mutex
+	vacuum   prometheus.Histogram
+	observed uint64
+}
+
+// NewCollector returns a Collector for s, with metrics named bugfruit_*.
+func NewCollector(s *bugfruit.Storage) *Collector {
+	label := prometheus.Labels{"file": s.Name()}
+	return &Collector{
+		s:          s,
+		keys:       prometheus.NewDesc("bugfruit_keys", "Number of live keys.", nil, label),
+		fileSize:   prometheus.NewDesc("bugfruit_file_size_bytes", "Size of the database file.", nil, label),
+		deadBytes:  prometheus.NewDesc("bugfruit_dead_bytes", "Bytes of deleted, overwritten, and expired records in the database file.", nil, label),
+		sets:       prometheus.NewDesc("bugfruit_sets_total", "Number of key/value pairs set.", nil, label),
+		gets:       prometheus.NewDesc("bugfruit_gets_total", "Number of keys got.", nil, label),
+		deletes:    prometheus.NewDesc("bugfruit_deletes_total", "Number of keys deleted.", nil, label),
+		vacuums:    prometheus.NewDesc("bugfruit_vacuums_total", "Number of times the database file was vacuumed.", nil, label),
+		vacuumTime: prometheus.NewDesc("bugfruit_vacuum_seconds_total", "How long vacuums took in total.", nil, label),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "bugfruit_stats_errors_total",
+			Help:        "Number of times the stats couldn't be read, like after the Storage is closed.",
+			ConstLabels: label,
+		}),
+		vacuum: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "bugfruit_vacuum_duration_seconds",
+			Help:        "How long vacuums took. Only the latest 64 vacuums between scrapes are observed.",
+			ConstLabels: label,
+			Buckets:     prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+	}
+}
+
+// Describe sends the descriptors of the metrics to ch.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.keys
+	ch <- c.fileSize
+	ch <- c.deadBytes
+	ch <- c.sets
+	ch <- c.gets
+	ch <- c.deletes
+	ch <- c.vacuums
+	ch <- c.vacuumTime
+	c.errors.Describe(ch)
+	c.vacuum.Describe(ch)
+}
+
+// Collect reads the Stats of the Storage, and sends the metrics to ch.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st, err := c.s.Stats()
+	if err != nil {
+		c.errors.Inc()
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.keys, prometheus.GaugeValue, float64(st.Keys))
+		ch <- prometheus.MustNewConstMetric(c.fileSize, prometheus.GaugeValue, float64(st.FileSize))
+		ch <- prometheus.MustNewConstMetric(c.deadBytes, prometheus.GaugeValue, float64(st.DeadBytes))
+		ch <- prometheus.MustNewConstMetric(c.sets, prometheus.CounterValue, float64(st.Sets))
+		ch <- prometheus.MustNewConstMetric(c.gets, prometheus.CounterValue, float64(st.Gets))
+		ch <- prometheus.MustNewConstMetric(c.deletes, prometheus.CounterValue, float64(st.Deletes))
+
+		ch <- prometheus.MustNewConstMetric(c.vacuums, prometheus.CounterValue, float64(st.Vacuums))
+		ch <- prometheus.MustNewConstMetric(c.vacuumTime, prometheus.CounterValue, st.VacuumTime.Seconds())
+		// the vacuums since the last scrape are the latest ones, as far back as
+		// Stats has them
+		times := st.VacuumTimes
+		if n := st.Vacuums - c.observed; n < uint64(len(times)) {
+			times = times[uint64(len(times))-n:]
+		}
+		for _, d := range times {
+			c.vacuum.Observe(d.Seconds())
+		}
+		c.observed = st.Vacuums
+	}
+
+	c.errors.Collect(ch)
+	c.vacuum.Collect(ch)
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/reesporte/bugfruit"
+	"github.com/reesporte/bugfruit/test"
+)
+
+func TestCollector(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := bugfruit.NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.Set("treebeard", []byte("Hoom, hom!")))
+	test.AssertNil(t, s.Set("quickbeam", []byte("Bregalad")))
+	test.AssertNil(t, s.Delete("quickbeam"))
+	s.Get("treebeard")
+	test.AssertNil(t, s.Vacuum())
+	test.AssertNil(t, s.Vacuum())
+
+	c := NewCollector(s)
+	reg := prometheus.NewPedanticRegistry()
+	test.AssertNil(t, reg.Register(c))
+
+	st, err := s.Stats()
+	test.AssertNil(t, err)
+	expected := strings.ReplaceAll(`
+# HELP bugfruit_keys Number of live keys.
+# TYPE bugfruit_keys gauge
+bugfruit_keys{file="FILE"} 1
+# HELP bugfruit_file_size_bytes Size of the database file.
+# TYPE bugfruit_file_size_bytes gauge
+bugfruit_file_size_bytes{file="FILE"} SIZE
+# HELP bugfruit_sets_total Number of key/value pairs set.
+# TYPE bugfruit_sets_total counter
+bugfruit_sets_total{file="FILE"} 2
+# HELP bugfruit_gets_total Number of keys got.
+# TYPE bugfruit_gets_total counter
+bugfruit_gets_total{file="FILE"} 1
+# HELP bugfruit_deletes_total Number of keys deleted.
+# TYPE bugfruit_deletes_total counter
+bugfruit_deletes_total{file="FILE"} 1
+# HELP bugfruit_vacuums_total Number of times the database file was vacuumed.
+# TYPE bugfruit_vacuums_total counter
+bugfruit_vacuums_total{file="FILE"} 2
+`, "FILE", fname)
+	expected = strings.ReplaceAll(expected, "SIZE", strconv.FormatUint(st.FileSize, 10))
+	test.AssertNil(t, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"bugfruit_keys", "bugfruit_file_size_bytes", "bugfruit_sets_total", "bugfruit_gets_total", "bugfruit_deletes_total", "bugfruit_vacuums_total"))
+
+	// both vacuums are in the histogram as long as they took, and only counted
+	// once
+	test.AssertEqual(t, uint64(2), vacuumCount(t, reg))
+	test.AssertEqual(t, uint64(2), vacuumCount(t, reg))
+	test.AssertEqual(t, true, math.Abs(st.VacuumTime.Seconds()-vacuumSum(t, reg)) < 1e-9)
+	test.AssertNil(t, s.Vacuum())
+	test.AssertEqual(t, uint64(3), vacuumCount(t, reg))
+	st, err = s.Stats()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, true, math.Abs(st.VacuumTime.Seconds()-vacuumSum(t, reg)) < 1e-9)
+
+	// a closed Storage counts an error instead
+	test.AssertNil(t, s.Close())
+	_, err = reg.Gather()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, float64(1), testutil.ToFloat64(c.errors))
+}
+
+// vacuumCount returns the number of vacuums in the histogram.
+func vacuumCount(t *testing.T, reg *prometheus.Registry) uint64 {
+	return vacuumHistogram(t, reg).GetSampleCount()
+}
+
+// vacuumSum returns the total seconds of the vacuums in the histogram.
+func vacuumSum(t *testing.T, reg *prometheus.Registry) float64 {
+	return vacuumHistogram(t, reg).GetSampleSum()
+}
+
+// vacuumHistogram gathers the vacuum histogram.
+func vacuumHistogram(t *testing.T, reg *prometheus.Registry) *dto.Histogram {
+	mfs, err := reg.Gather()
+	test.AssertNil(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == "bugfruit_vacuum_duration_seconds" {
+			return mf.GetMetric()[0].GetHistogram()
+		}
+	}
+	t.Fatal("no vacuum histogram")
+	return nil
+}
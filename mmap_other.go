@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package bugfruit
+
+import "os"
+
+// mmap is not supported on this platform.
+func mmap(f *os.File) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+// munmap is not supported on this platform.
+func munmap(b []byte) error {
+	return errMmapUnsupported
+}
@@ -0,0 +1,125 @@
+package bugfruit
+
+// ReadSnapshot is a consistent view of the database as it was when it was
+// taken with Storage.ReadSnapshot, which writes since don't change. It must be
+// released with Release once it's done with.
+type ReadSnapshot struct {
+	s    *Storage
+	snap *fileSnapshot
+	done bool // guarded by the file lock
+}
+
+// ReadSnapshot takes a read snapshot of the database, for reads that mustn't
+// see the writes made while they're going on, like a report that reads many
+// keys. Taking one is cheap: nothing is copied, but the records written since
+// it was taken are told apart by their sequence numbers, and the old datums of
+// the keys written since are kept until it's released.
+//
+// Like while a snapshot is written with WriteTo, the database file isn't
+// vacuumed, cleared, or overwritten in place while there's a read snapshot, so
+// the records it reads stay where they are. Since it's only released when
+// Release is called, Vacuum, Clear, CompactKey and Undelete don't wait for it,
+// but return ErrSnapshotActive, and background vacuums are skipped until it's
+// released. Closing the Storage releases it.
+func (s *Storage) ReadSnapshot() *ReadSnapshot {
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	if s.isClosed() {
+		return &ReadSnapshot{s: s, done: true}
+	}
+	snap := &fileSnapshot{taken: s.now(), seq: s.seq, deleted: map[uint64]struct{}{}, old: map[string]*datum{}}
+	s.snapshots = append(s.snapshots, snap)
+	return &ReadSnapshot{s: s, snap: snap}
+}
+
+// noteOld keeps a copy of d, which is being deleted or replaced, if it's the
+// datum its key had when the read snapshot was taken.
+// It is NOT thread safe without external file locking.
+func (snap *fileSnapshot) noteOld(d *datum) {
+	if d.meta.seq > snap.seq {
+		return
+	}
+	if _, ok := snap.old[d.key]; ok {
+		return
+	}
+	m := *d.meta
+	snap.old[d.key] = &datum{meta: &m, key: d.key, value: d.value, idx: d.idx, size: d.size, spilled: d.spilled}
+}
+
+// Seq returns the sequence number of the last write the read snapshot sees, or
+// 0 if it sees none.
+func (rs *ReadSnapshot) Seq() uint64 {
+	if rs.snap == nil {
+		return 0
+	}
+	return rs.snap.seq
+}
+
+// Get returns a copy of the value the key had when the read snapshot was taken,
+// and whether it was found then. A key that had expired by then isn't found.
+// Nothing is found once the read snapshot is released.
+func (rs *ReadSnapshot) Get(key string) ([]byte, bool) {
+	s := rs.s
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	if rs.done || s.isClosed() {
+		return nil, false
+	}
+	var v []byte
+	var err error
+	if d, ok := rs.snap.old[key]; ok {
+		if d.expired(rs.snap.taken) {
+			return nil, false
+		}
+		if !d.spilled {
+			return d.Value(), true
+		}
+		// the key's old value isn't cached, so reading it doesn't push out its
+		// current one
+		v, err = s.unprotectedReadValue(d)
+	} else {
+		d, ok := s.data.Load(key)
+		if !ok || d.meta.seq > rs.snap.seq || d.expired(rs.snap.taken) {
+			return nil, false
+		}
+		v, err = s.unprotectedValue(d)
+	}
+	if err != nil {
+		s.log.Printf("bugfruit: reading '%s' from read snapshot: %v", key, err)
+		return nil, false
+	}
+	return v, true
+}
+
+// Release releases the read snapshot, so the datums it kept around can be let
+// go, and the database file can be vacuumed again. Releasing it again does
+// nothing.
+func (rs *ReadSnapshot) Release() {
+	s := rs.s
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	if rs.done {
+		return
+	}
+	rs.done = true
+	s.unprotectedEndSnapshot(rs.snap)
+}
+
+// unprotectedEndReadSnapshots releases every read snapshot, for Close, so
+// nothing waits on them while it closes the Storage.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedEndReadSnapshots() {
+	kept := s.snapshots[:0]
+	for _, snap := range s.snapshots {
+		if snap.old == nil {
+			kept = append(kept, snap)
+		}
+	}
+	s.snapshots = kept
+	if len(s.snapshots) == 0 {
+		s.snapshotDone.Broadcast()
+	}
+}
@@ -0,0 +1,124 @@
+package bugfruit
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestReadSnapshot ensures a read snapshot reads the values the keys had when
+// it was taken, whatever's written since, with values in memory or on disk.
+func TestReadSnapshot(t *testing.T) {
+	for _, diskValues := range []bool{false, true} {
+		fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+		s, err := NewStorage(fname, 0600, WithReuseSpace(true), WithDiskValues(diskValues), WithWriteBufferSize(1<<10))
+		test.AssertNil(t, err)
+
+		test.AssertNil(t, s.Set("frodo", []byte("baggins")))
+		test.AssertNil(t, s.Set("sam", []byte("gamgee")))
+		test.AssertNil(t, s.Set("merry", []byte("brandybuck")))
+		test.AssertNil(t, s.SetWithTTL("gandalf", []byte("grey"), time.Hour))
+		test.AssertNil(t, s.Set("boromir", []byte("son of denethor")))
+		test.AssertNil(t, s.Delete("boromir"))
+
+		snap := s.ReadSnapshot()
+		test.AssertNil(t, s.Set("frodo", []byte("underhill")))
+		test.AssertNil(t, s.Set("frodo", []byte("ring-bearer")))
+		test.AssertNil(t, s.Delete("sam"))
+		test.AssertNil(t, s.Expire("gandalf", time.Nanosecond))
+		test.AssertNil(t, s.Set("pippin", []byte("took")))
+		test.AssertNil(t, s.Set("boromir", []byte("captain of gondor")))
+		b := s.Batch()
+		b.Set("merry", []byte("esquire of rohan"))
+		b.Set("sam", []byte("gardner"))
+		test.AssertNil(t, b.Commit())
+
+		want := map[string]string{"frodo": "baggins", "sam": "gamgee", "merry": "brandybuck", "gandalf": "grey"}
+		for _, k := range []string{"frodo", "sam", "merry", "gandalf", "pippin", "boromir"} {
+			got, ok := snap.Get(k)
+			w, found := want[k]
+			test.AssertEqual(t, found, ok)
+			if found {
+				test.AssertEqual(t, []byte(w), got)
+			}
+		}
+		frodo, _ := s.Get("frodo")
+		test.AssertEqual(t, []byte("ring-bearer"), frodo)
+		test.AssertEqual(t, false, s.Has("gandalf"))
+
+		// what would move the records it reads doesn't wait for it to be
+		// released, which would deadlock here
+		test.AssertEqual(t, true, errors.Is(s.Vacuum(), ErrSnapshotActive))
+		test.AssertEqual(t, true, errors.Is(s.Clear(), ErrSnapshotActive))
+		test.AssertEqual(t, true, errors.Is(s.CompactKey("frodo"), ErrSnapshotActive))
+		test.AssertEqual(t, true, errors.Is(s.Undelete("sam"), ErrSnapshotActive))
+		got, _ := snap.Get("frodo")
+		test.AssertEqual(t, []byte("baggins"), got)
+		snap.Release()
+		test.AssertNil(t, s.Vacuum())
+		_, ok := snap.Get("frodo")
+		test.AssertEqual(t, false, ok)
+		snap.Release()
+		test.AssertNil(t, s.Close())
+	}
+}
+
+// TestReadSnapshotVacuumWorker ensures writes that call for a vacuum while
+// there's a read snapshot don't wait on it, nor fail, and that the vacuum
+// happens once it's released.
+func TestReadSnapshotVacuumWorker(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithVacuumBatch(1))
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	snap := s.ReadSnapshot()
+	for i := 0; i < 20; i++ {
+		test.AssertNil(t, s.Set("treebeard", []byte(fmt.Sprint("don't be hasty ", i))))
+	}
+	got, ok := snap.Get("treebeard")
+	test.AssertEqual(t, false, ok)
+	test.AssertEqual(t, []byte(nil), got)
+	vacuums := func() uint64 {
+		st, err := s.Stats()
+		test.AssertNil(t, err)
+		return st.Vacuums
+	}
+	test.AssertEqual(t, uint64(0), vacuums())
+
+	snap.Release()
+	for i := 0; vacuums() == 0; i++ {
+		if i == 100 {
+			t.Fatal("never vacuumed after the read snapshot was released")
+		}
+		test.AssertNil(t, s.Set("treebeard", []byte("fangorn")))
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestReadSnapshotClose ensures closing the Storage releases its read
+// snapshots, instead of waiting on them.
+func TestReadSnapshotClose(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, nil)
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("gollum", []byte("smeagol")))
+	snap := s.ReadSnapshot()
+	got, ok := snap.Get("gollum")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("smeagol"), got)
+
+	test.AssertNil(t, s.Close())
+	_, ok = snap.Get("gollum")
+	test.AssertEqual(t, false, ok)
+	snap.Release()
+
+	// a read snapshot of a closed Storage finds nothing
+	_, ok = s.ReadSnapshot().Get("gollum")
+	test.AssertEqual(t, false, ok)
+}
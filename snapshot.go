@@ -0,0 +1,193 @@
+package bugfruit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// fileSnapshot is a point-in-time view of the database file, which is read
+// while writes go on. The file is append-only up to end while there's a
+// snapshot, so the records live when it was taken are the ones before end that
+// either still aren't deleted, or were deleted since.
+type fileSnapshot struct {
+	taken time.Time // when the snapshot was taken, for expiry
+	end   uint64    // the size of the file when the snapshot was taken
+
+	mu      sync.Mutex          // guards deleted
+	deleted map[uint64]struct{} // the offsets of the records deleted since the snapshot was taken
+
+	// for a ReadSnapshot, the sequence number of the last record written when it
+	// was taken, and the datums the keys set or deleted since had then, guarded
+	// by the file lock. old is nil otherwise
+	seq uint64
+	old map[string]*datum
+}
+
+// beginSnapshot takes a snapshot of the database file, and keeps the file from
+// being vacuumed, cleared, or overwritten in place until endSnapshot is called
+// with it. The write buffer is written first, so every record before the end of
+// the snapshot is in the file.
+func (s *Storage) beginSnapshot() (*fileSnapshot, error) {
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	if s.isClosed() {
+		return nil, ErrDBClosed
+	}
+	if err := s.unprotectedFlush(); err != nil {
+		return nil, err
+	}
+	fi, err := s.file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("statting '%s': %w", s.name, err)
+	}
+	snap := &fileSnapshot{taken: s.now(), end: uint64(fi.Size()), deleted: map[uint64]struct{}{}}
+	s.snapshots = append(s.snapshots, snap)
+	return snap, nil
+}
+
+// endSnapshot lets the database file be vacuumed, cleared, and overwritten in
+// place again, once no other snapshot is being read.
+func (s *Storage) endSnapshot(snap *fileSnapshot) {
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+	s.unprotectedEndSnapshot(snap)
+}
+
+// unprotectedEndSnapshot is endSnapshot for when the file lock is held.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedEndSnapshot(snap *fileSnapshot) {
+	for i, o := range s.snapshots {
+		if o == snap {
+			s.snapshots = append(s.snapshots[:i], s.snapshots[i+1:]...)
+			break
+		}
+	}
+	// the waiters check whether it was the last snapshot, or only read
+	// snapshots are left
+	s.snapshotDone.Broadcast()
+}
+
+// unprotectedWaitForSnapshots waits until no snapshot is being read, with the
+// file lock released while it waits, so writes go on. It returns ErrDBClosed
+// if the Storage was closed while it waited. A read snapshot is only released
+// when its holder is done with it, which may be never, so it returns
+// ErrSnapshotActive instead of waiting on one.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedWaitForSnapshots() error {
+	waited := false
+	for len(s.snapshots) > 0 {
+		for _, snap := range s.snapshots {
+			if snap.old != nil {
+				return ErrSnapshotActive
+			}
+		}
+		s.snapshotDone.Wait()
+		waited = true
+	}
+	if waited && s.isClosed() {
+		return ErrDBClosed
+	}
+	return nil
+}
+
+// unprotectedNoteDeleted tells the snapshots being read that the record of d
+// is being deleted, before its deleted byte is written, so they still copy it
+// if they find it deleted, and read snapshots can still read it.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedNoteDeleted(d *datum) {
+	for _, snap := range s.snapshots {
+		if d.idx < snap.end {
+			snap.mu.Lock()
+			snap.deleted[d.idx] = struct{}{}
+			snap.mu.Unlock()
+		}
+		if snap.old != nil {
+			snap.noteOld(d)
+		}
+	}
+}
+
+// wasDeleted returns whether the record at idx with metadata m, read from the
+// database file after the snapshot was taken, was deleted when it was taken.
+func (snap *fileSnapshot) wasDeleted(idx uint64, m *meta) bool {
+	if m.deleted == 0 {
+		return false
+	}
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	_, ok := snap.deleted[idx]
+	return !ok
+}
+
+// writeSnapshot writes the live records in the database file to w in the
+// database file format, as they were when it was called, and returns the number
+// of bytes written. If withDeleted is true, the deleted and expired records are
+// written too, so w gets a copy of the file as it was. The records are copied
+// as they are in the file, without the file lock, so writes aren't held up
+// while w is written to.
+func (s *Storage) writeSnapshot(w io.Writer, withDeleted bool) (int64, error) {
+	snap, err := s.beginSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer s.endSnapshot(snap)
+
+	written := int64(0)
+	n, err := w.Write((&header{version: s.version}).Bytes())
+	written += int64(n)
+	if err != nil {
+		return written, fmt.Errorf("writing header: %w", err)
+	}
+
+	r := bufio.NewReaderSize(io.NewSectionReader(s.file, headerSize, int64(snap.end-headerSize)), 64<<10)
+	buf := []byte{}
+	for idx := uint64(headerSize); idx < snap.end; {
+		buf = growBuf(buf, maxMetaSize)
+		m, mb, err := readMeta(r, s.version, buf)
+		if errors.Is(err, ErrInvalidMetaSlice) {
+			return written, fmt.Errorf("record at %d: converting metadata: %w", idx, err)
+		} else if err != nil {
+			return written, fmt.Errorf("record at %d: reading metadata: %w", idx, err)
+		}
+		msz := uint64(len(mb))
+		size := msz + uint64(m.keySize) + uint64(m.valSize)
+
+		deleted := snap.wasDeleted(idx, m)
+		if !withDeleted && (deleted || (&datum{meta: m}).expired(snap.taken)) {
+			// a deleted record cut short at the end of the file is skipped
+			// when it's opened too
+			if _, err := r.Discard(int(size - msz)); err != nil && idx+size <= snap.end {
+				return written, fmt.Errorf("record at %d: skipping: %w", idx, err)
+			}
+			idx += size
+			continue
+		}
+		// which is copied as it is with withDeleted
+		if idx+size > snap.end {
+			size = snap.end - idx
+		}
+
+		rec := growBuf(buf, int(size))
+		copy(rec, mb)
+		if _, err := io.ReadFull(r, rec[msz:]); err != nil {
+			return written, fmt.Errorf("record at %d: reading key/val data: %w", idx, err)
+		}
+		rec[deletedOffset] = 0
+		if deleted {
+			rec[deletedOffset] = 1
+		}
+		n, err := w.Write(rec)
+		written += int64(n)
+		if err != nil {
+			return written, fmt.Errorf("writing record at %d: %w", idx, err)
+		}
+		buf = rec
+		idx += size
+	}
+	return written, nil
+}
@@ -0,0 +1,195 @@
+package bugfruit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// stallWriter is an io.Writer that waits to be let go before its first write
+// after the header, like a slow backup destination.
+type stallWriter struct {
+	buf     bytes.Buffer
+	stalled chan struct{} // closed once a write is waiting
+	release chan struct{} // close to let the writes go
+	once    sync.Once
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	if w.buf.Len() >= headerSize {
+		w.once.Do(func() { close(w.stalled) })
+		<-w.release
+	}
+	return w.buf.Write(p)
+}
+
+// TestSnapshotWrites ensures writes go on while a snapshot is being written,
+// and that the snapshot has the pairs as they were when it was taken.
+func TestSnapshotWrites(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithReuseSpace(true), WithWriteBufferSize(1<<10))
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.Set("frodo", []byte("baggins")))
+	test.AssertNil(t, s.Set("sam", []byte("gamgee")))
+	test.AssertNil(t, s.Set("merry", []byte("brandybuck")))
+	test.AssertNil(t, s.SetWithTTL("gandalf", []byte("grey"), time.Hour))
+	test.AssertNil(t, s.Set("pippin", []byte("took")))
+	test.AssertNil(t, s.Delete("pippin"))
+
+	w := &stallWriter{stalled: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		_, err := s.WriteTo(w)
+		done <- err
+	}()
+	<-w.stalled
+
+	// none of these wait for the snapshot
+	test.AssertNil(t, s.Set("frodo", []byte("underhill")))
+	test.AssertNil(t, s.Set("sam", []byte("gardner")))
+	test.AssertNil(t, s.Delete("merry"))
+	test.AssertNil(t, s.Expire("gandalf", time.Nanosecond))
+	test.AssertNil(t, s.Set("pippin", []byte("guard of the citadel")))
+	test.AssertNil(t, s.Sync())
+
+	// but a vacuum waits until it's done, without holding up writes
+	vacuumed := make(chan error)
+	go func() { vacuumed <- s.Vacuum() }()
+	select {
+	case <-vacuumed:
+		t.Fatal("vacuumed during a snapshot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	test.AssertNil(t, s.Set("bilbo", []byte("baggins")))
+
+	close(w.release)
+	test.AssertNil(t, <-done)
+	test.AssertNil(t, <-vacuumed)
+
+	restored, err := RestoreFrom(filepath.Join(t.TempDir(), "restored"), 0600, &w.buf)
+	test.AssertNil(t, err)
+	defer restored.Close()
+	pairs := map[string]string{}
+	test.AssertNil(t, restored.ForEach(func(k string, v []byte) bool {
+		pairs[k] = string(v)
+		return true
+	}))
+	test.AssertEqual(t, map[string]string{"frodo": "baggins", "sam": "gamgee", "merry": "brandybuck", "gandalf": "grey"}, pairs)
+
+	got, _ := s.Get("frodo")
+	test.AssertEqual(t, []byte("underhill"), got)
+	test.AssertEqual(t, []string{"bilbo", "frodo", "pippin", "sam"}, s.SortedKeys())
+}
+
+// TestSnapshotConsistent ensures snapshots taken while batches are written and
+// the file is vacuumed each see every batch whole or not at all.
+func TestSnapshotConsistent(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithReuseSpace(true), WithDiskValues(true))
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	hobbits := []string{"frodo", "sam", "merry", "pippin"}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			b := s.Batch()
+			for _, h := range hobbits {
+				b.Set(h, []byte(fmt.Sprint(i)))
+			}
+			test.AssertNil(t, b.Commit())
+			if i%10 == 0 {
+				test.AssertNil(t, s.Vacuum())
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		var buf bytes.Buffer
+		_, err := s.WriteTo(&buf)
+		test.AssertNil(t, err)
+		snap, err := RestoreFrom(filepath.Join(t.TempDir(), "restored"), 0600, io.Reader(&buf))
+		test.AssertNil(t, err)
+		vals := map[string]bool{}
+		for _, h := range hobbits {
+			v, _ := snap.Get(h)
+			vals[string(v)] = true
+		}
+		test.AssertEqual(t, 1, len(vals))
+		test.AssertNil(t, snap.Close())
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// TestSnapshotWithDeleted ensures SnapshotWithDeleted copies the database file
+// as it was, deleted records and all, even if records are deleted while it's
+// copied, and that a vacuum leaves it nothing extra to copy.
+func TestSnapshotWithDeleted(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithVacuumBatch(0))
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.Set("gimli", []byte("son of gloin")))
+	test.AssertNil(t, s.Set("legolas", []byte("greenleaf")))
+	test.AssertNil(t, s.Set("gimli", []byte("lord of the glittering caves")))
+	test.AssertNil(t, s.SetWithTTL("boromir", []byte("son of denethor"), time.Nanosecond))
+	test.AssertNil(t, s.Sync())
+	file, err := os.ReadFile(fname)
+	test.AssertNil(t, err)
+
+	snapname := filepath.Join(t.TempDir(), "snapshot")
+	test.AssertNil(t, s.SnapshotWithDeleted(snapname, 0600))
+	got, err := os.ReadFile(snapname)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, file, got)
+
+	// a record deleted while it's copied is copied as it was
+	w := &stallWriter{stalled: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		_, err := s.writeSnapshot(w, true)
+		done <- err
+	}()
+	<-w.stalled
+	test.AssertNil(t, s.Delete("legolas"))
+	close(w.release)
+	test.AssertNil(t, <-done)
+	test.AssertEqual(t, file, w.buf.Bytes())
+
+	snap, err := NewStorage(snapname, 0600, WithVacuumBatch(0))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 2, snap.Len())
+	test.AssertNil(t, snap.Close())
+
+	// after a vacuum, there's nothing but the live records, and the marker of
+	// the sequence number of the last delete
+	test.AssertNil(t, s.Vacuum())
+	test.AssertNil(t, s.SnapshotWithDeleted(snapname, 0600))
+	withDeleted, err := os.ReadFile(snapname)
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Snapshot(snapname, 0600))
+	without, err := os.ReadFile(snapname)
+	test.AssertNil(t, err)
+	marker, err := s.seqMarker(s.seq)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, append(without, marker...), withDeleted)
+}
@@ -0,0 +1,88 @@
+package bugfruit
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// vacuumHistory is how many of the latest vacuums Stats has the durations of.
+const vacuumHistory = 64
+
+// Stats describes how a Storage's database file is used.
+type Stats struct {
+	// Keys is the number of live keys.
+	Keys int
+
+	// LiveBytes is the number of bytes the live key/value pairs take up in the
+	// database file, including their metadata.
+	LiveBytes uint64
+
+	// DeadBytes is the number of bytes deleted, overwritten, and expired
+	// key/value pairs take up in the database file. Vacuuming reclaims them.
+	DeadBytes uint64
+
+	// FileSize is the size of the database file, including its header.
+	FileSize uint64
+
+	// Fragmentation is DeadBytes divided by LiveBytes plus DeadBytes, or 0 if
+	// there's no data.
+	Fragmentation float64
+
+	// Sets, Gets, and Deletes are the number of key/value pairs set, keys got,
+	// and keys deleted since the Storage was opened. Gets counts every key asked
+	// for, found or not, and Deletes only counts keys that existed.
+	Sets, Gets, Deletes uint64
+
+	// Vacuums is the number of times the database file has been vacuumed since
+	// the Storage was opened, and VacuumTime is how long they took in total.
+	Vacuums    uint64
+	VacuumTime time.Duration
+
+	// VacuumTimes is how long each of the latest vacuums took, oldest first, up
+	// to the last 64 of them.
+	VacuumTimes []time.Duration
+}
+
+// Stats returns the current Stats for the Storage.
+func (s *Storage) Stats() (Stats, error) {
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	if s.isClosed() {
+		return Stats{}, ErrDBClosed
+	}
+
+	if err := s.unprotectedFlush(); err != nil {
+		return Stats{}, err
+	}
+	fi, err := s.file.Stat()
+	if err != nil {
+		return Stats{}, fmt.Errorf("statting '%s': %w", s.name, err)
+	}
+
+	st := Stats{
+		FileSize:    uint64(fi.Size()),
+		Sets:        atomic.LoadUint64(&s.sets),
+		Gets:        atomic.LoadUint64(&s.gets),
+		Deletes:     atomic.LoadUint64(&s.deletes),
+		Vacuums:     s.vacuums,
+		VacuumTime:  s.vacuumTime,
+		VacuumTimes: append([]time.Duration(nil), s.vacuumTimes...),
+	}
+	now := s.now()
+
+	s.data.Range(func(_ string, d *datum) bool {
+		if !d.expired(now) {
+			st.Keys++
+			st.LiveBytes += d.Size()
+		}
+		return true
+	})
+
+	if total := st.FileSize - headerSize; total > 0 {
+		st.DeadBytes = total - st.LiveBytes
+		st.Fragmentation = float64(st.DeadBytes) / float64(total)
+	}
+	return st, nil
+}
@@ -0,0 +1,80 @@
+package bugfruit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestStats ensures Stats counts live and dead bytes, and goes back to no
+// fragmentation after a vacuum.
+func TestStats(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, WithVacuumBatch(0))
+	test.AssertNil(t, err)
+
+	st, err := s.Stats()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, Stats{FileSize: headerSize}, st)
+
+	test.AssertNil(t, s.Set("arwen", []byte("If you want him, come and claim him!")))
+	test.AssertNil(t, s.Set("elrond", []byte("She will die.")))
+	test.AssertNil(t, s.Set("elrond", []byte("Nothing is certain.")))
+	arwen, _ := s.data.Load("arwen")
+	elrond, _ := s.data.Load("elrond")
+	live := arwen.Size() + elrond.Size()
+	dead := uint64(minMetaSize + len("elrond") + len("She will die."))
+
+	st, err = s.Stats()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, Stats{
+		Sets:          3,
+		Keys:          2,
+		LiveBytes:     live,
+		DeadBytes:     dead,
+		FileSize:      headerSize + live + dead,
+		Fragmentation: float64(dead) / float64(live+dead),
+	}, st)
+
+	test.AssertNil(t, s.Vacuum())
+	s.Get("arwen")
+	test.AssertNil(t, s.Delete("arwen"))
+	test.AssertNil(t, s.Delete("arwen"))
+	st, err = s.Stats()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, true, st.VacuumTime > 0)
+	test.AssertEqual(t, []time.Duration{st.VacuumTime}, st.VacuumTimes)
+	st.VacuumTime, st.VacuumTimes = 0, nil
+	test.AssertEqual(t, Stats{
+		Keys:          1,
+		LiveBytes:     elrond.Size(),
+		DeadBytes:     arwen.Size(),
+		FileSize:      headerSize + live,
+		Fragmentation: float64(arwen.Size()) / float64(live),
+		Sets:          3,
+		Gets:          1,
+		Deletes:       1,
+		Vacuums:       1,
+	}, st)
+
+	// only the latest vacuum times are kept
+	for i := 0; i < vacuumHistory; i++ {
+		test.AssertNil(t, s.Vacuum())
+	}
+	st, err = s.Stats()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, uint64(vacuumHistory+1), st.Vacuums)
+	test.AssertEqual(t, vacuumHistory, len(st.VacuumTimes))
+	total := time.Duration(0)
+	for _, d := range st.VacuumTimes {
+		total += d
+	}
+	test.AssertEqual(t, true, total < st.VacuumTime)
+
+	test.AssertNil(t, s.Close())
+	_, err = s.Stats()
+	test.AssertEqual(t, ErrDBClosed, err)
+}
@@ -1,287 +1,3070 @@
 package bugfruit
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Storage handles reading and writing key/value pairs to/from disk and memory.
 type Storage struct {
-	name             string   // the name of the database file
-	file             *os.File // the database file
-	writeCountSync   uint64   // how many write operations since the last fsync
-	writeCountVacuum uint64   // how many write operations since the last vacuum
+	name             string // the name of the database file
+	file             file   // the database file
+	mem              bool   // whether the Storage only lives in memory
+	writeCountSync   uint64 // how many write operations since the last fsync
+	writeCountVacuum uint64 // how many write operations since the last vacuum
+	sets             uint64 // how many key/value pairs have been set
+	gets             uint64 // how many keys have been got
+	deletes          uint64 // how many keys have been deleted
 
 	muFile sync.Mutex // the database file lock
 	data   muMap      // the in-memory representation of the data
 
-	idx uint32 // the current index in the file
+	muSync  sync.Mutex // held while syncing for writers waiting on it, before muFile if both are held
+	syncSeq uint64     // how many writes there have been to sync, guarded by muFile
+	synced  uint64     // how many of those writes have been synced, guarded by muSync
 
-	closed chan struct{} // this channel is closed when the Storage is closed
+	idx       uint64 // the current index in the file
+	version   uint16 // the format version of the database file
+	dataBytes uint64 // how many bytes of records are in the file
+	deadBytes uint64 // how many bytes of deleted records are in the file
+	seq       uint64 // the sequence number of the last record written, or the highest in the file
+	wbuf      []byte // records appended, but not yet written to the file
+	wbufStart uint64 // the offset in the file that wbuf starts at
+
+	free       map[uint64][]uint64 // the offsets of deleted datums that can be reused, by size
+	superseded []*datum            // datums replaced by later records for their keys while the file is loaded
+	tombstones map[string]*datum   // the latest deleted datum of each deleted key, for Undelete
+	tombKeys   map[uint64]string   // the keys of the tombstones, by offset
+	rbuf       []byte              // reused to read records while the file is opened or vacuumed
+	rec        []byte              // reused to build records before they're written, by recordBytes
+
+	snapshots    []*fileSnapshot // the snapshots of the database file being read
+	snapshotDone *sync.Cond      // broadcast on the file lock when the last snapshot is done
+
+	wal *os.File // the write-ahead log, or nil if it's off
+
+	cache   *valueCache // the most recently used values, with DiskValues
+	indexed bool        // whether the index file matches the database file
+	opened  bool        // whether opening the storage finished, so the in-memory map is complete
+
+	markerSize uint64 // the size of a seqMarker, once it's needed
+
+	vacuums    uint64        // how many times the file has been vacuumed
+	vacuumTime time.Duration // how long vacuuming has taken in total
+
+	vacuumTimes []time.Duration // how long each of the latest vacuums took, oldest first
+
+	now  func() time.Time // the clock used for expiry and modification times
+	aead cipher.AEAD      // the cipher records are encrypted with, or nil
+
+	watchers watchers   // the channels writes are published to
+	hooked   []Event    // the writes for the OnSet and OnDelete hooks, once the file lock is released, guarded by muFile
+	changes  changeFeed // the channels every change is published to in order, guarded by muFile
+	log      Logger     // where internal events are logged
+
+	closed       chan struct{}  // this channel is closed when the Storage is closed
+	vacuumNeeded chan struct{}  // the vacuum worker vacuums when this channel receives
+	vacuumErr    error          // the last error from the vacuum worker
+	syncErr      error          // the last error from the fsync worker
+	workers      sync.WaitGroup // the background workers, like the vacuum worker
 
 	config *Config // configuration for Storage
 }
 
-// NewStorage creates a new Storage from a file. If the file does not exist,
-// it will be created. If the config is nil, a default VacuumBatch of
-// 50,000 and default FsyncBatch of 25,000 will be set.
-func NewStorage(filename string, mode os.FileMode, config *Config) (s *Storage, err error) {
-	if config == nil {
-		config = &Config{
-			VacuumBatch: 50000,
-			FsyncBatch:  25000,
-		}
+// NewStorage creates a new Storage from a file. If the file does not exist,
+// it will be created. Options are applied in order on top of a default
+// VacuumBatch of 50,000 and default FsyncBatch of 25,000. A nil option is
+// ignored, so passing a nil *Config keeps the defaults.
+//
+// The file is locked until the Storage is closed. If another Storage, in this
+// process or another, already has it open, ErrLocked is returned.
+func NewStorage(filename string, mode os.FileMode, opts ...Option) (s *Storage, err error) {
+	s = newStorage(filename, opts)
+	start := time.Now()
+	if s.aead, err = newAEAD(s.config.EncryptionKey); err != nil {
+		return nil, fmt.Errorf("setting up encryption: %w", err)
+	}
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+	created := err == nil
+	if errors.Is(err, os.ErrExist) {
+		f, err = os.OpenFile(filename, os.O_RDWR, mode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening database file %s: %w", filename, err)
+	}
+	// keep other Storages from appending to the file too. The lock is released
+	// when the file is closed.
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking database file %s: %w", filename, err)
+	}
+	s.file = f
+
+	// a new file isn't there after a crash until its directory is synced
+	if created {
+		if err = syncDir(filepath.Dir(filename)); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("syncing the directory of %s: %w", filename, err)
+		}
+	}
+
+	if err = s.initHeader(); err != nil {
+		if err2 := s.file.Close(); err2 != nil {
+			return nil, fmt.Errorf("reading header: while handling error '%v': encountered %w", err, err2)
+		}
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	// the index file, if it's up to date, saves reading the whole file
+	loaded := false
+	if s.indexFile() {
+		loaded, err = s.loadIndex()
+	}
+	if err == nil && !loaded {
+		err = s.loadFile()
+	}
+	if err != nil {
+		err = s.recoverTornWrite(err)
+	}
+	if err != nil {
+		if err2 := s.Close(); err2 != nil {
+			return nil, fmt.Errorf("reading datum: while handling error '%v': encountered %w", err, err2)
+		}
+		return nil, fmt.Errorf("reading datum: %w", err)
+	}
+
+	// records replaced by later ones are dead too, and no vacuum may get to
+	// them for a while
+	if err = s.unprotectedDropSuperseded(); err != nil {
+		if err2 := s.Close(); err2 != nil {
+			return nil, fmt.Errorf("deleting replaced records: while handling error '%v': encountered %w", err, err2)
+		}
+		return nil, fmt.Errorf("deleting replaced records: %w", err)
+	}
+
+	// everything that wasn't loaded is dead
+	s.dataBytes = s.idx - headerSize
+	s.deadBytes = s.dataBytes
+	s.data.Range(func(_ string, d *datum) bool {
+		s.deadBytes -= d.Size()
+		return true
+	})
+	s.log.Printf("bugfruit: opened %s in %v: %d keys, %d bytes of records, %d bytes dead", s.name, time.Since(start), s.data.Len(), s.dataBytes, s.deadBytes)
+
+	// rewrite files from older format versions in the current format
+	if s.version < formatVersion {
+		if err := s.unprotectedVacuum(); err != nil {
+			if err2 := s.Close(); err2 != nil {
+				return nil, fmt.Errorf("upgrading file format: while handling error '%v': encountered %w", err, err2)
+			}
+			return nil, fmt.Errorf("upgrading file format: %w", err)
+		}
+	}
+
+	// write the batches that were committed to the write-ahead log, but may not
+	// have made it to the database file
+	if s.config.WAL {
+		if err := s.openWAL(mode); err != nil {
+			if err2 := s.Close(); err2 != nil {
+				return nil, fmt.Errorf("opening write-ahead log: while handling error '%v': encountered %w", err, err2)
+			}
+			return nil, err
+		}
+	}
+
+	// the changes made while the file was opened aren't kept for subscribers
+	s.changes.reset(s.seq)
+	s.opened = true
+	s.startWorkers()
+
+	return s, nil
+}
+
+// NewMemStorage creates a new Storage that only lives in memory, and never
+// touches disk. It behaves like a Storage created by NewStorage, except that
+// vacuuming and fsync are no-ops. Snapshot still writes to disk.
+func NewMemStorage(opts ...Option) (*Storage, error) {
+	s := newStorage("", opts)
+	var err error
+	if s.aead, err = newAEAD(s.config.EncryptionKey); err != nil {
+		return nil, fmt.Errorf("setting up encryption: %w", err)
+	}
+	s.file = &nopFile{}
+	s.mem = true
+	if err := s.initHeader(); err != nil {
+		return nil, fmt.Errorf("writing header: %w", err)
+	}
+	s.opened = true
+	return s, nil
+}
+
+// newStorage creates a Storage with the options applied on top of the default
+// config, without a backing file.
+func newStorage(name string, opts []Option) *Storage {
+	config := defaultConfig()
+	for _, opt := range opts {
+		if opt != nil {
+			opt.apply(config)
+		}
+	}
+
+	now := time.Now
+	if config.Clock != nil {
+		now = config.Clock
+	}
+	var log Logger = nopLogger{}
+	if config.Logger != nil {
+		log = config.Logger
+	}
+
+	expectedKeys := config.ExpectedKeys
+	if expectedKeys < 0 {
+		expectedKeys = 0
+	}
+
+	s := &Storage{
+		name:         name,
+		config:       config,
+		data:         newMuMap(expectedKeys),
+		free:         make(map[uint64][]uint64),
+		tombstones:   make(map[string]*datum),
+		tombKeys:     make(map[uint64]string),
+		now:          now,
+		log:          log,
+		closed:       make(chan struct{}),
+		vacuumNeeded: make(chan struct{}, 1),
+	}
+	s.snapshotDone = sync.NewCond(&s.muFile)
+	if config.Ordered {
+		s.data.index = newSkiplist()
+	}
+	if config.DiskValues {
+		s.cache = newValueCache(config.ValueCacheSize)
+	}
+	return s
+}
+
+// initHeader writes the header to the database file if it's empty, and
+// otherwise reads and checks the header. It leaves the file positioned at the
+// first record.
+func (s *Storage) initHeader() error {
+	fi, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("statting '%s': %w", s.name, err)
+	}
+
+	h := &header{version: formatVersion}
+	if fi.Size() == 0 {
+		if _, err := s.file.Write(h.Bytes()); err != nil {
+			return fmt.Errorf("writing header: %w", err)
+		}
+	} else {
+		buf := make([]byte, headerSize)
+		if _, err := io.ReadFull(s.file, buf); err == io.ErrUnexpectedEOF {
+			return ErrInvalidHeader
+		} else if err != nil {
+			return err
+		}
+		if err := h.FromBytes(buf); err != nil {
+			return err
+		}
+	}
+
+	s.version = h.version
+	s.idx = headerSize
+	return nil
+}
+
+// loadFile reads every datum in the database file into the in-memory map,
+// starting from the first record. If the config calls for it, the file is
+// memory-mapped for the read, where that's supported, and the records are
+// decoded by several goroutines.
+func (s *Storage) loadFile() error {
+	r := io.ReadSeeker(s.file)
+	ra := io.ReaderAt(s.file)
+	if f, ok := s.file.(*os.File); ok && s.config.Mmap {
+		m, err := mmap(f)
+		if err != nil && !errors.Is(err, errMmapUnsupported) {
+			return fmt.Errorf("memory-mapping %s: %w", s.name, err)
+		}
+		if m != nil {
+			defer munmap(m)
+			mr := bytes.NewReader(m)
+			if _, err := mr.Seek(int64(s.idx), 0); err != nil {
+				return err
+			}
+			r, ra = mr, mr
+		}
+	}
+	if s.config.OpenConcurrency > 1 {
+		return s.loadConcurrently(ra, s.config.OpenConcurrency)
+	}
+
+	// the read buffer is only needed while the file is read
+	defer func() { s.rbuf = nil }()
+	for d, err := s.readDatumFrom(r); err != io.EOF; d, err = s.readDatumFrom(r) {
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			s.loadDatum(d)
+		}
+	}
+	return nil
+}
+
+// loadDatum adds d, which was just read from the database file, to the
+// in-memory map, unless it's expired. If there's already a datum for its key,
+// from a record earlier in the file that should have been marked deleted, but
+// wasn't, like after a crash, d replaces it even if d is expired, and the
+// earlier one is kept to be marked deleted once the file is loaded.
+// It is NOT thread safe without external file locking.
+func (s *Storage) loadDatum(d *datum) {
+	if old, ok := s.data.Load(d.key); ok {
+		s.superseded = append(s.superseded, old)
+		if d.expired(s.now()) {
+			s.data.LoadAndDelete(d.key)
+		}
+	}
+	if !d.expired(s.now()) {
+		s.spill(d)
+		s.data.Store(d.key, d)
+	}
+}
+
+// unprotectedDropSuperseded marks the records that loadDatum found a later
+// record for deleted in the database file, and vacuums the file to reclaim
+// their space if vacuuming is on. Files in older format versions are vacuumed
+// when they're upgraded anyway, so their records aren't marked.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedDropSuperseded() error {
+	superseded := s.superseded
+	s.superseded = nil
+	if len(superseded) == 0 || s.version < formatVersion {
+		return nil
+	}
+
+	s.log.Printf("bugfruit: %s has %d records that were replaced, but not deleted", s.name, len(superseded))
+	for _, d := range superseded {
+		d.MarkDeleted()
+		if err := s.writeDeletedByte(d); err != nil {
+			return fmt.Errorf("deleting replaced record: %w", err)
+		}
+	}
+	if s.config.VacuumBatch > 0 || s.config.VacuumFragmentationThreshold > 0 || s.config.VacuumInterval > 0 {
+		return s.unprotectedVacuum()
+	}
+	return nil
+}
+
+// startWorkers starts the background workers the config calls for.
+func (s *Storage) startWorkers() {
+	if s.config.VacuumBatch > 0 || s.config.VacuumFragmentationThreshold > 0 || s.config.VacuumInterval > 0 {
+		s.workers.Add(1)
+		go s.vacuumWorker()
+	}
+	if s.config.FsyncInterval > 0 {
+		s.workers.Add(1)
+		go s.fsyncWorker(s.config.FsyncInterval)
+	}
+}
+
+// Get returns a copy of the value for a key and whether the key was found.
+// Nothing is found once the Storage is closed.
+func (s *Storage) Get(key string) ([]byte, bool) {
+	atomic.AddUint64(&s.gets, 1)
+	d, ok := s.load(key)
+	if !ok {
+		return nil, ok
+	}
+	return s.loggedValue(d)
+}
+
+// GetBytes is Get for a key given as bytes. Keys are equal when their bytes
+// are, so GetBytes([]byte(k)) finds the same value as Get(k). It doesn't copy
+// the key to look it up.
+func (s *Storage) GetBytes(key []byte) ([]byte, bool) {
+	atomic.AddUint64(&s.gets, 1)
+	if s.isClosed() {
+		return nil, false
+	}
+	d, ok := s.data.LoadBytes(key)
+	if !ok || d.expired(s.now()) {
+		return nil, false
+	}
+	return s.loggedValue(d)
+}
+
+// GetCtx is Get, but it gives up and returns ctx.Err() if ctx is done before it
+// can read the in-memory map, like while a vacuum is updating it.
+func (s *Storage) GetCtx(ctx context.Context, key string) ([]byte, bool, error) {
+	if s.isClosed() {
+		return nil, false, ErrDBClosed
+	}
+
+	if err := lockCtx(ctx, s.data.RLock, s.data.TryRLock); err != nil {
+		return nil, false, err
+	}
+	atomic.AddUint64(&s.gets, 1)
+	d, ok := s.data.data[key]
+	s.data.RUnlock()
+	if !ok || d.expired(s.now()) {
+		return nil, false, nil
+	}
+	return s.value(d)
+}
+
+// GetMulti returns a copy of the value for each key that was found. Missing
+// keys are left out of the map. It takes the read lock once for all the keys.
+func (s *Storage) GetMulti(keys []string) (map[string][]byte, error) {
+	if s.isClosed() {
+		return nil, ErrDBClosed
+	}
+
+	atomic.AddUint64(&s.gets, uint64(len(keys)))
+	now := s.now()
+
+	ds := make([]*datum, 0, len(keys))
+	s.data.RLock()
+	for _, k := range keys {
+		if d, ok := s.data.data[k]; ok && !d.expired(now) {
+			ds = append(ds, d)
+		}
+	}
+	s.data.RUnlock()
+
+	// the values are read without the read lock, since they might have to be
+	// read from the file
+	vals := make(map[string][]byte, len(ds))
+	for _, d := range ds {
+		v, ok, err := s.value(d)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			vals[d.key] = v
+		}
+	}
+	return vals, nil
+}
+
+// Has returns whether the key exists in the database. Nothing exists once the
+// Storage is closed.
+func (s *Storage) Has(key string) bool {
+	_, ok := s.load(key)
+	return ok
+}
+
+// load returns the datum for a key, and whether the key exists. Expired keys
+// and the keys of a closed Storage don't exist. With DiskValues, the datum's
+// value has to be got with value.
+func (s *Storage) load(key string) (*datum, bool) {
+	if s.isClosed() {
+		return nil, false
+	}
+	d, ok := s.data.Load(key)
+	if !ok || d.expired(s.now()) {
+		return nil, false
+	}
+	return d, true
+}
+
+// Len returns the number of keys in the database. It includes expired keys
+// that haven't been vacuumed yet.
+func (s *Storage) Len() int {
+	return s.data.Len()
+}
+
+// Keys returns the keys in the database. The order of the keys is unspecified.
+// The slice is a point-in-time copy, so it is not affected by later calls to Set
+// or Delete.
+func (s *Storage) Keys() []string {
+	now := s.now()
+	keys := make([]string, 0, s.data.Len())
+	s.data.Range(func(k string, v *datum) bool {
+		if !v.expired(now) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	return keys
+}
+
+// SortedKeys returns the keys in the database, sorted lexicographically. Like
+// Keys, the slice is a point-in-time copy.
+func (s *Storage) SortedKeys() []string {
+	if !s.data.Ordered() {
+		keys := s.Keys()
+		sort.Strings(keys)
+		return keys
+	}
+
+	now := s.now()
+	keys := make([]string, 0, s.data.Len())
+	s.data.RangeFrom("", func(k string, d *datum) bool {
+		if !d.expired(now) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	return keys
+}
+
+// MinKey returns the smallest live key in the database, and whether there is
+// one. Without Ordered, every key is checked.
+func (s *Storage) MinKey() (string, bool) {
+	if !s.data.Ordered() {
+		return s.extremeKey(func(k, min string) bool { return k < min })
+	}
+	return s.firstLive(s.data.RangeFrom)
+}
+
+// MaxKey returns the largest live key in the database, and whether there is
+// one. Without Ordered, every key is checked.
+func (s *Storage) MaxKey() (string, bool) {
+	if !s.data.Ordered() {
+		return s.extremeKey(func(k, max string) bool { return k > max })
+	}
+	return s.firstLive(s.data.RangeBackFrom)
+}
+
+// extremeKey returns the live key that comes before every other one by less,
+// and whether there is one.
+func (s *Storage) extremeKey(less func(a, b string) bool) (key string, ok bool) {
+	now := s.now()
+	s.data.Range(func(k string, d *datum) bool {
+		if !d.expired(now) && (!ok || less(k, key)) {
+			key, ok = k, true
+		}
+		return true
+	})
+	return key, ok
+}
+
+// firstLive returns the first live key that rangeFn visits from the start or
+// end of the ordered index, and whether there is one.
+func (s *Storage) firstLive(rangeFn func(string, func(string, *datum) bool)) (key string, ok bool) {
+	now := s.now()
+	rangeFn("", func(k string, d *datum) bool {
+		if d.expired(now) {
+			return true
+		}
+		key, ok = k, true
+		return false
+	})
+	return key, ok
+}
+
+// ScanPage returns up to limit keys in the database that sort after cursor, in
+// sorted order, and the cursor to pass to get the next page, which is empty if
+// there are no more keys. An empty cursor starts from the first key. Keys set or
+// deleted between calls are seen by the pages after them.
+//
+// Without Ordered, every key is sorted on each call.
+func (s *Storage) ScanPage(cursor string, limit int) (keys []string, next string, err error) {
+	if s.isClosed() {
+		return nil, "", ErrDBClosed
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid page limit %d", limit)
+	}
+
+	now := s.now()
+	live := func(k string, d *datum) bool {
+		return k > cursor && d.Deleted() != byte(1) && !d.expired(now)
+	}
+	more := false
+	if s.data.Ordered() {
+		s.data.RangeFrom(cursor, func(k string, d *datum) bool {
+			if !live(k, d) {
+				return true
+			}
+			if len(keys) == limit {
+				more = true
+				return false
+			}
+			keys = append(keys, k)
+			return true
+		})
+	} else {
+		s.data.Range(func(k string, d *datum) bool {
+			if live(k, d) {
+				keys = append(keys, k)
+			}
+			return true
+		})
+		sort.Strings(keys)
+		if len(keys) > limit {
+			keys, more = keys[:limit], true
+		}
+	}
+
+	if more {
+		next = keys[len(keys)-1]
+	}
+	return keys, next, nil
+}
+
+// rangeBatchSize is how many pairs RangeKeys copies out of an ordered index at
+// a time.
+const rangeBatchSize = 256
+
+// RangeKeys calls fn with a copy of each key/value pair in the database where
+// start <= key < end, in sorted order, until fn returns false. An empty end has
+// no upper bound. The pairs are copied out before fn is called, so fn may call
+// methods on the Storage. Returns nil on success.
+//
+// Without Ordered, every key is sorted on each call. With it, the pairs are
+// copied out of the ordered index in batches, so writes between batches are
+// seen.
+func (s *Storage) RangeKeys(start, end string, fn func(key string, value []byte) bool) error {
+	return s.rangeKeys(start, end, false, fn)
+}
+
+// RangeKeysReverse is RangeKeys, but it calls fn with the pairs in reverse
+// sorted order, from the largest key before end down to start.
+func (s *Storage) RangeKeysReverse(start, end string, fn func(key string, value []byte) bool) error {
+	return s.rangeKeys(start, end, true, fn)
+}
+
+// rangeKeys is RangeKeys, in reverse sorted order if reverse is true.
+func (s *Storage) rangeKeys(start, end string, reverse bool, fn func(key string, value []byte) bool) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	type pair struct {
+		key string
+		d   *datum
+	}
+	var pairs []pair
+	now := s.now()
+	live := func(k string, d *datum) bool {
+		return d.Deleted() != byte(1) && !d.expired(now)
+	}
+	// call fn with each pair's value, which is read after the read lock is
+	// released, since it might have to be read from the file
+	call := func() (bool, error) {
+		for _, p := range pairs {
+			v, ok, err := s.value(p.d)
+			if err != nil {
+				return false, err
+			} else if ok && !fn(p.key, v) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	if !s.data.Ordered() {
+		s.data.Range(func(k string, d *datum) bool {
+			if k >= start && (end == "" || k < end) && live(k, d) {
+				pairs = append(pairs, pair{key: k, d: d})
+			}
+			return true
+		})
+		sort.Slice(pairs, func(i, j int) bool {
+			if reverse {
+				return pairs[i].key > pairs[j].key
+			}
+			return pairs[i].key < pairs[j].key
+		})
+
+		_, err := call()
+		return err
+	}
+
+	for {
+		pairs = pairs[:0]
+		more := false
+		if reverse {
+			s.data.RangeBackFrom(end, func(k string, d *datum) bool {
+				if k < start {
+					return false
+				}
+				if live(k, d) {
+					pairs = append(pairs, pair{key: k, d: d})
+				}
+				if len(pairs) == rangeBatchSize {
+					// pick up before here in the next batch, unless there's
+					// nothing before here
+					end, more = k, k != ""
+					return false
+				}
+				return true
+			})
+		} else {
+			s.data.RangeFrom(start, func(k string, d *datum) bool {
+				if end != "" && k >= end {
+					return false
+				}
+				if len(pairs) == rangeBatchSize {
+					// pick up from here in the next batch
+					start, more = k, true
+					return false
+				}
+				if live(k, d) {
+					pairs = append(pairs, pair{key: k, d: d})
+				}
+				return true
+			})
+		}
+
+		if cont, err := call(); !cont || err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// ScanPrefix calls fn with a copy of each key/value pair in the database whose
+// key starts with prefix, in sorted order, until fn returns false. Like
+// RangeKeys, fn may call methods on the Storage. Returns nil on success.
+func (s *Storage) ScanPrefix(prefix string, fn func(key string, value []byte) bool) error {
+	return s.RangeKeys(prefix, prefixEnd(prefix), fn)
+}
+
+// prefixEnd returns the smallest key greater than every key that starts with
+// prefix, or "" if there isn't one.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// CountPrefix returns the number of live keys in the database that start with
+// prefix. Without Ordered, every key is checked.
+func (s *Storage) CountPrefix(prefix string) int {
+	now := s.now()
+	n := 0
+	s.rangePrefix(prefix, func(k string, d *datum) {
+		if !d.expired(now) {
+			n++
+		}
+	})
+	return n
+}
+
+// rangePrefix calls fn for each key in the in-memory map that starts with
+// prefix, expired or not, with the map locked for reading, so fn must not
+// modify the map. With Ordered, only the keys with the prefix are visited.
+func (s *Storage) rangePrefix(prefix string, fn func(key string, d *datum)) {
+	if !s.data.Ordered() {
+		s.data.Range(func(k string, d *datum) bool {
+			if strings.HasPrefix(k, prefix) {
+				fn(k, d)
+			}
+			return true
+		})
+		return
+	}
+	s.data.RangeFrom(prefix, func(k string, d *datum) bool {
+		if !strings.HasPrefix(k, prefix) {
+			return false
+		}
+		fn(k, d)
+		return true
+	})
+}
+
+// ForEach calls fn with a copy of each key/value pair in the database, in an
+// unspecified order, until fn returns false. Returns nil on success.
+//
+// Writes wait for ForEach to finish, so it sees every key that's live the whole
+// time it's taking place, and fn must not write to s. With DiskValues, the
+// datums are copied out first so their values can be read from the file, and
+// writes while fn runs may be seen.
+func (s *Storage) ForEach(fn func(key string, value []byte) bool) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	now := s.now()
+	if s.diskValues() {
+		ds := make([]*datum, 0, s.data.Len())
+		s.data.Range(func(_ string, v *datum) bool {
+			if v.Deleted() != byte(1) && !v.expired(now) {
+				ds = append(ds, v)
+			}
+			return true
+		})
+		for _, d := range ds {
+			v, ok, err := s.value(d)
+			if err != nil {
+				return err
+			} else if ok && !fn(d.key, v) {
+				break
+			}
+		}
+		return nil
+	}
+
+	s.data.Range(func(k string, v *datum) bool {
+		if v.Deleted() == byte(1) || v.expired(now) {
+			return true
+		}
+		return fn(k, v.Value())
+	})
+	return nil
+}
+
+// Set sets the key/value pair in-memory and on disk.
+// Returns nil on success.
+func (s *Storage) Set(key string, value []byte) error {
+	return s.set(context.Background(), key, value, 0, false)
+}
+
+// SetBytes is Set for a key given as bytes. The key is copied, so the caller
+// may reuse it.
+func (s *Storage) SetBytes(key, value []byte) error {
+	return s.Set(string(key), value)
+}
+
+// SetCtx is Set, but it gives up and returns ctx.Err() if ctx is done before
+// the write can start, like while a vacuum is holding the file lock.
+func (s *Storage) SetCtx(ctx context.Context, key string, value []byte) error {
+	return s.set(ctx, key, value, 0, false)
+}
+
+// SetSync sets the key/value pair in-memory and on disk, and syncs the database
+// file before returning, regardless of FsyncBatch. Returns nil on success.
+func (s *Storage) SetSync(key string, value []byte) error {
+	return s.set(context.Background(), key, value, 0, true)
+}
+
+// SetWithTTL sets the key/value pair in-memory and on disk, and expires it
+// after ttl. If ttl is not positive, the key never expires. Returns nil on
+// success.
+func (s *Storage) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	return s.set(context.Background(), key, value, s.expiresAt(ttl), false)
+}
+
+// Expire sets the key to expire after ttl, replacing any existing expiry. If ttl
+// is not positive, the key never expires. Returns nil on success. If the key
+// does not exist in the database, error is nil.
+func (s *Storage) Expire(key string, ttl time.Duration) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	d, exists := s.data.Load(key)
+	if !exists || d.expired(s.now()) {
+		return nil
+	}
+	// rewrite the datum with the new expiry, keeping its modification time. d
+	// stays as it is until e replaces it, since readers may still see it
+	e, err := s.unprotectedClone(d)
+	if err != nil {
+		return err
+	}
+	if err := s.reclaimSpace(d); err != nil {
+		return fmt.Errorf("reclaiming datum space: %w", err)
+	}
+	e.meta.expires = s.expiresAt(ttl)
+	err = s.writeDatum(e)
+	s.storeDatum(e)
+	if err != nil {
+		return err
+	}
+	return s.incAndSync(1, false)
+}
+
+// GetTTL returns the time left before the key expires, and whether the key
+// exists. If the key exists and never expires, the duration is 0.
+func (s *Storage) GetTTL(key string) (time.Duration, bool) {
+	d, ok := s.load(key)
+	if !ok {
+		return 0, false
+	}
+	if d.meta.expires == 0 {
+		return 0, true
+	}
+	return time.Duration(d.meta.expires - s.now().UnixNano()), true
+}
+
+// ModTime returns when the key was last set, and whether the key exists. Keys
+// last set before modification times were recorded have a zero time.
+func (s *Storage) ModTime(key string) (time.Time, bool) {
+	d, ok := s.load(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	if d.meta.modTime == 0 {
+		return time.Time{}, true
+	}
+	return time.Unix(0, d.meta.modTime), true
+}
+
+// GetVersioned is Get, but also returns the version of the key, which changes
+// every time the key is set or its expiry is changed. Versions are numbered
+// across all keys and only go up, so a write since the version was read makes
+// it stale, like SetIfVersion checks. Keys last set before versions were
+// recorded have version 0 until they're set again.
+func (s *Storage) GetVersioned(key string) ([]byte, uint64, bool) {
+	atomic.AddUint64(&s.gets, 1)
+	d, ok := s.load(key)
+	if !ok {
+		return nil, 0, false
+	}
+	v, ok := s.loggedValue(d)
+	if !ok {
+		return nil, 0, false
+	}
+	return v, d.meta.seq, true
+}
+
+// expiresAt returns the Unix nanosecond timestamp ttl from now, or 0 if ttl is
+// not positive.
+func (s *Storage) expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return s.now().Add(ttl).UnixNano()
+}
+
+// set sets the key/value pair in-memory and on disk, expiring at the Unix
+// nanosecond timestamp expires, or never if expires is 0. It optionally syncs
+// the database file. It gives up if ctx is done before it gets the file lock.
+func (s *Storage) set(ctx context.Context, key string, value []byte, expires int64, sync bool) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	// hold the file lock across the whole update, so a vacuum can't move the
+	// datums out from under us
+	if err := lockCtx(ctx, s.muFile.Lock, s.muFile.TryLock); err != nil {
+		return err
+	}
+	// the sync happens after the file lock is released, so that concurrent
+	// writers' syncs can be done together, and the write is only published to
+	// watchers once it's done
+	var held *heldEvents
+	if sync {
+		held = s.watchers.hold()
+	}
+	err := s.unprotectedSet(key, value, expires, false)
+	seq := uint64(0)
+	if err == nil {
+		s.syncSeq++
+		seq = s.syncSeq
+	}
+	if sync {
+		s.watchers.seal(held)
+	}
+	hooked := s.takeHooks()
+	s.muFile.Unlock()
+
+	if err == nil && sync {
+		err = s.syncTo(seq)
+	}
+	if sync {
+		s.watchers.release(held, err == nil)
+	}
+	if err != nil {
+		return err
+	}
+	s.runHooks(hooked)
+	return nil
+}
+
+// syncTo syncs the database file, unless it's already been synced since the
+// write numbered seq by syncSeq. While one writer syncs, the writers that
+// wrote after it wait, then the first of them syncs once for all of them.
+func (s *Storage) syncTo(seq uint64) error {
+	if s.mem {
+		s.muFile.Lock()
+		defer s.muFile.Unlock()
+		return s.unprotectedSync()
+	}
+
+	s.muSync.Lock()
+	defer s.muSync.Unlock()
+	if s.synced >= seq {
+		// another writer synced our write while we waited
+		return nil
+	}
+
+	s.muFile.Lock()
+	if err := s.unprotectedFlush(); err != nil {
+		s.muFile.Unlock()
+		return err
+	}
+	f, target := s.file, s.syncSeq
+	writes := atomic.LoadUint64(&s.writeCountSync)
+	s.muFile.Unlock()
+
+	// sync without the file lock, so other writers can write in the meantime
+	start := time.Now()
+	if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		s.log.Printf("bugfruit: syncing %s failed after %v: %v", s.name, time.Since(start), err)
+		return fmt.Errorf("syncing %s: %w", s.name, err)
+	}
+	// a file closed in the meantime was synced first, by Close, or by a vacuum
+	// that swapped in a synced copy of it
+	s.log.Printf("bugfruit: synced %d writes to %s in %v", writes, s.name, time.Since(start))
+	s.synced = target
+
+	// the writes made since f was flushed still need syncing
+	s.muFile.Lock()
+	if wcs := atomic.LoadUint64(&s.writeCountSync); wcs > writes {
+		atomic.StoreUint64(&s.writeCountSync, wcs-writes)
+	} else {
+		atomic.StoreUint64(&s.writeCountSync, 0)
+	}
+	s.muFile.Unlock()
+	return nil
+}
+
+// unprotectedSet is set without the closed check or the file lock.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedSet(key string, value []byte, expires int64, sync bool) error {
+	if err := s.checkSize(key, value); err != nil {
+		return err
+	}
+	if d, exists := s.data.Load(key); exists {
+		if s.config.ReuseSpace {
+			if ok, err := s.overwriteDatum(d, value, expires); err != nil {
+				return fmt.Errorf("overwriting datum: %w", err)
+			} else if ok && sync {
+				return s.unprotectedSync()
+			} else if ok {
+				return nil
+			}
+		}
+		if err := s.reclaimSpace(d); err != nil {
+			return fmt.Errorf("reclaiming datum space: %w", err)
+		}
+	}
+	if err := s.appendDatum(key, value, expires); err != nil {
+		return err
+	}
+	if sync {
+		return s.unprotectedSync()
+	}
+	return nil
+}
+
+// checkSize returns ErrKeyTooLarge or ErrValueTooLarge if the key or value is
+// larger than the config allows, or than the file format can hold.
+func (s *Storage) checkSize(key string, value []byte) error {
+	maxKey := maxSize
+	if s.config.MaxKeySize != 0 && uint64(s.config.MaxKeySize) < maxKey {
+		maxKey = uint64(s.config.MaxKeySize)
+	}
+	return checkSize(key, value, maxKey, s.MaxValueSize())
+}
+
+// MaxValueSize returns the most bytes a value can be set to: the configured
+// MaxValueSize, or the most the file format can hold if there isn't one.
+func (s *Storage) MaxValueSize() uint64 {
+	if s.config.MaxValueSize != 0 && uint64(s.config.MaxValueSize) < maxSize {
+		return uint64(s.config.MaxValueSize)
+	}
+	return maxSize
+}
+
+// SetMulti sets all the key/value pairs in-memory and on disk, and syncs the
+// database file once after writing them all. Returns nil on success.
+//
+// The pairs are not written atomically: if the process crashes or an error is
+// returned partway through, some of the pairs may be set and others not.
+func (s *Storage) SetMulti(pairs map[string][]byte) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	// check every pair first, so that a pair that's too large doesn't leave
+	// the others half set
+	for k, v := range pairs {
+		if err := s.checkSize(k, v); err != nil {
+			return fmt.Errorf("setting '%s': %w", k, err)
+		}
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	writes := uint64(0)
+	now := s.now().UnixNano()
+	for k, v := range pairs {
+		n, err := s.writePair(k, v, 0, now)
+		writes += n
+		if err != nil {
+			return err
+		}
+	}
+	return s.incAndSync(writes, true)
+}
+
+// mergeResolves is how many times Merge resolves the conflicts of keys that are
+// written to while it resolves them before it gives up.
+const mergeResolves = 8
+
+// mergeEntry is a pair copied out of the other database by Merge.
+type mergeEntry struct {
+	value   []byte
+	expires int64
+}
+
+// Merge sets every live key/value pair from other in-memory and on disk, keeping
+// their expiry times, and syncs the database file once after writing them all.
+// If a key exists in both databases, conflict is called with the key, the value
+// in s, and the value in other, and the value it returns is set. A nil conflict
+// means the value in other wins. Returns nil on success.
+//
+// conflict is called without the file lock held, so it may use s. If a key is
+// written to in s after conflict is called for it, but before the merged pairs
+// are written, conflict is called again with the new value in s. If keys are
+// still being written to after conflict has been called 8 times for them, like
+// when conflict writes to the key it's called for, nothing is merged and
+// ErrMergeContended is returned.
+//
+// The pairs are copied out of other all at once, so writes to other while Merge
+// is taking place aren't merged. Like SetMulti, the pairs are not written
+// atomically.
+func (s *Storage) Merge(other *Storage, conflict func(key string, a, b []byte) []byte) error {
+	if s.isClosed() || other.isClosed() {
+		return ErrDBClosed
+	}
+
+	ds := make([]*datum, 0, other.data.Len())
+	now := other.now()
+	other.data.Range(func(k string, d *datum) bool {
+		if d.Deleted() != byte(1) && !d.expired(now) {
+			ds = append(ds, d)
+		}
+		return true
+	})
+	entries := make(map[string]mergeEntry, len(ds))
+	for _, d := range ds {
+		v, ok, err := other.value(d)
+		if err != nil {
+			return fmt.Errorf("merging '%s': %w", d.key, err)
+		} else if ok {
+			entries[d.key] = mergeEntry{value: v, expires: d.meta.expires}
+		}
+	}
+
+	if conflict == nil {
+		s.muFile.Lock()
+		defer s.unlockFile()
+		return s.unprotectedMerge(entries, nil)
+	}
+
+	// resolve the conflicts without the file lock, so conflict can use s, then
+	// resolve again the ones whose keys were written to in the meantime
+	merged := make(map[string][]byte, len(entries))
+	seqs := make(map[string]uint64, len(entries)) // of the values in s merged, or 0
+	toResolve := make([]string, 0, len(entries))
+	for k := range entries {
+		toResolve = append(toResolve, k)
+	}
+	for try := 1; ; try++ {
+		for _, k := range toResolve {
+			merged[k], seqs[k] = entries[k].value, 0
+			d, ok := s.load(k)
+			if !ok {
+				continue
+			}
+			cur, ok, err := s.value(d)
+			if err != nil {
+				return fmt.Errorf("merging '%s': %w", k, err)
+			} else if ok {
+				merged[k], seqs[k] = conflict(k, cur, entries[k].value), d.meta.seq
+			}
+		}
+
+		s.muFile.Lock()
+		if s.isClosed() {
+			s.unlockFile()
+			return ErrDBClosed
+		}
+		toResolve = toResolve[:0]
+		for k, seq := range seqs {
+			if d, ok := s.load(k); ok && d.meta.seq != seq || !ok && seq != 0 {
+				toResolve = append(toResolve, k)
+			}
+		}
+		if len(toResolve) == 0 {
+			defer s.unlockFile()
+			return s.unprotectedMerge(entries, merged)
+		}
+		s.unlockFile()
+		if try == mergeResolves {
+			return fmt.Errorf("%w: %d keys", ErrMergeContended, len(toResolve))
+		}
+	}
+}
+
+// unprotectedMerge writes the pairs for Merge, with the values in merged if
+// there are any.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedMerge(entries map[string]mergeEntry, merged map[string][]byte) error {
+	writes := uint64(0)
+	modTime := s.now().UnixNano()
+	for k, e := range entries {
+		if v, ok := merged[k]; ok {
+			e.value = v
+		}
+		n, err := s.writePair(k, e.value, e.expires, modTime)
+		writes += n
+		if err != nil {
+			return fmt.Errorf("merging '%s': %w", k, err)
+		}
+	}
+	return s.incAndSync(writes, true)
+}
+
+// writePair marks the datum for a key deleted if it exists, and writes a new
+// datum for the key/value pair that expires at the Unix nanosecond timestamp
+// expires, without counting the writes towards a sync or vacuum. It returns how
+// many records it wrote.
+// It is NOT thread safe without external file locking.
+func (s *Storage) writePair(key string, value []byte, expires, modTime int64) (writes uint64, err error) {
+	if err := s.checkSize(key, value); err != nil {
+		return writes, err
+	}
+	// the datum stays in the in-memory map, where readers may see it, until
+	// the new one replaces it
+	if d, exists := s.data.Load(key); exists {
+		if err := s.writeDeletedByte(d.deletedCopy()); err != nil {
+			return writes, fmt.Errorf("reclaiming datum space: updating db file: %w", err)
+		}
+		writes++
+	}
+
+	d := newDatum()
+	if err := d.Set(key, value); err != nil {
+		return writes, fmt.Errorf("setting new datum: %w", err)
+	}
+	d.meta.expires = expires
+	d.meta.modTime = modTime
+	err = s.writeDatum(d)
+	s.storeDatum(d)
+	atomic.AddUint64(&s.sets, 1)
+	if err != nil {
+		return writes, err
+	}
+	return writes + 1, nil
+}
+
+// DeleteMulti deletes all the keys in-memory and on disk, syncs the database
+// file once after deleting them all, and returns how many keys were deleted.
+// Keys that don't exist are skipped.
+//
+// The keys are not deleted atomically: if the process crashes or an error is
+// returned partway through, some of the keys may be deleted and others not.
+func (s *Storage) DeleteMulti(keys []string) (int, error) {
+	if s.isClosed() {
+		return 0, ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	deleted := 0
+	for _, k := range keys {
+		if d, exists := s.data.LoadAndDelete(k); exists {
+			atomic.AddUint64(&s.deletes, 1)
+			d.MarkDeleted()
+			if err := s.writeDeletedByte(d); err != nil {
+				return deleted, fmt.Errorf("reclaiming datum space: updating db file: %w", err)
+			}
+			deleted++
+		}
+	}
+	return deleted, s.incAndSync(uint64(deleted), deleted > 0)
+}
+
+// DeletePrefix deletes every key that starts with prefix in-memory and on disk,
+// syncs the database file once after deleting them all, and returns how many
+// live keys were deleted. The keys are deleted in batches, with the file lock
+// released between them so other writes can go on, and a key with the prefix
+// set while it runs may or may not be deleted. Like any delete, the vacuum
+// worker is notified if the deletes leave the file fragmented past the
+// VacuumFragmentationThreshold.
+//
+// Like DeleteMulti, the keys are not deleted atomically.
+func (s *Storage) DeletePrefix(prefix string) (int, error) {
+	if s.isClosed() {
+		return 0, ErrDBClosed
+	}
+
+	var keys []string
+	s.rangePrefix(prefix, func(k string, d *datum) {
+		keys = append(keys, k)
+	})
+
+	deleted, writes := 0, uint64(0)
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > rangeBatchSize {
+			batch = batch[:rangeBatchSize]
+		}
+		keys = keys[len(batch):]
+
+		s.muFile.Lock()
+		now := s.now()
+		n := uint64(0)
+		for _, k := range batch {
+			if d, exists := s.data.LoadAndDelete(k); exists {
+				atomic.AddUint64(&s.deletes, 1)
+				if !d.expired(now) {
+					deleted++
+				}
+				d.MarkDeleted()
+				if err := s.writeDeletedByte(d); err != nil {
+					s.unlockFile()
+					return deleted, fmt.Errorf("reclaiming datum space: updating db file: %w", err)
+				}
+				n++
+			}
+		}
+		writes += n
+		err := s.incAndSync(n, len(keys) == 0 && writes > 0)
+		s.unlockFile()
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// SetIfAbsent sets the key/value pair, like Set, if the key doesn't exist, and
+// returns whether it did. No other write can happen between the check and the
+// set.
+func (s *Storage) SetIfAbsent(key string, value []byte) (bool, error) {
+	if s.isClosed() {
+		return false, ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	if d, ok := s.data.Load(key); ok && !d.expired(s.now()) {
+		return false, nil
+	}
+	if err := s.unprotectedSet(key, value, 0, false); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetOrSet returns a copy of the key's value if it exists, and otherwise sets
+// the key/value pair, like Set, and returns a copy of value. The bool reports
+// whether the key already existed. No other write can happen between the check
+// and the set.
+func (s *Storage) GetOrSet(key string, value []byte) ([]byte, bool, error) {
+	if s.isClosed() {
+		return nil, false, ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	if d, ok := s.data.Load(key); ok && !d.expired(s.now()) {
+		v, err := s.unprotectedValue(d)
+		if err != nil {
+			return nil, false, err
+		}
+		return v, true, nil
+	}
+	if err := s.unprotectedSet(key, value, 0, false); err != nil {
+		return nil, false, err
+	}
+	v := make([]byte, len(value))
+	copy(v, value)
+	return v, false, nil
+}
+
+// CompareAndSwap sets the key to new, like Set, if its current value is equal
+// to old, and returns whether it did. A missing key has a nil value, so an old
+// value of nil or empty swaps a missing key. No other write can happen between
+// the compare and the swap.
+func (s *Storage) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	if s.isClosed() {
+		return false, ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	if cur, _, err := s.unprotectedLoad(key); err != nil {
+		return false, err
+	} else if !bytes.Equal(cur, old) {
+		return false, nil
+	}
+	if err := s.unprotectedSet(key, new, 0, false); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetIfVersion sets the key to value if its current version, as returned by
+// GetVersioned, is expected, and returns whether it did. A missing key has
+// version 0, so expected 0 sets the key only if it doesn't exist yet, or was
+// last set before versions were recorded. No other write can happen between
+// the compare and the set.
+//
+// A version is only ever given to one write while the Storage is open. Across
+// a reopen that holds too, unless the latest writes were deletes that were
+// vacuumed away.
+func (s *Storage) SetIfVersion(key string, value []byte, expected uint64) (bool, error) {
+	if s.isClosed() {
+		return false, ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	cur := uint64(0)
+	if d, ok := s.data.Load(key); ok && !d.expired(s.now()) {
+		cur = d.meta.seq
+	}
+	if cur != expected {
+		return false, nil
+	}
+	if err := s.unprotectedSet(key, value, 0, false); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CompareAndDelete deletes the key if its current value is equal to old, and
+// returns whether it did. A missing key is never deleted. No other write can
+// happen between the compare and the delete.
+func (s *Storage) CompareAndDelete(key string, old []byte) (bool, error) {
+	if s.isClosed() {
+		return false, ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	d, ok := s.data.Load(key)
+	if !ok || d.expired(s.now()) {
+		return false, nil
+	}
+	if cur, err := s.unprotectedValue(d); err != nil {
+		return false, err
+	} else if !bytes.Equal(cur, old) {
+		return false, nil
+	}
+	s.data.LoadAndDelete(key)
+	atomic.AddUint64(&s.deletes, 1)
+	if err := s.reclaimSpace(d); err != nil {
+		return false, fmt.Errorf("reclaiming datum space: %w", err)
+	}
+	return true, nil
+}
+
+// Pop deletes the key, and returns a copy of its value and whether it existed.
+// No other write can happen between reading and deleting the value.
+func (s *Storage) Pop(key string) ([]byte, bool, error) {
+	if s.isClosed() {
+		return nil, false, ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	d, ok := s.data.Load(key)
+	if !ok || d.expired(s.now()) {
+		return nil, false, nil
+	}
+	v, err := s.unprotectedValue(d)
+	if err != nil {
+		return nil, false, err
+	}
+	s.data.LoadAndDelete(key)
+	atomic.AddUint64(&s.deletes, 1)
+	if err := s.reclaimSpace(d); err != nil {
+		return nil, false, fmt.Errorf("reclaiming datum space: %w", err)
+	}
+	return v, true, nil
+}
+
+// RenameKey moves the value of oldKey to newKey, keeping its expiry, and
+// deletes oldKey. If newKey exists, its value is overwritten. It returns
+// ErrKeyNotFound if oldKey doesn't exist. No other write can happen in between,
+// and newKey is set before oldKey is deleted, so a concurrent reader finds at
+// least one of them. If the process crashes partway through, both keys may
+// exist when the database is next opened.
+func (s *Storage) RenameKey(oldKey, newKey string) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	d, ok := s.data.Load(oldKey)
+	if !ok || d.expired(s.now()) {
+		return ErrKeyNotFound
+	}
+	if oldKey == newKey {
+		return nil
+	}
+	v, err := s.unprotectedValue(d)
+	if err != nil {
+		return err
+	}
+
+	writes, err := s.writePair(newKey, v, d.meta.expires, s.now().UnixNano())
+	if err != nil {
+		return fmt.Errorf("setting '%s': %w", newKey, err)
+	}
+	s.data.LoadAndDelete(oldKey)
+	atomic.AddUint64(&s.deletes, 1)
+	d.MarkDeleted()
+	if err := s.writeDeletedByte(d); err != nil {
+		return fmt.Errorf("deleting '%s': updating db file: %w", oldKey, err)
+	}
+	return s.incAndSync(writes+1, false)
+}
+
+// CopyKey sets dstKey to a copy of the value of srcKey, with the same expiry,
+// and leaves srcKey as it is. If dstKey exists, its value is overwritten. It
+// returns ErrKeyNotFound if srcKey doesn't exist. No other write can happen
+// between reading srcKey and setting dstKey.
+func (s *Storage) CopyKey(srcKey, dstKey string) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	d, ok := s.data.Load(srcKey)
+	if !ok || d.expired(s.now()) {
+		return ErrKeyNotFound
+	}
+	if srcKey == dstKey {
+		return nil
+	}
+	// the value is a copy, so the datums don't share it
+	v, err := s.unprotectedValue(d)
+	if err != nil {
+		return err
+	}
+
+	writes, err := s.writePair(dstKey, v, d.meta.expires, s.now().UnixNano())
+	if err != nil {
+		return fmt.Errorf("setting '%s': %w", dstKey, err)
+	}
+	return s.incAndSync(writes, false)
+}
+
+// Update calls fn with a copy of the key's value and whether it exists, and
+// then sets the key to the new value fn returns, keeping the key's expiry, or
+// deletes the key if fn returns true for delete. If fn returns an error, nothing
+// is written, and the error is returned. No other write can happen between
+// reading and writing the value, so fn must not call methods on the Storage.
+func (s *Storage) Update(key string, fn func(old []byte, exists bool) (new []byte, delete bool, err error)) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	var old []byte
+	d, exists := s.data.Load(key)
+	if exists && d.expired(s.now()) {
+		exists = false
+	}
+	if exists {
+		var err error
+		if old, err = s.unprotectedValue(d); err != nil {
+			return err
+		}
+	}
+
+	new, del, err := fn(old, exists)
+	if err != nil {
+		return err
+	}
+
+	if del {
+		if exists {
+			s.data.LoadAndDelete(key)
+			atomic.AddUint64(&s.deletes, 1)
+			if err := s.reclaimSpace(d); err != nil {
+				return fmt.Errorf("reclaiming datum space: %w", err)
+			}
+		}
+		return nil
+	}
+
+	var expires int64
+	if exists {
+		expires = d.meta.expires
+	}
+	return s.unprotectedSet(key, new, expires, false)
+}
+
+// Increment adds delta to the key's value, stored as a little-endian int64, and
+// returns the new total. A missing key counts from 0. The key keeps its expiry.
+// No other write can happen between reading and writing the value.
+func (s *Storage) Increment(key string, delta int64) (int64, error) {
+	if s.isClosed() {
+		return 0, ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	var total int64
+	cur, expires, err := s.unprotectedLoad(key)
+	if err != nil {
+		return 0, err
+	}
+	if cur != nil {
+		if len(cur) != 8 {
+			return 0, fmt.Errorf("incrementing %q: %w: %d bytes", key, ErrNotCounter, len(cur))
+		}
+		total = int64(binary.LittleEndian.Uint64(cur))
+	}
+	total += delta
+
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(total))
+	if err := s.unprotectedSet(key, b, expires, false); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// Append appends suffix to the key's value, creating the key if it's missing,
+// and returns a copy of the new value. The key keeps its expiry. No other write
+// can happen between reading and writing the value.
+func (s *Storage) Append(key string, suffix []byte) ([]byte, error) {
+	if s.isClosed() {
+		return nil, ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	cur, expires, err := s.unprotectedLoad(key)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, 0, len(cur)+len(suffix))
+	value = append(append(value, cur...), suffix...)
+	if err := s.unprotectedSet(key, value, expires, false); err != nil {
+		return nil, err
+	}
+
+	v := make([]byte, len(value))
+	copy(v, value)
+	return v, nil
+}
+
+// unprotectedLoad returns the current value and expiry of a key, or nil and 0
+// if it's missing or expired. The value is not a copy, unless it had to be read
+// from the database file.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedLoad(key string) ([]byte, int64, error) {
+	d, ok := s.data.Load(key)
+	if !ok || d.expired(s.now()) {
+		return nil, 0, nil
+	}
+	if !d.spilled {
+		return d.value, d.meta.expires, nil
+	}
+	v, err := s.unprotectedValue(d)
+	return v, d.meta.expires, err
+}
+
+// Delete deletes the key/value pair in-memory and on disk.
+// Returns nil on success. If the key does not exist in the
+// database, error is nil.
+func (s *Storage) Delete(key string) error {
+	return s.delete(context.Background(), key)
+}
+
+// DeleteBytes is Delete for a key given as bytes.
+func (s *Storage) DeleteBytes(key []byte) error {
+	return s.Delete(string(key))
+}
+
+// DeleteCtx is Delete, but it gives up and returns ctx.Err() if ctx is done
+// before the delete can start, like while a vacuum is holding the file lock.
+func (s *Storage) DeleteCtx(ctx context.Context, key string) error {
+	return s.delete(ctx, key)
+}
+
+// delete deletes the key/value pair in-memory and on disk. It gives up if ctx
+// is done before it gets the file lock.
+func (s *Storage) delete(ctx context.Context, key string) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	if err := lockCtx(ctx, s.muFile.Lock, s.muFile.TryLock); err != nil {
+		return err
+	}
+	d, exists := s.data.LoadAndDelete(key)
+	if !exists {
+		s.muFile.Unlock()
+		return nil
+	}
+	atomic.AddUint64(&s.deletes, 1)
+	err := s.reclaimSpace(d)
+	s.unlockFile()
+
+	if err != nil {
+		return fmt.Errorf("reclaiming datum space: %w", err)
+	}
+	return nil
+}
+
+// Close and sync the database. Returns nil on success. The database file is
+// closed and unlocked even if flushing or syncing it fails. Calling Close on a
+// closed Storage does nothing, and returns nil.
+func (s *Storage) Close() error {
+	s.muFile.Lock()
+	if s.isClosed() {
+		s.muFile.Unlock()
+		return nil
+	}
+	s.unprotectedMarkClosed()
+	s.muFile.Unlock()
+	return s.closeFiles()
+}
+
+// unprotectedMarkClosed marks the Storage closed, so nothing more is written to
+// it, before its files are closed by closeFiles.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedMarkClosed() {
+	// notify vaccuum to stop vaccuuming, and everything else that the Storage
+	// is closed
+	if s.closed != nil {
+		close(s.closed)
+	}
+	s.watchers.close()
+	s.changes.close()
+	s.unprotectedEndReadSnapshots()
+}
+
+// closeFiles waits for the background workers of a Storage marked closed, then
+// flushes, syncs, and closes its files.
+func (s *Storage) closeFiles() error {
+	// wait for the background workers to finish before closing the file
+	s.workers.Wait()
+
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	// snapshots read the file until they're done
+	s.unprotectedWaitForSnapshots()
+	err := s.unprotectedFlush()
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err == nil {
+		if err := s.unprotectedWriteIndex(); err != nil {
+			s.log.Printf("bugfruit: writing index file: %v", err)
+		}
+	}
+
+	// the files are closed even if flushing or syncing failed, so the file
+	// lock is released, and the first error is returned
+	if err2 := s.file.Close(); err == nil {
+		err = err2
+	}
+	if s.wal != nil {
+		if err2 := s.wal.Close(); err == nil && err2 != nil {
+			err = fmt.Errorf("closing write-ahead log: %w", err2)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("closing Storage: %w", err)
+	}
+	return nil
+}
+
+// Name returns the name of the underlying data file. It is empty for a Storage
+// created by NewMemStorage.
+func (s *Storage) Name() string {
+	return s.name
+}
+
+// Snapshot takes a snapshot of the database at the time the function
+// is called and writes it to disk at the path indicated by snapname with
+// permissions perms. Returns nil on success.
+//
+// If the file indicated by snapname already exists, it will be deleted
+// before being written to.
+//
+// Writes go on while Snapshot is taking place, and don't change what's in the
+// snapshot, but the database file isn't vacuumed or cleared until it's done.
+// For a Storage that only lives in memory, no writes can occur while Snapshot
+// is taking place.
+func (s *Storage) Snapshot(snapname string, perms os.FileMode) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	// try to remove the existing file
+	if err := os.Remove(snapname); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if s.mem {
+		return s.memSnapshot(snapname, perms)
+	}
+	return s.writeSnapshotFile(snapname, perms, false)
+}
+
+// SnapshotWithDeleted is Snapshot, but the snapshot keeps the deleted and
+// expired records still in the database file too, so it's a copy of the file
+// as it was, rather than a compacted one. Only records that haven't been
+// vacuumed away are kept, so there are none right after a vacuum, and like any
+// database file, the snapshot drops them when it's vacuumed once it's opened.
+// A Storage that only lives in memory has no deleted records to keep, so for
+// it, SnapshotWithDeleted is the same as Snapshot.
+func (s *Storage) SnapshotWithDeleted(snapname string, perms os.FileMode) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	if err := os.Remove(snapname); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if s.mem {
+		return s.memSnapshot(snapname, perms)
+	}
+	return s.writeSnapshotFile(snapname, perms, true)
+}
+
+// writeSnapshotFile writes a snapshot of the database file to a new file at
+// snapname with permissions perms, with the deleted records too if withDeleted
+// is true, and syncs it.
+func (s *Storage) writeSnapshotFile(snapname string, perms os.FileMode, withDeleted bool) error {
+	f, err := os.OpenFile(snapname, os.O_RDWR|os.O_CREATE|os.O_EXCL, perms)
+	if err != nil {
+		return fmt.Errorf("opening snapshot file %s: %w", snapname, err)
+	}
+	w := bufio.NewWriterSize(f, 64<<10)
+	if _, err = s.writeSnapshot(w, withDeleted); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(snapname))
+	}
+	if err != nil {
+		os.Remove(snapname)
+		return fmt.Errorf("writing snapshot %s: %w", snapname, err)
+	}
+	return nil
+}
+
+// memSnapshot is Snapshot for a Storage that only lives in memory, which
+// writes the datums in the in-memory map to a new Storage at snapname.
+func (s *Storage) memSnapshot(snapname string, perms os.FileMode) error {
+	// make the new storage
+	snap, err := NewStorage(snapname, perms, &Config{
+		VacuumBatch:   0, // we don't need to vacuum if we don't write deleted data
+		FsyncBatch:    0, // we won't need to fsync until the end
+		Compression:   s.config.Compression,
+		EncryptionKey: s.config.EncryptionKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	// write the data in one pass under the read lock, so this is an atomic
+	// transaction. each datum is cloned so the snapshot's offsets don't clobber
+	// ours. the file lock is held too, to read values from the file
+	now := s.now()
+	s.muFile.Lock()
+	s.data.Range(func(k string, v *datum) bool {
+		if v.Deleted() != byte(1) && !v.expired(now) {
+			var c *datum
+			if c, err = s.unprotectedClone(v); err != nil {
+				return false
+			}
+			if err = snap.writeDatumToFile(c); err != nil {
+				err = fmt.Errorf("setting '%s': %w", k, err)
+				return false
+			}
+		}
+		return true
+	})
+	s.muFile.Unlock()
+	if err != nil {
+		snap.Close()
+		return err
+	}
+
+	return snap.Close()
+}
+
+// WriteTo writes the live key/value pairs in the database to w in the database
+// file format, so that writing them to a file makes a database NewStorage can
+// open. It returns the number of bytes written.
+//
+// Like with Snapshot, writes go on while WriteTo is taking place, except for a
+// Storage that only lives in memory.
+func (s *Storage) WriteTo(w io.Writer) (int64, error) {
+	if s.isClosed() {
+		return 0, ErrDBClosed
+	}
+	if !s.mem {
+		return s.writeSnapshot(w, false)
+	}
+
+	written := int64(0)
+	n, err := w.Write((&header{version: formatVersion}).Bytes())
+	written += int64(n)
+	if err != nil {
+		return written, fmt.Errorf("writing header: %w", err)
+	}
+
+	// encode clones, so the sizes of our datums aren't changed under the read
+	// lock. the file lock is held too, to read values from the file
+	now := s.now()
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+	s.data.Range(func(k string, v *datum) bool {
+		if v.Deleted() == byte(1) || v.expired(now) {
+			return true
+		}
+		c, err2 := s.unprotectedClone(v)
+		if err2 != nil {
+			err = err2
+			return false
+		}
+		e, err2 := s.encode(c)
+		if err2 != nil {
+			err = fmt.Errorf("encoding '%s': %w", k, err2)
+			return false
+		}
+		n, err2 := w.Write(s.recordBytes(e))
+		written += int64(n)
+		if err2 != nil {
+			err = fmt.Errorf("writing '%s': %w", k, err2)
+			return false
+		}
+		return true
+	})
+	return written, err
+}
+
+// RestoreFrom creates a database file indicated by filename from r, which reads
+// a stream in the database file format, like one written by WriteTo, and opens
+// it with the given options. Each record is checked as it's read, into a
+// temporary file next to filename, and if the stream is truncated or a record
+// is invalid, an error is returned and any existing file is left as it was.
+// Otherwise the restored file replaces any existing file, which must not be
+// open by another Storage, along with its write-ahead log and index file.
+func RestoreFrom(filename string, mode os.FileMode, r io.Reader, opts ...Option) (*Storage, error) {
+	dir := filepath.Dir(filename)
+	f, err := os.CreateTemp(dir, "bugfruit-restore")
+	if err != nil {
+		return nil, fmt.Errorf("creating temp file to restore %s: %w", filename, err)
+	}
+	// once it's renamed over it, the temp file is the db file
+	renamed := false
+	defer func() {
+		f.Close()
+		if !renamed {
+			os.Remove(f.Name())
+		}
+	}()
+	if err := restoreRecords(f, r); err != nil {
+		return nil, fmt.Errorf("restoring %s: %w", filename, err)
+	}
+	if err := f.Chmod(mode); err != nil {
+		return nil, fmt.Errorf("setting the mode of %s: %w", f.Name(), err)
+	}
+	if err := f.Sync(); err != nil {
+		return nil, fmt.Errorf("syncing %s: %w", f.Name(), err)
+	}
+
+	// keep a Storage from having the existing file open while it's replaced
+	old, err := os.OpenFile(filename, os.O_RDWR, mode)
+	if err == nil {
+		defer old.Close()
+		if err := lockFile(old); err != nil {
+			return nil, fmt.Errorf("locking database file %s: %w", filename, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("opening database file %s: %w", filename, err)
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return nil, fmt.Errorf("replacing %s: %w", filename, err)
+	}
+	renamed = true
+	// remove the write-ahead log and index file too, so its batches aren't
+	// replayed onto the restored file, and it isn't indexed by the old file's
+	for _, name := range []string{filename + walSuffix, filename + indexSuffix} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if err := syncDir(dir); err != nil {
+		return nil, fmt.Errorf("syncing the directory of %s: %w", filename, err)
+	}
+
+	return NewStorage(filename, mode, opts...)
+}
+
+// restoreRecords copies the header and every live record from r to w, checking
+// that each record is structurally valid and matches its checksum before it's
+// written.
+func restoreRecords(w io.Writer, r io.Reader) error {
+	buf := make([]byte, headerSize)
+	h := &header{}
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	} else if err := h.FromBytes(buf); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(buf); err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+
+	for off := uint64(headerSize); ; {
+		m, buf, err := readMeta(r, h.version, nil)
+		if err == io.EOF {
+			// a clean EOF at a record boundary
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("record at %d: %w: stream ended partway through metadata", off, ErrCorrupt)
+		} else if errors.Is(err, ErrInvalidMetaSlice) {
+			return fmt.Errorf("record at %d: converting metadata: %w", off, err)
+		} else if err != nil {
+			return fmt.Errorf("record at %d: reading metadata: %w", off, err)
+		}
+		msz := uint64(len(buf))
+
+		d := newDatum()
+		d.meta = m
+		if del := d.Deleted(); del > 1 {
+			return fmt.Errorf("record at %d: %w: invalid deleted byte %#x", off, ErrCorrupt, del)
+		}
+
+		totalSize := uint64(d.meta.keySize) + uint64(d.meta.valSize)
+		kv := make([]byte, totalSize)
+		if n, err := io.ReadFull(r, kv); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("record at %d: %w: stream ended after %d bytes, need %d for key/val data", off, ErrCorrupt, n, totalSize)
+		} else if err != nil {
+			return fmt.Errorf("record at %d: reading key/val data: %w", off, err)
+		}
+		if err := d.KeyValFromBytes(kv); err != nil {
+			return fmt.Errorf("record at %d: converting key/val data: %w", off, err)
+		}
+		if crc := d.Checksum(); crc != d.meta.crc {
+			return fmt.Errorf("record at %d: %w: expected %#x, got %#x", off, ErrChecksumMismatch, d.meta.crc, crc)
+		}
+
+		// deleted records are valid, but there's no need to restore them
+		if d.Deleted() == byte(0) {
+			if _, err := bw.Write(buf); err != nil {
+				return fmt.Errorf("record at %d: writing metadata: %w", off, err)
+			} else if _, err := bw.Write(kv); err != nil {
+				return fmt.Errorf("record at %d: writing key/val data: %w", off, err)
+			}
+		}
+		off += msz + totalSize
+	}
+
+	return bw.Flush()
+}
+
+// Vacuum compacts the database file by removing deleted data. Vacuuming happens
+// automatically every VacuumBatch writes, but Vacuum can be used to reclaim
+// space immediately. Returns nil on success, and ErrSnapshotActive while there's
+// a ReadSnapshot.
+func (s *Storage) Vacuum() error {
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	if err := s.unprotectedVacuum(); err != nil {
+		return fmt.Errorf("vacuuming %s: %w", s.name, err)
+	}
+	atomic.StoreUint64(&s.writeCountVacuum, 0)
+	return nil
+}
+
+// Clear deletes every key/value pair in-memory and on disk, by truncating the
+// database file down to its header, and syncs the database file. Returns nil on
+// success, and ErrSnapshotActive while there's a ReadSnapshot.
+func (s *Storage) Clear() error {
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	if err := s.unprotectedWaitForSnapshots(); err != nil {
+		return err
+	}
+	if err := s.unprotectedDropIndex(); err != nil {
+		return err
+	}
+	s.wbuf = s.wbuf[:0]
+	if err := s.file.Truncate(headerSize); err != nil {
+		return fmt.Errorf("truncating %s: %w", s.name, err)
+	}
+	if r, err := s.file.Seek(headerSize, 0); err != nil || r != headerSize {
+		return fmt.Errorf("tried to seek to index %d, got to %d: %w", headerSize, r, err)
+	}
+	s.idx = headerSize
+	s.dataBytes, s.deadBytes = 0, 0
+	s.free = make(map[uint64][]uint64)
+	s.tombstones, s.tombKeys = make(map[string]*datum), make(map[uint64]string)
+	keys := []string{}
+	s.data.Range(func(k string, _ *datum) bool {
+		keys = append(keys, k)
+		return true
+	})
+	for _, k := range keys {
+		s.seq++
+		s.unprotectedPublishChange(Change{Seq: s.seq, Op: OpDelete, Key: k})
+	}
+	s.data.Clear()
+	s.cache.clear()
+	atomic.StoreUint64(&s.writeCountVacuum, 0)
+	if err := s.unprotectedKeepSeq(0); err != nil {
+		return err
+	}
+	return s.unprotectedSync()
+}
+
+// Sync commits the database file to stable storage. Syncing happens
+// automatically every FsyncBatch writes, but Sync can be used to make sure
+// writes are durable at a specific point. Returns nil on success.
+func (s *Storage) Sync() error {
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+	if err := s.unprotectedSync(); err != nil {
+		return err
+	}
+	if err := s.unprotectedWriteIndex(); err != nil {
+		s.log.Printf("bugfruit: writing index file: %v", err)
+	}
+	return nil
+}
+
+// isClosed returns whether the Storage has been closed.
+func (s *Storage) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Verify checks that every record in the database file, including deleted
+// ones, is structurally valid and matches its checksum. It does not modify the
+// file. Returns nil if the file is valid, otherwise an error that reports the
+// offset of the first invalid record.
+func (s *Storage) Verify() error {
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	// there's nothing on disk to verify
+	if s.mem {
+		return nil
+	}
+
+	if err := s.unprotectedFlush(); err != nil {
+		return err
+	}
+	fi, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("statting '%s': %w", s.name, err)
+	}
+
+	if r, err := s.file.Seek(headerSize, 0); err != nil || r != headerSize {
+		return fmt.Errorf("tried to seek to index %d, got to %d: %w", headerSize, r, err)
+	}
+
+	_, _, err = checkRecords(bufio.NewReader(s.file), uint64(fi.Size()), s.version)
+	return err
+}
+
+// Repair truncates a partially written record from the end of the database file
+// indicated by filename, like one left behind if the process is killed in the
+// middle of a write. It returns the number of bytes discarded. Repair never
+// drops valid records: if there's an invalid record anywhere but the end of the
+// file, nothing is truncated and an error is returned.
+//
+// Repair must not be called on a database file that is open.
+func Repair(filename string) (int64, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("opening database file %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("statting '%s': %w", filename, err)
+	}
+	size := uint64(fi.Size())
+
+	buf := make([]byte, headerSize)
+	h := &header{}
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return 0, fmt.Errorf("reading header: %w", err)
+	} else if err := h.FromBytes(buf); err != nil {
+		return 0, fmt.Errorf("reading header: %w", err)
+	}
+
+	good, torn, err := checkRecords(bufio.NewReader(f), size, h.version)
+	if err == nil {
+		return 0, nil
+	} else if !torn {
+		return 0, fmt.Errorf("repairing %s: %w", filename, err)
+	}
+
+	if err := truncateTorn(filename, f, good); err != nil {
+		return 0, err
+	}
+	return int64(size - good), f.Close()
+}
+
+// truncateTorn truncates f, the database file indicated by filename, to good
+// bytes, which discards a torn write after the last intact record, and syncs
+// it. Its index file is removed first, since it won't match anymore.
+func truncateTorn(filename string, f file, good uint64) error {
+	if err := os.Remove(filename + indexSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing index file: %w", err)
+	}
+	if err := f.Truncate(int64(good)); err != nil {
+		return fmt.Errorf("truncating %s: %w", filename, err)
+	} else if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", filename, err)
+	}
+	return nil
+}
+
+// checkRecords reads every record from r, which is positioned at the first
+// record of a file in the given format version that holds size bytes, and checks
+// that each is structurally valid and matches its checksum. It returns the
+// offset just past the last valid record, and if a record is invalid, an error
+// describing it and whether it was a trailing record that runs past the end of
+// the file.
+func checkRecords(r io.Reader, size uint64, version uint16) (good uint64, torn bool, err error) {
+	good = headerSize
+	for off := uint64(headerSize); off < size; {
+		m, buf, err := readMeta(r, version, nil)
+		if err == io.ErrUnexpectedEOF {
+			return off, true, fmt.Errorf("record at %d: %w: %d bytes left, not enough for metadata", off, ErrCorrupt, size-off)
+		} else if errors.Is(err, ErrInvalidMetaSlice) {
+			return off, false, fmt.Errorf("record at %d: converting metadata: %w", off, err)
+		} else if err != nil {
+			return off, false, fmt.Errorf("record at %d: reading metadata: %w", off, err)
+		}
+		msz := uint64(len(buf))
+
+		d := newDatum()
+		d.meta = m
+		if del := d.Deleted(); del > 1 {
+			return off, false, fmt.Errorf("record at %d: %w: invalid deleted byte %#x", off, ErrCorrupt, del)
+		}
+
+		totalSize := uint64(d.meta.keySize) + uint64(d.meta.valSize)
+		if left := size - off - msz; left < totalSize {
+			return off, true, fmt.Errorf("record at %d: %w: %d bytes left, need %d for key/val data", off, ErrCorrupt, left, totalSize)
+		}
+
+		kv := make([]byte, totalSize)
+		if _, err := io.ReadFull(r, kv); err != nil {
+			return off, false, fmt.Errorf("record at %d: reading key/val data: %w", off, err)
+		}
+		if err := d.KeyValFromBytes(kv); err != nil {
+			return off, false, fmt.Errorf("record at %d: converting key/val data: %w", off, err)
+		}
+		if crc := d.Checksum(); crc != d.meta.crc {
+			return off, false, fmt.Errorf("record at %d: %w: expected %#x, got %#x", off, ErrChecksumMismatch, d.meta.crc, crc)
+		}
+
+		off += msz + totalSize
+		good = off
+	}
+
+	return good, false, nil
+}
+
+// appendDatum appends a datum that expires at the Unix nanosecond timestamp
+// expires, or never if expires is 0, to the end of the db file, and
+// adds/changes it in the in-memory map.
+// It is NOT thread safe without external file locking.
+func (s *Storage) appendDatum(key string, value []byte, expires int64) (err error) {
+	d := newDatum()
+	err = d.Set(key, value)
+	if err != nil {
+		return fmt.Errorf("setting new datum: %w", err)
+	}
+	d.meta.expires = expires
+	d.meta.modTime = s.now().UnixNano()
+
+	err = s.writeDatum(d)
+	s.storeDatum(d)
+	atomic.AddUint64(&s.sets, 1)
+	if err != nil {
+		return err
+	}
+	return s.incAndSync(1, false)
+}
+
+// overwriteDatum replaces the datum d in-memory and in the db file with a new
+// datum for its key with value, that expires at the Unix nanosecond timestamp
+// expires, if the new datum is the same size in the file. It returns whether it
+// did.
+// It is NOT thread safe without external file locking.
+func (s *Storage) overwriteDatum(d *datum, value []byte, expires int64) (bool, error) {
+	// a snapshot may still copy the datum
+	if len(s.snapshots) > 0 {
+		return false, nil
+	}
+	nd := newDatum()
+	if err := nd.Set(d.key, value); err != nil {
+		return false, fmt.Errorf("setting new datum: %w", err)
+	}
+	nd.meta.expires = expires
+	nd.meta.modTime = s.now().UnixNano()
+
+	e, err := s.encode(nd)
+	if err != nil {
+		return false, err
+	}
+	if nd.Size() != d.Size() {
+		return false, nil
+	}
+
+	// the sequence number is only used up once the datum is written
+	s.seq++
+	nd.meta.seq = s.seq
+	e.meta.seq = s.seq
+	nd.idx = d.idx
+	if err := s.writeAt(nd.idx, s.recordBytes(e)); err != nil {
+		return false, err
+	}
+	s.unprotectedPublishChange(Change{Seq: nd.meta.seq, Op: OpSet, Key: nd.key, Value: value})
+	s.storeDatum(nd)
+	atomic.AddUint64(&s.sets, 1)
+	return true, s.incAndSync(1, false)
+}
+
+// writeDatumToFile persists a datum to disk.
+func (s *Storage) writeDatumToFile(d *datum) error {
+	s.muFile.Lock()
+	defer s.unlockFile()
+	return s.unprotectedWriteDatumToFile(d)
+}
+
+// unprotectedWriteDatumToFile persists a datum to disk.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedWriteDatumToFile(d *datum) error {
+	if err := s.writeDatum(d); err != nil {
+		return err
+	}
+	return s.incAndSync(1, false)
+}
+
+// writeDatum writes a datum to the db file, without counting the write towards
+// syncing or vacuuming, and publishes it as a change.
+// It is NOT thread safe without external file locking.
+func (s *Storage) writeDatum(d *datum) error {
+	if err := s.writeRecord(d); err != nil {
+		return err
+	}
+	s.unprotectedPublishChange(Change{Seq: d.meta.seq, Op: OpSet, Key: d.key, Value: d.value})
+	return nil
+}
+
+// writeRecord writes the record of a datum to the db file, with the next
+// sequence number. The datum goes in the space of a deleted datum of the same
+// size if the config allows it and there is one, and otherwise at the end of
+// the file.
+// It is NOT thread safe without external file locking.
+func (s *Storage) writeRecord(d *datum) error {
+	if err := s.unprotectedDropIndex(); err != nil {
+		return err
+	}
+	s.seq++
+	d.meta.seq = s.seq
+	e, err := s.encode(d)
+	if err != nil {
+		return err
+	}
+	// the space a snapshot may still copy from isn't reused
+	if s.config.ReuseSpace && len(s.snapshots) == 0 {
+		if offs := s.free[d.Size()]; len(offs) > 0 {
+			d.idx = offs[len(offs)-1]
+			s.free[d.Size()] = offs[:len(offs)-1]
+			s.dropTombstoneAt(d.idx)
+			s.deadBytes -= d.Size()
+			return s.writeAt(d.idx, s.recordBytes(e))
+		}
+	}
+
+	if len(s.wbuf) > 0 {
+		// the buffered records end at the end of the file
+		d.idx = s.wbufStart + uint64(len(s.wbuf))
+	} else if offset, err := s.file.Seek(0, 2); err != nil {
+		return fmt.Errorf("seeking to end of file: %w", err)
+	} else {
+		d.idx = uint64(offset)
+	}
+	s.dataBytes = d.idx + d.Size() - headerSize
+
+	// buffer the record, and write the buffer once it's full
+	if size := s.config.WriteBufferSize; size > 0 {
+		if len(s.wbuf) == 0 {
+			s.wbufStart = d.idx
+		}
+		e.WriteTo(sliceWriter{&s.wbuf}) // appending can't fail
+		if len(s.wbuf) >= size {
+			return s.unprotectedFlush()
+		}
+		return nil
+	}
+
+	if n, err := s.file.Write(s.recordBytes(e)); err != nil {
+		return fmt.Errorf("writing to db file: %w", err)
+	} else if sz := d.Size(); n != int(sz) {
+		return fmt.Errorf("number of bytes written '%d' does not equal size '%d'", n, sz)
+	}
+
+	return nil
+}
+
+// writeAt overwrites the bytes at offset in the db file, or in the write buffer
+// if that's where they are.
+// It is NOT thread safe without external file locking.
+func (s *Storage) writeAt(offset uint64, b []byte) error {
+	if err := s.unprotectedDropIndex(); err != nil {
+		return err
 	}
-
-	s = &Storage{
-		name:   filename,
-		config: config,
-		data:   newMuMap(),
+	if len(s.wbuf) > 0 && offset >= s.wbufStart {
+		copy(s.wbuf[offset-s.wbufStart:], b)
+		return nil
 	}
 
-	if s.file, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE, mode); err != nil {
-		return nil, fmt.Errorf("opening database file %s: %w", filename, err)
+	if ret, err := s.file.Seek(int64(offset), 0); err != nil {
+		return fmt.Errorf("seeking to %d: %w", offset, err)
+	} else if ret != int64(offset) {
+		return fmt.Errorf("seeking to %d: sought to %d instead", offset, ret)
+	}
+	if n, err := s.file.Write(b); err != nil {
+		return fmt.Errorf("writing to db file: %w", err)
+	} else if n != len(b) {
+		return fmt.Errorf("number of bytes written '%d' does not equal size '%d'", n, len(b))
 	}
+	return nil
+}
 
-	for d, err := s.readDatum(); err != io.EOF; d, err = s.readDatum() {
+// encode returns a datum as it's written to file, with its value compressed and
+// its key and value encrypted if the config calls for it, and sets the datum's
+// size in the file. The datum returned is d itself if neither is called for.
+func (s *Storage) encode(d *datum) (*datum, error) {
+	e := d
+	if v, ok := compress(s.config.Compression, d.value); ok {
+		e = d.Clone()
+		if err := e.Set(d.key, v); err != nil {
+			return nil, fmt.Errorf("compressing: %w", err)
+		}
+		e.meta.flags |= flagGzip
+	}
+	if s.aead != nil {
+		// the sealed key and value keep the key's size, so the value's size in
+		// the metadata also covers the nonce and the authentication tag
+		sealed, err := seal(s.aead, append([]byte(e.key), e.value...))
 		if err != nil {
-			if err2 := s.Close(); err2 != nil {
-				return nil, fmt.Errorf("reading datum: while handling error '%v': encountered %w", err, err2)
-			}
-			return nil, fmt.Errorf("reading datum: %w", err)
+			return nil, fmt.Errorf("encrypting: %w", err)
 		}
-		if d != nil {
-			s.data.Store(d.key, d)
+		flags := e.meta.flags | flagEncrypted
+		e = d.Clone()
+		if err := e.Set(string(sealed[:e.meta.keySize]), sealed[e.meta.keySize:]); err != nil {
+			return nil, fmt.Errorf("encrypting: %w", err)
 		}
+		e.meta.flags = flags
 	}
-
-	return s, nil
-}
-
-// Get returns the value for a key and whether the key was found.
-func (s *Storage) Get(key string) ([]byte, bool) {
-	val, ok := s.data.Load(key)
-	if !ok {
-		return nil, ok
+	d.size = 0
+	if sz := e.Size(); sz != d.Size() {
+		d.size = sz
 	}
-	return val.value, ok
+	return e, nil
 }
 
-// Set sets the key/value pair in-memory and on disk.
-// Returns nil on success.
-func (s *Storage) Set(key string, value []byte) error {
-	if d, exists := s.data.Load(key); exists {
-		if err := s.reclaimSpace(d); err != nil {
-			return fmt.Errorf("reclaiming datum space: %w", err)
-		}
+// maxRecordBuffer is the largest the buffer recordBytes builds records in is
+// kept between calls, so one large record doesn't keep its memory around.
+const maxRecordBuffer = 64 << 10
+
+// recordBytes returns the bytes of the encoded datum e as it's written to file,
+// built in a buffer that's reused by the next call, so each write doesn't have
+// to allocate its own. The bytes are only valid until then.
+// It is NOT thread safe without external file locking.
+func (s *Storage) recordBytes(e *datum) []byte {
+	if cap(s.rec) > maxRecordBuffer {
+		s.rec = nil
 	}
-	return s.appendDatum(key, value)
+	s.rec = s.rec[:0]
+	e.WriteTo(sliceWriter{&s.rec}) // appending can't fail
+	return s.rec
 }
 
-// Delete deletes the key/value pair in-memory and on disk.
-// Returns nil on success. If the key does not exist in the
-// database, error is nil.
-func (s *Storage) Delete(key string) error {
-	if d, exists := s.data.LoadAndDelete(key); exists {
-		if err := s.reclaimSpace(d); err != nil {
-			return fmt.Errorf("reclaiming datum space: %w", err)
+// writeDeletedByte writes the deleted byte of a datum to file, without counting
+// the write towards syncing or vacuuming.
+// It is NOT thread safe without external file locking.
+func (s *Storage) writeDeletedByte(d *datum) error {
+	if err := s.unprotectedDropIndex(); err != nil {
+		return err
+	}
+	s.unprotectedNoteDeleted(d)
+	// records replaced by later ones found while the file is opened weren't
+	// deleted by a write then
+	deleting := s.opened && s.deleting(d)
+	s.noteTombstone(d)
+	// the datum hasn't been written to the file yet
+	if len(s.wbuf) > 0 && d.idx >= s.wbufStart {
+		s.wbuf[d.idx-s.wbufStart+deletedOffset] = d.Deleted()
+		s.freeSpace(d)
+		if deleting {
+			return s.unprotectedPublishDelete(d)
 		}
+		return nil
 	}
-	return nil
-}
 
-// Close and sync the database. Returns nil on success.
-func (s *Storage) Close() error {
-	s.muFile.Lock()
-	defer s.muFile.Unlock()
+	delIdx := int64(d.idx) + deletedOffset
+	if ret, err := s.file.Seek(delIdx, 0); err != nil {
+		return fmt.Errorf("seeking to %d: %w", d.idx, err)
+	} else if ret != delIdx {
+		return fmt.Errorf("seeking to %d: sought to %d instead", d.idx, ret)
+	}
 
-	// notify vaccuum to stop vaccuuming
-	if s.closed != nil {
-		close(s.closed)
+	if n, err := s.file.Write([]byte{d.Deleted()}); err != nil {
+		return fmt.Errorf("writing to db file: %w", err)
+	} else if n != 1 {
+		return fmt.Errorf("number of bytes written '%d' does not equal size '1'", n)
 	}
 
-	if err := s.file.Sync(); err != nil {
-		return fmt.Errorf("closing Storage: %w", err)
-	} else if err = s.file.Close(); err != nil {
-		return fmt.Errorf("closing Storage: %w", err)
+	s.freeSpace(d)
+	if deleting {
+		return s.unprotectedPublishDelete(d)
 	}
 	return nil
 }
 
-// Name returns the name of the underlying data file.
-func (s *Storage) Name() string {
-	return s.name
+// writeSeq writes seq over the sequence number in the record of d, so the
+// sequence number handed out to a delete or an undelete is in the file, and
+// isn't handed out again once it's reopened.
+// It is NOT thread safe without external file locking.
+func (s *Storage) writeSeq(d *datum, seq uint64) error {
+	b := make([]byte, 8)
+	byteOrder.PutUint64(b, seq)
+	if err := s.writeAt(d.idx+d.metaSize()-8, b); err != nil {
+		return fmt.Errorf("writing the sequence number of the record at %d: %w", d.idx, err)
+	}
+	return nil
 }
 
-// Snapshot takes a snapshot of the database at the time the function
-// is called and writes it to disk at the path indicated by snapname with
-// permissions perms. Returns nil on success.
-//
-// If the file indicated by snapname already exists, it will be deleted
-// before being written to.
-//
-// No writes can occur while Snapshot is taking place.
-func (s *Storage) Snapshot(snapname string, perms os.FileMode) error {
-	// make sure this is an atomic transaction
-	s.data.RLock()
-	defer s.data.RUnlock()
-
-	// try to remove the existing file
-	if err := os.Remove(snapname); err != nil && !errors.Is(err, os.ErrNotExist) {
-		return err
+// seqMarker returns the record of a deleted datum for no key with seq as its
+// sequence number. It's written to the database file when no record left in it
+// has the latest sequence number handed out, like when the latest writes were
+// deletes that were vacuumed away, so it isn't handed out again once the file
+// is reopened. It's skipped like any other deleted record, but for its
+// sequence number.
+// It is NOT thread safe without external file locking.
+func (s *Storage) seqMarker(seq uint64) ([]byte, error) {
+	d := newDatum()
+	d.meta.seq = seq
+	e, err := s.encode(d)
+	if err != nil {
+		return nil, err
 	}
+	e.MarkDeleted()
+	return s.recordBytes(e), nil
+}
 
-	// make the new storage
-	snap, err := NewStorage(snapname, perms, &Config{
-		VacuumBatch: 0, // we don't need to vacuum if we don't write deleted data
-		FsyncBatch:  0, // we won't need to fsync until the end
-	})
+// unprotectedKeepSeq appends a seqMarker to the end of the database file, if
+// no live datum has the latest sequence number handed out. liveSeq is the
+// highest sequence number of a live datum.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedKeepSeq(liveSeq uint64) error {
+	if s.mem || s.seq <= liveSeq {
+		return nil
+	}
+	b, err := s.seqMarker(s.seq)
 	if err != nil {
-		return err
+		return fmt.Errorf("writing the latest sequence number: %w", err)
 	}
-
-	// write the data
-	for k, v := range s.data.data {
-		if v.Deleted() != byte(1) {
-			if err := snap.writeDatumToFile(v); err != nil {
-				return fmt.Errorf("setting '%s': %w", k, err)
-			}
-		}
+	end := headerSize + s.dataBytes
+	if err := s.writeAt(end, b); err != nil {
+		return fmt.Errorf("writing the latest sequence number: %w", err)
 	}
-
-	return snap.Close()
+	n := uint64(len(b))
+	s.idx = end + n
+	s.dataBytes += n
+	s.deadBytes += n
+	return nil
 }
 
-// appendDatum appends a datum to the end of the db file, and
-// adds/changes it in the in-memory map.
-func (s *Storage) appendDatum(key string, value []byte) (err error) {
-	d := newDatum()
-	err = d.Set(key, value)
-	if err != nil {
-		return fmt.Errorf("setting new datum: %w", err)
+// freeSpace counts a deleted datum's bytes as dead, and if the config allows it,
+// keeps track of its space to reuse.
+// It is NOT thread safe without external file locking.
+func (s *Storage) freeSpace(d *datum) {
+	s.deadBytes += d.Size()
+	if s.config.ReuseSpace {
+		s.free[d.Size()] = append(s.free[d.Size()], d.idx)
 	}
+}
 
-	s.data.Store(key, d)
-	return s.writeDatumToFile(d)
+// unfreeSpace undoes freeSpace for the deleted record of size bytes at idx,
+// which is live again.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unfreeSpace(idx, size uint64) {
+	s.deadBytes -= size
+	offs := s.free[size]
+	for i, off := range offs {
+		if off == idx {
+			s.free[size] = append(offs[:i], offs[i+1:]...)
+			return
+		}
+	}
 }
 
-// writeDatumToFile persists a datum to disk.
-func (s *Storage) writeDatumToFile(d *datum) error {
-	s.muFile.Lock()
-	defer s.muFile.Unlock()
+// unprotectedFlush writes the buffered records to the end of the file.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedFlush() error {
+	if len(s.wbuf) == 0 {
+		return nil
+	}
 
-	// seek to the end of the file
-	offset, err := s.file.Seek(0, 2)
-	if err != nil {
-		return fmt.Errorf("seeking to end of file: %w", err)
+	if r, err := s.file.Seek(int64(s.wbufStart), 0); err != nil || r != int64(s.wbufStart) {
+		return fmt.Errorf("flushing %s: tried to seek to index %d, got to %d: %w", s.name, s.wbufStart, r, err)
 	}
+	if n, err := s.file.Write(s.wbuf); err != nil {
+		return fmt.Errorf("flushing %s: %w", s.name, err)
+	} else if n != len(s.wbuf) {
+		return fmt.Errorf("flushing %s: number of bytes written '%d' does not equal size '%d'", s.name, n, len(s.wbuf))
+	}
+	s.wbuf = s.wbuf[:0]
+	return nil
+}
 
-	d.idx = uint32(offset)
+// incAndSync adds n writes to the write counters for vacuuming and syncing.
+// If sync is true, or the number of writes is greater than or equal to the fsync
+// batch size, the file is synced, and the sync counter is reset to 0. If the
+// number of writes is greater than or equal to the vacuum batch size, or the file
+// is fragmented past the vacuum fragmentation threshold, the vacuum worker is
+// notified to vacuum the file. If the vacuum or fsync worker failed since the
+// last write, its error is returned.
+// It is NOT thread safe without external file locking.
+func (s *Storage) incAndSync(n uint64, sync bool) error {
+	if err := s.vacuumErr; err != nil {
+		s.vacuumErr = nil
+		return fmt.Errorf("vacuuming %s: %w", s.name, err)
+	}
+	if err := s.syncErr; err != nil {
+		s.syncErr = nil
+		return err
+	}
 
-	if n, err := s.file.Write(d.Bytes()); err != nil {
-		return fmt.Errorf("writing to db file: %w", err)
-	} else if sz := d.Size(); n != int(sz) {
-		return fmt.Errorf("number of bytes written '%d' does not equal size '%d'", n, sz)
+	wcs := atomic.AddUint64(&s.writeCountSync, n)
+	wcv := atomic.AddUint64(&s.writeCountVacuum, n)
+	if b := s.config.VacuumBatch; b > 0 && wcv >= b || s.fragmented() {
+		select {
+		case s.vacuumNeeded <- struct{}{}:
+		default:
+			// the vacuum worker has already been notified
+		}
+	}
+	if b := s.config.FsyncBatch; sync || b > 0 && wcs >= b {
+		return s.unprotectedSync()
 	}
+	return nil
+}
 
-	return s.incAndSync()
+// fragmented returns whether the fraction of dead bytes in the database file is
+// over the VacuumFragmentationThreshold. Expired records aren't counted as dead
+// until a vacuum drops them.
+// It is NOT thread safe without external file locking.
+func (s *Storage) fragmented() bool {
+	th := s.config.VacuumFragmentationThreshold
+	return th > 0 && s.fragmentation() > th
 }
 
-// writeDeletedByte writes the deleted byte of a datum to file.
-func (s *Storage) writeDeletedByte(d *datum) error {
-	s.muFile.Lock()
-	defer s.muFile.Unlock()
+// fragmentation returns the fraction of the database file's records that are
+// dead. A file whose only dead record is a seqMarker isn't fragmented, as
+// vacuuming it would just write the marker again.
+// It is NOT thread safe without external file locking.
+func (s *Storage) fragmentation() float64 {
+	if s.mem || s.dataBytes == 0 {
+		return 0
+	}
+	if s.markerSize == 0 {
+		if b, err := s.seqMarker(0); err == nil {
+			s.markerSize = uint64(len(b))
+		}
+	}
+	if s.deadBytes <= s.markerSize {
+		return 0
+	}
+	return float64(s.deadBytes) / float64(s.dataBytes)
+}
 
-	delIdx := int64(d.idx) + metaSize - 1
-	if ret, err := s.file.Seek(delIdx, 0); err != nil {
-		return fmt.Errorf("seeking to %d: %w", d.idx, err)
-	} else if ret != delIdx {
-		return fmt.Errorf("seeking to %d: sought to %d instead", d.idx, ret)
+// unprotectedSync flushes the write buffer and syncs the database file, and
+// resets the sync counter to 0.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedSync() error {
+	if err := s.unprotectedFlush(); err != nil {
+		return err
 	}
+	start := time.Now()
+	if err := s.file.Sync(); err != nil {
+		s.log.Printf("bugfruit: syncing %s failed after %v: %v", s.name, time.Since(start), err)
+		return fmt.Errorf("syncing %s: %w", s.name, err)
+	}
+	if !s.mem {
+		s.log.Printf("bugfruit: synced %d writes to %s in %v", atomic.LoadUint64(&s.writeCountSync), s.name, time.Since(start))
+	}
+	atomic.StoreUint64(&s.writeCountSync, 0)
+	return nil
+}
 
-	if n, err := s.file.Write([]byte{d.Deleted()}); err != nil {
-		return fmt.Errorf("writing to db file: %w", err)
-	} else if n != 1 {
-		return fmt.Errorf("number of bytes written '%d' does not equal size '1'", n)
+// reclaimSpace marks the record of a datum as deleted in the db file, and that
+// byte range as freed. The datum itself isn't changed.
+// It is NOT thread safe without external file locking.
+func (s *Storage) reclaimSpace(d *datum) error {
+	// d may still be in the in-memory map, where readers see it without the
+	// file lock, until the datum replacing it is stored
+	if err := s.writeDeletedByte(d.deletedCopy()); err != nil {
+		return fmt.Errorf("updating db file: %w", err)
 	}
 
-	return s.incAndSync()
+	return s.incAndSync(1, false)
 }
 
-// incAndSync increments the write counter for vacuuming and syncing.
-// If the number of writes is greater than or equal to the fsync batch size, the
-// file is synced, and the sync counter is reset to 0. If the number of writes is
-// greater than or equal to the vacuum batch size, the file is vacuumed, and the
-// vacuum counter is reset to 0.
-func (s *Storage) incAndSync() error {
-	wcs := atomic.AddUint64(&s.writeCountSync, 1)
-	wcv := atomic.AddUint64(&s.writeCountVacuum, 1)
-	if b := s.config.VacuumBatch; b > 0 && wcv >= b {
-		if err := s.vacuum(); err != nil {
-			return fmt.Errorf("vacuuming %s: %v", s.name, err)
-		}
-		atomic.StoreUint64(&s.writeCountVacuum, 0)
+// minScheduledFragmentation is the fraction of the database file that has to
+// be dead for a scheduled vacuum to run, so an idle file isn't rewritten every
+// VacuumInterval for nothing.
+const minScheduledFragmentation = 0.01
+
+// vacuumWorker vacuums the database file whenever incAndSync notifies it to,
+// and every VacuumInterval, until the Storage is closed.
+func (s *Storage) vacuumWorker() {
+	defer s.workers.Done()
+	var tick <-chan time.Time
+	if s.config.VacuumInterval > 0 {
+		t := time.NewTicker(s.config.VacuumInterval)
+		defer t.Stop()
+		tick = t.C
 	}
-	if b := s.config.FsyncBatch; b > 0 && wcs >= b {
-		if err := s.file.Sync(); err != nil {
-			return fmt.Errorf("syncing %s: %w", s.name, err)
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.vacuumNeeded:
+			s.muFile.Lock()
+			if !s.isClosed() {
+				s.unprotectedBackgroundVacuum()
+			}
+			s.muFile.Unlock()
+		case <-tick:
+			s.muFile.Lock()
+			if !s.isClosed() && s.fragmentation() >= minScheduledFragmentation {
+				s.unprotectedBackgroundVacuum()
+			}
+			s.muFile.Unlock()
 		}
-		atomic.StoreUint64(&s.writeCountSync, 0)
 	}
-	return nil
 }
 
-// reclaimSpace marks a datum as deleted, and marks that
-// byte range in the db file as freed.
-func (s *Storage) reclaimSpace(d *datum) error {
-	d.MarkDeleted()
-
-	if err := s.writeDeletedByte(d); err != nil {
-		return fmt.Errorf("updating db file: %w", err)
+// unprotectedBackgroundVacuum vacuums the database file for the vacuum worker,
+// keeping the error for the next write to return. While there's a read
+// snapshot, the vacuum is skipped, and tried again after the next write.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedBackgroundVacuum() {
+	err := s.unprotectedVacuum()
+	if errors.Is(err, ErrSnapshotActive) {
+		return
 	}
+	s.vacuumErr = err
+	atomic.StoreUint64(&s.writeCountVacuum, 0)
+}
 
-	return nil
+// fsyncWorker syncs the database file every interval if it's been written to
+// since it was last synced, until the Storage is closed.
+func (s *Storage) fsyncWorker(interval time.Duration) {
+	defer s.workers.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-t.C:
+			s.muFile.Lock()
+			if !s.isClosed() && atomic.LoadUint64(&s.writeCountSync) > 0 {
+				s.syncErr = s.unprotectedSync()
+			}
+			s.muFile.Unlock()
+		}
+	}
 }
 
-// vacuum compacts the database file by removing deleted datums.
-func (s *Storage) vacuum() error {
-	s.muFile.Lock()
-	defer s.muFile.Unlock()
+// unprotectedVacuum compacts the database file by removing deleted datums, and
+// updates the offsets of the live datums in the in-memory map to match the
+// compacted file. It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedVacuum() (err error) {
+	// there's nothing on disk to compact
+	if s.mem {
+		return nil
+	}
+	// the records being copied by snapshots mustn't move
+	if err := s.unprotectedWaitForSnapshots(); err != nil {
+		return err
+	}
+	if err := s.unprotectedDropIndex(); err != nil {
+		return err
+	}
 
-	// seek to beginning of file
-	if r, err := s.file.Seek(0, 0); err != nil || r != 0 {
-		return fmt.Errorf("tried to seek to index 0, got to %d: %w", r, err)
+	start := time.Now()
+	before := s.idx
+	s.log.Printf("bugfruit: vacuuming %s", s.name)
+	defer func() {
+		if err != nil {
+			s.log.Printf("bugfruit: vacuuming %s failed after %v: %v", s.name, time.Since(start), err)
+		} else {
+			took := time.Since(start)
+			s.vacuums++
+			s.vacuumTime += took
+			s.vacuumTimes = append(s.vacuumTimes, took)
+			if n := len(s.vacuumTimes); n > vacuumHistory {
+				s.vacuumTimes = append(s.vacuumTimes[:0], s.vacuumTimes[n-vacuumHistory:]...)
+			}
+			s.log.Printf("bugfruit: vacuumed %s in %v: %d bytes down to %d", s.name, took, before, s.idx)
+		}
+	}()
+
+	if err := s.unprotectedFlush(); err != nil {
+		return err
 	}
 
-	// create temp clean db file
-	cleaned, err := os.CreateTemp("", "bugfruit-cleanup")
+	// create temp clean db file, next to the db file unless configured
+	// otherwise, so it's on the same filesystem
+	dir := s.config.TempDir
+	if dir == "" {
+		dir = filepath.Dir(s.name)
+	}
+	cleaned, err := os.CreateTemp(dir, "bugfruit-cleanup")
 	if err != nil {
 		return fmt.Errorf("creating temp db file during vacuum: %w", err)
 	}
-	cleanedSize := 0
-	defer os.Remove(cleaned.Name())
+	// once it's been swapped in, the cleaned file is the db file
+	keepCleaned := false
+	defer func() {
+		if !keepCleaned {
+			cleaned.Close()
+			os.Remove(cleaned.Name())
+		}
+	}()
+
+	// seek to the first datum in the file
+	if r, err := s.file.Seek(headerSize, 0); err != nil || r != headerSize {
+		return fmt.Errorf("tried to seek to index %d, got to %d: %w", headerSize, r, err)
+	}
+	s.idx = headerSize
+
+	// write the header to the tmp file
+	h := &header{version: formatVersion}
+	if _, err := cleaned.Write(h.Bytes()); err != nil {
+		return fmt.Errorf("writing header to cleanup file: %w", err)
+	}
+	cleanedSize := uint64(headerSize)
+
+	// the live datums, with their old offsets, and their new offsets
+	type move struct {
+		d      *datum
+		newIdx uint64
+	}
+	moved := []move{}
+	// the expired datums, which are dropped from the file and the map
+	expired := []*datum{}
+	now := s.now()
+	liveSeq := uint64(0)
 
 	// read each non-deleted datum from file
+	defer func() { s.rbuf = nil }()
 	for d, err := s.readDatum(); err != io.EOF; d, err = s.readDatum() {
 		if err != nil {
 			return fmt.Errorf("reading datum: %w", err)
 		}
-		if d != nil {
-			toWrite := d.Bytes()
+		if d != nil && d.expired(now) {
+			expired = append(expired, d)
+		} else if d != nil {
+			e, err := s.encode(d)
+			if err != nil {
+				return err
+			}
+			toWrite := s.recordBytes(e)
 			n := len(toWrite)
-			cleanedSize += n
+			moved = append(moved, move{d: d, newIdx: cleanedSize})
+			cleanedSize += uint64(n)
 			// write our good datum to tmp file
-			if written, err := cleaned.Write(d.Bytes()); err != nil || written != n {
+			if written, err := cleaned.Write(toWrite); err != nil || written != n {
 				return fmt.Errorf("writing %d bytes to cleanup file, wrote %d: %w", n, written, err)
 			}
+			if d.meta.seq > liveSeq {
+				liveSeq = d.meta.seq
+			}
+		}
+	}
+
+	// the latest sequence number handed out stays in the file
+	deadSize := uint64(0)
+	if s.seq > liveSeq {
+		marker, err := s.seqMarker(s.seq)
+		if err != nil {
+			return fmt.Errorf("writing the latest sequence number: %w", err)
+		}
+		if _, err := cleaned.Write(marker); err != nil {
+			return fmt.Errorf("writing the latest sequence number to cleanup file: %w", err)
+		}
+		deadSize = uint64(len(marker))
+		cleanedSize += deadSize
+	}
+
+	// make the cleaned file durable, then swap it in for the db file, so a
+	// crash leaves either the old file or the new one intact, never a mix
+	if err := cleaned.Sync(); err != nil {
+		return fmt.Errorf("syncing cleanup file: %w", err)
+	}
+	// values are read from the file under the read lock, so hold the write lock
+	// until the datums point into the file that's swapped in
+	s.data.Lock()
+	defer s.data.Unlock()
+	swapped, err := s.swapFile(cleaned)
+	if err != nil {
+		return err
+	}
+	if swapped {
+		keepCleaned = true
+	} else if err := s.copyFrom(cleaned, cleanedSize); err != nil {
+		return err
+	}
+
+	// reset our index to point to the end of the file
+	s.idx = cleanedSize
+	s.version = h.version
+	s.dataBytes, s.deadBytes = cleanedSize-headerSize, deadSize
+	s.free = make(map[uint64][]uint64)
+	s.tombstones, s.tombKeys = make(map[string]*datum), make(map[uint64]string)
+
+	// point the live datums at their new offsets
+	for _, m := range moved {
+		if d, ok := s.data.data[m.d.key]; ok && d.idx == m.d.idx {
+			d.idx = m.newIdx
+			d.size = m.d.size
 		}
 	}
+	for _, e := range expired {
+		if d, ok := s.data.data[e.key]; ok && d.idx == e.idx {
+			s.data.unprotectedDelete(e.key)
+			s.cache.remove(e.key)
+		}
+	}
+
+	return nil
+}
+
+// swapFile renames cleaned over the database file, and makes it the file the
+// Storage reads and writes. It returns false, and leaves the database file as
+// it was, if cleaned can't be renamed over it, like when it's on another
+// filesystem.
+// It is NOT thread safe without external file locking.
+func (s *Storage) swapFile(cleaned *os.File) (bool, error) {
+	old, ok := s.file.(*os.File)
+	if !ok {
+		return false, nil
+	}
+	fi, err := old.Stat()
+	if err != nil {
+		return false, fmt.Errorf("statting '%s': %w", s.name, err)
+	}
+	if err := cleaned.Chmod(fi.Mode().Perm()); err != nil {
+		return false, fmt.Errorf("setting the mode of the cleanup file: %w", err)
+	}
+	// lock the cleaned file before it replaces the locked db file, so there's
+	// no moment the db file isn't locked
+	if err := lockFile(cleaned); err != nil {
+		return false, fmt.Errorf("locking the cleanup file: %w", err)
+	}
+	if err := os.Rename(cleaned.Name(), s.name); err != nil {
+		s.log.Printf("bugfruit: renaming the cleanup file over %s failed, copying it instead: %v", s.name, err)
+		return false, nil
+	}
+
+	s.file = cleaned
+	if err := old.Close(); err != nil {
+		s.log.Printf("bugfruit: closing the old %s after vacuuming failed: %v", s.name, err)
+	}
+	// make the rename itself durable. Until it is, a crash leaves the old file,
+	// which is still intact.
+	if err := syncDir(filepath.Dir(s.name)); err != nil {
+		s.log.Printf("bugfruit: syncing the directory of %s after vacuuming failed: %v", s.name, err)
+	}
+	return true, nil
+}
 
+// copyFrom overwrites the database file with the size bytes of cleaned. If the
+// process dies partway through, the database file is left half overwritten, so
+// it's only used when cleaned can't be renamed over the database file.
+// It is NOT thread safe without external file locking.
+func (s *Storage) copyFrom(cleaned *os.File, size uint64) error {
 	// seek back to the beginning of our cleaned tmp file, and regular db file
 	if sought, err := cleaned.Seek(0, 0); err != nil || sought != 0 {
 		return fmt.Errorf("seeking temporary cleanup file to 0, sought to %d: %w", sought, err)
@@ -303,78 +3086,105 @@ func (s *Storage) vacuum() error {
 	}
 
 	// truncate to the appropriate size
-	if err := s.file.Truncate(int64(cleanedSize)); err != nil {
+	if err := s.file.Truncate(int64(size)); err != nil {
 		return fmt.Errorf("truncating cleaned db file: %w", err)
 	}
-
-	// reset our index to point to the end of the file
-	s.idx = uint32(cleanedSize)
-
 	return nil
 }
 
 // fileSize returns the size of the underlying data file.
-func (s *Storage) fileSize() (uint32, error) {
+func (s *Storage) fileSize() (uint64, error) {
 	s.muFile.Lock()
 	defer s.muFile.Unlock()
 
+	if err := s.unprotectedFlush(); err != nil {
+		return 0, err
+	}
 	fi, err := s.file.Stat()
 	if err != nil {
 		return 0, fmt.Errorf("statting '%s': %w", s.Name(), err)
 	}
-	sz := fi.Size()
-	if sz > math.MaxUint32 {
-		return 0, fmt.Errorf("file size '%d' is too large", sz)
-	}
-	return uint32(sz), nil
+	return uint64(fi.Size()), nil
 }
 
 // readDatum reads one datum from the file in Storage.
 // It is NOT thread safe without external file locking.
 func (s *Storage) readDatum() (*datum, error) {
+	return s.readDatumFrom(s.file)
+}
+
+// readDatumFrom reads one datum from r, which reads the file in Storage at the
+// current index.
+// It is NOT thread safe without external file locking.
+func (s *Storage) readDatumFrom(r io.ReadSeeker) (*datum, error) {
 	// read in the meta
-	buf := make([]byte, metaSize)
-	n, err := s.file.Read(buf)
-	if err != nil && ((err != io.EOF) || (err == io.EOF && n != 0)) {
-		return nil, fmt.Errorf("reading database file: reading metadata: read %d bytes: %w", n, err)
-	} else if err == io.EOF {
+	// the metadata and then the key and value are read into the same buffer,
+	// which is reused for the next record
+	s.rbuf = growBuf(s.rbuf, maxMetaSize)
+	m, buf, err := readMeta(r, s.version, s.rbuf)
+	if err == io.EOF {
+		// a clean EOF at a record boundary
 		return nil, io.EOF
-	}
-
-	// convert to meta
-	m := &meta{}
-	if err = m.FromBytes(buf); err != nil {
+	} else if errors.Is(err, ErrInvalidMetaSlice) {
 		return nil, fmt.Errorf("reading database file: converting metadata: %w", err)
+	} else if err != nil {
+		return nil, fmt.Errorf("reading database file: reading metadata: %w", err)
+	}
+	msz := uint64(len(buf))
+	if m.seq > s.seq {
+		s.seq = m.seq
 	}
 
-	totalSize := m.keySize + m.valSize
+	totalSize := uint64(m.keySize) + uint64(m.valSize)
 
 	// if it's deleted, don't read it in
 	if m.deleted == byte(1) {
 		// skip to the end of the datum
-		if _, err := s.file.Seek(int64(totalSize), 1); err != nil {
+		if _, err := r.Seek(int64(totalSize), 1); err != nil {
 			return nil, fmt.Errorf("reading database file: skipping deleted: %w", err)
 		}
 		// update the current index
-		s.idx += totalSize + metaSize
+		s.idx += totalSize + msz
 		return nil, nil
 	}
 
 	// read total size bytes
-	buf = make([]byte, totalSize)
-	if n, err = s.file.Read(buf); err != nil && err != io.EOF {
-		return nil, fmt.Errorf("reading database file: reading key/val data: %w", err)
-	} else if uint32(n) != totalSize {
+	s.rbuf = growBuf(s.rbuf, int(totalSize))
+	buf = s.rbuf
+	if n, err := io.ReadFull(r, buf); err == io.ErrUnexpectedEOF || err == io.EOF {
 		return nil, fmt.Errorf("reading database file: reading key/val data: read %d bytes, need %d", n, totalSize)
+	} else if err != nil {
+		return nil, fmt.Errorf("reading database file: reading key/val data: %w", err)
 	}
 
-	// convert to datum
-	d := &datum{meta: m, idx: s.idx}
-	if err2 := d.KeyValFromBytes(buf); err2 != nil {
-		return nil, fmt.Errorf("reading database file: converting key/val data: %w", err2)
+	d, err := recordDatum(m, msz, buf, s.idx, s.aead)
+	if err != nil {
+		return nil, err
 	}
 
 	// update the current idx
-	s.idx += d.Size()
+	s.idx += msz + totalSize
+	return d, nil
+}
+
+// recordDatum converts the record at idx, with metadata m that took msz bytes
+// and key and value bytes buf, to a datum, checking its checksum and decoding
+// it with aead. The datum doesn't share memory with buf.
+func recordDatum(m *meta, msz uint64, buf []byte, idx uint64, aead cipher.AEAD) (*datum, error) {
+	d := &datum{meta: m, idx: idx}
+	if err := d.KeyValFromBytes(buf); err != nil {
+		return nil, fmt.Errorf("reading database file: converting key/val data: %w", err)
+	}
+	if crc := d.Checksum(); crc != m.crc {
+		return nil, fmt.Errorf("reading database file: datum at %d: %w: expected %#x, got %#x", d.idx, ErrChecksumMismatch, m.crc, crc)
+	}
+	// the key is already a copy, but the value is a view of the buffer
+	d.value = copyValue(d.value)
+	if err := d.decode(aead); err != nil {
+		return nil, fmt.Errorf("reading database file: datum at %d: %w", d.idx, err)
+	}
+	if sz := msz + uint64(len(buf)); sz != d.Size() {
+		d.size = sz
+	}
 	return d, nil
 }
@@ -2,12 +2,19 @@ package bugfruit
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/reesporte/bugfruit/test"
 )
@@ -16,7 +23,7 @@ import (
 // have been written to file does not result in unexpected errors.
 func TestReadDatum(t *testing.T) {
 	// initialize a Storage
-	s := &Storage{}
+	s := &Storage{version: formatVersion}
 	fname := filepath.Join(t.TempDir(), "test-read-datum")
 
 	// create a test db file
@@ -45,7 +52,7 @@ func TestReadDatum(t *testing.T) {
 	}
 	datums := []*datum{}
 	// add some data to the test db file
-	idx := uint32(0)
+	idx := uint64(0)
 	for _, kv := range kvs {
 		d := newDatum()
 		err = d.Set(kv.k, kv.v)
@@ -62,7 +69,7 @@ func TestReadDatum(t *testing.T) {
 		test.AssertNil(t, err)
 		test.AssertEqual(t, n, len(b))
 
-		idx += uint32(n)
+		idx += uint64(n)
 		datums = append(datums, d)
 	}
 
@@ -71,7 +78,7 @@ func TestReadDatum(t *testing.T) {
 	test.AssertNil(t, err)
 	test.AssertEqual(t, int(0), int(off))
 
-	curIdx := uint32(0)
+	curIdx := uint64(0)
 	test.AssertEqual(t, curIdx, s.idx)
 
 	for i, kv := range kvs {
@@ -115,18 +122,96 @@ func TestReadDatumCorruptVal(t *testing.T) {
 	test.AssertNil(t, err)
 	test.AssertEqual(t, len(b), n)
 
-	// seek the file back to the start
-	off, err := s.file.Seek(0, 0)
+	// seek the file back to the first datum
+	off, err := s.file.Seek(headerSize, 0)
 	test.AssertNil(t, err)
-	test.AssertEqual(t, int(0), int(off))
+	test.AssertEqual(t, int(headerSize), int(off))
 
 	// read the first datum
 	galadriel2, err := s.readDatum()
-	exp := fmt.Errorf("reading database file: reading key/val data: read %d bytes, need %d", len(b)-metaSize, len(b)-metaSize+4)
+	exp := fmt.Errorf("reading database file: reading key/val data: read %d bytes, need %d", len(b)-minMetaSize, len(b)-minMetaSize+4)
 	test.AssertEqual(t, exp.Error(), err.Error())
 	test.AssertEqual(t, (*datum)(nil), galadriel2)
 }
 
+// TestReadDatumCorruptChecksum ensures that reading a datum whose key/value
+// doesn't match its checksum results in a checksum mismatch error.
+func TestReadDatumCorruptChecksum(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "test-read-datum-corrupt-checksum")
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	// make corrupt data
+	bombadil := newDatum()
+	err = bombadil.Set("bombadil", []byte("Hey dol! merry dol!"))
+	test.AssertNil(t, err)
+	b := bombadil.Bytes()
+	b[len(b)-1] ^= 0xff
+
+	// write the corrupt data to file
+	n, err := s.file.Write(b)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, len(b), n)
+
+	// seek the file back to the first datum
+	off, err := s.file.Seek(headerSize, 0)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int(headerSize), int(off))
+
+	bombadil2, err := s.readDatum()
+	test.AssertEqual(t, true, errors.Is(err, ErrChecksumMismatch))
+	test.AssertEqual(t, (*datum)(nil), bombadil2)
+}
+
+// TestReadDatumCorruptMeta ensures that reading a datum with truncated metadata
+// results in an unexpected EOF error rather than a clean EOF.
+func TestReadDatumCorruptMeta(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "test-read-datum-corrupt-meta")
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	// make corrupt data
+	pippin := newDatum()
+	err = pippin.Set("pippin", []byte("Fool of a Took!"))
+	test.AssertNil(t, err)
+	b := pippin.Bytes()[:minMetaSize-2]
+
+	// write the corrupt data to file
+	n, err := s.file.Write(b)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, len(b), n)
+
+	// seek the file back to the first datum
+	off, err := s.file.Seek(headerSize, 0)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int(headerSize), int(off))
+
+	pippin2, err := s.readDatum()
+	test.AssertEqual(t, true, errors.Is(err, io.ErrUnexpectedEOF))
+	test.AssertEqual(t, (*datum)(nil), pippin2)
+}
+
+// TestReadDatumLargeVal ensures that large values are read back in full.
+func TestReadDatumLargeVal(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "test-read-datum-large-val")
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+
+	v := bytes.Repeat([]byte("One ring to rule them all. "), 1<<15)
+	test.AssertNil(t, s.Set("sauron", v))
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	got, ok := s.Get("sauron")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, v, got)
+}
+
 // TestNewStorage ensures that a new Storage can be created safely. It also ensures
 // that Storage will err if the file is not a regular file.
 func TestNewStorage(t *testing.T) {
@@ -136,8 +221,20 @@ func TestNewStorage(t *testing.T) {
 	test.AssertNil(t, err)
 	test.AssertNotEqual(t, (*Storage)(nil), s)
 	test.AssertEqual(t, fname, s.Name())
+	test.AssertNil(t, s.Set("gimli", []byte("son of gloin")))
+	s.Close()
+
+	// reopening the file it created
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	got, _ := s.Get("gimli")
+	test.AssertEqual(t, []byte("son of gloin"), got)
 	s.Close()
 
+	// bad path: a directory that doesn't exist
+	_, err = NewStorage(filepath.Join(t.TempDir(), "lothlorien", "galadriel"), 0644)
+	test.AssertEqual(t, true, errors.Is(err, os.ErrNotExist))
+
 	// bad path: writing on a directory
 	tdir := t.TempDir()
 	s, err = NewStorage(tdir, 0644, nil)
@@ -147,6 +244,100 @@ func TestNewStorage(t *testing.T) {
 	test.AssertEqual(t, exp.Error(), err.Error())
 }
 
+// TestNewStorageMmap ensures that opening a database file memory-mapped reads
+// the same data as opening it normally.
+func TestNewStorageMmap(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	// an empty file
+	s, err := NewStorage(fname, 0644, WithMmap(true))
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644, WithMmap(true))
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Set("elrond", []byte("The Ring cannot be destroyed, Gimli, son of Gloin.")))
+	test.AssertNil(t, s.Set("gimli", []byte("Let's see what it takes to destroy it.")))
+	test.AssertNil(t, s.Set("boromir", []byte("It is a gift.")))
+	test.AssertNil(t, s.Delete("boromir"))
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Close())
+
+	m, err := NewStorage(fname, 0644, WithMmap(true))
+	test.AssertNil(t, err)
+	test.AssertNil(t, m.Close())
+
+	test.AssertEqual(t, s.data.data, m.data.data)
+	test.AssertEqual(t, s.dataBytes, m.dataBytes)
+	test.AssertEqual(t, s.deadBytes, m.deadBytes)
+}
+
+// TestNewMemStorage ensures that a Storage created by NewMemStorage works
+// without a backing file, and can still be snapshotted to disk.
+func TestNewMemStorage(t *testing.T) {
+	s, err := NewMemStorage(WithVacuumBatch(2), WithFsyncBatch(1))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, "", s.Name())
+
+	k, v := "radagast", []byte("The Greenwood is sick, Gandalf.")
+	test.AssertNil(t, s.Set(k, v))
+	test.AssertNil(t, s.Set(k, v))
+	test.AssertNil(t, s.Set("saruman", []byte("Against the power of Mordor there can be no victory.")))
+	test.AssertNil(t, s.Delete("saruman"))
+	test.AssertNil(t, s.Vacuum())
+	test.AssertNil(t, s.Sync())
+
+	got, ok := s.Get(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, v, got)
+	test.AssertEqual(t, false, s.Has("saruman"))
+
+	snapname := filepath.Join(t.TempDir(), "snap")
+	test.AssertNil(t, s.Snapshot(snapname, 0644))
+	test.AssertNil(t, s.Close())
+
+	snap, err := NewStorage(snapname, 0644, nil)
+	test.AssertNil(t, err)
+	defer snap.Close()
+	got, ok = snap.Get(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, v, got)
+	test.AssertEqual(t, 1, snap.Len())
+}
+
+// TestNewStorageHeader ensures that NewStorage writes a header to new database
+// files, and rejects files without a valid header.
+func TestNewStorageHeader(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "gimli_and_galadriel")
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, formatVersion, s.version)
+	test.AssertEqual(t, uint64(headerSize), s.idx)
+	test.AssertNil(t, s.Close())
+
+	b, err := os.ReadFile(fname)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, (&header{version: formatVersion}).Bytes(), b)
+
+	// not a bugfruit file
+	test.AssertNil(t, os.WriteFile(fname, []byte("I amar prestar aen"), 0644))
+	_, err = NewStorage(fname, 0644, nil)
+	test.AssertEqual(t, true, errors.Is(err, ErrInvalidHeader))
+
+	// too short to be a bugfruit file
+	test.AssertNil(t, os.WriteFile(fname, []byte("BGF"), 0644))
+	_, err = NewStorage(fname, 0644, nil)
+	test.AssertEqual(t, true, errors.Is(err, ErrInvalidHeader))
+
+	// from the future
+	test.AssertNil(t, os.WriteFile(fname, (&header{version: formatVersion + 1}).Bytes(), 0644))
+	_, err = NewStorage(fname, 0644, nil)
+	test.AssertEqual(t, true, errors.Is(err, ErrUnsupportedVersion))
+}
+
 // TestIntegratedStorageWithData ensures that reading datum that have been written
 // to file does not result in unexpected errors.
 func TestIntegratedStorageWithData(t *testing.T) {
@@ -196,6 +387,9 @@ func createTestDBFile(t *testing.T) string {
 	file, err := os.OpenFile(fname, os.O_CREATE|os.O_RDWR, 0644)
 	test.AssertNil(t, err)
 
+	_, err = file.Write((&header{version: formatVersion}).Bytes())
+	test.AssertNil(t, err)
+
 	kvs := []struct {
 		k string
 		v []byte
@@ -242,17 +436,191 @@ func TestWriteDatumToFile(t *testing.T) {
 	err = d.Set("aragorn", []byte("He's trying to bring down the mountain!"))
 	test.AssertNil(t, err)
 
-	bytes := d.Bytes()
-
 	err = s.writeDatumToFile(d)
 	test.AssertNil(t, err)
+	test.AssertEqual(t, uint64(1), d.meta.seq)
+	bytes := d.Bytes()
 
 	s.Close()
 
 	b, err := os.ReadFile(fname)
 	test.AssertNil(t, err)
 
-	test.AssertEqual(t, b, bytes)
+	test.AssertEqual(t, b[headerSize:], bytes)
+}
+
+// TestWriteBuffer ensures that buffered records aren't written to the file until
+// the buffer fills up or the file is synced, and that deleting a buffered record
+// deletes it in the buffer.
+func TestWriteBuffer(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	d := newDatum()
+	test.AssertNil(t, d.Set("pippin", []byte("Fool of a Took!")))
+	s, err := NewStorage(fname, 0644, WithVacuumBatch(0), WithFsyncBatch(0), WithWriteBufferSize(3*int(d.Size())))
+	test.AssertNil(t, err)
+
+	size := func() int64 {
+		fi, err := os.Stat(fname)
+		test.AssertNil(t, err)
+		return fi.Size()
+	}
+
+	// the first two records are buffered
+	test.AssertNil(t, s.Set("pippin", []byte("Fool of a Took!")))
+	test.AssertNil(t, s.Set("pippin", []byte("Fool of a Took!")))
+	test.AssertEqual(t, int64(headerSize), size())
+	pippin, ok := s.Get("pippin")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("Fool of a Took!"), pippin)
+
+	// the third fills the buffer
+	test.AssertNil(t, s.Set("pippin", []byte("Fool of a Took!")))
+	test.AssertEqual(t, int64(headerSize+3*d.Size()), size())
+
+	// deleting a buffered record, and one that's in the file
+	test.AssertNil(t, s.Set("merry", []byte("Just throw me a mint!")))
+	test.AssertNil(t, s.Delete("merry"))
+	test.AssertNil(t, s.Delete("pippin"))
+	test.AssertEqual(t, int64(headerSize+3*d.Size()), size())
+
+	// syncing writes the buffer
+	test.AssertNil(t, s.Set("sam", []byte("I can't carry it for you, but I can carry you!")))
+	test.AssertNil(t, s.Sync())
+	sam, _ := s.data.Load("sam")
+	test.AssertEqual(t, int64(sam.idx+sam.Size()), size())
+	test.AssertNil(t, s.Verify())
+
+	// closing writes the buffer
+	test.AssertNil(t, s.Set("frodo", []byte("I wish the Ring had never come to me.")))
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+	keys := s.Keys()
+	sort.Strings(keys)
+	test.AssertEqual(t, []string{"frodo", "sam"}, keys)
+
+	// all three pippins and merry are dead
+	merry := newDatum()
+	test.AssertNil(t, merry.Set("merry", []byte("Just throw me a mint!")))
+	test.AssertEqual(t, 3*d.Size()+merry.Size(), s.deadBytes)
+}
+
+// TestReuseSpace ensures that same-size updates overwrite the deleted datum's
+// space instead of growing the file, in the file and in the write buffer.
+func TestReuseSpace(t *testing.T) {
+	for _, wbuf := range []int{0, 1 << 16} {
+		fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+		s, err := NewStorage(fname, 0644, WithVacuumBatch(0), WithReuseSpace(true), WithWriteBufferSize(wbuf))
+		test.AssertNil(t, err)
+
+		for i := 0; i < 10; i++ {
+			_, err := s.Increment("orcs", 1)
+			test.AssertNil(t, err)
+			test.AssertNil(t, s.Set("gimli", []byte(fmt.Sprintf("That's %d!", i))))
+		}
+		test.AssertNil(t, s.Set("legolas", []byte("It still only counts as one!")))
+		test.AssertNil(t, s.Sync())
+
+		orcs, _ := s.data.Load("orcs")
+		gimli, _ := s.data.Load("gimli")
+		legolas, _ := s.data.Load("legolas")
+		size, err := s.fileSize()
+		test.AssertNil(t, err)
+		test.AssertEqual(t, headerSize+orcs.Size()+gimli.Size()+legolas.Size(), size)
+		test.AssertEqual(t, uint64(0), s.deadBytes)
+
+		// a datum of a different size can't reuse the space
+		test.AssertNil(t, s.Set("gimli", []byte("Nobody tosses a dwarf!")))
+		test.AssertEqual(t, gimli.Size(), s.deadBytes)
+		test.AssertNil(t, s.Verify())
+		test.AssertNil(t, s.Close())
+
+		s, err = NewStorage(fname, 0644, nil)
+		test.AssertNil(t, err)
+		total, err := s.Increment("orcs", 0)
+		test.AssertNil(t, err)
+		test.AssertEqual(t, int64(10), total)
+		got, _ := s.Get("gimli")
+		test.AssertEqual(t, []byte("Nobody tosses a dwarf!"), got)
+		test.AssertEqual(t, 3, s.Len())
+		test.AssertNil(t, s.Close())
+	}
+}
+
+// TestOverwriteInPlace ensures that with ReuseSpace, same-size updates of a key
+// overwrite its datum where it is, so the file doesn't grow.
+func TestOverwriteInPlace(t *testing.T) {
+	for _, wbuf := range []int{0, 1 << 16} {
+		fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+		s, err := NewStorage(fname, 0644, WithVacuumBatch(0), WithReuseSpace(true), WithWriteBufferSize(wbuf))
+		test.AssertNil(t, err)
+
+		test.AssertNil(t, s.Set("faramir", []byte("Day 00 in Ithilien")))
+		first, _ := s.data.Load("faramir")
+		size, err := s.fileSize()
+		test.AssertNil(t, err)
+
+		for i := 1; i < 100; i++ {
+			test.AssertNil(t, s.Set("faramir", []byte(fmt.Sprintf("Day %02d in Ithilien", i))))
+			got, err := s.fileSize()
+			test.AssertNil(t, err)
+			test.AssertEqual(t, size, got)
+		}
+		last, _ := s.data.Load("faramir")
+		test.AssertEqual(t, first.idx, last.idx)
+		test.AssertEqual(t, uint64(0), s.deadBytes)
+		test.AssertNil(t, s.Verify())
+		test.AssertNil(t, s.Close())
+
+		s, err = NewStorage(fname, 0644, nil)
+		test.AssertNil(t, err)
+		got, _ := s.Get("faramir")
+		test.AssertEqual(t, []byte("Day 99 in Ithilien"), got)
+		test.AssertNil(t, s.Close())
+	}
+}
+
+// TestSync ensures that Sync syncs the database file and resets the sync
+// counter.
+func TestSync(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, &Config{FsyncBatch: 100})
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("boromir", []byte("One does not simply walk into Mordor.")))
+	test.AssertEqual(t, uint64(1), s.writeCountSync)
+
+	test.AssertNil(t, s.Sync())
+	test.AssertEqual(t, uint64(0), s.writeCountSync)
+
+	// syncing a closed file errs
+	test.AssertNil(t, s.Close())
+	test.AssertEqual(t, ErrDBClosed, s.Sync())
+}
+
+// TestSetSync ensures that SetSync sets the key/value pair and syncs the
+// database file.
+func TestSetSync(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, &Config{FsyncBatch: 100})
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.Set("samwise", []byte("I can't carry it for you, but I can carry you!")))
+	test.AssertEqual(t, uint64(1), s.writeCountSync)
+
+	k, v := "frodo", []byte("I will take the ring, though I do not know the way.")
+	test.AssertNil(t, s.SetSync(k, v))
+	test.AssertEqual(t, uint64(0), s.writeCountSync)
+
+	got, ok := s.Get(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, v, got)
 }
 
 // TestFileSize ensures that calling s.fileSize() returns the correct file size.
@@ -273,20 +641,51 @@ func TestFileSize(t *testing.T) {
 	// normal path
 	got, err := s.fileSize()
 	test.AssertNil(t, err)
-	test.AssertEqual(t, d.Size(), got)
+	test.AssertEqual(t, headerSize+d.Size(), got)
 
 	// weird path
 	err = s.Close()
 	test.AssertNil(t, err)
 
 	got, err = s.fileSize()
-	exp := fmt.Errorf("statting '%s': stat %s: use of closed file", fname, fname)
+	exp := fmt.Errorf("statting '%s': stat %s: %w", fname, fname, os.ErrClosed)
 	test.AssertEqual(t, exp.Error(), err.Error())
-	test.AssertEqual(t, uint32(0), got)
+	test.AssertEqual(t, uint64(0), got)
+}
+
+// TestLargeOffsets ensures that datums past the 4GB mark get the right offsets,
+// and that deleting them marks the right byte.
+func TestLargeOffsets(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	// make the file sparse, and larger than 4GB
+	offset := uint64(5 << 30)
+	test.AssertNil(t, s.file.Truncate(int64(offset)))
+
+	k, v := "elendil", []byte("Out of the Great Sea to Middle-earth I am come.")
+	test.AssertNil(t, s.Set(k, v))
+
+	d, ok := s.data.Load(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, offset, d.idx)
+
+	test.AssertNil(t, s.Delete(k))
+
+	// ensure the datum is marked as deleted
+	_, err = s.file.Seek(int64(offset)+deletedOffset, 0)
+	test.AssertNil(t, err)
+	b := make([]byte, 1)
+	_, err = s.file.Read(b)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, byte(1), b[0])
 }
 
 // TestReclaimSpace ensures that calling s.reclaimSpace on
-// a datum marks that datum as deleted.
+// a datum marks its record as deleted, but not the datum in the in-memory map.
 func TestReclaimSpace(t *testing.T) {
 	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
 
@@ -303,10 +702,10 @@ func TestReclaimSpace(t *testing.T) {
 	err = s.reclaimSpace(d)
 	test.AssertNil(t, err)
 
-	test.AssertEqual(t, byte(1), d.Deleted())
+	test.AssertEqual(t, byte(0), d.Deleted())
 
 	// ensure the datum is marked as deleted
-	_, err = s.file.Seek(int64(d.idx)+metaSize-1, 0)
+	_, err = s.file.Seek(int64(d.idx)+deletedOffset, 0)
 	test.AssertNil(t, err)
 
 	b := make([]byte, 1)
@@ -322,22 +721,26 @@ func TestReclaimSpace(t *testing.T) {
 func TestAppendDatum(t *testing.T) {
 	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
 
-	s, err := NewStorage(fname, 0644, nil)
+	now := time.Unix(3019, 0)
+	s, err := NewStorage(fname, 0644, WithClock(func() time.Time { return now }))
 	test.AssertNil(t, err)
 
 	k, v := "legolas", []byte("That is no orc horn.")
-	err = s.appendDatum(k, v)
+	err = s.appendDatum(k, v, 0)
 	test.AssertNil(t, err)
 
 	legolas := newDatum()
 	err = legolas.Set(k, v)
 	test.AssertNil(t, err)
+	legolas.meta.modTime = now.UnixNano()
+	legolas.meta.seq = 1
+	legolas.idx = headerSize
 
 	got, ok := s.data.Load("legolas")
 	test.AssertEqual(t, true, ok)
 	test.AssertEqual(t, legolas, got)
 
-	_, err = s.file.Seek(0, 0)
+	_, err = s.file.Seek(headerSize, 0)
 	test.AssertNil(t, err)
 
 	buf := make([]byte, legolas.Size())
@@ -347,143 +750,2673 @@ func TestAppendDatum(t *testing.T) {
 	test.AssertEqual(t, legolas.Bytes(), buf)
 }
 
-// TestDelete ensures that calling Delete on Storage
-// deletes the key/value pair.
-func TestDelete(t *testing.T) {
+// TestGetReturnsCopy ensures that modifying the value returned by Get does not
+// modify the stored value.
+func TestGetReturnsCopy(t *testing.T) {
 	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
 
 	s, err := NewStorage(fname, 0644, nil)
 	test.AssertNil(t, err)
+	defer s.Close()
 
-	k, v := "aragorn", []byte("You will suffer me.")
-
-	// deleting something that doesn't exist returns nil
-	err = s.Delete(k)
-	test.AssertNil(t, err)
-
-	// set the thing
+	k, v := "gollum", []byte("My precious.")
 	err = s.Set(k, v)
 	test.AssertNil(t, err)
 
-	// make sure it's there:
-	aragorn, ok := s.Get(k)
+	got, ok := s.Get(k)
 	test.AssertEqual(t, true, ok)
-	test.AssertEqual(t, v, aragorn)
+	got[0] = 'Y'
 
-	// delete it
-	err = s.Delete(k)
-	test.AssertNil(t, err)
-
-	// get it again, should be nil
-	aragorn, ok = s.Get(k)
-	test.AssertEqual(t, false, ok)
-	test.AssertEqual(t, []byte(nil), aragorn)
+	got, ok = s.Get(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("My precious."), got)
 }
 
-// TestVacuum ensures that s.vacuum compacts
-// the database file by removing deleted data.
-//
-// It also tests to a small extent that one can safely
-// and concurrently run Set/Delete operations on Storage.
-func TestVacuum(t *testing.T) {
+// TestKeys ensures that Keys returns the live keys in the database.
+func TestKeys(t *testing.T) {
 	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
-	// set ticks to 0 so that we can call vacuum manually
-	s, err := NewStorage(fname, 0644, &Config{VacuumBatch: 0})
+
+	s, err := NewStorage(fname, 0644, nil)
 	test.AssertNil(t, err)
+	defer s.Close()
 
-	expected := new(bytes.Buffer)
+	test.AssertEqual(t, []string{}, s.Keys())
 
-	type kv struct {
-		key string
-		val []byte
-	}
-	pairs := []kv{
-		{
-			key: "elrond",
-			val: []byte("Let him not vow to walk in the dark, who has not seen the nightfall."),
-		},
-		{
-			key: "tom",
-			val: []byte("Ring a ding dillo!"),
-		},
-		{
-			key: "sauron",
-			val: []byte("You cannot hide, I see you!"),
-		},
-		{
-			key: "gandalf",
-			val: []byte("Fly, you fools!"),
-		},
-		{
-			key: "faramir",
-			val: []byte("War will make corpses of us all."),
-		},
+	for _, k := range []string{"merry", "pippin", "sam"} {
+		test.AssertNil(t, s.Set(k, []byte("hobbit")))
 	}
+	test.AssertNil(t, s.Delete("pippin"))
 
-	toDelete := map[string]struct{}{
-		"sauron":  struct{}{},
-		"faramir": struct{}{},
-	}
+	keys := s.Keys()
+	sort.Strings(keys)
+	test.AssertEqual(t, []string{"merry", "sam"}, keys)
 
-	var wg sync.WaitGroup
-	order := make(chan kv, len(pairs))
+	// the slice is a copy
+	test.AssertNil(t, s.Delete("sam"))
+	test.AssertEqual(t, []string{"merry", "sam"}, keys)
+}
 
-	for _, pair := range pairs {
-		p := pair
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err := s.Set(p.key, p.val)
-			test.AssertNil(t, err)
-			order <- p
-		}()
+// TestSortedKeys ensures that SortedKeys returns the live keys in order, with
+// and without an ordered index.
+func TestSortedKeys(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		now := time.Unix(3019, 0)
+		s, err := NewMemStorage(WithOrdered(ordered), WithClock(func() time.Time { return now }))
+		test.AssertNil(t, err)
 
+		test.AssertEqual(t, []string{}, s.SortedKeys())
+
+		for _, k := range []string{"samwise", "rosie", "elanor", "frodo", "merry", "pippin", "goldilocks"} {
+			test.AssertNil(t, s.Set(k, []byte("gamgee")))
+		}
+		test.AssertNil(t, s.Delete("merry"))
+		test.AssertNil(t, s.SetWithTTL("pippin", []byte("took"), time.Minute))
+		now = now.Add(time.Hour)
+		test.AssertEqual(t, []string{"elanor", "frodo", "goldilocks", "rosie", "samwise"}, s.SortedKeys())
+
+		test.AssertNil(t, s.Clear())
+		test.AssertEqual(t, []string{}, s.SortedKeys())
+		test.AssertNil(t, s.Close())
 	}
+}
 
-	wg.Wait()
+// TestRangeKeys ensures that RangeKeys visits the live keys in the interval in
+// order, and stops when told to, with and without an ordered index.
+func TestRangeKeys(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		s, err := NewMemStorage(WithOrdered(ordered))
+		test.AssertNil(t, err)
 
-	// write the bytes to file in the order they come in
-	for i := 0; i < len(pairs); i++ {
-		p := <-order
-		if _, ok := toDelete[p.key]; !ok {
-			d := newDatum()
-			err := d.Set(p.key, p.val)
-			test.AssertNil(t, err)
-			expected.Write(d.Bytes())
+		for _, k := range []string{"age/1", "age/2", "age/3", "age/4", "ages", "beren", "luthien"} {
+			test.AssertNil(t, s.Set(k, []byte("value of "+k)))
+		}
+		test.AssertNil(t, s.Delete("age/2"))
+
+		visit := func(start, end string, limit int) []string {
+			var keys []string
+			test.AssertNil(t, s.RangeKeys(start, end, func(key string, value []byte) bool {
+				test.AssertEqual(t, []byte("value of "+key), value)
+				keys = append(keys, key)
+				return len(keys) < limit
+			}))
+			return keys
 		}
+		test.AssertEqual(t, []string{"age/1", "age/3", "age/4"}, visit("age/", "age0", 10))
+		test.AssertEqual(t, []string{"age/1", "age/3"}, visit("age/", "age0", 2))
+		test.AssertEqual(t, []string{"age/3", "age/4", "ages", "beren"}, visit("age/3", "beren\x00", 10))
+		test.AssertEqual(t, []string{"beren", "luthien"}, visit("b", "", 10))
+		test.AssertEqual(t, []string(nil), visit("m", "z", 10))
+
+		// more keys than fit in a batch
+		var want []string
+		for i := 0; i < 3*rangeBatchSize; i++ {
+			k := fmt.Sprintf("orc/%04d", i)
+			want = append(want, k)
+			test.AssertNil(t, s.Set(k, []byte("value of "+k)))
+		}
+		test.AssertEqual(t, want, visit("orc/", "orc0", len(want)+1))
+		test.AssertEqual(t, want[:rangeBatchSize+1], visit("orc/", "", rangeBatchSize+1))
+
+		// fn can write to the Storage
+		test.AssertNil(t, s.RangeKeys("", "", func(key string, value []byte) bool {
+			test.AssertNil(t, s.Delete(key))
+			return true
+		}))
+		test.AssertEqual(t, 0, s.Len())
+
+		test.AssertNil(t, s.Close())
+		test.AssertEqual(t, ErrDBClosed, s.RangeKeys("", "", func(string, []byte) bool { return true }))
 	}
+}
+
+// TestRangeKeysReverse ensures that RangeKeysReverse visits the live keys in
+// overwriteWhile overwrites keys in s with Set and Expire on another goroutine,
+// calling read each time until there have been n writes.
+func overwriteWhile(t *testing.T, s *Storage, keys []string, n int64, read func()) {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var writes int64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := keys[i%len(keys)]
+			if i%2 == 0 {
+				test.AssertNil(t, s.Set(key, []byte("overwritten")))
+			} else {
+				test.AssertNil(t, s.Expire(key, time.Hour))
+			}
+			atomic.AddInt64(&writes, 1)
+		}
+	}()
+
+	for atomic.LoadInt64(&writes) < n {
+		read()
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// TestRangeKeysConcurrentWrites ensures RangeKeys and RangeKeysReverse visit
+// every live key while other goroutines overwrite them, and don't race with the
+// writes.
+func TestRangeKeysConcurrentWrites(t *testing.T) {
+	s, err := NewMemStorage(WithOrdered(true))
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	keys := []string{}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("rohirrim-%02d", i))
+		test.AssertNil(t, s.Set(keys[i], []byte("rider")))
+	}
+	overwriteWhile(t, s, keys, 2000, func() {
+		for _, rangeKeys := range []func(string, string, func(string, []byte) bool) error{s.RangeKeys, s.RangeKeysReverse} {
+			visited := 0
+			test.AssertNil(t, rangeKeys("rohirrim-", "rohirrim.", func(string, []byte) bool {
+				visited++
+				return true
+			}))
+			test.AssertEqual(t, len(keys), visited)
+		}
+	})
+}
+
+// the interval in reverse order, with and without an ordered index.
+func TestRangeKeysReverse(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		s, err := NewMemStorage(WithOrdered(ordered))
+		test.AssertNil(t, err)
+
+		for _, k := range []string{"", "age/1", "age/2", "age/3", "age/4", "ages", "beren", "luthien"} {
+			test.AssertNil(t, s.Set(k, []byte("value of "+k)))
+		}
+		test.AssertNil(t, s.Delete("age/2"))
+		test.AssertNil(t, s.SetWithTTL("age/5", []byte("gone"), time.Nanosecond))
+
+		visit := func(start, end string, limit int) []string {
+			var keys []string
+			test.AssertNil(t, s.RangeKeysReverse(start, end, func(key string, value []byte) bool {
+				test.AssertEqual(t, []byte("value of "+key), value)
+				keys = append(keys, key)
+				return len(keys) < limit
+			}))
+			return keys
+		}
+		test.AssertEqual(t, []string{"age/4", "age/3", "age/1"}, visit("age/", "age0", 10))
+		test.AssertEqual(t, []string{"age/4", "age/3"}, visit("age/", "age0", 2))
+		test.AssertEqual(t, []string{"luthien", "beren"}, visit("b", "", 10))
+		test.AssertEqual(t, []string{"ages", "age/4", "age/3", "age/1", ""}, visit("", "beren", 10))
+		test.AssertEqual(t, []string(nil), visit("m", "z", 10))
+
+		// more keys than fit in a batch
+		var want []string
+		for i := 3*rangeBatchSize - 1; i >= 0; i-- {
+			k := fmt.Sprintf("orc/%04d", i)
+			want = append(want, k)
+			test.AssertNil(t, s.Set(k, []byte("value of "+k)))
+		}
+		test.AssertEqual(t, want, visit("orc/", "orc0", len(want)+1))
+		test.AssertEqual(t, want[:rangeBatchSize+1], visit("orc/", "", rangeBatchSize+1))
+		test.AssertNil(t, s.Close())
+	}
+}
+
+// TestMinMaxKey ensures MinKey and MaxKey skip expired keys, and report when
+// there are no keys.
+func TestMinMaxKey(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"unordered": {},
+		"ordered":   {WithOrdered(true)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewStorage(filepath.Join(t.TempDir(), "testing-testing-one-two-three"), 0600, opts...)
+			test.AssertNil(t, err)
+			defer s.Close()
+
+			_, ok := s.MinKey()
+			test.AssertEqual(t, false, ok)
+			_, ok = s.MaxKey()
+			test.AssertEqual(t, false, ok)
+
+			for _, k := range []string{"gwaihir", "landroval", "meneldor"} {
+				test.AssertNil(t, s.Set(k, []byte("eagle")))
+			}
+			test.AssertNil(t, s.SetWithTTL("alfirin", []byte("flower"), time.Nanosecond))
+			test.AssertNil(t, s.SetWithTTL("thorondor", []byte("eagle"), time.Nanosecond))
+			min, ok := s.MinKey()
+			test.AssertEqual(t, true, ok)
+			test.AssertEqual(t, "gwaihir", min)
+			max, ok := s.MaxKey()
+			test.AssertEqual(t, true, ok)
+			test.AssertEqual(t, "meneldor", max)
+
+			test.AssertNil(t, s.Delete("meneldor"))
+			max, _ = s.MaxKey()
+			test.AssertEqual(t, "landroval", max)
+		})
+	}
+}
+
+// TestScanPage ensures ScanPage pages through the live keys in sorted order,
+// and picks up keys set between pages.
+func TestScanPage(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"unordered": {},
+		"ordered":   {WithOrdered(true)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewStorage(filepath.Join(t.TempDir(), "testing-testing-one-two-three"), 0600, opts...)
+			test.AssertNil(t, err)
+			defer s.Close()
+
+			for _, k := range []string{"gloin", "balin", "dwalin", "fili", "kili", "thorin", "oin"} {
+				test.AssertNil(t, s.Set(k, []byte("dwarf")))
+			}
+			test.AssertNil(t, s.SetWithTTL("bifur", []byte("dwarf"), time.Nanosecond))
+			test.AssertNil(t, s.Delete("fili"))
+
+			keys, next, err := s.ScanPage("", 3)
+			test.AssertNil(t, err)
+			test.AssertEqual(t, []string{"balin", "dwalin", "gloin"}, keys)
+			test.AssertEqual(t, "gloin", next)
+
+			test.AssertNil(t, s.Set("dori", []byte("dwarf")))
+			test.AssertNil(t, s.Set("kili", []byte("dwarf")))
+			test.AssertNil(t, s.Set("nori", []byte("dwarf")))
+			keys, next, err = s.ScanPage(next, 3)
+			test.AssertNil(t, err)
+			test.AssertEqual(t, []string{"kili", "nori", "oin"}, keys)
+			test.AssertEqual(t, "oin", next)
+
+			keys, next, err = s.ScanPage(next, 3)
+			test.AssertNil(t, err)
+			test.AssertEqual(t, []string{"thorin"}, keys)
+			test.AssertEqual(t, "", next)
+
+			keys, next, err = s.ScanPage("thorin", 3)
+			test.AssertNil(t, err)
+			test.AssertEqual(t, 0, len(keys))
+			test.AssertEqual(t, "", next)
+
+			_, _, err = s.ScanPage("", 0)
+			test.AssertEqual(t, true, err != nil)
+		})
+	}
+}
+
+// TestScanPageConcurrentWrites ensures paging through the keys finds every live
+// key while other goroutines overwrite them, and doesn't race with the writes.
+func TestScanPageConcurrentWrites(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"unordered": {},
+		"ordered":   {WithOrdered(true)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewMemStorage(opts...)
+			test.AssertNil(t, err)
+			defer s.Close()
+
+			keys := []string{}
+			for i := 0; i < 20; i++ {
+				keys = append(keys, fmt.Sprintf("dwarf-%02d", i))
+				test.AssertNil(t, s.Set(keys[i], []byte("khazad-dum")))
+			}
+			overwriteWhile(t, s, keys, 1000, func() {
+				var all []string
+				cursor := ""
+				for {
+					page, next, err := s.ScanPage(cursor, 3)
+					test.AssertNil(t, err)
+					all = append(all, page...)
+					if next == "" {
+						break
+					}
+					cursor = next
+				}
+				test.AssertEqual(t, keys, all)
+			})
+		})
+	}
+}
+
+// TestScanPrefix ensures that ScanPrefix visits exactly the keys with a prefix.
+func TestScanPrefix(t *testing.T) {
+	test.AssertEqual(t, "b", prefixEnd("a"))
+	test.AssertEqual(t, "a\x01", prefixEnd("a\x00\xff"))
+	test.AssertEqual(t, "", prefixEnd("\xff\xff"))
+	test.AssertEqual(t, "", prefixEnd(""))
+
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0644, WithOrdered(true))
+	test.AssertNil(t, err)
+	for _, k := range []string{"ent", "entwife", "entmoot", "eomer", "eowyn", "en", "\xffent"} {
+		test.AssertNil(t, s.Set(k, []byte("Rohan")))
+	}
+	test.AssertNil(t, s.Close())
+
+	// the index is rebuilt when the file is opened
+	s, err = NewStorage(fname, 0644, WithOrdered(true))
+	test.AssertNil(t, err)
+	defer s.Close()
+	var keys []string
+	test.AssertNil(t, s.ScanPrefix("ent", func(key string, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	test.AssertEqual(t, []string{"ent", "entmoot", "entwife"}, keys)
+	test.AssertEqual(t, []string{"en", "ent", "entmoot", "entwife", "eomer", "eowyn", "\xffent"}, s.SortedKeys())
+}
+
+// TestForEach ensures that ForEach visits every key/value pair, and stops when
+// told to.
+func TestForEach(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	kvs := map[string][]byte{
+		"arwen":   []byte("I would rather share one lifetime with you than face all the ages of this world alone."),
+		"eowyn":   []byte("I am no man!"),
+		"theoden": []byte("Where is the horse and the rider?"),
+	}
+	for k, v := range kvs {
+		test.AssertNil(t, s.Set(k, v))
+	}
+	test.AssertNil(t, s.Set("wormtongue", []byte("Late is the hour.")))
+	test.AssertNil(t, s.Delete("wormtongue"))
+
+	got := map[string][]byte{}
+	err = s.ForEach(func(key string, value []byte) bool {
+		got[key] = value
+		// the value is a copy
+		value[0] = 'X'
+		return true
+	})
+	test.AssertNil(t, err)
+	test.AssertEqual(t, len(kvs), len(got))
+	for k, v := range kvs {
+		val, ok := s.Get(k)
+		test.AssertEqual(t, true, ok)
+		test.AssertEqual(t, v, val)
+	}
+
+	// stop early
+	visited := 0
+	err = s.ForEach(func(key string, value []byte) bool {
+		visited++
+		return false
+	})
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 1, visited)
+}
+
+// TestForEachConcurrentWrites ensures ForEach visits every live key while other
+// goroutines overwrite them, and doesn't race with the writes.
+func TestForEachConcurrentWrites(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		test.AssertNil(t, s.Set(fmt.Sprintf("ent-%d", i), []byte("treebeard")))
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var writes int64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := fmt.Sprintf("ent-%d", i%n)
+			if i%2 == 0 {
+				test.AssertNil(t, s.Set(key, []byte("quickbeam")))
+			} else {
+				test.AssertNil(t, s.Expire(key, time.Hour))
+			}
+			atomic.AddInt64(&writes, 1)
+		}
+	}()
+
+	for atomic.LoadInt64(&writes) < 2000 {
+		visited := 0
+		test.AssertNil(t, s.ForEach(func(string, []byte) bool {
+			visited++
+			return true
+		}))
+		test.AssertEqual(t, n, visited)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// TestClosed ensures that operations on a closed Storage return ErrDBClosed.
+func TestClosed(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+
+	k, v := "isildur", []byte("This is mine.")
+	test.AssertNil(t, s.Set(k, v))
+	test.AssertNil(t, s.Close())
+
+	got, ok := s.Get(k)
+	test.AssertEqual(t, false, ok)
+	test.AssertEqual(t, []byte(nil), got)
+	test.AssertEqual(t, false, s.Has(k))
+
+	test.AssertEqual(t, ErrDBClosed, s.Set(k, v))
+	test.AssertEqual(t, ErrDBClosed, s.SetSync(k, v))
+	test.AssertEqual(t, ErrDBClosed, s.Delete(k))
+	test.AssertEqual(t, ErrDBClosed, s.Vacuum())
+	test.AssertEqual(t, ErrDBClosed, s.Sync())
+	test.AssertEqual(t, ErrDBClosed, s.Snapshot(filepath.Join(t.TempDir(), "snap"), 0644))
+	test.AssertEqual(t, ErrDBClosed, s.ForEach(func(string, []byte) bool { return true }))
+}
+
+// TestCloseTwice ensures that closing a Storage more than once is safe.
+func TestCloseTwice(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Close())
+	test.AssertNil(t, s.Close())
+}
+
+// failWriteFile is a database file that can't be written to.
+type failWriteFile struct {
+	file
+}
+
+func (f failWriteFile) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+// TestCloseFlushFails ensures that the database file is closed and unlocked
+// even if flushing it fails.
+func TestCloseFlushFails(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, WithWriteBufferSize(1<<20))
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Set("gandalf", []byte("You shall not pass!")))
+	s.file = failWriteFile{s.file}
+
+	err = s.Close()
+	test.AssertEqual(t, "closing Storage: flushing "+fname+": disk full", err.Error())
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644)
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Close())
+}
+
+// TestDelete ensures that calling Delete on Storage
+// deletes the key/value pair.
+func TestDelete(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+
+	k, v := "aragorn", []byte("You will suffer me.")
+
+	// deleting something that doesn't exist returns nil
+	err = s.Delete(k)
+	test.AssertNil(t, err)
+
+	// set the thing
+	err = s.Set(k, v)
+	test.AssertNil(t, err)
+
+	// make sure it's there:
+	aragorn, ok := s.Get(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, v, aragorn)
+	test.AssertEqual(t, 1, s.Len())
+	test.AssertEqual(t, true, s.Has(k))
+
+	// delete it
+	err = s.Delete(k)
+	test.AssertNil(t, err)
+
+	// get it again, should be nil
+	aragorn, ok = s.Get(k)
+	test.AssertEqual(t, false, ok)
+	test.AssertEqual(t, []byte(nil), aragorn)
+	test.AssertEqual(t, 0, s.Len())
+	test.AssertEqual(t, false, s.Has(k))
+}
+
+// TestHooks ensures OnSet and OnDelete are called after successful writes, and
+// without the file lock held.
+func TestHooks(t *testing.T) {
+	var sets, deletes []string
+	var s *Storage
+	s, err := NewMemStorage(
+		WithOnSet(func(key string, value []byte) {
+			sets = append(sets, key+": "+string(value))
+			if key != "red book" {
+				// this would deadlock if the file lock were held
+				test.AssertNil(t, s.Set("red book", []byte(key)))
+			}
+		}),
+		WithOnDelete(func(key string) {
+			deletes = append(deletes, key)
+		}),
+	)
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("bilbo", []byte("There and Back Again")))
+	test.AssertNil(t, s.SetSync("frodo", []byte("The Lord of the Rings")))
+	test.AssertNil(t, s.Delete("frodo"))
+	test.AssertNil(t, s.Delete("sam"))
+	test.AssertEqual(t, []string{
+		"bilbo: There and Back Again",
+		"red book: bilbo",
+		"frodo: The Lord of the Rings",
+		"red book: frodo",
+	}, sets)
+	test.AssertEqual(t, []string{"frodo"}, deletes)
+
+	// failed writes don't call hooks
+	test.AssertNil(t, s.Close())
+	test.AssertEqual(t, ErrDBClosed, s.Set("sam", []byte("The Fall of the Lord of the Rings")))
+	test.AssertEqual(t, ErrDBClosed, s.Delete("bilbo"))
+	test.AssertEqual(t, 4, len(sets))
+	test.AssertEqual(t, 1, len(deletes))
+}
+
+// TestHooksWrites ensures OnSet and OnDelete are called for every kind of
+// write, not just Set and Delete, without the file lock held.
+func TestHooksWrites(t *testing.T) {
+	var hooked []string
+	var s *Storage
+	s, err := NewMemStorage(
+		WithOnSet(func(key string, value []byte) {
+			hooked = append(hooked, "set "+key+": "+string(value))
+			// this would deadlock if the file lock were held
+			_, err := s.Stats()
+			test.AssertNil(t, err)
+		}),
+		WithOnDelete(func(key string) {
+			hooked = append(hooked, "delete "+key)
+			_, err := s.Stats()
+			test.AssertNil(t, err)
+		}),
+	)
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.SetMulti(map[string][]byte{"frodo": []byte("baggins")}))
+	_, _, err = s.Pop("frodo")
+	test.AssertNil(t, err)
+	_, err = s.SetIfAbsent("sam", []byte("gamgee"))
+	test.AssertNil(t, err)
+	_, err = s.CompareAndDelete("sam", []byte("gamgee"))
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Update("merry", func([]byte, bool) ([]byte, bool, error) {
+		return []byte("brandybuck"), false, nil
+	}))
+	test.AssertNil(t, s.RenameKey("merry", "meriadoc"))
+	b := s.Batch()
+	b.Set("pippin", []byte("took"))
+	b.Delete("meriadoc")
+	test.AssertNil(t, b.Commit())
+	_, err = s.DeletePrefix("pip")
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Undelete("pippin"))
+	test.AssertNil(t, s.Clear())
+
+	test.AssertEqual(t, []string{
+		"set frodo: baggins",
+		"delete frodo",
+		"set sam: gamgee",
+		"delete sam",
+		"set merry: brandybuck",
+		"set meriadoc: brandybuck",
+		"delete merry",
+		"set pippin: took",
+		"delete meriadoc",
+		"delete pippin",
+		"set pippin: took",
+		"delete pippin",
+	}, hooked)
+	test.AssertNil(t, s.Close())
+}
+
+// TestHooksWALReplay ensures the writes replayed from the write-ahead log while
+// a Storage is opened don't call the hooks.
+func TestHooksWALReplay(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithWAL(true))
+	test.AssertNil(t, err)
+	s.muFile.Lock()
+	test.AssertNil(t, s.logBatch([]batchOp{{op: walSet, key: "replayed", value: []byte("gollum")}}))
+	s.muFile.Unlock()
+	test.AssertNil(t, s.Close())
+
+	var sets []string
+	s, err = NewStorage(fname, 0600, WithWAL(true), WithOnSet(func(key string, value []byte) {
+		sets = append(sets, key)
+	}))
+	test.AssertNil(t, err)
+	defer s.Close()
+	got, _ := s.Get("replayed")
+	test.AssertEqual(t, []byte("gollum"), got)
+
+	test.AssertNil(t, s.Set("other", []byte("smeagol")))
+	test.AssertEqual(t, []string{"other"}, sets)
+}
+
+// recordLogger is a Logger that records what's logged.
+type recordLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) Printf(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+// loggedPrefix returns whether a line logged to l starts with prefix.
+func loggedPrefix(l *recordLogger, prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestLogger ensures opening, syncing, and vacuuming are logged.
+func TestLogger(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	l := &recordLogger{}
+
+	s, err := NewStorage(fname, 0644, WithLogger(l), WithVacuumBatch(0), WithFsyncBatch(0))
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Set("saruman", []byte("We must join with him, Gandalf.")))
+	test.AssertNil(t, s.Set("saruman", []byte("Against the power of Mordor there can be no victory.")))
+	test.AssertNil(t, s.Sync())
+	test.AssertNil(t, s.Vacuum())
+	test.AssertNil(t, s.Close())
+
+	test.AssertEqual(t, 4, len(l.lines))
+	prefixes := []string{
+		"bugfruit: opened " + fname + " in ",
+		"bugfruit: synced 3 writes to " + fname + " in ",
+		"bugfruit: vacuuming " + fname,
+		"bugfruit: vacuumed " + fname + " in ",
+	}
+	for i, p := range prefixes {
+		test.AssertEqual(t, true, strings.HasPrefix(l.lines[i], p))
+	}
+	test.AssertEqual(t, true, strings.HasSuffix(l.lines[0], ": 0 keys, 0 bytes of records, 0 bytes dead"))
+}
+
+// TestCtx ensures GetCtx, SetCtx, and DeleteCtx give up when their context is
+// done before they get their lock, and work like Get, Set, and Delete otherwise.
+func TestCtx(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+	ctx := context.Background()
+
+	test.AssertNil(t, s.SetCtx(ctx, "denethor", []byte("Steward of Gondor")))
+	got, ok, err := s.GetCtx(ctx, "denethor")
+	test.AssertNil(t, err)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("Steward of Gondor"), got)
+
+	// hold the locks like a long vacuum would
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	s.muFile.Lock()
+	test.AssertEqual(t, context.DeadlineExceeded, s.SetCtx(short, "denethor", []byte("Lord of the City")))
+	test.AssertEqual(t, context.DeadlineExceeded, s.DeleteCtx(short, "denethor"))
+	s.data.Lock()
+	_, _, err = s.GetCtx(short, "denethor")
+	test.AssertEqual(t, context.DeadlineExceeded, err)
+	s.data.Unlock()
+	s.muFile.Unlock()
+
+	got, _ = s.Get("denethor")
+	test.AssertEqual(t, []byte("Steward of Gondor"), got)
+	test.AssertNil(t, s.DeleteCtx(ctx, "denethor"))
+	_, ok, err = s.GetCtx(ctx, "denethor")
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, ok)
+
+	test.AssertNil(t, s.Close())
+	test.AssertEqual(t, ErrDBClosed, s.SetCtx(ctx, "denethor", nil))
+	test.AssertEqual(t, ErrDBClosed, s.DeleteCtx(ctx, "denethor"))
+	_, _, err = s.GetCtx(ctx, "denethor")
+	test.AssertEqual(t, ErrDBClosed, err)
+}
+
+// TestBytesKeys ensures keys given as bytes are the same keys as strings with
+// the same bytes, including bytes that aren't valid UTF-8.
+func TestBytesKeys(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+
+	key := []byte("palantír")
+	test.AssertNil(t, s.SetBytes(key, []byte("seeing stone")))
+	key[0] = 'P' // the stored key is a copy
+	got, ok := s.Get("palantír")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("seeing stone"), got)
+	_, ok = s.GetBytes(key)
+	test.AssertEqual(t, false, ok)
+
+	test.AssertNil(t, s.Set("orthanc", []byte("tower of saruman")))
+	got, ok = s.GetBytes([]byte("orthanc"))
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("tower of saruman"), got)
+
+	raw := []byte{0xff, 0xfe, 0x00, 0x80}
+	test.AssertNil(t, s.SetBytes(raw, []byte("not utf-8")))
+	got, ok = s.GetBytes(raw)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("not utf-8"), got)
+	test.AssertNil(t, s.DeleteBytes(raw))
+	_, ok = s.Get(string(raw))
+	test.AssertEqual(t, false, ok)
+
+	test.AssertNil(t, s.Close())
+	_, ok = s.GetBytes([]byte("orthanc"))
+	test.AssertEqual(t, false, ok)
+	test.AssertEqual(t, ErrDBClosed, s.SetBytes([]byte("orthanc"), nil))
+	test.AssertEqual(t, ErrDBClosed, s.DeleteBytes([]byte("orthanc")))
+}
+
+// TestMaxSizes ensures keys and values larger than the configured limits
+// aren't set, and don't replace the existing value.
+func TestMaxSizes(t *testing.T) {
+	s, err := NewMemStorage(WithMaxSizes(8, 16))
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("glamdrin", []byte("foe-hammer")))
+	err = s.Set("glamdring", []byte("foe-hammer"))
+	test.AssertEqual(t, true, errors.Is(err, ErrKeyTooLarge))
+	err = s.Set("glamdrin", []byte("the sword of gandalf"))
+	test.AssertEqual(t, true, errors.Is(err, ErrValueTooLarge))
+	got, _ := s.Get("glamdrin")
+	test.AssertEqual(t, []byte("foe-hammer"), got)
+
+	err = s.SetMulti(map[string][]byte{"sting": []byte("glows blue"), "orcrist": []byte("the goblin-cleaver")})
+	test.AssertEqual(t, true, errors.Is(err, ErrValueTooLarge))
+	_, ok := s.Get("sting")
+	test.AssertEqual(t, false, ok)
+
+	err = s.Update("glamdrin", func(old []byte, exists bool) ([]byte, bool, error) {
+		return append(old, []byte(" of gondolin")...), false, nil
+	})
+	test.AssertEqual(t, true, errors.Is(err, ErrValueTooLarge))
+	test.AssertNil(t, s.Close())
+}
+
+// TestMaxSizesHardLimit ensures values too large for the file format aren't
+// set, whatever the config says.
+func TestMaxSizesHardLimit(t *testing.T) {
+	defer func(old uint64) { maxSize = old }(maxSize)
+	maxSize = 8
+
+	s, err := NewMemStorage(WithMaxSizes(0, 100))
+	test.AssertNil(t, err)
+	err = s.Set("sting", []byte("glows blue"))
+	test.AssertEqual(t, true, errors.Is(err, ErrValueTooLarge))
+	err = s.Set("glamdring", nil)
+	test.AssertEqual(t, true, errors.Is(err, ErrKeyTooLarge))
+	test.AssertEqual(t, 0, s.Len())
+	test.AssertNil(t, s.Close())
+}
+
+// TestExpectedKeys ensures the ExpectedKeys hint doesn't change what's read
+// from the database file, even when it's wrong.
+func TestExpectedKeys(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithExpectedKeys(1))
+	test.AssertNil(t, err)
+	for _, k := range []string{"arwen", "elrond", "elladan", "elrohir"} {
+		test.AssertNil(t, s.Set(k, []byte(k)))
+	}
+	test.AssertNil(t, s.Close())
+
+	for _, n := range []int{-1, 0, 2, 1000} {
+		s, err = NewStorage(fname, 0600, WithExpectedKeys(n))
+		test.AssertNil(t, err)
+		test.AssertEqual(t, 4, s.Len())
+		got, _ := s.Get("elrohir")
+		test.AssertEqual(t, []byte("elrohir"), got)
+		test.AssertNil(t, s.Close())
+	}
+}
+
+// TestFsyncWorker ensures the fsync worker syncs the database file in the
+// background every FsyncInterval once it's been written to, including the
+// buffered writes.
+func TestFsyncWorker(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	l := &recordLogger{}
+	s, err := NewStorage(fname, 0644, WithLogger(l), WithFsyncBatch(0), WithFsyncInterval(5*time.Millisecond), WithWriteBufferSize(1<<20))
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("radagast", []byte("the brown")))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.muFile.Lock()
+		wcs := s.writeCountSync
+		s.muFile.Unlock()
+		if wcs == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the write to be synced, but %d writes weren't", wcs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	fi, err := os.Stat(fname)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, true, fi.Size() > headerSize)
+
+	// nothing's synced while nothing's written
+	time.Sleep(20 * time.Millisecond)
+	test.AssertNil(t, s.Close())
+	synced := 0
+	l.mu.Lock()
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, "bugfruit: synced 1 writes") {
+			synced++
+		}
+	}
+	l.mu.Unlock()
+	test.AssertEqual(t, 1, synced)
+}
+
+// TestSetSyncGroupCommit ensures concurrent SetSync callers waiting on a sync
+// are synced together by a single fsync.
+func TestSetSyncGroupCommit(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	l := &recordLogger{}
+	s, err := NewStorage(fname, 0644, WithLogger(l), WithVacuumBatch(0), WithFsyncBatch(0))
+	test.AssertNil(t, err)
+
+	// hold the sync lock like a slow fsync would, while the writers write
+	n := 20
+	s.muSync.Lock()
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- s.SetSync(fmt.Sprintf("rider-%d", i), []byte("rohirrim"))
+		}(i)
+	}
+	for {
+		s.muFile.Lock()
+		seq := s.syncSeq
+		s.muFile.Unlock()
+		if seq == uint64(n) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.muSync.Unlock()
+	for i := 0; i < n; i++ {
+		test.AssertNil(t, <-errs)
+	}
+	test.AssertEqual(t, uint64(0), s.writeCountSync)
+	test.AssertNil(t, s.Close())
+
+	synced := 0
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, "bugfruit: synced") {
+			synced++
+			test.AssertEqual(t, true, strings.HasPrefix(line, fmt.Sprintf("bugfruit: synced %d writes", n)))
+		}
+	}
+	test.AssertEqual(t, 1, synced)
+
+	s, err = NewStorage(fname, 0644)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, n, s.Len())
+	test.AssertNil(t, s.Close())
+}
+
+// TestSetMulti ensures SetMulti sets every pair, and counts the writes towards
+// vacuuming once it's done.
+func TestSetMulti(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, WithVacuumBatch(0), WithFsyncBatch(2))
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("rohan", []byte("Where is the horse and the rider?")))
+	pairs := map[string][]byte{
+		"rohan":    []byte("Where is the horn that was blowing?"),
+		"gondor":   []byte("The beacons of Minas Tirith! The beacons are lit!"),
+		"isengard": []byte("They're taking the hobbits to Isengard!"),
+	}
+	test.AssertNil(t, s.SetMulti(pairs))
+	test.AssertEqual(t, uint64(0), s.writeCountSync)
+	// one write for the first set, one for reclaiming it, and one for each pair
+	test.AssertEqual(t, uint64(5), s.writeCountVacuum)
+	test.AssertNil(t, s.Verify())
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+	test.AssertEqual(t, len(pairs), s.Len())
+	for k, v := range pairs {
+		got, ok := s.Get(k)
+		test.AssertEqual(t, true, ok)
+		test.AssertEqual(t, v, got)
+	}
+
+	test.AssertNil(t, s.Close())
+	test.AssertEqual(t, ErrDBClosed, s.SetMulti(pairs))
+}
+
+// TestMerge ensures Merge copies every live pair from the other database,
+// resolves conflicts, and syncs once it's done.
+func TestMerge(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, WithVacuumBatch(0), WithFsyncBatch(2))
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Set("shire", []byte("Hobbiton")))
+	test.AssertNil(t, s.Set("bree", []byte("The Prancing Pony")))
+
+	other, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer other.Close()
+	test.AssertNil(t, other.Set("bree", []byte("Barliman Butterbur")))
+	test.AssertNil(t, other.SetWithTTL("weathertop", []byte("Amon Sûl"), time.Hour))
+	test.AssertNil(t, other.Set("moria", []byte("Speak, friend, and enter.")))
+	test.AssertNil(t, other.Delete("moria"))
+
+	// other wins by default
+	test.AssertNil(t, s.Merge(other, nil))
+	test.AssertEqual(t, uint64(0), s.writeCountSync)
+	test.AssertEqual(t, 3, s.Len())
+	got, _ := s.Get("bree")
+	test.AssertEqual(t, []byte("Barliman Butterbur"), got)
+	ttl, ok := s.GetTTL("weathertop")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, true, ttl > 0)
+	test.AssertEqual(t, false, s.Has("moria"))
+
+	// conflicts only see keys in both
+	test.AssertNil(t, other.Set("rivendell", []byte("Imladris")))
+	var conflicts []string
+	test.AssertNil(t, s.Merge(other, func(key string, a, b []byte) []byte {
+		conflicts = append(conflicts, key)
+		return append(append(a, " & "...), b...)
+	}))
+	test.AssertEqual(t, 2, len(conflicts))
+	got, _ = s.Get("bree")
+	test.AssertEqual(t, []byte("Barliman Butterbur & Barliman Butterbur"), got)
+	got, _ = s.Get("rivendell")
+	test.AssertEqual(t, []byte("Imladris"), got)
+	test.AssertNil(t, s.Verify())
+
+	// conflict is called without the file lock held, so it can use s, and is
+	// called again if it writes to the key it's merging
+	calls := 0
+	test.AssertNil(t, s.Merge(other, func(key string, a, b []byte) []byte {
+		if key != "bree" {
+			return b
+		}
+		calls++
+		_, err := s.Stats()
+		test.AssertNil(t, err)
+		if calls == 1 {
+			test.AssertNil(t, s.Set("bree", []byte("Bree-hill")))
+		}
+		return append(append(a, " & "...), b...)
+	}))
+	test.AssertEqual(t, 2, calls)
+	got, _ = s.Get("bree")
+	test.AssertEqual(t, []byte("Bree-hill & Barliman Butterbur"), got)
+
+	// conflict gives up if it always writes to the key it's merging
+	calls = 0
+	err = s.Merge(other, func(key string, a, b []byte) []byte {
+		if key == "bree" {
+			calls++
+			test.AssertNil(t, s.Set("bree", []byte("Bree-hill")))
+		}
+		return b
+	})
+	test.AssertEqual(t, true, errors.Is(err, ErrMergeContended))
+	test.AssertEqual(t, mergeResolves, calls)
+	got, _ = s.Get("bree")
+	test.AssertEqual(t, []byte("Bree-hill"), got)
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 4, s.Len())
+	got, _ = s.Get("shire")
+	test.AssertEqual(t, []byte("Hobbiton"), got)
+	test.AssertNil(t, s.Close())
+
+	test.AssertEqual(t, ErrDBClosed, s.Merge(other, nil))
+}
+
+// TestMergeConcurrentReads ensures readers see every key while Merge and
+// RenameKey overwrite them, and don't race with the writes.
+func TestMergeConcurrentReads(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer s.Close()
+	other, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer other.Close()
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		test.AssertNil(t, s.Set(fmt.Sprintf("palantir-%d", i), []byte("orthanc")))
+		test.AssertNil(t, other.Set(fmt.Sprintf("palantir-%d", i), []byte("minas tirith")))
+	}
+	test.AssertNil(t, s.Set("seeing-stone", []byte("amon sûl")))
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var writes int64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				test.AssertNil(t, s.Merge(other, nil))
+			} else {
+				// renaming onto a key that exists overwrites it
+				test.AssertNil(t, s.CopyKey("seeing-stone", "stone"))
+				test.AssertNil(t, s.RenameKey("stone", fmt.Sprintf("palantir-%d", i%n)))
+				test.AssertNil(t, s.Set("seeing-stone", []byte("amon sûl")))
+			}
+			atomic.AddInt64(&writes, 1)
+		}
+	}()
+
+	for atomic.LoadInt64(&writes) < 200 {
+		visited := 0
+		test.AssertNil(t, s.ForEach(func(key string, _ []byte) bool {
+			if strings.HasPrefix(key, "palantir-") {
+				visited++
+			}
+			return true
+		}))
+		test.AssertEqual(t, n, visited)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// TestDeleteMulti ensures DeleteMulti deletes every key that exists, and counts
+// them.
+func TestDeleteMulti(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, WithVacuumBatch(0), WithFsyncBatch(2))
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("nazgul", []byte("Baggins!")))
+	test.AssertNil(t, s.Set("witch-king", []byte("No man can kill me.")))
+	test.AssertNil(t, s.Set("eowyn", []byte("I am no man.")))
+
+	deleted, err := s.DeleteMulti([]string{"nazgul", "witch-king", "nazgul", "sauron"})
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 2, deleted)
+	test.AssertEqual(t, uint64(0), s.writeCountSync)
+	test.AssertEqual(t, uint64(5), s.writeCountVacuum)
+	test.AssertEqual(t, []string{"eowyn"}, s.Keys())
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, []string{"eowyn"}, s.Keys())
+	test.AssertNil(t, s.Close())
+
+	_, err = s.DeleteMulti([]string{"eowyn"})
+	test.AssertEqual(t, ErrDBClosed, err)
+}
+
+// TestDeletePrefix ensures DeletePrefix deletes every key with a prefix across
+// batches, syncs once, and leaves the other keys alone.
+func TestDeletePrefix(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"unordered": {},
+		"ordered":   {WithOrdered(true)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+			opts := append([]Option{WithVacuumBatch(0), WithFsyncBatch(0)}, opts...)
+			s, err := NewStorage(fname, 0600, opts...)
+			test.AssertNil(t, err)
+
+			for i := 0; i < 2*rangeBatchSize+10; i++ {
+				test.AssertNil(t, s.Set(fmt.Sprintf("mordor:orc-%d", i), []byte("uruk")))
+			}
+			test.AssertNil(t, s.SetWithTTL("mordor:nazgul", []byte("ringwraith"), time.Nanosecond))
+			test.AssertNil(t, s.Set("mordor", []byte("black land")))
+			test.AssertNil(t, s.Set("mordor;", []byte("not in mordor")))
+			test.AssertNil(t, s.Set("gondor:minas-tirith", []byte("white city")))
+			test.AssertNil(t, s.Sync())
+
+			deleted, err := s.DeletePrefix("mordor:")
+			test.AssertNil(t, err)
+			test.AssertEqual(t, 2*rangeBatchSize+10, deleted)
+			test.AssertEqual(t, uint64(0), s.writeCountSync)
+			test.AssertEqual(t, []string{"gondor:minas-tirith", "mordor", "mordor;"}, s.SortedKeys())
+
+			deleted, err = s.DeletePrefix("rohan:")
+			test.AssertNil(t, err)
+			test.AssertEqual(t, 0, deleted)
+			test.AssertNil(t, s.Close())
+
+			s, err = NewStorage(fname, 0600, opts...)
+			test.AssertNil(t, err)
+			test.AssertEqual(t, []string{"gondor:minas-tirith", "mordor", "mordor;"}, s.SortedKeys())
+			test.AssertNil(t, s.Close())
+
+			_, err = s.DeletePrefix("mordor")
+			test.AssertEqual(t, ErrDBClosed, err)
+		})
+	}
+}
+
+// TestCountPrefix ensures CountPrefix counts only the live keys with a prefix.
+func TestCountPrefix(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"unordered": {},
+		"ordered":   {WithOrdered(true)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewStorage(filepath.Join(t.TempDir(), "testing-testing-one-two-three"), 0600, opts...)
+			test.AssertNil(t, err)
+			defer s.Close()
+
+			test.AssertNil(t, s.Set("fellowship:frodo", []byte("ring-bearer")))
+			test.AssertNil(t, s.Set("fellowship:sam", []byte("gardener")))
+			test.AssertNil(t, s.Set("fellowship:boromir", []byte("son of denethor")))
+			test.AssertNil(t, s.Delete("fellowship:boromir"))
+			test.AssertNil(t, s.SetWithTTL("fellowship:gandalf", []byte("the grey"), time.Nanosecond))
+			test.AssertNil(t, s.Set("fellowship", []byte("nine walkers")))
+			test.AssertNil(t, s.Set("fellowshiq", []byte("nine riders")))
+
+			test.AssertEqual(t, 2, s.CountPrefix("fellowship:"))
+			test.AssertEqual(t, 3, s.CountPrefix("fellowship"))
+			test.AssertEqual(t, 4, s.CountPrefix(""))
+			test.AssertEqual(t, 0, s.CountPrefix("mordor:"))
+		})
+	}
+}
+
+// TestSetIfAbsent ensures SetIfAbsent only sets missing keys, and that only one
+// of many concurrent sets of the same key wins.
+func TestSetIfAbsent(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	var winners int32
+	for i := 0; i < 8; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			set, err := s.SetIfAbsent("king", []byte(fmt.Sprintf("king %d", i)))
+			test.AssertNil(t, err)
+			if set {
+				atomic.AddInt32(&winners, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	test.AssertEqual(t, int32(1), winners)
+	test.AssertEqual(t, 1, s.Len())
+
+	// the key exists, so it isn't set
+	king, _ := s.Get("king")
+	set, err := s.SetIfAbsent("king", []byte("Aragorn, son of Arathorn"))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, set)
+	got, _ := s.Get("king")
+	test.AssertEqual(t, king, got)
+
+	test.AssertNil(t, s.Close())
+	_, err = s.SetIfAbsent("steward", []byte("Denethor"))
+	test.AssertEqual(t, ErrDBClosed, err)
+}
+
+// TestGetOrSet ensures GetOrSet returns existing values and sets missing ones,
+// and that concurrent callers all see the value that won.
+func TestGetOrSet(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	v := []byte("Po-tay-toes")
+	got, existed, err := s.GetOrSet("sam", v)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, existed)
+	test.AssertEqual(t, v, got)
+
+	// the returned value is a copy
+	got[0] = 'X'
+	test.AssertEqual(t, []byte("Po-tay-toes"), v)
+
+	got, existed, err = s.GetOrSet("sam", []byte("Boil 'em, mash 'em"))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, true, existed)
+	test.AssertEqual(t, v, got)
+
+	// concurrent fills of a missing key all see the same value
+	var wg sync.WaitGroup
+	vals := make([][]byte, 8)
+	var fills int32
+	for i := range vals {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, existed, err := s.GetOrSet("stew", []byte(fmt.Sprintf("stew %d", i)))
+			test.AssertNil(t, err)
+			if !existed {
+				atomic.AddInt32(&fills, 1)
+			}
+			vals[i] = got
+		}()
+	}
+	wg.Wait()
+	test.AssertEqual(t, int32(1), fills)
+	stew, _ := s.Get("stew")
+	for _, got := range vals {
+		test.AssertEqual(t, stew, got)
+	}
+
+	test.AssertNil(t, s.Close())
+	_, _, err = s.GetOrSet("sam", v)
+	test.AssertEqual(t, ErrDBClosed, err)
+}
+
+// TestCompareAndSwap ensures CompareAndSwap only swaps when the current value
+// matches, and that concurrent swaps don't lose updates.
+func TestCompareAndSwap(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	// a missing key swaps with nil
+	k := "sam"
+	swapped, err := s.CompareAndSwap(k, []byte("Po-tay-toes"), []byte("Boil 'em"))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, swapped)
+	test.AssertEqual(t, false, s.Has(k))
+
+	swapped, err = s.CompareAndSwap(k, nil, []byte("Boil 'em"))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, true, swapped)
+
+	swapped, err = s.CompareAndSwap(k, []byte("Stick 'em in a stew"), []byte("Mash 'em"))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, swapped)
+	sam, _ := s.Get(k)
+	test.AssertEqual(t, []byte("Boil 'em"), sam)
+
+	swapped, err = s.CompareAndSwap(k, []byte("Boil 'em"), []byte("Mash 'em"))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, true, swapped)
+	sam, _ = s.Get(k)
+	test.AssertEqual(t, []byte("Mash 'em"), sam)
+
+	// concurrent increments
+	n, each := 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; {
+				old, _ := s.Get("second breakfast")
+				count, _ := strconv.Atoi(string(old))
+				swapped, err := s.CompareAndSwap("second breakfast", old, []byte(strconv.Itoa(count+1)))
+				test.AssertNil(t, err)
+				if swapped {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	count, _ := s.Get("second breakfast")
+	test.AssertEqual(t, strconv.Itoa(n*each), string(count))
+
+	test.AssertNil(t, s.Close())
+	_, err = s.CompareAndSwap(k, nil, nil)
+	test.AssertEqual(t, ErrDBClosed, err)
+}
+
+// TestSetIfVersion ensures versions go up with every set, that SetIfVersion
+// only sets a key at the version it's expected to be at, and that versions
+// are kept when the Storage is reopened.
+func TestSetIfVersion(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+
+	// a missing key is at version 0
+	_, v, ok := s.GetVersioned("bilbo")
+	test.AssertEqual(t, false, ok)
+	test.AssertEqual(t, uint64(0), v)
+	set, err := s.SetIfVersion("bilbo", []byte("baggins"), 1)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, set)
+	set, err = s.SetIfVersion("bilbo", []byte("baggins"), 0)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, true, set)
+
+	val, v1, ok := s.GetVersioned("bilbo")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("baggins"), val)
+	test.AssertEqual(t, true, v1 > 0)
+
+	// any write makes the version stale
+	test.AssertNil(t, s.Set("frodo", []byte("baggins")))
+	test.AssertNil(t, s.Set("bilbo", []byte("eleventy-one")))
+	_, v2, _ := s.GetVersioned("bilbo")
+	_, frodo, _ := s.GetVersioned("frodo")
+	test.AssertEqual(t, true, v2 > frodo && frodo > v1)
+	set, err = s.SetIfVersion("bilbo", []byte("ring-bearer"), v1)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, set)
+	set, err = s.SetIfVersion("bilbo", []byte("ring-bearer"), v2)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, true, set)
+	val, v3, _ := s.GetVersioned("bilbo")
+	test.AssertEqual(t, []byte("ring-bearer"), val)
+	test.AssertEqual(t, true, v3 > v2)
+	test.AssertNil(t, s.Close())
+
+	// versions are kept, and new ones are still higher
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+	_, v, _ = s.GetVersioned("bilbo")
+	test.AssertEqual(t, v3, v)
+	test.AssertNil(t, s.Set("sam", []byte("gamgee")))
+	_, sam, _ := s.GetVersioned("sam")
+	test.AssertEqual(t, true, sam > v3)
+}
+
+// TestVersionsWithoutGaps ensures each set takes exactly the next version,
+// whether the datum is overwritten in place or not, and that versions are
+// kept in compressed and encrypted records.
+func TestVersionsWithoutGaps(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	opts := []Option{WithReuseSpace(true), WithCompression(GzipCompression), WithEncryptionKey(bytes.Repeat([]byte("k"), 32))}
+	s, err := NewStorage(fname, 0644, opts...)
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("shadowfax", bytes.Repeat([]byte("lord of all horses "), 10)))
+	test.AssertNil(t, s.Set("shadowfax", bytes.Repeat([]byte("mearas "), 100)))
+	_, v, _ := s.GetVersioned("shadowfax")
+	test.AssertEqual(t, uint64(2), v)
+	test.AssertNil(t, s.Set("shadowfax", bytes.Repeat([]byte("mearas "), 100)))
+	_, v, _ = s.GetVersioned("shadowfax")
+	test.AssertEqual(t, uint64(3), v)
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644, opts...)
+	test.AssertNil(t, err)
+	defer s.Close()
+	_, v, _ = s.GetVersioned("shadowfax")
+	test.AssertEqual(t, uint64(3), v)
+}
+
+// TestCompareAndDelete ensures CompareAndDelete only deletes when the current
+// value matches.
+func TestCompareAndDelete(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	// a missing key is never deleted
+	k, v := "bilbo", []byte("My precious.")
+	deleted, err := s.CompareAndDelete(k, nil)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, deleted)
+
+	test.AssertNil(t, s.Set(k, v))
+	deleted, err = s.CompareAndDelete(k, []byte("Gollum's precious."))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, deleted)
+	test.AssertEqual(t, true, s.Has(k))
+
+	deleted, err = s.CompareAndDelete(k, v)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, true, deleted)
+	test.AssertEqual(t, false, s.Has(k))
+	test.AssertEqual(t, 0, s.Len())
+
+	// the delete is on disk too
+	test.AssertNil(t, s.Close())
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, s.Has(k))
+	test.AssertNil(t, s.Close())
+
+	_, err = s.CompareAndDelete(k, v)
+	test.AssertEqual(t, ErrDBClosed, err)
+}
+
+// TestRenameKey ensures RenameKey moves a value and its expiry to a new key,
+// overwriting it, and that a reader never finds neither key while it does.
+func TestRenameKey(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600)
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.SetWithTTL("strider", []byte("ranger of the north"), time.Hour))
+	test.AssertNil(t, s.Set("elessar", []byte("the elfstone")))
+	test.AssertNil(t, s.RenameKey("strider", "elessar"))
+	_, ok := s.Get("strider")
+	test.AssertEqual(t, false, ok)
+	got, _ := s.Get("elessar")
+	test.AssertEqual(t, []byte("ranger of the north"), got)
+	ttl, ok := s.GetTTL("elessar")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, true, ttl > 0)
+
+	test.AssertEqual(t, ErrKeyNotFound, s.RenameKey("strider", "aragorn"))
+	test.AssertNil(t, s.RenameKey("elessar", "elessar"))
+	test.AssertEqual(t, 1, s.Len())
+
+	// the key only moves forward along the chain, so a reader looking for it
+	// from where it last was always finds it further on
+	chain := func(i int) string { return fmt.Sprintf("ring-%d", i) }
+	test.AssertNil(t, s.RenameKey("elessar", chain(0)))
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for at := 0; ; {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for ; at < 100; at++ {
+				if _, ok := s.Get(chain(at)); ok {
+					break
+				}
+			}
+			test.AssertEqual(t, true, at < 100)
+		}
+	}()
+	for i := 1; i < 100; i++ {
+		test.AssertNil(t, s.RenameKey(chain(i-1), chain(i)))
+	}
+	close(done)
+	wg.Wait()
+	test.AssertNil(t, s.RenameKey(chain(99), "elessar"))
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0600)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, []string{"elessar"}, s.Keys())
+	test.AssertNil(t, s.Close())
+}
+
+// TestCopyKey ensures CopyKey copies a value and its expiry to another key,
+// without the two sharing memory.
+func TestCopyKey(t *testing.T) {
+	s, err := NewStorage(filepath.Join(t.TempDir(), "testing-testing-one-two-three"), 0600)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.SetWithTTL("palantir-orthanc", []byte("seeing stone"), time.Hour))
+	test.AssertNil(t, s.Set("palantir-minas-tirith", []byte("lost")))
+	test.AssertNil(t, s.CopyKey("palantir-orthanc", "palantir-minas-tirith"))
+	got, _ := s.Get("palantir-minas-tirith")
+	test.AssertEqual(t, []byte("seeing stone"), got)
+	ttl, ok := s.GetTTL("palantir-minas-tirith")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, true, ttl > 0)
+
+	src, _ := s.data.Load("palantir-orthanc")
+	dst, _ := s.data.Load("palantir-minas-tirith")
+	test.AssertEqual(t, false, &src.value[0] == &dst.value[0])
+	_, err = s.Append("palantir-orthanc", []byte(" of saruman"))
+	test.AssertNil(t, err)
+	got, _ = s.Get("palantir-minas-tirith")
+	test.AssertEqual(t, []byte("seeing stone"), got)
+
+	test.AssertEqual(t, ErrKeyNotFound, s.CopyKey("palantir-amon-sul", "palantir-annuminas"))
+	test.AssertNil(t, s.CopyKey("palantir-orthanc", "palantir-orthanc"))
+	test.AssertEqual(t, 2, s.Len())
+}
+
+// TestPop ensures Pop deletes keys and returns their values, and that only one
+// of many concurrent pops of the same key gets it.
+func TestPop(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	_, ok, err := s.Pop("ring")
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, ok)
+
+	test.AssertNil(t, s.Set("ring", []byte("Ash nazg durbatuluk")))
+	ring, ok, err := s.Pop("ring")
+	test.AssertNil(t, err)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("Ash nazg durbatuluk"), ring)
+	test.AssertEqual(t, false, s.Has("ring"))
+
+	// only one worker claims the item
+	test.AssertNil(t, s.Set("ring", []byte("Ash nazg gimbatul")))
+	var wg sync.WaitGroup
+	var claims int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok, err := s.Pop("ring")
+			test.AssertNil(t, err)
+			if ok {
+				atomic.AddInt32(&claims, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	test.AssertEqual(t, int32(1), claims)
+
+	test.AssertNil(t, s.Close())
+	_, _, err = s.Pop("ring")
+	test.AssertEqual(t, ErrDBClosed, err)
+}
+
+// TestUpdate ensures Update sets or deletes keys based on fn, writes nothing
+// when fn fails, and doesn't lose concurrent updates.
+func TestUpdate(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	// create a missing key
+	err = s.Update("treebeard", func(old []byte, exists bool) ([]byte, bool, error) {
+		test.AssertEqual(t, false, exists)
+		test.AssertEqual(t, []byte(nil), old)
+		return []byte("Don't be hasty."), false, nil
+	})
+	test.AssertNil(t, err)
+	treebeard, _ := s.Get("treebeard")
+	test.AssertEqual(t, []byte("Don't be hasty."), treebeard)
+
+	// an error writes nothing
+	errHasty := errors.New("hasty")
+	err = s.Update("treebeard", func(old []byte, exists bool) ([]byte, bool, error) {
+		test.AssertEqual(t, true, exists)
+		test.AssertEqual(t, []byte("Don't be hasty."), old)
+		old[0] = 'X'
+		return []byte("Hoom, hom."), false, errHasty
+	})
+	test.AssertEqual(t, errHasty, err)
+	treebeard, _ = s.Get("treebeard")
+	test.AssertEqual(t, []byte("Don't be hasty."), treebeard)
+
+	// delete it
+	err = s.Update("treebeard", func(old []byte, exists bool) ([]byte, bool, error) {
+		return nil, true, nil
+	})
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, s.Has("treebeard"))
+
+	// concurrent updates
+	n, each := 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				err := s.Update("entmoot", func(old []byte, exists bool) ([]byte, bool, error) {
+					count, _ := strconv.Atoi(string(old))
+					return []byte(strconv.Itoa(count + 1)), false, nil
+				})
+				test.AssertNil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	entmoot, _ := s.Get("entmoot")
+	test.AssertEqual(t, strconv.Itoa(n*each), string(entmoot))
+
+	test.AssertNil(t, s.Close())
+	err = s.Update("entmoot", func(old []byte, exists bool) ([]byte, bool, error) {
+		return nil, true, nil
+	})
+	test.AssertEqual(t, ErrDBClosed, err)
+}
+
+// TestIncrement ensures Increment adds to counters, and that concurrent
+// increments don't lose updates.
+func TestIncrement(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	// a missing key counts from 0
+	total, err := s.Increment("orcs", 2)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(2), total)
+	total, err = s.Increment("orcs", -5)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(-3), total)
+	orcs, _ := s.Get("orcs")
+	test.AssertEqual(t, []byte{0xfd, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, orcs)
+
+	// values that aren't counters can't be incremented
+	test.AssertNil(t, s.Set("gimli", []byte("That still only counts as one!")))
+	_, err = s.Increment("gimli", 1)
+	test.AssertEqual(t, true, errors.Is(err, ErrNotCounter))
+
+	// concurrent increments
+	n, each := 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				_, err := s.Increment("legolas", 1)
+				test.AssertNil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	total, err = s.Increment("legolas", 0)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(n*each), total)
+
+	test.AssertNil(t, s.Close())
+	_, err = s.Increment("legolas", 1)
+	test.AssertEqual(t, ErrDBClosed, err)
+}
+
+// TestAppend ensures Append extends values, and that concurrent appends don't
+// interleave or get lost.
+func TestAppend(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	// a missing key is created
+	got, err := s.Append("gollum", []byte("My "))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, []byte("My "), got)
+	got, err = s.Append("gollum", []byte("precious."))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, []byte("My precious."), got)
+
+	// the returned value is a copy
+	got[0] = 'X'
+	gollum, _ := s.Get("gollum")
+	test.AssertEqual(t, []byte("My precious."), gollum)
+
+	// concurrent appends
+	n, each := 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				_, err := s.Append("smeagol", []byte("ab"))
+				test.AssertNil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	smeagol, _ := s.Get("smeagol")
+	test.AssertEqual(t, strings.Repeat("ab", n*each), string(smeagol))
+
+	// it's on disk too
+	test.AssertNil(t, s.Close())
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	gollum, _ = s.Get("gollum")
+	test.AssertEqual(t, []byte("My precious."), gollum)
+	test.AssertNil(t, s.Close())
+
+	_, err = s.Append("gollum", nil)
+	test.AssertEqual(t, ErrDBClosed, err)
+}
+
+// TestGetMulti ensures GetMulti returns copies of the values of the keys that
+// exist.
+func TestGetMulti(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.Set("merry", []byte("We've had one, yes.")))
+	test.AssertNil(t, s.Set("pippin", []byte("What about second breakfast?")))
+	test.AssertNil(t, s.SetWithTTL("lobelia", []byte("Thieves!"), time.Nanosecond))
+	time.Sleep(time.Millisecond)
+
+	got, err := s.GetMulti([]string{"merry", "pippin", "lobelia", "farmer maggot"})
+	test.AssertNil(t, err)
+	test.AssertEqual(t, map[string][]byte{
+		"merry":  []byte("We've had one, yes."),
+		"pippin": []byte("What about second breakfast?"),
+	}, got)
+
+	// the values are copies
+	got["merry"][0] = 'X'
+	merry, _ := s.Get("merry")
+	test.AssertEqual(t, []byte("We've had one, yes."), merry)
+
+	test.AssertNil(t, s.Close())
+	_, err = s.GetMulti([]string{"merry"})
+	test.AssertEqual(t, ErrDBClosed, err)
+}
+
+// TestExpire ensures keys set with a TTL expire, and that Expire and GetTTL
+// change and report when they do.
+func TestExpire(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+
+	now := time.Unix(3019, 0)
+	s.now = func() time.Time { return now }
+
+	k, v := "gandalf", []byte("I come back to you now at the turn of the tide.")
+	err = s.SetWithTTL(k, v, time.Hour)
+	test.AssertNil(t, err)
+	err = s.Set("sauron", []byte("You cannot hide. I see you."))
+	test.AssertNil(t, err)
+
+	ttl, ok := s.GetTTL(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, time.Hour, ttl)
+	ttl, ok = s.GetTTL("sauron")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, time.Duration(0), ttl)
+	_, ok = s.GetTTL("saruman")
+	test.AssertEqual(t, false, ok)
+
+	// it's gone once the ttl passes
+	now = now.Add(time.Hour)
+	gandalf, ok := s.Get(k)
+	test.AssertEqual(t, false, ok)
+	test.AssertEqual(t, []byte(nil), gandalf)
+	test.AssertEqual(t, false, s.Has(k))
+	test.AssertEqual(t, []string{"sauron"}, s.Keys())
+
+	// expiring a missing or expired key does nothing
+	test.AssertNil(t, s.Expire(k, time.Hour))
+	test.AssertEqual(t, false, s.Has(k))
+	test.AssertNil(t, s.Expire("saruman", time.Hour))
+
+	// set it again, then expire and un-expire it. The datum replaced isn't
+	// changed, since readers of the in-memory map may still see it
+	test.AssertNil(t, s.Set(k, v))
+	d, _ := s.data.Load(k)
+	test.AssertNil(t, s.Expire(k, time.Minute))
+	test.AssertEqual(t, byte(0), d.Deleted())
+	test.AssertEqual(t, int64(0), d.meta.expires)
+	ttl, ok = s.GetTTL(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, time.Minute, ttl)
+	test.AssertNil(t, s.Expire(k, 0))
+	ttl, ok = s.GetTTL(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, time.Duration(0), ttl)
+	gandalf, ok = s.Get(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, v, gandalf)
+
+	// expire it, and make sure vacuum drops it from the file and the map
+	test.AssertNil(t, s.Expire(k, time.Minute))
+	now = now.Add(time.Minute)
+	test.AssertNil(t, s.Vacuum())
+	test.AssertEqual(t, 1, s.Len())
+	sauron, _ := s.data.Load("sauron")
+	size, err := s.fileSize()
+	test.AssertNil(t, err)
+	// gandalf's sequence number is kept by a marker
+	marker, err := s.seqMarker(s.seq)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, headerSize+sauron.Size()+uint64(len(marker)), size)
+	test.AssertNil(t, s.Close())
+}
+
+// TestModTime ensures ModTime reports when a key was last set, and that it
+// survives Expire, snapshots, and reopening the database.
+func TestModTime(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	now := time.Unix(3019, 0)
+	s, err := NewStorage(fname, 0644, WithClock(func() time.Time { return now }))
+	test.AssertNil(t, err)
+
+	_, ok := s.ModTime("bilbo")
+	test.AssertEqual(t, false, ok)
+
+	k, v := "bilbo", []byte("I'm going on an adventure!")
+	test.AssertNil(t, s.Set(k, v))
+	set := now
+	now = now.Add(time.Hour)
+
+	mod, ok := s.ModTime(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, true, set.Equal(mod))
+
+	// changing the expiry doesn't change the value, so it isn't a modification
+	test.AssertNil(t, s.Expire(k, time.Hour))
+	mod, ok = s.ModTime(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, true, set.Equal(mod))
+
+	snapname := filepath.Join(t.TempDir(), "snap")
+	test.AssertNil(t, s.Snapshot(snapname, 0644))
+	test.AssertNil(t, s.Close())
+
+	for _, name := range []string{fname, snapname} {
+		s, err = NewStorage(name, 0644, WithClock(func() time.Time { return now }))
+		test.AssertNil(t, err)
+		mod, ok = s.ModTime(k)
+		test.AssertEqual(t, true, ok)
+		test.AssertEqual(t, true, set.Equal(mod))
+		ttl, ok := s.GetTTL(k)
+		test.AssertEqual(t, true, ok)
+		test.AssertEqual(t, time.Hour, ttl)
+		test.AssertNil(t, s.Close())
+	}
+}
+
+// TestExpirePersists ensures expiry times survive reopening the database.
+func TestExpirePersists(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.SetWithTTL("boromir", []byte("One does not simply walk into Mordor."), time.Hour))
+	test.AssertNil(t, s.SetWithTTL("faramir", []byte("I would not take this thing."), -time.Hour))
+	test.AssertNil(t, s.SetWithTTL("denethor", []byte("Go now, and die in what way seems best to you."), time.Nanosecond))
+	test.AssertNil(t, s.Close())
+
+	time.Sleep(time.Millisecond)
+
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	ttl, ok := s.GetTTL("boromir")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, true, ttl > 0 && ttl <= time.Hour)
+	ttl, ok = s.GetTTL("faramir")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, time.Duration(0), ttl)
+	test.AssertEqual(t, false, s.Has("denethor"))
+	test.AssertEqual(t, 2, s.Len())
+	test.AssertNil(t, s.Close())
+}
+
+// TestUpgradeFormat ensures files in an older format version are readable, and
+// are rewritten in the current format when opened.
+func TestUpgradeFormat(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	// write a version 1 file
+	d := newDatum()
+	err := d.Set("frodo", []byte("I will take the Ring to Mordor."))
+	test.AssertNil(t, err)
+	old := (&header{version: 1}).Bytes()
+	m := make([]byte, metaSizeOf(1))
+	byteOrder.PutUint32(m[0:4], d.meta.keySize)
+	byteOrder.PutUint32(m[4:8], d.meta.valSize)
+	byteOrder.PutUint32(m[9:13], d.meta.crc)
+	old = append(old, m...)
+	old = append(old, []byte(d.key)...)
+	old = append(old, d.value...)
+	test.AssertNil(t, os.WriteFile(fname, old, 0644))
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, formatVersion, s.version)
+	frodo, ok := s.Get(d.key)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, d.value, frodo)
+	test.AssertNil(t, s.Verify())
+	test.AssertNil(t, s.Close())
+
+	b, err := os.ReadFile(fname)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, (&header{version: formatVersion}).Bytes(), b[:headerSize])
+	test.AssertEqual(t, headerSize+d.Size(), uint64(len(b)))
+}
+
+// TestClear ensures Clear deletes everything, leaving an empty database that
+// can still be written to.
+func TestClear(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("smaug", []byte("I am fire. I am death.")))
+	test.AssertNil(t, s.Set("thorin", []byte("If more of us valued food and cheer and song above hoarded gold, it would be a merrier world.")))
+	test.AssertNil(t, s.Clear())
+	test.AssertEqual(t, 0, s.Len())
+	test.AssertEqual(t, false, s.Has("smaug"))
+	// all that's left is the marker of the sequence number of the last delete
+	marker, err := s.seqMarker(4)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, uint64(headerSize+len(marker)), s.idx)
+	size, err := s.fileSize()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, uint64(headerSize+len(marker)), size)
+
+	test.AssertNil(t, s.Set("bard", []byte("Black arrow!")))
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, []string{"bard"}, s.Keys())
+	test.AssertNil(t, s.Close())
+	test.AssertEqual(t, ErrDBClosed, s.Clear())
+
+	// in-memory storage can be cleared too
+	m, err := NewMemStorage()
+	test.AssertNil(t, err)
+	test.AssertNil(t, m.Set("smaug", []byte("I am fire. I am death.")))
+	test.AssertNil(t, m.Clear())
+	test.AssertEqual(t, 0, m.Len())
+	test.AssertNil(t, m.Close())
+}
+
+// TestVacuum ensures that s.Vacuum compacts
+// the database file by removing deleted data.
+//
+// It also tests to a small extent that one can safely
+// and concurrently run Set/Delete operations on Storage.
+func TestVacuum(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	// set ticks to 0 so that we can call vacuum manually
+	now := time.Unix(3019, 0)
+	s, err := NewStorage(fname, 0644, &Config{VacuumBatch: 0, Clock: func() time.Time { return now }})
+	test.AssertNil(t, err)
+
+	expected := bytes.NewBuffer((&header{version: formatVersion}).Bytes())
+
+	type kv struct {
+		key string
+		val []byte
+	}
+	pairs := []kv{
+		{
+			key: "elrond",
+			val: []byte("Let him not vow to walk in the dark, who has not seen the nightfall."),
+		},
+		{
+			key: "tom",
+			val: []byte("Ring a ding dillo!"),
+		},
+		{
+			key: "sauron",
+			val: []byte("You cannot hide, I see you!"),
+		},
+		{
+			key: "gandalf",
+			val: []byte("Fly, you fools!"),
+		},
+		{
+			key: "faramir",
+			val: []byte("War will make corpses of us all."),
+		},
+	}
+
+	toDelete := map[string]struct{}{
+		"sauron":  struct{}{},
+		"faramir": struct{}{},
+	}
+
+	var wg sync.WaitGroup
+	order := make(chan kv, len(pairs))
+
+	for _, pair := range pairs {
+		p := pair
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.Set(p.key, p.val)
+			test.AssertNil(t, err)
+			order <- p
+		}()
+
+	}
+
+	wg.Wait()
+
+	// write the bytes to file in the order they come in
+	for i := 0; i < len(pairs); i++ {
+		p := <-order
+		if _, ok := toDelete[p.key]; !ok {
+			d := newDatum()
+			err := d.Set(p.key, p.val)
+			test.AssertNil(t, err)
+			d.meta.modTime = now.UnixNano()
+			d.meta.seq = uint64(i + 1)
+			expected.Write(d.Bytes())
+		}
+	}
+
+	for deleteMe := range toDelete {
+		wg.Add(1)
+		d := deleteMe
 
-	for deleteMe := range toDelete {
-		wg.Add(1)
-		d := deleteMe
-
 		go func() {
 			defer wg.Done()
 			err := s.Delete(d)
 			test.AssertNil(t, err)
-		}()
+		}()
+	}
+	wg.Wait()
+
+	for _, v := range pairs {
+		if _, ok := toDelete[v.key]; ok {
+			val, ok := s.Get(v.key)
+			test.AssertEqual(t, []byte(nil), val)
+			test.AssertEqual(t, false, ok)
+		} else {
+			val, ok := s.Get(v.key)
+			test.AssertEqual(t, true, ok)
+			test.AssertEqual(t, v.val, val)
+		}
+	}
+
+	// the deletes came last, so the last sequence number is kept by a marker
+	marker, err := s.seqMarker(s.seq)
+	test.AssertNil(t, err)
+	expected.Write(marker)
+
+	test.AssertNil(t, s.Vacuum())
+	test.AssertEqual(t, uint64(expected.Len()), s.idx)
+	test.AssertNil(t, s.Close())
+
+	got, err := os.ReadFile(fname)
+	test.AssertNil(t, err)
+
+	test.AssertEqual(t, expected.Bytes(), got)
+}
+
+// TestVacuumUpdatesOffsets ensures that vacuuming updates the offsets of the
+// datums in the in-memory map, so that later deletes tombstone the right record.
+func TestVacuumUpdatesOffsets(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0644, &Config{VacuumBatch: 10})
+	test.AssertNil(t, err)
+
+	// overwrite some keys so there's something to vacuum
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 10; j++ {
+			err = s.Set(fmt.Sprintf("ent-%d", j), []byte(fmt.Sprintf("treebeard says hoom %d", i)))
+			test.AssertNil(t, err)
+		}
 	}
-	wg.Wait()
 
-	for _, v := range pairs {
-		if _, ok := toDelete[v.key]; ok {
-			val, ok := s.Get(v.key)
-			test.AssertEqual(t, []byte(nil), val)
+	test.AssertNil(t, s.Vacuum())
+
+	err = s.Delete("ent-3")
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	for j := 0; j < 10; j++ {
+		val, ok := s.Get(fmt.Sprintf("ent-%d", j))
+		if j == 3 {
 			test.AssertEqual(t, false, ok)
+			test.AssertEqual(t, []byte(nil), val)
 		} else {
-			val, ok := s.Get(v.key)
 			test.AssertEqual(t, true, ok)
-			test.AssertEqual(t, v.val, val)
+			test.AssertEqual(t, []byte("treebeard says hoom 2"), val)
+		}
+	}
+}
+
+// TestVacuumTempDir ensures the vacuum's temporary file is created in the
+// configured TempDir, and cleaned up afterwards.
+func TestVacuumTempDir(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	tmp := t.TempDir()
+	s, err := NewStorage(fname, 0644, WithTempDir(filepath.Join(tmp, "mirkwood")))
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Set("thranduil", []byte("elvenking")))
+	test.AssertNil(t, s.Set("thranduil", []byte("king of the woodland realm")))
+
+	// the temp dir doesn't exist yet
+	test.AssertNotEqual(t, nil, s.Vacuum())
+	got, _ := s.Get("thranduil")
+	test.AssertEqual(t, []byte("king of the woodland realm"), got)
+	test.AssertNil(t, s.Set("legolas", []byte("prince of mirkwood")))
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644, WithTempDir(tmp))
+	test.AssertNil(t, err)
+	got, _ = s.Get("legolas")
+	test.AssertEqual(t, []byte("prince of mirkwood"), got)
+	test.AssertNil(t, s.Vacuum())
+	entries, err := os.ReadDir(tmp)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 0, len(entries))
+	test.AssertNil(t, s.Close())
+
+	// by default, it goes next to the database file, and is cleaned up too
+	s, err = NewStorage(fname, 0644)
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Vacuum())
+	entries, err = os.ReadDir(filepath.Dir(fname))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 1, len(entries))
+	test.AssertNil(t, s.Close())
+}
+
+// TestVacuumRename ensures vacuuming replaces the database file with a new one
+// with the same mode, rather than overwriting it, and keeps using the new one.
+func TestVacuumRename(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0640)
+	test.AssertNil(t, err)
+	test.AssertNil(t, os.Chmod(fname, 0640))
+	test.AssertNil(t, s.Set("gollum", []byte("smeagol")))
+	test.AssertNil(t, s.Set("gollum", []byte("stinker")))
+
+	before, err := os.Stat(fname)
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Vacuum())
+	after, err := os.Stat(fname)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, os.SameFile(before, after))
+	test.AssertEqual(t, os.FileMode(0640), after.Mode().Perm())
+
+	test.AssertNil(t, s.Set("deagol", []byte("found the ring first")))
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0640)
+	test.AssertNil(t, err)
+	got, _ := s.Get("gollum")
+	test.AssertEqual(t, []byte("stinker"), got)
+	got, _ = s.Get("deagol")
+	test.AssertEqual(t, []byte("found the ring first"), got)
+	test.AssertNil(t, s.Close())
+}
+
+// TestVacuumWorker ensures that the vacuum worker vacuums the database file in
+// the background every VacuumBatch writes.
+func TestVacuumWorker(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0644, &Config{VacuumBatch: 4})
+	test.AssertNil(t, err)
+
+	k, v := "gandalf", []byte("A wizard is never late.")
+	d := newDatum()
+	test.AssertNil(t, d.Set(k, v))
+
+	for i := 0; i < 4; i++ {
+		test.AssertNil(t, s.Set(k, v))
+	}
+
+	// wait for the worker to compact the file down to a single datum
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sz, err := s.fileSize()
+		test.AssertNil(t, err)
+		if sz == headerSize+d.Size() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected file size %d, got %d", headerSize+d.Size(), sz)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+	got, ok := s.Get(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, v, got)
+}
+
+// TestVacuumInterval ensures the vacuum worker vacuums the database file every
+// VacuumInterval, but only once there's something to reclaim.
+func TestVacuumInterval(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0644, WithVacuumBatch(0), WithVacuumInterval(5*time.Millisecond))
+	test.AssertNil(t, err)
+	vacuums := func() uint64 {
+		s.muFile.Lock()
+		defer s.muFile.Unlock()
+		return s.vacuums
+	}
+
+	test.AssertNil(t, s.Set("shadowfax", []byte("lord of all horses")))
+	time.Sleep(30 * time.Millisecond)
+	test.AssertEqual(t, uint64(0), vacuums())
+
+	test.AssertNil(t, s.Set("shadowfax", []byte("the horse of gandalf")))
+	deadline := time.Now().Add(5 * time.Second)
+	for vacuums() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a scheduled vacuum")
 		}
+		time.Sleep(time.Millisecond)
 	}
+	st, err := s.Stats()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, uint64(0), st.DeadBytes)
+	test.AssertNil(t, s.Close())
+}
+
+// TestVacuumFragmentation ensures that the vacuum worker vacuums the file once
+// enough of it is dead, and that dead bytes are counted across reopening.
+func TestVacuumFragmentation(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0644, WithVacuumBatch(0), WithVacuumFragmentationThreshold(0.6))
+	test.AssertNil(t, err)
+
+	k, v := "gandalf", []byte("A wizard is never late.")
+	d := newDatum()
+	test.AssertNil(t, d.Set(k, v))
 
-	test.AssertNil(t, s.vacuum())
+	// half the file is dead, which is under the threshold
+	test.AssertNil(t, s.Set(k, v))
+	test.AssertNil(t, s.Set(k, v))
 	test.AssertNil(t, s.Close())
 
+	s, err = NewStorage(fname, 0644, WithVacuumBatch(0), WithVacuumFragmentationThreshold(0.6))
+	test.AssertNil(t, err)
+	defer s.Close()
+	test.AssertEqual(t, 2*d.Size(), s.dataBytes)
+	test.AssertEqual(t, d.Size(), s.deadBytes)
+
+	// two thirds of the file is dead, which is over it
+	test.AssertNil(t, s.Set(k, v))
+
+	// wait for the worker to compact the file down to a single datum
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sz, err := s.fileSize()
+		test.AssertNil(t, err)
+		if sz == headerSize+d.Size() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected file size %d, got %d", headerSize+d.Size(), sz)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	s.muFile.Lock()
+	test.AssertEqual(t, d.Size(), s.dataBytes)
+	test.AssertEqual(t, uint64(0), s.deadBytes)
+	s.muFile.Unlock()
+
+	got, ok := s.Get(k)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, v, got)
+}
+
+// TestVerify ensures that Verify accepts a valid database file without
+// modifying it, and reports the offset of the first invalid record.
+func TestVerify(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0644, &Config{VacuumBatch: 0})
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	k, v := "elrond", []byte("The Ring cannot be destroyed, Gimli, son of Gloin, by any craft that we here possess.")
+	d := newDatum()
+	test.AssertNil(t, d.Set(k, v))
+
+	test.AssertNil(t, s.Set(k, v))
+	test.AssertNil(t, s.Set("gimli", []byte("Never thought I'd die fighting side by side with an Elf.")))
+	test.AssertNil(t, s.Delete("gimli"))
+
+	before, err := os.ReadFile(fname)
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Verify())
+	after, err := os.ReadFile(fname)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, before, after)
+
+	// a truncated record
+	test.AssertNil(t, s.file.Truncate(int64(len(before))-1))
+	err = s.Verify()
+	test.AssertEqual(t, true, errors.Is(err, ErrCorrupt))
+	test.AssertEqual(t, true, strings.HasPrefix(err.Error(), fmt.Sprintf("record at %d: ", headerSize+d.Size())))
+
+	// an invalid deleted byte
+	_, err = s.file.Seek(int64(headerSize+d.Size())+deletedOffset, 0)
+	test.AssertNil(t, err)
+	_, err = s.file.Write([]byte{2})
+	test.AssertNil(t, err)
+	err = s.Verify()
+	test.AssertEqual(t, true, errors.Is(err, ErrCorrupt))
+	test.AssertEqual(t, fmt.Sprintf("record at %d: corrupt record: invalid deleted byte 0x2", headerSize+d.Size()), err.Error())
+
+	// a checksum mismatch
+	_, err = s.file.Seek(int64(headerSize+d.Size())-1, 0)
+	test.AssertNil(t, err)
+	_, err = s.file.Write([]byte{'!'})
+	test.AssertNil(t, err)
+	err = s.Verify()
+	test.AssertEqual(t, true, errors.Is(err, ErrChecksumMismatch))
+	test.AssertEqual(t, true, strings.HasPrefix(err.Error(), fmt.Sprintf("record at %d: ", headerSize)))
+}
+
+// TestRepair ensures that Repair truncates a partially written record from the
+// end of a database file, and only from the end.
+func TestRepair(t *testing.T) {
+	fname := createTestDBFile(t)
+
+	// a valid file needs no repairs
+	n, err := Repair(fname)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(0), n)
+
+	good, err := os.ReadFile(fname)
+	test.AssertNil(t, err)
+
+	// write half a record to the end of the file
+	d := newDatum()
+	test.AssertNil(t, d.Set("legolas", []byte("A red sun rises. Blood has been spilled this night.")))
+	partial := d.Bytes()[:d.Size()/2]
+	f, err := os.OpenFile(fname, os.O_APPEND|os.O_WRONLY, 0644)
+	test.AssertNil(t, err)
+	_, err = f.Write(partial)
+	test.AssertNil(t, err)
+	test.AssertNil(t, f.Close())
+
+	_, err = NewStorage(fname, 0644, nil)
+	test.AssertNotEqual(t, nil, err)
+
+	n, err = Repair(fname)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(len(partial)), n)
+
 	got, err := os.ReadFile(fname)
 	test.AssertNil(t, err)
+	test.AssertEqual(t, good, got)
 
-	test.AssertEqual(t, expected.Bytes(), got)
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 3, s.Len())
+	test.AssertNil(t, s.Close())
+
+	// corruption in the middle of the file can't be repaired
+	corrupt := append([]byte{}, good...)
+	corrupt[headerSize+minMetaSize] ^= 0xff
+	test.AssertNil(t, os.WriteFile(fname, corrupt, 0644))
+
+	n, err = Repair(fname)
+	test.AssertEqual(t, true, errors.Is(err, ErrChecksumMismatch))
+	test.AssertEqual(t, int64(0), n)
+
+	got, err = os.ReadFile(fname)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, corrupt, got)
+}
+
+// TestOpenTornWrite ensures opening a database file whose last record was cut
+// short fails with a TornWriteError, or truncates the record with
+// RepairTornWrite, while corruption in the middle of the file is still an error.
+func TestOpenTornWrite(t *testing.T) {
+	fname := createTestDBFile(t)
+	good, err := os.ReadFile(fname)
+	test.AssertNil(t, err)
+
+	d := newDatum()
+	test.AssertNil(t, d.Set("aragorn", []byte("You shall not pass!")))
+	b := d.Bytes()
+	for _, cut := range []uint64{minMetaSize - 1, d.Size() - 1} {
+		test.AssertNil(t, os.WriteFile(fname, append(append([]byte{}, good...), b[:cut]...), 0644))
+
+		_, err := NewStorage(fname, 0644, nil)
+		test.AssertEqual(t, true, errors.Is(err, ErrTornWrite))
+		test.AssertEqual(t, true, errors.Is(err, ErrCorrupt))
+		var torn *TornWriteError
+		test.AssertEqual(t, true, errors.As(err, &torn))
+		test.AssertEqual(t, int64(len(good)), torn.Good)
+		test.AssertEqual(t, int64(len(good))+int64(cut), torn.Size)
+
+		l := &recordLogger{}
+		s, err := NewStorage(fname, 0644, WithRepairTornWrite(true), WithOpenConcurrency(2), WithLogger(l))
+		test.AssertNil(t, err)
+		test.AssertEqual(t, 3, s.Len())
+		test.AssertEqual(t, true, loggedPrefix(l, fmt.Sprintf("bugfruit: discarded %d bytes of a torn write at the end of %s", cut, fname)))
+		test.AssertNil(t, s.Close())
+		got, err := os.ReadFile(fname)
+		test.AssertNil(t, err)
+		test.AssertEqual(t, good, got)
+	}
+
+	// corruption in the middle of the file isn't a torn write
+	corrupt := append([]byte{}, good...)
+	corrupt[headerSize+minMetaSize] ^= 0xff
+	test.AssertNil(t, os.WriteFile(fname, append(corrupt, b[:5]...), 0644))
+	_, err = NewStorage(fname, 0644, WithRepairTornWrite(true))
+	test.AssertEqual(t, true, errors.Is(err, ErrChecksumMismatch))
+	test.AssertEqual(t, false, errors.Is(err, ErrTornWrite))
+}
+
+// TestWriteTo ensures WriteTo writes a database file that NewStorage can open.
+func TestWriteTo(t *testing.T) {
+	s, err := NewMemStorage(WithCompression(GzipCompression))
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	song := bytes.Repeat([]byte("Ho! Ho! Ho! to the bottle I go "), 10)
+	test.AssertNil(t, s.Set("pippin", song))
+	test.AssertNil(t, s.Set("merry", []byte("To heal my heart and drown my woe.")))
+	test.AssertNil(t, s.Set("bill ferny", []byte("Squint-eyed.")))
+	test.AssertNil(t, s.Delete("bill ferny"))
+
+	var buf bytes.Buffer
+	n, err := s.WriteTo(&buf)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, int64(buf.Len()), n)
+
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	test.AssertNil(t, os.WriteFile(fname, buf.Bytes(), 0644))
+	r, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer r.Close()
+	test.AssertNil(t, r.Verify())
+	test.AssertEqual(t, 2, r.Len())
+	got, _ := r.Get("pippin")
+	test.AssertEqual(t, song, got)
+	got, _ = r.Get("merry")
+	test.AssertEqual(t, []byte("To heal my heart and drown my woe."), got)
+
+	_, err = s.WriteTo(errWriter{})
+	test.AssertEqual(t, true, errors.Is(err, errWrite))
+
+	test.AssertNil(t, s.Close())
+	_, err = s.WriteTo(&buf)
+	test.AssertEqual(t, ErrDBClosed, err)
+}
+
+// TestRestoreFrom ensures that RestoreFrom restores a stream written by WriteTo,
+// and cleans up after a truncated stream.
+func TestRestoreFrom(t *testing.T) {
+	s, err := NewMemStorage(WithEncryptionKey(bytes.Repeat([]byte("k"), 32)))
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.Set("sam", []byte("Share the load.")))
+	test.AssertNil(t, s.Set("frodo", []byte("I will take the Ring, though I do not know the way.")))
+	test.AssertNil(t, s.Set("gollum", []byte("My precious.")))
+	test.AssertNil(t, s.Delete("gollum"))
+
+	var buf bytes.Buffer
+	_, err = s.WriteTo(&buf)
+	test.AssertNil(t, err)
+
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	r, err := RestoreFrom(fname, 0644, bytes.NewReader(buf.Bytes()), WithEncryptionKey(bytes.Repeat([]byte("k"), 32)))
+	test.AssertNil(t, err)
+	test.AssertNil(t, r.Verify())
+	test.AssertEqual(t, 2, r.Len())
+	got, _ := r.Get("sam")
+	test.AssertEqual(t, []byte("Share the load."), got)
+	got, _ = r.Get("frodo")
+	test.AssertEqual(t, []byte("I will take the Ring, though I do not know the way."), got)
+	test.AssertNil(t, r.Close())
+
+	// every cut short of the end is a truncated stream, which leaves the
+	// existing file as it was
+	for _, n := range []int{0, headerSize - 1, headerSize + 1, buf.Len() - 3, buf.Len() - 1} {
+		_, err = RestoreFrom(fname, 0644, bytes.NewReader(buf.Bytes()[:n]))
+		test.AssertNotEqual(t, nil, err)
+	}
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	_, err = RestoreFrom(fname, 0644, bytes.NewReader(corrupt))
+	test.AssertEqual(t, true, errors.Is(err, ErrChecksumMismatch))
+
+	r, err = NewStorage(fname, 0644, WithEncryptionKey(bytes.Repeat([]byte("k"), 32)))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 2, r.Len())
+	got, _ = r.Get("sam")
+	test.AssertEqual(t, []byte("Share the load."), got)
+	test.AssertNil(t, r.Close())
+
+	// no temp files are left behind
+	entries, err := os.ReadDir(filepath.Dir(fname))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 1, len(entries))
+}
+
+// TestRestoreFromTruncated ensures a truncated stream restored over a database
+// leaves the database as it was, with its write-ahead log.
+func TestRestoreFromTruncated(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0644, WithWAL(true))
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Set("precious", []byte("my own, my love")))
+	test.AssertNil(t, s.Close())
+
+	m, err := NewMemStorage()
+	test.AssertNil(t, err)
+	test.AssertNil(t, m.Set("ring", []byte("one ring to rule them all")))
+	var buf bytes.Buffer
+	_, err = m.WriteTo(&buf)
+	test.AssertNil(t, err)
+
+	_, err = RestoreFrom(fname, 0644, bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	test.AssertNotEqual(t, nil, err)
+	_, err = os.Stat(fname + walSuffix)
+	test.AssertNil(t, err)
+
+	s, err = NewStorage(fname, 0644, WithWAL(true))
+	test.AssertNil(t, err)
+	defer s.Close()
+	got, ok := s.Get("precious")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("my own, my love"), got)
+	test.AssertEqual(t, false, s.Has("ring"))
+}
+
+// TestFileFixture ensures a database file is read the same way on every
+// platform, by opening a fixture with its numbers spelled out byte by byte.
+func TestFileFixture(t *testing.T) {
+	fixture := []byte{
+		// header: magic, then version 4
+		'B', 'G', 'F', 'R', 0x04, 0x00,
+		// key size 3, value size 4, not deleted
+		0x03, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00,
+		// crc
+		0x45, 0x3c, 0x6c, 0xa9,
+		// never expires
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// modified at 3019 seconds after the epoch
+		0x00, 0x2e, 0x6c, 0xea, 0xbe, 0x02, 0x00, 0x00,
+		// no flags
+		0x00,
+		'e', 'n', 't', 'h', 'o', 'o', 'm',
+	}
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	test.AssertNil(t, os.WriteFile(fname, fixture, 0644))
+
+	s, err := NewStorage(fname, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+	got, ok := s.Get("ent")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("hoom"), got)
+	mod, _ := s.ModTime("ent")
+	test.AssertEqual(t, time.Unix(3019, 0), mod)
+	ttl, ok := s.GetTTL("ent")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, time.Duration(0), ttl)
 }
 
 // TestSnapshot ensures that Snapshot accurately snapshots Storage.
@@ -541,3 +3474,171 @@ func TestSnapshot(t *testing.T) {
 		test.AssertEqual(t, expVal, bval)
 	}
 }
+
+// TestSnapshotKeepsOffsets ensures that taking a Snapshot does not change the
+// offsets of the datums in the source Storage.
+func TestSnapshotKeepsOffsets(t *testing.T) {
+	testA := filepath.Join(t.TempDir(), "testA")
+	s, err := NewStorage(testA, 0644, nil)
+	test.AssertNil(t, err)
+
+	kvs := []struct {
+		k string
+		v []byte
+	}{
+		{
+			k: "bilbo",
+			v: []byte("I'm going on an adventure!"),
+		},
+		{
+			k: "thorin",
+			v: []byte("If more of us valued food and cheer and song above hoarded gold, it would be a merrier world."),
+		},
+		{
+			k: "smaug",
+			v: []byte("I am fire. I am death."),
+		},
+	}
+
+	// leave some garbage at the start of the file so the snapshot's offsets
+	// differ from ours
+	test.AssertNil(t, s.Set("bilbo", []byte("Good morning!")))
+	for _, kv := range kvs {
+		test.AssertNil(t, s.Set(kv.k, kv.v))
+	}
+
+	testB := filepath.Join(t.TempDir(), "testB")
+	test.AssertNil(t, s.Snapshot(testB, 0644))
+
+	// delete from the original, then make sure the original is still intact
+	test.AssertNil(t, s.Delete("smaug"))
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(testA, 0644, nil)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	for _, kv := range kvs {
+		val, ok := s.Get(kv.k)
+		if kv.k == "smaug" {
+			test.AssertEqual(t, false, ok)
+			test.AssertEqual(t, []byte(nil), val)
+		} else {
+			test.AssertEqual(t, true, ok)
+			test.AssertEqual(t, kv.v, val)
+		}
+	}
+}
+
+// TestOpenDuplicates ensures that when the database file has more than one live
+// record for a key, like after a crash, opening it keeps the latest, marks the
+// others deleted, and vacuums them away if vacuuming is on.
+func TestOpenDuplicates(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	write := func() {
+		s, err := NewStorage(fname, 0600)
+		test.AssertNil(t, err)
+		test.AssertNil(t, s.Set("gollum", []byte("smeagol")))
+		test.AssertNil(t, s.Set("bilbo", []byte("baggins")))
+		// appended without deleting the records they replace
+		s.muFile.Lock()
+		test.AssertNil(t, s.appendDatum("gollum", []byte("stinker"), 0))
+		test.AssertNil(t, s.appendDatum("bilbo", []byte("ring-bearer"), 1))
+		s.muFile.Unlock()
+		test.AssertNil(t, s.Close())
+	}
+
+	write()
+	l := &recordLogger{}
+	s, err := NewStorage(fname, 0600, WithLogger(l))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, 1, s.Len())
+	got, _ := s.Get("gollum")
+	test.AssertEqual(t, []byte("stinker"), got)
+	// the later record for bilbo is expired, so he's gone
+	_, ok := s.Get("bilbo")
+	test.AssertEqual(t, false, ok)
+	test.AssertEqual(t, uint64(1), s.vacuums)
+	// bilbo's expired record had the last sequence number, which is kept by a
+	// marker
+	marker, err := s.seqMarker(s.seq)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, uint64(len(marker)), s.deadBytes)
+	d, _ := s.data.Load("gollum")
+	size, err := s.fileSize()
+	test.AssertNil(t, err)
+	test.AssertEqual(t, headerSize+d.Size()+uint64(len(marker)), size)
+	test.AssertEqual(t, true, loggedPrefix(l, "bugfruit: "+fname+" has 2 records that were replaced, but not deleted"))
+	test.AssertNil(t, s.Close())
+
+	// without vacuuming, they're still deleted, so they're dead on later opens
+	test.AssertNil(t, os.Remove(fname))
+	write()
+	s, err = NewStorage(fname, 0600, WithVacuumBatch(0))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, uint64(0), s.vacuums)
+	dead := s.deadBytes
+	test.AssertNil(t, s.Close())
+	l = &recordLogger{}
+	s, err = NewStorage(fname, 0600, WithVacuumBatch(0), WithLogger(l))
+	test.AssertNil(t, err)
+	test.AssertEqual(t, dead, s.deadBytes)
+	test.AssertEqual(t, false, loggedPrefix(l, "bugfruit: "+fname+" has "))
+	got, _ = s.Get("gollum")
+	test.AssertEqual(t, []byte("stinker"), got)
+	test.AssertNil(t, s.Close())
+}
+
+// BenchmarkOpen measures opening a database file of 100,000 keys, which reads
+// every record in it.
+func BenchmarkOpen(b *testing.B) {
+	fname := filepath.Join(b.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithFsyncBatch(0), WithWriteBufferSize(1<<20))
+	if err != nil {
+		b.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("mellon"), 16)
+	for i := 0; i < 100000; i++ {
+		if err := s.Set(fmt.Sprintf("door-of-durin-%d", i), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, err := NewStorage(fname, 0600, WithVacuumBatch(0))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSet measures setting keys, with and without a write buffer.
+func BenchmarkSet(b *testing.B) {
+	for _, wbuf := range []int{0, 1 << 20} {
+		b.Run(fmt.Sprintf("wbuf=%d", wbuf), func(b *testing.B) {
+			fname := filepath.Join(b.TempDir(), "testing-testing-one-two-three")
+			s, err := NewStorage(fname, 0600, WithFsyncBatch(0), WithVacuumBatch(0), WithWriteBufferSize(wbuf))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			value := bytes.Repeat([]byte("mellon"), 16)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := s.Set("speak friend and enter", value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package bugfruit
+
+// Tx is a transaction: a Batch of sets and deletes whose Get sees the writes
+// in it before they're committed. Gets of keys it hasn't written read the
+// database as it is at the time, so writes committed by others since the Tx
+// began are seen. It's all-or-nothing across a crash or an error, so a Tx on a
+// Storage created by NewStorage needs Config.WAL on. A Tx is not safe for
+// concurrent use.
+type Tx struct {
+	b       Batch
+	pending map[string]batchOp // the last write of each key in the Tx
+	done    bool
+}
+
+// Begin returns a transaction on s with no writes in it.
+func (s *Storage) Begin() *Tx {
+	return &Tx{b: Batch{s: s}, pending: map[string]batchOp{}}
+}
+
+// Get returns a copy of the value of the key as the Tx would leave it, and
+// whether it exists.
+func (tx *Tx) Get(key string) ([]byte, bool) {
+	if o, ok := tx.pending[key]; ok {
+		if o.op == walDelete {
+			return nil, false
+		}
+		return copyValue(o.value), true
+	}
+	return tx.b.s.Get(key)
+}
+
+// Set adds setting the key/value pair to the Tx. The value is copied, so the
+// caller may reuse it.
+func (tx *Tx) Set(key string, value []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.b.Set(key, value)
+	tx.pending[key] = tx.b.ops[len(tx.b.ops)-1]
+	return nil
+}
+
+// Delete adds deleting the key to the Tx.
+func (tx *Tx) Delete(key string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.b.Delete(key)
+	tx.pending[key] = tx.b.ops[len(tx.b.ops)-1]
+	return nil
+}
+
+// Commit writes every write in the Tx like Batch.Commit, with one sync of the
+// database file. Without Config.WAL, an error partway through would leave the
+// Tx half written, so ErrNoWAL is returned instead for a Storage created by
+// NewStorage, and nothing is written. The Tx is done once Commit returns, even
+// if it returns an error, in which case its writes may need to be retried in a
+// new Tx.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if s := tx.b.s; s.wal == nil && !s.mem && !s.isClosed() {
+		tx.Rollback()
+		return ErrNoWAL
+	}
+	tx.done = true
+	tx.pending = map[string]batchOp{}
+	return tx.b.Commit()
+}
+
+// Rollback discards the writes in the Tx, none of which were written to the
+// database.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.pending = map[string]batchOp{}
+	tx.b.ops = nil
+	return nil
+}
@@ -0,0 +1,98 @@
+package bugfruit
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestTx ensures a Tx sees its own writes, and that they're only in the
+// database once it's committed.
+func TestTx(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithWAL(true))
+	test.AssertNil(t, err)
+
+	test.AssertNil(t, s.Set("ring", []byte("frodo")))
+	test.AssertNil(t, s.Set("sting", []byte("bilbo")))
+
+	tx := s.Begin()
+	v := []byte("sam")
+	test.AssertNil(t, tx.Set("ring", v))
+	v[0] = 'p'
+	test.AssertNil(t, tx.Delete("sting"))
+	test.AssertNil(t, tx.Set("light of earendil", []byte("galadriel")))
+	got, ok := tx.Get("ring")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("sam"), got)
+	_, ok = tx.Get("sting")
+	test.AssertEqual(t, false, ok)
+
+	// nothing's written until it's committed
+	got, _ = s.Get("ring")
+	test.AssertEqual(t, []byte("frodo"), got)
+	test.AssertEqual(t, []string{"ring", "sting"}, s.SortedKeys())
+
+	// a later write of a key in the Tx wins
+	test.AssertNil(t, tx.Set("sting", []byte("sam")))
+	got, _ = tx.Get("sting")
+	test.AssertEqual(t, []byte("sam"), got)
+
+	test.AssertNil(t, tx.Commit())
+	test.AssertEqual(t, ErrTxDone, tx.Commit())
+	test.AssertEqual(t, ErrTxDone, tx.Set("ring", []byte("gollum")))
+	test.AssertEqual(t, ErrTxDone, tx.Rollback())
+	test.AssertNil(t, s.Close())
+
+	s, err = NewStorage(fname, 0600, WithWAL(true))
+	test.AssertNil(t, err)
+	defer s.Close()
+	got, _ = s.Get("ring")
+	test.AssertEqual(t, []byte("sam"), got)
+	got, _ = s.Get("sting")
+	test.AssertEqual(t, []byte("sam"), got)
+	test.AssertEqual(t, []string{"light of earendil", "ring", "sting"}, s.SortedKeys())
+}
+
+// TestTxRollback ensures a rolled back Tx writes nothing.
+func TestTxRollback(t *testing.T) {
+	s, err := NewStorage(filepath.Join(t.TempDir(), "testing-testing-one-two-three"), 0600)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.Set("ring", []byte("frodo")))
+	tx := s.Begin()
+	test.AssertNil(t, tx.Set("ring", []byte("gollum")))
+	test.AssertNil(t, tx.Delete("ring"))
+	test.AssertNil(t, tx.Rollback())
+	got, ok := tx.Get("ring")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("frodo"), got)
+	test.AssertEqual(t, ErrTxDone, tx.Commit())
+	got, _ = s.Get("ring")
+	test.AssertEqual(t, []byte("frodo"), got)
+}
+
+// TestTxNoWAL ensures a Tx on a database file without the write-ahead log
+// writes nothing, since it couldn't be all-or-nothing.
+func TestTxNoWAL(t *testing.T) {
+	s, err := NewStorage(filepath.Join(t.TempDir(), "testing-testing-one-two-three"), 0600)
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	tx := s.Begin()
+	test.AssertNil(t, tx.Set("ring", []byte("gollum")))
+	test.AssertEqual(t, ErrNoWAL, tx.Commit())
+	test.AssertEqual(t, ErrTxDone, tx.Commit())
+	test.AssertEqual(t, false, s.Has("ring"))
+
+	// a Storage that only lives in memory has no file to leave half written
+	m, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer m.Close()
+	tx = m.Begin()
+	test.AssertNil(t, tx.Set("ring", []byte("gollum")))
+	test.AssertNil(t, tx.Commit())
+	test.AssertEqual(t, true, m.Has("ring"))
+}
@@ -0,0 +1,67 @@
+package bugfruit
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Codec converts values to and from the bytes stored in the database.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec is a Codec that stores values as JSON.
+type JSONCodec struct{}
+
+// Marshal returns the JSON encoding of v.
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal parses the JSON encoded data into v.
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// Typed stores values of type T in a Storage, converting them to and from bytes
+// with a Codec.
+type Typed[T any] struct {
+	s     *Storage
+	codec Codec
+}
+
+// NewTyped returns a Typed that stores values in s with codec. A nil codec
+// defaults to JSONCodec.
+func NewTyped[T any](s *Storage, codec Codec) *Typed[T] {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &Typed[T]{s: s, codec: codec}
+}
+
+// Get returns the value for a key and whether the key was found.
+func (t *Typed[T]) Get(key string) (T, bool, error) {
+	var v T
+	if t.s.isClosed() {
+		return v, false, ErrDBClosed
+	}
+
+	b, ok := t.s.Get(key)
+	if !ok {
+		return v, false, nil
+	}
+	if err := t.codec.Unmarshal(b, &v); err != nil {
+		return v, true, fmt.Errorf("decoding '%s': %w", key, err)
+	}
+	return v, true, nil
+}
+
+// Set sets the value for a key in-memory and on disk. Returns nil on success.
+func (t *Typed[T]) Set(key string, v T) error {
+	b, err := t.codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding '%s': %w", key, err)
+	}
+	return t.s.Set(key, b)
+}
@@ -0,0 +1,51 @@
+package bugfruit
+
+import (
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+type hobbit struct {
+	Name  string   `json:"name"`
+	Age   int      `json:"age"`
+	Meals []string `json:"meals"`
+}
+
+func TestTyped(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	hobbits := NewTyped[hobbit](s, nil)
+	bilbo := hobbit{
+		Name:  "Bilbo Baggins",
+		Age:   111,
+		Meals: []string{"breakfast", "second breakfast", "elevenses", "luncheon", "afternoon tea", "dinner", "supper"},
+	}
+	test.AssertNil(t, hobbits.Set("bilbo", bilbo))
+
+	got, ok, err := hobbits.Get("bilbo")
+	test.AssertNil(t, err)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, bilbo, got)
+
+	// the bytes are still there for the untyped API
+	b, _ := s.Get("bilbo")
+	test.AssertEqual(t, `{"name":"Bilbo Baggins","age":111,"meals":["breakfast","second breakfast","elevenses","luncheon","afternoon tea","dinner","supper"]}`, string(b))
+
+	got, ok, err = hobbits.Get("sackville-baggins")
+	test.AssertNil(t, err)
+	test.AssertEqual(t, false, ok)
+	test.AssertEqual(t, hobbit{}, got)
+
+	test.AssertNil(t, s.Set("gollum", []byte("not a hobbit anymore")))
+	_, ok, err = hobbits.Get("gollum")
+	test.AssertNotEqual(t, nil, err)
+	test.AssertEqual(t, true, ok)
+
+	test.AssertNil(t, s.Close())
+	_, _, err = hobbits.Get("bilbo")
+	test.AssertEqual(t, ErrDBClosed, err)
+	test.AssertEqual(t, ErrDBClosed, hobbits.Set("bilbo", bilbo))
+}
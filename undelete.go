@@ -0,0 +1,129 @@
+package bugfruit
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// noteTombstone keeps track of d, which is being deleted, as the latest deleted
+// datum of its key if its key was deleted, and not just set again, so Undelete
+// can restore it. Without a database file to read it back from, its value is
+// kept in memory.
+// It is NOT thread safe without external file locking.
+func (s *Storage) noteTombstone(d *datum) {
+	if !s.deleting(d) {
+		return
+	}
+	s.dropTombstone(d.key)
+	m := *d.meta
+	t := &datum{meta: &m, key: d.key, idx: d.idx, size: d.size, spilled: true}
+	if s.mem {
+		t.value, t.spilled = d.value, false
+	}
+	s.tombstones[d.key] = t
+	s.tombKeys[d.idx] = d.key
+}
+
+// deleting returns whether d is being deleted because its key was, rather than
+// because it's being replaced by a new datum for its key.
+// It is NOT thread safe without external file locking.
+func (s *Storage) deleting(d *datum) bool {
+	if d.Deleted() != byte(1) {
+		return false
+	}
+	_, ok := s.data.Load(d.key)
+	return !ok
+}
+
+// dropTombstone forgets the deleted datum of key, if there is one.
+// It is NOT thread safe without external file locking.
+func (s *Storage) dropTombstone(key string) {
+	if t, ok := s.tombstones[key]; ok {
+		delete(s.tombKeys, t.idx)
+		delete(s.tombstones, key)
+	}
+}
+
+// dropTombstoneAt forgets the deleted datum at idx, if there is one, since its
+// space is being reused.
+// It is NOT thread safe without external file locking.
+func (s *Storage) dropTombstoneAt(idx uint64) {
+	if key, ok := s.tombKeys[idx]; ok {
+		s.dropTombstone(key)
+	}
+}
+
+// Undelete restores the value the key had when it was last deleted, with its
+// expiry and modification time, by clearing the deleted byte of its record.
+// It returns ErrNotDeleted if the key isn't in Tombstones, because it exists,
+// or was never deleted, or its record isn't there to restore anymore since the
+// file was vacuumed or cleared or the space was reused, or if the record would
+// already have expired. It returns ErrSnapshotActive while there's a
+// ReadSnapshot.
+//
+// Setting a key again forgets its deleted record, so only the last delete of a
+// key can be undone, and only until the key is set.
+func (s *Storage) Undelete(key string) error {
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	s.muFile.Lock()
+	defer s.unlockFile()
+
+	// the deleted byte is written in place, which a snapshot may be copying
+	if err := s.unprotectedWaitForSnapshots(); err != nil {
+		return err
+	}
+	t, ok := s.tombstones[key]
+	if !ok || t.expired(s.now()) {
+		return ErrNotDeleted
+	}
+
+	if t.spilled {
+		if err := s.unprotectedFlush(); err != nil {
+			return err
+		}
+		v, err := s.readValueAt(t)
+		if errors.Is(err, ErrCorrupt) {
+			// the record isn't the key's anymore
+			s.dropTombstone(key)
+			return ErrNotDeleted
+		} else if err != nil {
+			return fmt.Errorf("reading '%s': %w", key, err)
+		}
+		t.value, t.spilled = v, false
+	}
+
+	if err := s.writeAt(t.idx+deletedOffset, []byte{0}); err != nil {
+		return fmt.Errorf("undeleting '%s': updating db file: %w", key, err)
+	}
+	if err := s.writeSeq(t, s.seq+1); err != nil {
+		return fmt.Errorf("undeleting '%s': %w", key, err)
+	}
+	t.meta.deleted = 0
+	s.unfreeSpace(t.idx, t.Size())
+	s.seq++
+	t.meta.seq = s.seq
+	s.unprotectedPublishChange(Change{Seq: s.seq, Op: OpSet, Key: key, Value: t.value})
+	s.storeDatum(t)
+	return s.incAndSync(1, false)
+}
+
+// Tombstones returns the keys deleted since the Storage was opened whose
+// deleted records are still in the database file, in sorted order. Each has a
+// record Undelete can restore unless it would already have expired. Keys set
+// again since they were deleted aren't included, nor are keys deleted before the
+// Storage was opened, though their records are in the file until it's vacuumed.
+func (s *Storage) Tombstones() []string {
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	keys := make([]string, 0, len(s.tombstones))
+	for k := range s.tombstones {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,102 @@
+package bugfruit
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestUndelete ensures Undelete restores the last deleted value of a key, for
+// good, and only while its record is still there.
+func TestUndelete(t *testing.T) {
+	configs := map[string][]Option{
+		"plain":       {},
+		"reuse space": {WithReuseSpace(true)},
+		"encrypted":   {WithDiskValues(true), WithEncryptionKey(bytes.Repeat([]byte("k"), 32)), WithCompression(GzipCompression)},
+	}
+	for name, opts := range configs {
+		t.Run(name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+			opts := append([]Option{WithVacuumBatch(0)}, opts...)
+			s, err := NewStorage(fname, 0600, opts...)
+			test.AssertNil(t, err)
+
+			test.AssertNil(t, s.Set("gandalf", []byte("the grey")))
+			test.AssertNil(t, s.Set("gandalf", []byte("the white")))
+			test.AssertNil(t, s.Delete("gandalf"))
+			test.AssertNil(t, s.Undelete("gandalf"))
+			got, _ := s.Get("gandalf")
+			test.AssertEqual(t, []byte("the white"), got)
+			test.AssertEqual(t, ErrNotDeleted, s.Undelete("gandalf"))
+			test.AssertEqual(t, ErrNotDeleted, s.Undelete("radagast"))
+
+			// deleted, then set again
+			test.AssertNil(t, s.Set("saruman", []byte("the white")))
+			test.AssertNil(t, s.Delete("saruman"))
+			test.AssertNil(t, s.Set("saruman", []byte("of many colours")))
+			test.AssertEqual(t, ErrNotDeleted, s.Undelete("saruman"))
+
+			// expired since it was deleted
+			test.AssertNil(t, s.SetWithTTL("balrog", []byte("flame of udun"), time.Nanosecond))
+			test.AssertNil(t, s.Delete("balrog"))
+			test.AssertEqual(t, ErrNotDeleted, s.Undelete("balrog"))
+
+			test.AssertNil(t, s.Set("shadowfax", []byte("lord of horses")))
+			test.AssertNil(t, s.Delete("shadowfax"))
+			test.AssertEqual(t, []string{"balrog", "shadowfax"}, s.Tombstones())
+			test.AssertNil(t, s.Close())
+
+			s, err = NewStorage(fname, 0600, opts...)
+			test.AssertNil(t, err)
+			got, _ = s.Get("gandalf")
+			test.AssertEqual(t, []byte("the white"), got)
+			got, _ = s.Get("saruman")
+			test.AssertEqual(t, []byte("of many colours"), got)
+			test.AssertEqual(t, []string{"gandalf", "saruman"}, s.SortedKeys())
+
+			// a vacuum leaves nothing to restore
+			test.AssertEqual(t, []string{}, s.Tombstones())
+			test.AssertNil(t, s.Delete("gandalf"))
+			test.AssertEqual(t, []string{"gandalf"}, s.Tombstones())
+			test.AssertNil(t, s.Vacuum())
+			test.AssertEqual(t, []string{}, s.Tombstones())
+			test.AssertEqual(t, ErrNotDeleted, s.Undelete("gandalf"))
+			test.AssertNil(t, s.Close())
+			test.AssertEqual(t, ErrDBClosed, s.Undelete("gandalf"))
+		})
+	}
+}
+
+// TestUndeleteReused ensures a key whose record's space was reused by another
+// key can't be restored.
+func TestUndeleteReused(t *testing.T) {
+	s, err := NewStorage(filepath.Join(t.TempDir(), "testing-testing-one-two-three"), 0600, WithReuseSpace(true))
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.Set("bill", []byte("pony")))
+	test.AssertNil(t, s.Delete("bill"))
+	test.AssertNil(t, s.Set("bela", []byte("pony")))
+	test.AssertNil(t, s.Delete("bela"))
+	test.AssertEqual(t, []string{"bela"}, s.Tombstones())
+	test.AssertEqual(t, ErrNotDeleted, s.Undelete("bill"))
+	test.AssertNil(t, s.Undelete("bela"))
+	got, _ := s.Get("bela")
+	test.AssertEqual(t, []byte("pony"), got)
+}
+
+// TestUndeleteMem ensures Undelete works without a database file.
+func TestUndeleteMem(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.Set("bilbo", []byte("there and back again")))
+	test.AssertNil(t, s.Delete("bilbo"))
+	test.AssertNil(t, s.Undelete("bilbo"))
+	got, _ := s.Get("bilbo")
+	test.AssertEqual(t, []byte("there and back again"), got)
+}
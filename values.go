@@ -0,0 +1,177 @@
+package bugfruit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// diskValues returns whether values are kept in the database file instead of in
+// memory.
+func (s *Storage) diskValues() bool {
+	return s.config.DiskValues && !s.mem
+}
+
+// spill drops the value of d from memory if values are kept in the database
+// file. Its metadata still describes the value as it was set. It must be done
+// before d is added to the in-memory map.
+func (s *Storage) spill(d *datum) {
+	if s.diskValues() {
+		d.value, d.spilled = nil, true
+	}
+}
+
+// storeDatum adds d, once it's been written to the database file, to the
+// in-memory map. If values are kept in the database file, its value is cached,
+// then dropped from memory.
+// It is NOT thread safe without external file locking.
+func (s *Storage) storeDatum(d *datum) {
+	if s.diskValues() {
+		s.cache.add(d, d.value)
+		s.spill(d)
+	}
+	s.dropTombstone(d.key)
+	s.data.Store(d.key, d)
+}
+
+// value returns a copy of the value of d, which was loaded from the in-memory
+// map, and whether its key still exists. If the value has to be read from the
+// database file and d's record has changed, it's read from the key's current
+// datum under the file lock, since d may have been replaced since it was
+// loaded. It must not be called while holding the lock on the in-memory map.
+func (s *Storage) value(d *datum) ([]byte, bool, error) {
+	if !d.spilled {
+		return d.Value(), true, nil
+	}
+	if v, ok := s.cache.get(d); ok {
+		return copyValue(v), true, nil
+	}
+
+	// read the record without the file lock, so reads don't wait on each other
+	// or on writes. The read lock keeps a vacuum from moving it, but a write can
+	// still overwrite it, or it may not have left the write buffer yet, so if it
+	// doesn't check out it's read again under the file lock
+	s.data.RLock()
+	v, err := s.readValueAt(d)
+	s.data.RUnlock()
+	if err == nil {
+		s.cache.add(d, v)
+		return copyValue(v), true, nil
+	}
+
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	if s.isClosed() {
+		return nil, false, ErrDBClosed
+	}
+	cur, ok := s.data.Load(d.key)
+	if !ok || cur.expired(s.now()) {
+		return nil, false, nil
+	}
+	if v, err = s.unprotectedValue(cur); err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+// loggedValue is value for methods that can't return an error, like Get. An
+// error reading the value is logged, and the key is reported missing.
+func (s *Storage) loggedValue(d *datum) ([]byte, bool) {
+	v, ok, err := s.value(d)
+	if err != nil {
+		if !errors.Is(err, ErrDBClosed) {
+			s.log.Printf("bugfruit: %v", err)
+		}
+		return nil, false
+	}
+	return v, ok
+}
+
+// unprotectedValue returns a copy of the value of d, reading it from the
+// database file if it isn't in memory or cached.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedValue(d *datum) ([]byte, error) {
+	if !d.spilled {
+		return d.Value(), nil
+	}
+	if v, ok := s.cache.get(d); ok {
+		return copyValue(v), nil
+	}
+	v, err := s.unprotectedReadValue(d)
+	if err != nil {
+		return nil, fmt.Errorf("reading the value of '%s': %w", d.key, err)
+	}
+	s.cache.add(d, v)
+	return copyValue(v), nil
+}
+
+// unprotectedClone returns a deep copy of d, with its value in memory.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedClone(d *datum) (*datum, error) {
+	if !d.spilled {
+		return d.Clone(), nil
+	}
+	v, err := s.unprotectedValue(d)
+	if err != nil {
+		return nil, err
+	}
+	return d.withValue(v), nil
+}
+
+// unprotectedReadValue reads the value of d from its record in the database
+// file, or in the write buffer if it hasn't been written yet, and checks that
+// the record is still d's.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedReadValue(d *datum) ([]byte, error) {
+	if len(s.wbuf) > 0 && d.idx >= s.wbufStart {
+		b := make([]byte, d.Size())
+		copy(b, s.wbuf[d.idx-s.wbufStart:])
+		return s.decodeValue(d, b)
+	}
+	return s.readValueAt(d)
+}
+
+// readValueAt reads the value of d from its record in the database file with
+// ReadAt, which doesn't move the file's position, and checks that the record is
+// still d's. The caller must hold the file lock or the read lock on the
+// in-memory map, so a vacuum can't move the record or swap the file out from
+// under it.
+func (s *Storage) readValueAt(d *datum) ([]byte, error) {
+	b := make([]byte, d.Size())
+	if _, err := s.file.ReadAt(b, int64(d.idx)); err != nil {
+		return nil, fmt.Errorf("record at %d: %w", d.idx, err)
+	}
+	return s.decodeValue(d, b)
+}
+
+// decodeValue returns the value in b, the bytes of d's record as it's written
+// to file, after checking that the record is d's and decoding it.
+func (s *Storage) decodeValue(d *datum, b []byte) ([]byte, error) {
+	m, mb, err := readMeta(bytes.NewReader(b), s.version, nil)
+	if err != nil {
+		return nil, fmt.Errorf("record at %d: reading metadata: %w", d.idx, err)
+	}
+	r := &datum{meta: m, idx: d.idx}
+	if err := r.KeyValFromBytes(b[len(mb):]); err != nil {
+		return nil, fmt.Errorf("record at %d: %w", d.idx, err)
+	}
+	if crc := r.Checksum(); crc != m.crc {
+		return nil, fmt.Errorf("record at %d: %w: expected %#x, got %#x", d.idx, ErrChecksumMismatch, m.crc, crc)
+	}
+	if err := r.decode(s.aead); err != nil {
+		return nil, fmt.Errorf("record at %d: %w", d.idx, err)
+	}
+	if r.key != d.key {
+		return nil, fmt.Errorf("record at %d: %w: it's for '%s'", d.idx, ErrCorrupt, r.key)
+	}
+	return r.value, nil
+}
+
+// copyValue returns a copy of a value, so that it doesn't share memory with a
+// cached value or a reused buffer.
+func copyValue(v []byte) []byte {
+	c := make([]byte, len(v))
+	copy(c, v)
+	return c
+}
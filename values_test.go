@@ -0,0 +1,226 @@
+package bugfruit
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestDiskValues ensures that with DiskValues, values aren't kept in memory,
+// but are still read back right, through writes, vacuums, and reopening.
+func TestDiskValues(t *testing.T) {
+	configs := map[string][]Option{
+		"plain":        {},
+		"cached":       {WithValueCacheSize(64)},
+		"encoded":      {WithCompression(GzipCompression), WithEncryptionKey(bytes.Repeat([]byte("k"), 32))},
+		"buffered":     {WithWriteBufferSize(1 << 10), WithValueCacheSize(8)},
+		"reused space": {WithReuseSpace(true)},
+	}
+	for name, opts := range configs {
+		t.Run(name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+			opts := append([]Option{WithDiskValues(true)}, opts...)
+			s, err := NewStorage(fname, 0600, opts...)
+			test.AssertNil(t, err)
+
+			test.AssertNil(t, s.Set("frodo", []byte("baggins")))
+			test.AssertNil(t, s.Set("sam", []byte("gamgee")))
+			test.AssertNil(t, s.Set("merry", []byte("brandybuck")))
+			test.AssertNil(t, s.Set("pippin", []byte("tooke")))
+			test.AssertNil(t, s.Set("pippin", []byte("took!")))
+			test.AssertNil(t, s.Expire("sam", time.Hour))
+			test.AssertNil(t, s.Delete("merry"))
+
+			// only the metadata is in memory
+			s.data.Range(func(_ string, d *datum) bool {
+				test.AssertEqual(t, true, d.spilled)
+				test.AssertEqual(t, []byte(nil), d.value)
+				return true
+			})
+
+			check := func(s *Storage) {
+				got, ok := s.Get("frodo")
+				test.AssertEqual(t, true, ok)
+				test.AssertEqual(t, []byte("baggins"), got)
+				got, _ = s.GetBytes([]byte("pippin"))
+				test.AssertEqual(t, []byte("took!"), got)
+				_, ok = s.Get("merry")
+				test.AssertEqual(t, false, ok)
+				got, ok, err := s.GetCtx(context.Background(), "sam")
+				test.AssertNil(t, err)
+				test.AssertEqual(t, true, ok)
+				test.AssertEqual(t, []byte("gamgee"), got)
+
+				vals, err := s.GetMulti([]string{"frodo", "sam", "merry"})
+				test.AssertNil(t, err)
+				test.AssertEqual(t, map[string][]byte{"frodo": []byte("baggins"), "sam": []byte("gamgee")}, vals)
+
+				pairs := map[string]string{}
+				test.AssertNil(t, s.ForEach(func(k string, v []byte) bool {
+					pairs[k] = string(v)
+					return true
+				}))
+				test.AssertEqual(t, map[string]string{"frodo": "baggins", "sam": "gamgee", "pippin": "took!"}, pairs)
+				keys := []string{}
+				test.AssertNil(t, s.RangeKeys("g", "", func(k string, v []byte) bool {
+					keys = append(keys, k+"="+string(v))
+					return true
+				}))
+				test.AssertEqual(t, []string{"pippin=took!", "sam=gamgee"}, keys)
+			}
+			check(s)
+			test.AssertNil(t, s.Vacuum())
+			check(s)
+
+			// the read-modify-write methods read the value from the file too
+			test.AssertNil(t, s.Update("frodo", func(old []byte, _ bool) ([]byte, bool, error) {
+				return append(old, " of bag end"...), false, nil
+			}))
+			got, _ := s.Get("frodo")
+			test.AssertEqual(t, []byte("baggins of bag end"), got)
+			got, err = s.Append("pippin", []byte("!"))
+			test.AssertNil(t, err)
+			test.AssertEqual(t, []byte("took!!"), got)
+			swapped, err := s.CompareAndSwap("sam", []byte("gamgee"), []byte("gardener"))
+			test.AssertNil(t, err)
+			test.AssertEqual(t, true, swapped)
+			got, existed, err := s.GetOrSet("sam", []byte("mayor"))
+			test.AssertNil(t, err)
+			test.AssertEqual(t, true, existed)
+			test.AssertEqual(t, []byte("gardener"), got)
+			test.AssertNil(t, s.Set("bill", []byte("pony")))
+			got, _, err = s.Pop("bill")
+			test.AssertNil(t, err)
+			test.AssertEqual(t, []byte("pony"), got)
+			test.AssertNil(t, s.Close())
+
+			s, err = NewStorage(fname, 0600, opts...)
+			test.AssertNil(t, err)
+			got, _ = s.Get("frodo")
+			test.AssertEqual(t, []byte("baggins of bag end"), got)
+			got, _ = s.Get("sam")
+			test.AssertEqual(t, []byte("gardener"), got)
+			_, ok := s.Get("bill")
+			test.AssertEqual(t, false, ok)
+
+			// a snapshot has the values, not just where they were
+			snapname := filepath.Join(t.TempDir(), "snapshot")
+			test.AssertNil(t, s.Snapshot(snapname, 0600))
+			test.AssertNil(t, s.Close())
+			snap, err := NewStorage(snapname, 0600, opts...)
+			test.AssertNil(t, err)
+			got, _ = snap.Get("pippin")
+			test.AssertEqual(t, []byte("took!!"), got)
+			test.AssertNil(t, snap.Close())
+		})
+	}
+}
+
+// TestDiskValuesCache ensures values got or set with DiskValues are cached,
+// with a copy returned to the caller.
+func TestDiskValuesCache(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithDiskValues(true), WithValueCacheSize(8))
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.Set("legolas", []byte("elf")))
+	d, _ := s.data.Load("legolas")
+	v, ok := s.cache.get(d)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("elf"), v)
+
+	// gimli pushes legolas out, then getting legolas brings him back
+	test.AssertNil(t, s.Set("gimli", []byte("dwarf")))
+	test.AssertNil(t, s.Set("gimli", []byte("dwarves!")))
+	_, ok = s.cache.get(d)
+	test.AssertEqual(t, false, ok)
+	got, _ := s.Get("legolas")
+	test.AssertEqual(t, []byte("elf"), got)
+	got[0] = 'E'
+	v, ok = s.cache.get(d)
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("elf"), v)
+}
+
+// TestDiskValuesConcurrent ensures values read from the file with DiskValues
+// are right while other goroutines overwrite them and vacuum.
+func TestDiskValuesConcurrent(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithDiskValues(true), WithValueCacheSize(16))
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	rings := []string{"narya", "nenya", "vilya"}
+	for _, r := range rings {
+		test.AssertNil(t, s.Set(r, []byte(r)))
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			for _, r := range rings {
+				test.AssertNil(t, s.Set(r, []byte(r)))
+			}
+			test.AssertNil(t, s.Vacuum())
+		}
+		close(done)
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, r := range rings {
+				got, ok := s.Get(r)
+				test.AssertEqual(t, true, ok)
+				test.AssertEqual(t, []byte(r), got)
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+// TestDiskValuesReadAt ensures values are read from the file without the file
+// lock, unless they're still in the write buffer.
+func TestDiskValuesReadAt(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithDiskValues(true), WithWriteBufferSize(1<<10))
+	test.AssertNil(t, err)
+	defer s.Close()
+
+	test.AssertNil(t, s.Set("eowyn", []byte("shieldmaiden")))
+	test.AssertNil(t, s.Sync())
+	test.AssertNil(t, s.Set("eomer", []byte("third marshal")))
+
+	// a writer that holds the file lock doesn't hold up reads of the file
+	s.muFile.Lock()
+	got, ok := s.Get("eowyn")
+	test.AssertEqual(t, true, ok)
+	test.AssertEqual(t, []byte("shieldmaiden"), got)
+
+	// but a read of the write buffer waits for it
+	read := make(chan []byte)
+	go func() {
+		v, _ := s.Get("eomer")
+		read <- v
+	}()
+	select {
+	case <-read:
+		t.Fatal("read the write buffer while the file lock was held")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.muFile.Unlock()
+	test.AssertEqual(t, []byte("third marshal"), <-read)
+}
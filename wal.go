@@ -0,0 +1,325 @@
+package bugfruit
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// walSuffix is added to the name of the database file to get the name of its
+// write-ahead log.
+const walSuffix = ".wal"
+
+// walCommit is the commit marker that ends each batch in the write-ahead log.
+// A batch without one, or with a checksum that doesn't match, was never
+// committed.
+var walCommit = []byte("CMIT")
+
+// the kinds of write in a batch
+const (
+	walSet    byte = 1
+	walDelete byte = 2
+)
+
+// batchOp is one write in a batch.
+type batchOp struct {
+	op    byte
+	key   string
+	value []byte
+}
+
+// Batch is a set of sets and deletes that Commit writes all together. With
+// Config.WAL on, a batch is all-or-nothing, even across a crash: after a
+// crash, either every write in a committed batch is in the database or none
+// of them are. A Batch is not safe for concurrent use.
+type Batch struct {
+	s   *Storage
+	ops []batchOp
+}
+
+// Batch returns an empty batch of writes to s.
+func (s *Storage) Batch() *Batch {
+	return &Batch{s: s}
+}
+
+// Set adds setting the key/value pair to the batch. The value is copied, so the
+// caller may reuse it.
+func (b *Batch) Set(key string, value []byte) {
+	v := make([]byte, len(value))
+	copy(v, value)
+	b.ops = append(b.ops, batchOp{op: walSet, key: key, value: v})
+}
+
+// Delete adds deleting the key to the batch.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{op: walDelete, key: key})
+}
+
+// Len returns how many writes are in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Commit writes every write in the batch, in the order they were added, and
+// syncs the database file. With Config.WAL on, the batch is written to the
+// write-ahead log and synced first, so if the process crashes before Commit
+// returns, the whole batch is replayed the next time the database is opened.
+// Without it, the writes are not atomic, like SetMulti's. If writing the batch
+// to the database file, or emptying the log after, fails once the batch was
+// written to the log, the batch is kept in the log and the Storage is closed,
+// so that nothing is written after it before it's replayed, when the database
+// is next opened. The batch is empty once Commit returns nil.
+func (b *Batch) Commit() error {
+	s := b.s
+	if s.isClosed() {
+		return ErrDBClosed
+	}
+
+	// check every write first, so that one that's too large doesn't leave the
+	// batch half written
+	for _, o := range b.ops {
+		if o.op != walSet {
+			continue
+		}
+		if err := s.checkSize(o.key, o.value); err != nil {
+			return fmt.Errorf("setting '%s': %w", o.key, err)
+		}
+	}
+
+	s.muFile.Lock()
+	if s.wal == nil {
+		defer s.unlockFile()
+		if err := s.applyBatch(b.ops); err != nil {
+			return err
+		}
+		b.ops = nil
+		return nil
+	}
+
+	if err := s.logBatch(b.ops); err != nil {
+		// a batch cut short would hide the batches logged after it
+		if err2 := s.unprotectedTruncateWAL(); err2 != nil {
+			err = fmt.Errorf("while handling error '%v': encountered %w", err, err2)
+		}
+		s.unlockFile()
+		return fmt.Errorf("writing to the write-ahead log: %w", err)
+	}
+	err := s.applyBatch(b.ops)
+	if err == nil {
+		err = s.unprotectedTruncateWAL()
+	}
+	if err != nil {
+		// replaying the batch over later writes would undo them
+		s.unprotectedMarkClosed()
+		s.unlockFile()
+		if err2 := s.closeFiles(); err2 != nil {
+			return fmt.Errorf("closing Storage to replay the batch: while handling error '%v': encountered %w", err, err2)
+		}
+		return fmt.Errorf("closed Storage to replay the batch when it's next opened: %w", err)
+	}
+	s.unlockFile()
+	b.ops = nil
+	return nil
+}
+
+// applyBatch writes every write in ops in-memory and on disk, and syncs the
+// database file.
+// It is NOT thread safe without external file locking.
+func (s *Storage) applyBatch(ops []batchOp) error {
+	writes := uint64(0)
+	now := s.now().UnixNano()
+	for _, o := range ops {
+		switch o.op {
+		case walSet:
+			n, err := s.writePair(o.key, o.value, 0, now)
+			writes += n
+			if err != nil {
+				return fmt.Errorf("setting '%s': %w", o.key, err)
+			}
+		case walDelete:
+			if d, exists := s.data.LoadAndDelete(o.key); exists {
+				atomic.AddUint64(&s.deletes, 1)
+				d.MarkDeleted()
+				if err := s.writeDeletedByte(d); err != nil {
+					return fmt.Errorf("deleting '%s': updating db file: %w", o.key, err)
+				}
+				writes++
+			}
+		}
+	}
+	return s.incAndSync(writes, true)
+}
+
+// logBatch appends ops to the write-ahead log as one batch, followed by the
+// commit marker and the batch's checksum, and syncs the log. The batch is
+// encrypted if the database file is.
+// It is NOT thread safe without external file locking.
+func (s *Storage) logBatch(ops []batchOp) error {
+	payload := encodeBatch(ops)
+	if s.aead != nil {
+		sealed, err := seal(s.aead, payload)
+		if err != nil {
+			return fmt.Errorf("encrypting: %w", err)
+		}
+		payload = sealed
+	}
+
+	b := make([]byte, 4+len(payload)+len(walCommit)+4)
+	byteOrder.PutUint32(b, uint32(len(payload)))
+	i := 4 + copy(b[4:], payload)
+	i += copy(b[i:], walCommit)
+	byteOrder.PutUint32(b[i:], crc32.Checksum(payload, crcTable))
+
+	if _, err := s.wal.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := s.wal.Write(b); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// unprotectedTruncateWAL empties the write-ahead log, once the batches in it
+// are synced to the database file.
+// It is NOT thread safe without external file locking.
+func (s *Storage) unprotectedTruncateWAL() error {
+	if err := s.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncating the write-ahead log: %w", err)
+	} else if err := s.wal.Sync(); err != nil {
+		return fmt.Errorf("syncing the write-ahead log: %w", err)
+	}
+	return nil
+}
+
+// openWAL opens the write-ahead log of the database file, creating it with
+// mode if it doesn't exist, and writes the batches committed to it that may not
+// have made it to the database file, before emptying it.
+// It is NOT thread safe without external file locking.
+func (s *Storage) openWAL(mode os.FileMode) error {
+	name := s.name + walSuffix
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return fmt.Errorf("opening write-ahead log %s: %w", name, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("statting '%s': %w", name, err)
+	}
+	s.wal = f
+	if fi.Size() == 0 {
+		return nil
+	}
+
+	batches, err := readBatches(bufio.NewReader(f), uint64(fi.Size()), s.aead)
+	if err != nil {
+		return fmt.Errorf("reading write-ahead log %s: %w", name, err)
+	}
+	for _, ops := range batches {
+		if err := s.applyBatch(ops); err != nil {
+			return fmt.Errorf("replaying write-ahead log %s: %w", name, err)
+		}
+	}
+	s.log.Printf("bugfruit: replayed %d batches from %s", len(batches), name)
+	return s.unprotectedTruncateWAL()
+}
+
+// readBatches reads the committed batches from r, which reads a write-ahead
+// log of size bytes, decrypting them with aead if they're encrypted. It stops
+// at the first batch that wasn't committed, since it and anything after it
+// were cut short by a crash.
+func readBatches(r io.Reader, size uint64, aead cipher.AEAD) ([][]batchOp, error) {
+	batches := [][]batchOp{}
+	read := uint64(0)
+	for {
+		lb := make([]byte, 4)
+		if _, err := io.ReadFull(r, lb); err != nil {
+			return batches, nil
+		}
+		n := uint64(byteOrder.Uint32(lb))
+		trailer := uint64(len(walCommit) + 4)
+		if read+4+n+trailer > size {
+			return batches, nil
+		}
+		b := make([]byte, n+trailer)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return batches, nil
+		}
+		read += 4 + n + trailer
+
+		payload, marker, crc := b[:n], b[n:n+uint64(len(walCommit))], byteOrder.Uint32(b[n+uint64(len(walCommit)):])
+		if string(marker) != string(walCommit) || crc != crc32.Checksum(payload, crcTable) {
+			return batches, nil
+		}
+
+		if aead != nil {
+			plain, err := open(aead, payload)
+			if err != nil {
+				return nil, fmt.Errorf("decrypting: %w", err)
+			}
+			payload = plain
+		}
+		ops, err := decodeBatch(payload)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, ops)
+	}
+}
+
+// encodeBatch converts ops to bytes for the write-ahead log. Each write is its
+// kind, then the uvarint size of its key and the key, and for sets, the uvarint
+// size of the value and the value.
+func encodeBatch(ops []batchOp) []byte {
+	b := []byte{}
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, o := range ops {
+		b = append(b, o.op)
+		b = append(b, tmp[:binary.PutUvarint(tmp, uint64(len(o.key)))]...)
+		b = append(b, o.key...)
+		if o.op == walSet {
+			b = append(b, tmp[:binary.PutUvarint(tmp, uint64(len(o.value)))]...)
+			b = append(b, o.value...)
+		}
+	}
+	return b
+}
+
+// decodeBatch converts bytes from the write-ahead log written by encodeBatch
+// back to writes.
+func decodeBatch(b []byte) ([]batchOp, error) {
+	ops := []batchOp{}
+	next := func() ([]byte, bool) {
+		n, sz := binary.Uvarint(b)
+		if sz <= 0 || n > uint64(len(b)-sz) {
+			return nil, false
+		}
+		field := b[sz : sz+int(n)]
+		b = b[sz+int(n):]
+		return field, true
+	}
+	for len(b) > 0 {
+		o := batchOp{op: b[0]}
+		b = b[1:]
+		if o.op != walSet && o.op != walDelete {
+			return nil, fmt.Errorf("%w: unknown write-ahead log write %d", ErrCorrupt, o.op)
+		}
+		key, ok := next()
+		if !ok {
+			return nil, fmt.Errorf("%w: truncated write-ahead log key", ErrCorrupt)
+		}
+		o.key = string(key)
+		if o.op == walSet {
+			if o.value, ok = next(); !ok {
+				return nil, fmt.Errorf("%w: truncated write-ahead log value", ErrCorrupt)
+			}
+		}
+		ops = append(ops, o)
+	}
+	return ops, nil
+}
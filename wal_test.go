@@ -0,0 +1,177 @@
+package bugfruit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+// TestBatch ensures a batch writes its sets and deletes in order, with and
+// without the write-ahead log.
+func TestBatch(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+		s, err := NewStorage(fname, 0600, WithWAL(wal))
+		test.AssertNil(t, err)
+		test.AssertNil(t, s.Set("boromir", []byte("captain of the white tower")))
+
+		b := s.Batch()
+		value := []byte("son of denethor")
+		b.Set("faramir", value)
+		value[0] = 'S' // the batch has a copy
+		b.Set("theoden", []byte("king of rohan"))
+		b.Delete("theoden")
+		b.Delete("boromir")
+		b.Delete("eomer")
+		test.AssertEqual(t, 5, b.Len())
+
+		// nothing is written until it's committed
+		_, ok := s.Get("faramir")
+		test.AssertEqual(t, false, ok)
+		test.AssertNil(t, b.Commit())
+		test.AssertEqual(t, 0, b.Len())
+		test.AssertNil(t, s.Close())
+
+		s, err = NewStorage(fname, 0600, WithWAL(wal))
+		test.AssertNil(t, err)
+		test.AssertEqual(t, []string{"faramir"}, s.Keys())
+		got, _ := s.Get("faramir")
+		test.AssertEqual(t, []byte("son of denethor"), got)
+		test.AssertNil(t, s.Close())
+
+		_, err = os.Stat(fname + walSuffix)
+		test.AssertEqual(t, !wal, errors.Is(err, os.ErrNotExist))
+	}
+}
+
+// TestBatchTooLarge ensures nothing in a batch is written if any value in it is
+// too large.
+func TestBatchTooLarge(t *testing.T) {
+	s, err := NewMemStorage(WithMaxSizes(0, 8))
+	test.AssertNil(t, err)
+	b := s.Batch()
+	b.Set("merry", []byte("meriadoc"))
+	b.Set("pippin", []byte("peregrin took"))
+	test.AssertEqual(t, true, errors.Is(b.Commit(), ErrValueTooLarge))
+	test.AssertEqual(t, 0, s.Len())
+
+	test.AssertNil(t, s.Close())
+	test.AssertEqual(t, ErrDBClosed, s.Batch().Commit())
+}
+
+// TestWALReplay ensures batches committed to the write-ahead log are written to
+// the database file when it's next opened, and a batch cut short isn't.
+func TestWALReplay(t *testing.T) {
+	for _, key := range [][]byte{nil, bytes.Repeat([]byte("k"), 32)} {
+		fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+		s, err := NewStorage(fname, 0600, WithWAL(true), WithEncryptionKey(key))
+		test.AssertNil(t, err)
+		test.AssertNil(t, s.Set("bilbo", []byte("burglar")))
+
+		// crash after the batches are logged, but before they're written
+		s.muFile.Lock()
+		test.AssertNil(t, s.logBatch([]batchOp{
+			{op: walSet, key: "frodo", value: []byte("ring-bearer")},
+			{op: walDelete, key: "bilbo"},
+		}))
+		test.AssertNil(t, s.logBatch([]batchOp{{op: walSet, key: "sam", value: []byte("gardener")}}))
+		test.AssertNil(t, s.logBatch([]batchOp{{op: walSet, key: "gollum", value: []byte("my precious")}}))
+		s.muFile.Unlock()
+		test.AssertNil(t, s.Close())
+
+		// the last batch's commit marker never made it to the log
+		fi, err := os.Stat(fname + walSuffix)
+		test.AssertNil(t, err)
+		test.AssertNil(t, os.Truncate(fname+walSuffix, fi.Size()-3))
+		if key != nil {
+			wal, err := os.ReadFile(fname + walSuffix)
+			test.AssertNil(t, err)
+			test.AssertEqual(t, false, bytes.Contains(wal, []byte("ring-bearer")))
+		}
+
+		s, err = NewStorage(fname, 0600, WithWAL(true), WithEncryptionKey(key))
+		test.AssertNil(t, err)
+		test.AssertEqual(t, 2, s.Len())
+		got, _ := s.Get("frodo")
+		test.AssertEqual(t, []byte("ring-bearer"), got)
+		got, _ = s.Get("sam")
+		test.AssertEqual(t, []byte("gardener"), got)
+		_, ok := s.Get("bilbo")
+		test.AssertEqual(t, false, ok)
+		_, ok = s.Get("gollum")
+		test.AssertEqual(t, false, ok)
+		test.AssertNil(t, s.Close())
+
+		// the replayed batches are in the database file, and the log is empty
+		fi, err = os.Stat(fname + walSuffix)
+		test.AssertNil(t, err)
+		test.AssertEqual(t, int64(0), fi.Size())
+		s, err = NewStorage(fname, 0600, WithEncryptionKey(key))
+		test.AssertNil(t, err)
+		test.AssertEqual(t, 2, s.Len())
+		test.AssertNil(t, s.Close())
+	}
+}
+
+// TestBatchApplyFails ensures that a batch that fails to be written to the
+// database file after it was logged is replayed when the database is next
+// opened, and that nothing written after it is undone by the replay.
+func TestBatchApplyFails(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testing-testing-one-two-three")
+	s, err := NewStorage(fname, 0600, WithWAL(true))
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Set("k", []byte("before")))
+
+	s.file = failWriteFile{s.file}
+	b := s.Batch()
+	b.Set("k", []byte("batch"))
+	b.Set("j", []byte("batch"))
+	err = b.Commit()
+	test.AssertEqual(t, true, err != nil)
+	test.AssertEqual(t, 2, b.Len())
+
+	// the Storage is closed, so nothing is written after the kept batch
+	test.AssertEqual(t, ErrDBClosed, s.Set("k", []byte("later-set")))
+	test.AssertEqual(t, ErrDBClosed, s.Batch().Commit())
+
+	s, err = NewStorage(fname, 0600, WithWAL(true))
+	test.AssertNil(t, err)
+	got, _ := s.Get("k")
+	test.AssertEqual(t, []byte("batch"), got)
+	got, _ = s.Get("j")
+	test.AssertEqual(t, []byte("batch"), got)
+
+	// later writes aren't undone by the batch on the next open
+	test.AssertNil(t, s.Set("k", []byte("later-set")))
+	test.AssertNil(t, s.Close())
+	s, err = NewStorage(fname, 0600, WithWAL(true))
+	test.AssertNil(t, err)
+	got, _ = s.Get("k")
+	test.AssertEqual(t, []byte("later-set"), got)
+	test.AssertNil(t, s.Close())
+}
+
+// TestBatchEncoding ensures writes are the same after encoding and decoding
+// them, and that cut short encodings are corrupt.
+func TestBatchEncoding(t *testing.T) {
+	ops := []batchOp{
+		{op: walSet, key: "aragorn", value: []byte("strider")},
+		{op: walSet, key: "", value: []byte{}},
+		{op: walDelete, key: "isildur"},
+	}
+	b := encodeBatch(ops)
+	got, err := decodeBatch(b)
+	test.AssertNil(t, err)
+	test.AssertEqual(t, ops, got)
+
+	for _, cut := range []int{1, 2, 5, len(b) - 1} {
+		_, err = decodeBatch(b[:len(b)-cut])
+		test.AssertEqual(t, true, errors.Is(err, ErrCorrupt))
+	}
+	_, err = decodeBatch([]byte{9})
+	test.AssertEqual(t, true, errors.Is(err, ErrCorrupt))
+}
@@ -0,0 +1,168 @@
+package bugfruit
+
+import "sync"
+
+// watchBufferSize is how many events a watch channel holds before events for it
+// are dropped.
+const watchBufferSize = 64
+
+// OpType is the kind of write an Event describes.
+type OpType int
+
+const (
+	// OpSet means the key was set to Value.
+	OpSet OpType = iota
+	// OpDelete means the key was deleted.
+	OpDelete
+)
+
+// Event describes a successful write to the database.
+type Event struct {
+	Key   string
+	Op    OpType
+	Value []byte // the new value for an OpSet, and nil for an OpDelete
+}
+
+// watchers is the set of channels events are published to.
+type watchers struct {
+	mu     sync.Mutex
+	subs   map[uint64]chan Event
+	next   uint64
+	closed bool
+	held   []*heldEvents // the events waiting on the sync of a write, in order
+}
+
+// heldEvents are the events of a write that syncs after the file lock is
+// released, or of the writes after it, which aren't published until it's done.
+type heldEvents struct {
+	events []Event
+	open   bool // whether the write that syncs is still adding its events
+	done   bool // whether the events can be published
+}
+
+// Watch returns a channel that receives an Event after each successful write
+// of a key, in the order the writes happened, and a function that unsubscribes
+// and closes the channel. Every set of a key is an OpSet, including by a Batch,
+// a Tx, Update, or Expire, and every delete of a key that exists is an OpDelete,
+// including by Pop, DeletePrefix, or Clear. The event of a SetSync is published
+// once its sync is done, and isn't if the sync fails.
+//
+// Writes never wait on a watcher: the channel is buffered, and if it's full
+// because the watcher isn't keeping up, the event is dropped. Closing the
+// Storage closes every watch channel. Subscribe is for a feed of every write
+// that never skips one.
+func (s *Storage) Watch() (<-chan Event, func()) {
+	w := &s.watchers
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ch := make(chan Event, watchBufferSize)
+	if w.closed || s.isClosed() {
+		close(ch)
+		return ch, func() {}
+	}
+	if w.subs == nil {
+		w.subs = make(map[uint64]chan Event)
+	}
+	id := w.next
+	w.next++
+	w.subs[id] = ch
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if ch, ok := w.subs[id]; ok {
+			delete(w.subs, id)
+			close(ch)
+		}
+	}
+}
+
+// publish sends an event to every watcher that has room for it, unless it has
+// to wait on the sync of an earlier write, or is part of a write being held.
+func (w *watchers) publish(key string, op OpType, value []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.subs) == 0 {
+		return
+	}
+	if len(w.held) == 0 {
+		w.send(Event{Key: key, Op: op, Value: value})
+		return
+	}
+	e := Event{Key: key, Op: op}
+	if op == OpSet {
+		// the writer can reuse value once it returns, before it's sent
+		e.Value = append([]byte{}, value...)
+	}
+	h := w.held[len(w.held)-1]
+	if !h.open && !h.done {
+		h = &heldEvents{done: true}
+		w.held = append(w.held, h)
+	}
+	h.events = append(h.events, e)
+}
+
+// hold holds back the events published from now on, until they're released.
+// It's called with the file lock held, before the write that will sync.
+func (w *watchers) hold() *heldEvents {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	h := &heldEvents{open: true}
+	w.held = append(w.held, h)
+	return h
+}
+
+// seal ends the events of the write h holds back, so the writes after it go
+// on to be published once it's released. It's called before the file lock is
+// released.
+func (w *watchers) seal(h *heldEvents) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	h.open = false
+}
+
+// release lets the events of h be published, or drops them if its write
+// failed, then publishes every event that isn't waiting on an earlier write.
+func (w *watchers) release(h *heldEvents, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	h.open, h.done = false, true
+	if !ok {
+		h.events = nil
+	}
+	for len(w.held) > 0 && w.held[0].done {
+		for _, e := range w.held[0].events {
+			w.send(e)
+		}
+		w.held = w.held[1:]
+	}
+}
+
+// send sends e to every watcher that has room for it.
+// It is NOT thread safe without w.mu held.
+func (w *watchers) send(e Event) {
+	for _, ch := range w.subs {
+		c := e
+		if c.Op == OpSet {
+			c.Value = append([]byte{}, e.Value...)
+		}
+		select {
+		case ch <- c:
+		default:
+			// the watcher is behind, so drop it rather than block the write
+		}
+	}
+}
+
+// close closes every watch channel, and stops any more from being opened.
+func (w *watchers) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for id, ch := range w.subs {
+		delete(w.subs, id)
+		close(ch)
+	}
+	w.held = nil
+	w.closed = true
+}
@@ -0,0 +1,138 @@
+package bugfruit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/reesporte/bugfruit/test"
+)
+
+func TestWatch(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+
+	events, unwatch := s.Watch()
+	other, unwatchOther := s.Watch()
+
+	test.AssertNil(t, s.Set("eärendil", []byte("the Mariner")))
+	test.AssertNil(t, s.SetWithTTL("silmaril", []byte("bound upon his brow"), time.Hour))
+	test.AssertNil(t, s.Delete("eärendil"))
+	test.AssertNil(t, s.Delete("morgoth"))
+
+	for _, ch := range []<-chan Event{events, other} {
+		test.AssertEqual(t, Event{Key: "eärendil", Op: OpSet, Value: []byte("the Mariner")}, <-ch)
+		test.AssertEqual(t, Event{Key: "silmaril", Op: OpSet, Value: []byte("bound upon his brow")}, <-ch)
+		test.AssertEqual(t, Event{Key: "eärendil", Op: OpDelete}, <-ch)
+	}
+
+	// unsubscribing closes the channel, and is safe to repeat
+	unwatchOther()
+	unwatchOther()
+	_, ok := <-other
+	test.AssertEqual(t, false, ok)
+
+	// a watcher that falls behind loses events instead of blocking writes
+	for i := 0; i < watchBufferSize+10; i++ {
+		test.AssertNil(t, s.Set("elwing", []byte("a white bird")))
+	}
+	test.AssertEqual(t, watchBufferSize, len(events))
+
+	// closing the database closes the rest
+	test.AssertNil(t, s.Close())
+	for range events {
+	}
+	unwatch()
+
+	closed, _ := s.Watch()
+	_, ok = <-closed
+	test.AssertEqual(t, false, ok)
+}
+
+// TestWatchWrites ensures every kind of write is published to watchers, not
+// just Set and Delete.
+func TestWatchWrites(t *testing.T) {
+	s, err := NewMemStorage()
+	test.AssertNil(t, err)
+	events, unwatch := s.Watch()
+	defer unwatch()
+
+	test.AssertNil(t, s.SetMulti(map[string][]byte{"frodo": []byte("baggins")}))
+	_, _, err = s.Pop("frodo")
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Set("sam", []byte("gamgee")))
+	_, err = s.CompareAndSwap("sam", []byte("gamgee"), []byte("gardner"))
+	test.AssertNil(t, err)
+	_, err = s.CompareAndDelete("sam", []byte("gardner"))
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.Update("merry", func([]byte, bool) ([]byte, bool, error) {
+		return []byte("brandybuck"), false, nil
+	}))
+	test.AssertNil(t, s.Update("merry", func([]byte, bool) ([]byte, bool, error) {
+		return nil, true, nil
+	}))
+	b := s.Batch()
+	b.Set("pippin", []byte("took"))
+	b.Set("hobbit:bilbo", []byte("baggins"))
+	test.AssertNil(t, b.Commit())
+	_, err = s.DeleteMulti([]string{"pippin"})
+	test.AssertNil(t, err)
+	_, err = s.DeletePrefix("hobbit:")
+	test.AssertNil(t, err)
+	test.AssertNil(t, s.SetSync("gandalf", []byte("the grey")))
+	test.AssertNil(t, s.Clear())
+
+	want := []Event{
+		{Key: "frodo", Op: OpSet, Value: []byte("baggins")},
+		{Key: "frodo", Op: OpDelete},
+		{Key: "sam", Op: OpSet, Value: []byte("gamgee")},
+		{Key: "sam", Op: OpSet, Value: []byte("gardner")},
+		{Key: "sam", Op: OpDelete},
+		{Key: "merry", Op: OpSet, Value: []byte("brandybuck")},
+		{Key: "merry", Op: OpDelete},
+		{Key: "pippin", Op: OpSet, Value: []byte("took")},
+		{Key: "hobbit:bilbo", Op: OpSet, Value: []byte("baggins")},
+		{Key: "pippin", Op: OpDelete},
+		{Key: "hobbit:bilbo", Op: OpDelete},
+		{Key: "gandalf", Op: OpSet, Value: []byte("the grey")},
+		{Key: "gandalf", Op: OpDelete},
+	}
+	for _, e := range want {
+		test.AssertEqual(t, e, <-events)
+	}
+	test.AssertEqual(t, 0, len(events))
+	test.AssertNil(t, s.Close())
+}
+
+// TestWatchHeld ensures the events of a write that syncs wait until its sync
+// is done, along with the events of the writes after it, so they're still
+// published in order, and that they're dropped if the sync fails.
+func TestWatchHeld(t *testing.T) {
+	w := &watchers{}
+	defer w.close()
+	ch := make(chan Event, watchBufferSize)
+	w.subs = map[uint64]chan Event{0: ch}
+
+	first := w.hold()
+	w.publish("isildur", OpSet, []byte("the heir"))
+	w.seal(first)
+	value := []byte("the doom")
+	w.publish("anarion", OpSet, value)
+	value[0] = 'T'
+	second := w.hold()
+	w.publish("elendil", OpSet, []byte("the tall"))
+	w.seal(second)
+	test.AssertEqual(t, 0, len(ch))
+
+	// the later write's sync fails, but it's still held back by the first
+	w.release(second, false)
+	test.AssertEqual(t, 0, len(ch))
+	w.release(first, true)
+	test.AssertEqual(t, Event{Key: "isildur", Op: OpSet, Value: []byte("the heir")}, <-ch)
+	test.AssertEqual(t, Event{Key: "anarion", Op: OpSet, Value: []byte("the doom")}, <-ch)
+	test.AssertEqual(t, 0, len(ch))
+
+	// with nothing held, events are sent right away
+	w.publish("elendil", OpDelete, nil)
+	test.AssertEqual(t, Event{Key: "elendil", Op: OpDelete}, <-ch)
+	test.AssertEqual(t, 0, len(w.held))
+}